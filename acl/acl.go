@@ -0,0 +1,259 @@
+package acl
+
+import (
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/xattr"
+)
+
+//
+// POSIX ACLs.  An inode's access ACL and default ACL are stored as
+// extended attributes, under the names Linux uses for them.  An inode
+// without an access ACL has the ACL that its mode implies.  A new file
+// or directory inherits its directory's default ACL as its access
+// ACL, and a new directory inherits it as its default ACL, too.
+//
+
+// Entry tags
+const (
+	USER_OBJ  uint32 = 0x01
+	USER      uint32 = 0x02
+	GROUP_OBJ uint32 = 0x04
+	GROUP     uint32 = 0x08
+	MASK      uint32 = 0x10
+	OTHER     uint32 = 0x20
+)
+
+// Permission bits
+const (
+	READ    uint32 = 4
+	WRITE   uint32 = 2
+	EXECUTE uint32 = 1
+)
+
+const (
+	ACCESS_XATTR  = "system.posix_acl_access"
+	DEFAULT_XATTR = "system.posix_acl_default"
+)
+
+const ENTRYSZ uint64 = 3 * 4
+
+type Entry struct {
+	Tag  uint32
+	Id   uint32 // uid or gid, for USER and GROUP entries
+	Perm uint32
+}
+
+type Acl []Entry
+
+// Cred identifies who accesses a file.
+type Cred struct {
+	Uid  uint32
+	Gid  uint32   // primary group
+	Gids []uint32 // supplementary groups
+}
+
+// Equal reports whether cred and other are the same credentials.
+func (cred Cred) Equal(other Cred) bool {
+	if cred.Uid != other.Uid || cred.Gid != other.Gid ||
+		len(cred.Gids) != len(other.Gids) {
+		return false
+	}
+	for i, g := range cred.Gids {
+		if other.Gids[i] != g {
+			return false
+		}
+	}
+	return true
+}
+
+// InGroup reports whether gid is one of cred's groups.
+func (cred Cred) InGroup(gid uint32) bool {
+	return hasGid(cred, gid)
+}
+
+// FromMode returns the ACL that mode implies.
+func FromMode(mode uint32) Acl {
+	return Acl{
+		{Tag: USER_OBJ, Perm: (mode >> 6) & 7},
+		{Tag: GROUP_OBJ, Perm: (mode >> 3) & 7},
+		{Tag: OTHER, Perm: mode & 7},
+	}
+}
+
+// Valid reports whether a is a well-formed ACL: it has one each of the
+// USER_OBJ, GROUP_OBJ, and OTHER entries, a MASK entry if it has USER
+// or GROUP entries, and no two USER or GROUP entries for the same id.
+func (a Acl) Valid() bool {
+	count := make(map[uint32]uint64)
+	users := make(map[uint32]bool)
+	groups := make(map[uint32]bool)
+	for _, e := range a {
+		if e.Perm&^(READ|WRITE|EXECUTE) != 0 {
+			return false
+		}
+		switch e.Tag {
+		case USER:
+			if users[e.Id] {
+				return false
+			}
+			users[e.Id] = true
+		case GROUP:
+			if groups[e.Id] {
+				return false
+			}
+			groups[e.Id] = true
+		case USER_OBJ, GROUP_OBJ, MASK, OTHER:
+			count[e.Tag]++
+		default:
+			return false
+		}
+	}
+	if count[USER_OBJ] != 1 || count[GROUP_OBJ] != 1 || count[OTHER] != 1 ||
+		count[MASK] > 1 {
+		return false
+	}
+	return count[MASK] == 1 || len(users)+len(groups) == 0
+}
+
+func (a Acl) perm(tag uint32) uint32 {
+	for _, e := range a {
+		if e.Tag == tag {
+			return e.Perm
+		}
+	}
+	return 0
+}
+
+// Perm returns the permissions that a grants to cred, for a file owned
+// by uid owner and gid group, following the POSIX access check
+// algorithm.
+func (a Acl) Perm(owner uint32, group uint32, cred Cred) uint32 {
+	if cred.Uid == owner {
+		return a.perm(USER_OBJ)
+	}
+	var mask uint32 = READ | WRITE | EXECUTE
+	for _, e := range a {
+		if e.Tag == MASK {
+			mask = e.Perm
+		}
+	}
+	for _, e := range a {
+		if e.Tag == USER && e.Id == cred.Uid {
+			return e.Perm & mask
+		}
+	}
+	var matched = false
+	var perm uint32 = 0
+	for _, e := range a {
+		if (e.Tag == GROUP_OBJ && hasGid(cred, group)) ||
+			(e.Tag == GROUP && hasGid(cred, e.Id)) {
+			matched = true
+			perm = perm | e.Perm
+		}
+	}
+	if matched {
+		return perm & mask
+	}
+	return a.perm(OTHER)
+}
+
+func hasGid(cred Cred, gid uint32) bool {
+	if cred.Gid == gid {
+		return true
+	}
+	for _, g := range cred.Gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(a Acl) []byte {
+	enc := marshal.NewEnc(uint64(len(a)) * ENTRYSZ)
+	for _, e := range a {
+		enc.PutInt32(e.Tag)
+		enc.PutInt32(e.Id)
+		enc.PutInt32(e.Perm)
+	}
+	return enc.Finish()
+}
+
+func decode(b []byte) Acl {
+	n := uint64(len(b)) / ENTRYSZ
+	dec := marshal.NewDec(b)
+	a := make(Acl, n)
+	for i := range a {
+		a[i].Tag = dec.GetInt32()
+		a[i].Id = dec.GetInt32()
+		a[i].Perm = dec.GetInt32()
+	}
+	return a
+}
+
+func get(ip *inode.Inode, atxn *alloctxn.AllocTxn, name string) Acl {
+	b, err := xattr.Get(ip, atxn, name)
+	if err != nfstypes.NFS3_OK {
+		return nil
+	}
+	return decode(b)
+}
+
+// GetAccess returns ip's access ACL, or nil if ip has none.
+func GetAccess(ip *inode.Inode, atxn *alloctxn.AllocTxn) Acl {
+	return get(ip, atxn, ACCESS_XATTR)
+}
+
+// GetDefault returns directory ip's default ACL, or nil if ip has none.
+func GetDefault(ip *inode.Inode, atxn *alloctxn.AllocTxn) Acl {
+	return get(ip, atxn, DEFAULT_XATTR)
+}
+
+func set(ip *inode.Inode, atxn *alloctxn.AllocTxn, name string, a Acl) nfstypes.Nfsstat3 {
+	if a == nil {
+		err := xattr.Remove(ip, atxn, name)
+		if err == nfstypes.NFS3ERR_NOENT {
+			return nfstypes.NFS3_OK
+		}
+		return err
+	}
+	if !a.Valid() {
+		return nfstypes.NFS3ERR_INVAL
+	}
+	return xattr.Set(ip, atxn, name, encode(a), 0)
+}
+
+// SetAccess sets ip's access ACL to a, or removes it if a is nil.
+func SetAccess(ip *inode.Inode, atxn *alloctxn.AllocTxn, a Acl) nfstypes.Nfsstat3 {
+	return set(ip, atxn, ACCESS_XATTR, a)
+}
+
+// SetDefault sets directory ip's default ACL to a, or removes it if a
+// is nil.
+func SetDefault(ip *inode.Inode, atxn *alloctxn.AllocTxn, a Acl) nfstypes.Nfsstat3 {
+	if ip.Kind != nfstypes.NF3DIR && a != nil {
+		return nfstypes.NFS3ERR_NOTDIR
+	}
+	return set(ip, atxn, DEFAULT_XATTR, a)
+}
+
+// Inherit gives ip, which was just created in directory dip, the ACLs
+// it inherits from dip's default ACL.
+func Inherit(dip *inode.Inode, ip *inode.Inode, atxn *alloctxn.AllocTxn) nfstypes.Nfsstat3 {
+	if dip.Xattr == 0 || ip.Kind == nfstypes.NF3LNK {
+		return nfstypes.NFS3_OK
+	}
+	a := GetDefault(dip, atxn)
+	if a == nil {
+		return nfstypes.NFS3_OK
+	}
+	err := SetAccess(ip, atxn, a)
+	if err != nfstypes.NFS3_OK || ip.Kind != nfstypes.NF3DIR {
+		return err
+	}
+	return SetDefault(ip, atxn, a)
+}
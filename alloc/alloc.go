@@ -0,0 +1,311 @@
+package alloc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Alloc uses a bit map to allocate and free numbers. Bit 0
+// corresponds to number 0, bit 1 to 1, and so on. Number 0 is never
+// handed out, so that 0 can signal failure.
+//
+// Alloc is go-journal's allocator extended with allocation groups and
+// allocation of contiguous runs of numbers. The numbers are split into
+// groups of groupsz numbers, each covering its own region of the bitmap
+// and protected by its own lock, so that threads allocating in
+// different groups don't contend. Callers pass a goal number to
+// allocate near, which keeps related numbers in the same group.
+// Extend adds groups while other threads allocate.
+type Alloc struct {
+	groupsz uint64
+	groups  atomic.Pointer[[]*group]
+
+	mu    *sync.Mutex // protects rotor, held and pool and serializes Extend
+	rotor uint64      // group for the next allocation without a goal
+	nfree atomic.Int64
+	held  uint64 // free numbers that Reserve set aside
+	pool  uint64 // free numbers that only privileged reservations may use
+}
+
+type group struct {
+	mu     *sync.Mutex
+	lo     uint64 // first number in the group
+	hi     uint64 // first number past the group
+	next   uint64 // first number to try
+	bitmap []byte // bits for [lo, hi)
+	stale  []byte // see MarkStale; nil if none is
+	fenced []byte // stale numbers that the running fence covers
+}
+
+// MkAlloc initializes with a bitmap, split into groups of groupsz
+// numbers. groupsz must be a multiple of 8.
+//
+// 0 bits correspond to free numbers and 1 bits correspond to in-use numbers.
+func MkAlloc(bitmap []byte, groupsz uint64) *Alloc {
+	if groupsz == 0 || groupsz%8 != 0 {
+		panic("MkAlloc: bad group size")
+	}
+	a := &Alloc{
+		groupsz: groupsz,
+		mu:      new(sync.Mutex),
+	}
+	groups := mkGroups(bitmap, 0, groupsz)
+	a.groups.Store(&groups)
+	a.nfree.Store(int64(a.NumFree()))
+	return a
+}
+
+func mkGroups(bitmap []byte, start uint64, groupsz uint64) []*group {
+	max := start + uint64(len(bitmap))*8
+	var groups []*group
+	for lo := start; lo < max; lo += groupsz {
+		hi := lo + groupsz
+		if hi > max {
+			hi = max
+		}
+		groups = append(groups, &group{
+			mu:     new(sync.Mutex),
+			lo:     lo,
+			hi:     hi,
+			next:   lo,
+			bitmap: bitmap[(lo-start)/8 : (hi-start+7)/8],
+		})
+	}
+	return groups
+}
+
+func (a *Alloc) getGroups() []*group {
+	return *a.groups.Load()
+}
+
+// Extend adds the numbers of bitmap after the current last number.
+// The current last group must be complete.
+func (a *Alloc) Extend(bitmap []byte) {
+	a.mu.Lock()
+	old := a.getGroups()
+	last := old[len(old)-1]
+	if last.hi-last.lo != a.groupsz {
+		panic("Extend: partial group")
+	}
+	added := mkGroups(bitmap, last.hi, a.groupsz)
+	groups := append(append([]*group{}, old...), added...)
+	a.groups.Store(&groups)
+	for gi := len(old); gi < len(groups); gi++ {
+		a.nfree.Add(int64(a.NumFreeGroup(uint64(gi))))
+	}
+	a.mu.Unlock()
+}
+
+// Max returns the first number past the bitmap.
+func (a *Alloc) Max() uint64 {
+	groups := a.getGroups()
+	return groups[len(groups)-1].hi
+}
+
+// NGroup returns the number of allocation groups.
+func (a *Alloc) NGroup() uint64 {
+	return uint64(len(a.getGroups()))
+}
+
+// Group returns the allocation group that num belongs to.
+func (a *Alloc) Group(num uint64) uint64 {
+	return num / a.groupsz
+}
+
+func (g *group) isFree(num uint64) bool {
+	i := num - g.lo
+	return g.bitmap[i/8]&(1<<(i%8)) == 0
+}
+
+func (g *group) markUsed(num uint64) {
+	i := num - g.lo
+	g.bitmap[i/8] = g.bitmap[i/8] | (1 << (i % 8))
+}
+
+func (g *group) markFree(num uint64) {
+	i := num - g.lo
+	g.bitmap[i/8] = g.bitmap[i/8] & ^(1 << (i % 8))
+}
+
+func (a *Alloc) groupOf(num uint64) *group {
+	groups := a.getGroups()
+	gi := num / a.groupsz
+	if gi >= uint64(len(groups)) || num >= groups[gi].hi {
+		panic("alloc: number out of range")
+	}
+	return groups[gi]
+}
+
+// MarkUsed marks num as in use.
+func (a *Alloc) MarkUsed(num uint64) {
+	g := a.groupOf(num)
+	g.mu.Lock()
+	if g.isFree(num) {
+		g.markUsed(num)
+		a.nfree.Add(-1)
+	}
+	g.mu.Unlock()
+}
+
+// allocIn allocates up to n contiguous free numbers in g, starting the
+// search at from. Caller must hold g.mu.
+func (a *Alloc) allocIn(g *group, from uint64, n uint64) (uint64, uint64) {
+	var num = from
+	for {
+		if num != 0 && g.isFree(num) {
+			break
+		}
+		num++
+		if num >= g.hi {
+			num = g.lo
+		}
+		if num == from { // looped around?
+			return 0, 0
+		}
+	}
+	g.markUsed(num)
+	var cnt uint64 = 1
+	for cnt < n && num+cnt < g.hi && g.isFree(num+cnt) {
+		g.markUsed(num + cnt)
+		cnt++
+	}
+	g.next = num + cnt
+	if g.next >= g.hi {
+		g.next = g.lo
+	}
+	a.nfree.Add(-int64(cnt))
+	return num, cnt
+}
+
+func (a *Alloc) nextGroup() uint64 {
+	a.mu.Lock()
+	gi := a.rotor
+	a.rotor = (a.rotor + 1) % a.NGroup()
+	a.mu.Unlock()
+	return gi
+}
+
+// allocFrom allocates up to n contiguous free numbers in group gi,
+// starting the search at goal if it isn't 0 and at the group's next
+// number otherwise, and then in the following groups.
+func (a *Alloc) allocFrom(gi uint64, goal uint64, n uint64) (uint64, uint64) {
+	groups := a.getGroups()
+	var g = gi % uint64(len(groups))
+	for i := 0; i < len(groups); i++ {
+		grp := groups[g]
+		grp.mu.Lock()
+		var from = grp.next
+		if i == 0 && goal != 0 && goal >= grp.lo && goal < grp.hi {
+			from = goal
+		}
+		start, cnt := a.allocIn(grp, from, n)
+		grp.mu.Unlock()
+		if start != 0 {
+			return start, cnt
+		}
+		g = (g + 1) % uint64(len(groups))
+	}
+	return 0, 0
+}
+
+// AllocRun allocates up to n contiguous free numbers, as close after
+// goal as possible: in goal's group if it has a free number, and
+// otherwise in the following groups. A goal of 0 spreads allocations
+// over the groups. It returns the first number and the length of the
+// run, which is 0 if no number is free.
+func (a *Alloc) AllocRun(goal uint64, n uint64) (uint64, uint64) {
+	if goal == 0 || goal >= a.Max() {
+		return a.allocFrom(a.nextGroup(), 0, n)
+	}
+	return a.allocFrom(goal/a.groupsz, goal, n)
+}
+
+// AllocGroup allocates a free number in group gi, or if it is full, in
+// the following groups. It returns 0 if there is none.
+func (a *Alloc) AllocGroup(gi uint64) uint64 {
+	num, _ := a.allocFrom(gi, 0, 1)
+	return num
+}
+
+// AllocNear allocates a free number close after goal, returning 0 if
+// there is none.
+func (a *Alloc) AllocNear(goal uint64) uint64 {
+	num, _ := a.AllocRun(goal, 1)
+	return num
+}
+
+// AllocNum allocates a free number, returning 0 if there is none.
+func (a *Alloc) AllocNum() uint64 {
+	return a.AllocNear(0)
+}
+
+// FreeNum marks num as free.
+func (a *Alloc) FreeNum(num uint64) {
+	if num == 0 {
+		panic("FreeNum")
+	}
+	g := a.groupOf(num)
+	g.mu.Lock()
+	if !g.isFree(num) {
+		g.markFree(num)
+		a.nfree.Add(1)
+	}
+	g.mu.Unlock()
+}
+
+// Run is a run of contiguous numbers.
+type Run struct {
+	Start uint64
+	N     uint64
+}
+
+// FreeRuns calls f with the runs of free numbers in group gi, holding
+// the group's lock, so that none of them is allocated until f returns.
+func (a *Alloc) FreeRuns(gi uint64, f func([]Run)) {
+	g := a.getGroups()[gi]
+	g.mu.Lock()
+	var runs []Run
+	for num := g.lo; num < g.hi; num++ {
+		if num == 0 || !g.isFree(num) {
+			continue
+		}
+		if len(runs) > 0 && runs[len(runs)-1].Start+runs[len(runs)-1].N == num {
+			runs[len(runs)-1].N++
+		} else {
+			runs = append(runs, Run{Start: num, N: 1})
+		}
+	}
+	f(runs)
+	g.mu.Unlock()
+}
+
+func popCnt(b byte) uint64 {
+	var count uint64
+	var x = b
+	for i := uint64(0); i < 8; i++ {
+		count += uint64(x & 1)
+		x = x >> 1
+	}
+	return count
+}
+
+// NumFreeGroup returns the number of free numbers in group gi.
+func (a *Alloc) NumFreeGroup(gi uint64) uint64 {
+	g := a.getGroups()[gi]
+	g.mu.Lock()
+	var count uint64
+	for _, b := range g.bitmap {
+		count += popCnt(b)
+	}
+	g.mu.Unlock()
+	return (g.hi - g.lo) - count
+}
+
+// NumFree returns the number of free numbers.
+func (a *Alloc) NumFree() uint64 {
+	var count uint64
+	for gi := range a.getGroups() {
+		count += a.NumFreeGroup(uint64(gi))
+	}
+	return count
+}
@@ -0,0 +1,146 @@
+package alloc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlloc(t *testing.T) {
+	assert := assert.New(t)
+	a := MkAlloc(make([]byte, 4), 32)
+	a.MarkUsed(0)
+
+	assert.Equal(uint64(31), a.NumFree(), "everything (but 0) should be initially free")
+
+	n := a.AllocNum()
+	assert.NotEqual(uint64(0), n, "should not allocate 0")
+
+	a.MarkUsed(n + 1)
+	n2 := a.AllocNum()
+	assert.NotEqual(n+1, n2, "should not allocate something marked used")
+	assert.Equal(uint64(28), a.NumFree(), "should have used 4 items")
+
+	a.FreeNum(n)
+	a.FreeNum(n2)
+	assert.Equal(uint64(30), a.NumFree(), "should have freed")
+}
+
+func TestAllocRun(t *testing.T) {
+	assert := assert.New(t)
+	a := MkAlloc(make([]byte, 4), 32)
+	a.MarkUsed(0)
+	a.MarkUsed(12)
+
+	start, n := a.AllocRun(5, 4)
+	assert.Equal(uint64(5), start, "should start at a free goal")
+	assert.Equal(uint64(4), n)
+
+	start, n = a.AllocRun(9, 8)
+	assert.Equal(uint64(9), start)
+	assert.Equal(uint64(3), n, "run should stop at a used number")
+
+	start, n = a.AllocRun(5, 2)
+	assert.NotEqual(uint64(5), start, "should not reuse an allocated goal")
+	assert.Equal(uint64(2), n)
+
+	for a.NumFree() > 0 {
+		a.AllocRun(0, 32)
+	}
+	_, n = a.AllocRun(0, 1)
+	assert.Equal(uint64(0), n, "should fail when full")
+}
+
+func TestAllocGroups(t *testing.T) {
+	assert := assert.New(t)
+	a := MkAlloc(make([]byte, 8), 16)
+	a.MarkUsed(0)
+	assert.Equal(uint64(4), a.NGroup())
+
+	n := a.AllocNear(35)
+	assert.Equal(uint64(35), n, "should allocate a free goal")
+	n = a.AllocNear(35)
+	assert.Equal(uint64(2), a.Group(n), "should stay in the goal's group")
+
+	for a.NumFreeGroup(2) > 0 {
+		a.AllocNear(32)
+	}
+	n = a.AllocNear(40)
+	assert.Equal(uint64(3), a.Group(n), "should move on to the next group")
+
+	g0 := a.Group(a.AllocNum())
+	g1 := a.Group(a.AllocNum())
+	assert.NotEqual(g0, g1, "should spread allocations without a goal")
+	assert.Equal(uint64(61)-16-1, a.NumFree())
+}
+
+func TestAllocExtend(t *testing.T) {
+	assert := assert.New(t)
+	a := MkAlloc(make([]byte, 4), 16)
+	a.MarkUsed(0)
+	for a.NumFree() > 0 {
+		a.AllocNum()
+	}
+	assert.Equal(uint64(0), a.AllocNum(), "should be full")
+
+	bitmap := make([]byte, 2)
+	bitmap[0] = 1 << 0
+	a.Extend(bitmap)
+	assert.Equal(uint64(48), a.Max())
+	assert.Equal(uint64(3), a.NGroup())
+	assert.Equal(uint64(15), a.NumFree())
+	n := a.AllocNum()
+	assert.Equal(uint64(33), n, "should allocate from the new group")
+	a.FreeNum(n)
+	a.FreeNum(5)
+	assert.Equal(uint64(16), a.NumFree())
+}
+
+func TestReserve(t *testing.T) {
+	assert := assert.New(t)
+	a := MkAlloc(make([]byte, 4), 32)
+	a.MarkUsed(0)
+	a.SetPool(4)
+	assert.Equal(uint64(27), a.NumAvail())
+
+	assert.True(a.Reserve(20, false))
+	assert.False(a.Reserve(8, false), "should keep the pool")
+	assert.True(a.Reserve(7, false))
+	assert.Equal(uint64(0), a.NumAvail())
+	assert.True(a.Reserve(4, true), "privileged reservations may use the pool")
+	assert.False(a.Reserve(1, true))
+
+	a.AllocRun(0, 5)
+	a.Unreserve(5)
+	assert.False(a.Reserve(1, true), "allocations use up reservations")
+	a.Unreserve(26)
+	assert.Equal(uint64(22), a.NumAvail())
+}
+
+func TestStale(t *testing.T) {
+	assert := assert.New(t)
+	a := MkAlloc(make([]byte, 4), 16)
+	assert.False(a.BeginFence())
+	a.EndFence()
+
+	a.MarkStale(3)
+	a.MarkStale(20)
+	assert.True(a.Stale(3))
+	assert.False(a.Stale(4))
+	assert.True(a.BeginFence())
+	a.MarkStale(4)
+	assert.True(a.Stale(3), "stale until the fence ends")
+	a.EndFence()
+	assert.False(a.Stale(3))
+	assert.False(a.Stale(20))
+	assert.True(a.Stale(4), "marked after the fence began")
+
+	// a fence that doesn't end leaves its numbers to the next one
+	assert.True(a.BeginFence())
+	a.MarkStale(5)
+	assert.True(a.BeginFence())
+	assert.True(a.Stale(4))
+	a.EndFence()
+	assert.False(a.Stale(4))
+	assert.False(a.Stale(5))
+}
@@ -0,0 +1,152 @@
+package alloc
+
+import (
+	"sync"
+
+	"github.com/tchajed/marshal"
+)
+
+// QUOTASZ is the size of an id's record in a quota table.
+const QUOTASZ uint64 = 64
+
+// NOID is the uid and gid of the file system's own inodes, whose
+// blocks and inodes no quota counts.
+const NOID uint32 = ^uint32(0)
+
+// MAXQUOTAID bounds the uids and gids that have quotas, and so the
+// size of the quota tables.  Files of larger ids count against no
+// quota.
+const MAXQUOTAID uint32 = 1 << 20
+
+// Quota types, numbered as in the rquota protocol
+const (
+	USRQUOTA uint32 = 0
+	GRPQUOTA uint32 = 1
+)
+
+// Owner is the user and group that a file's blocks and inode count
+// against.
+type Owner struct {
+	Uid uint32
+	Gid uint32
+}
+
+var NOOWNER = Owner{Uid: NOID, Gid: NOID}
+
+// QuotaId names a user's or a group's quota.
+type QuotaId struct {
+	Type uint32
+	Id   uint32
+}
+
+// Limits bound the blocks and inodes of a quota; 0 means no limit.
+// Only the hard limits are enforced.
+type Limits struct {
+	BlockHard uint64
+	BlockSoft uint64
+	InodeHard uint64
+	InodeSoft uint64
+}
+
+// Quota is the record of a quota: its limits and usage.
+type Quota struct {
+	Limits
+	Blocks uint64
+	Inodes uint64
+}
+
+// Over reports whether q exceeds a hard limit.
+func (q Quota) Over() bool {
+	return (q.BlockHard != 0 && q.Blocks > q.BlockHard) ||
+		(q.InodeHard != 0 && q.Inodes > q.InodeHard)
+}
+
+// IsZero reports whether q has neither limits nor usage.
+func (q Quota) IsZero() bool {
+	return q == Quota{}
+}
+
+func (q Quota) Encode() []byte {
+	enc := marshal.NewEnc(QUOTASZ)
+	enc.PutInt(q.BlockHard)
+	enc.PutInt(q.BlockSoft)
+	enc.PutInt(q.InodeHard)
+	enc.PutInt(q.InodeSoft)
+	enc.PutInt(q.Blocks)
+	enc.PutInt(q.Inodes)
+	return enc.Finish()
+}
+
+func DecodeQuota(b []byte) Quota {
+	dec := marshal.NewDec(b)
+	var q Quota
+	q.BlockHard = dec.GetInt()
+	q.BlockSoft = dec.GetInt()
+	q.InodeHard = dec.GetInt()
+	q.InodeSoft = dec.GetInt()
+	q.Blocks = dec.GetInt()
+	q.Inodes = dec.GetInt()
+	return q
+}
+
+// Quotas holds the quota records of committed transactions, like Refs
+// holds the committed reference counts.
+type Quotas struct {
+	mu *sync.Mutex
+	q  map[QuotaId]Quota // records that aren't zero
+}
+
+// MkQuotas initializes the records from the user and group quota
+// tables, which hold QUOTASZ bytes per id, indexed by id.
+func MkQuotas(usr []byte, grp []byte) *Quotas {
+	qs := &Quotas{
+		mu: new(sync.Mutex),
+		q:  make(map[QuotaId]Quota),
+	}
+	qs.load(USRQUOTA, usr)
+	qs.load(GRPQUOTA, grp)
+	return qs
+}
+
+func (qs *Quotas) load(t uint32, table []byte) {
+	for off := uint64(0); off+QUOTASZ <= uint64(len(table)); off += QUOTASZ {
+		q := DecodeQuota(table[off : off+QUOTASZ])
+		if !q.IsZero() {
+			qs.q[QuotaId{Type: t, Id: uint32(off / QUOTASZ)}] = q
+		}
+	}
+}
+
+// Get returns the committed record of id.
+func (qs *Quotas) Get(id QuotaId) Quota {
+	qs.mu.Lock()
+	q := qs.q[id]
+	qs.mu.Unlock()
+	return q
+}
+
+// List returns the committed records of type t that aren't zero.
+func (qs *Quotas) List(t uint32) map[uint32]Quota {
+	qs.mu.Lock()
+	l := make(map[uint32]Quota)
+	for id, q := range qs.q {
+		if id.Type == t {
+			l[id.Id] = q
+		}
+	}
+	qs.mu.Unlock()
+	return l
+}
+
+// Commit installs the records of a committed transaction.
+func (qs *Quotas) Commit(recs map[QuotaId]Quota) {
+	qs.mu.Lock()
+	for id, q := range recs {
+		if q.IsZero() {
+			delete(qs.q, id)
+		} else {
+			qs.q[id] = q
+		}
+	}
+	qs.mu.Unlock()
+}
@@ -0,0 +1,80 @@
+package alloc
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// REFSZ is the size of a block's reference count in the reference
+// count table.
+const REFSZ uint64 = 4
+
+// Refs counts the references to blocks that several files share.  A
+// block's count is the number of references besides its first one, so
+// a block with count 0 has a single owner, and most blocks have count
+// 0.  Refs holds the counts of committed transactions only; a
+// transaction that drops a reference to a shared block finds out
+// whether it dropped the last one when it commits, holding the
+// reference count table's lock (see AllocTxn.RefCounts), since the
+// transactions that drop the other references may still abort.
+type Refs struct {
+	mu  *sync.Mutex
+	cnt map[uint64]uint32 // committed counts, for blocks with count > 0
+}
+
+// MkRefs initializes the counts from table, which holds REFSZ bytes
+// per block, indexed by block number.
+func MkRefs(table []byte) *Refs {
+	r := &Refs{
+		mu:  new(sync.Mutex),
+		cnt: make(map[uint64]uint32),
+	}
+	for off := uint64(0); off+REFSZ <= uint64(len(table)); off += REFSZ {
+		n := binary.LittleEndian.Uint32(table[off : off+REFSZ])
+		if n > 0 {
+			r.cnt[off/REFSZ] = n
+		}
+	}
+	return r
+}
+
+// Count returns the committed count of block bn.
+func (r *Refs) Count(bn uint64) uint32 {
+	r.mu.Lock()
+	n := r.cnt[bn]
+	r.mu.Unlock()
+	return n
+}
+
+// Shared reports whether bn has more than one reference.  It counts
+// references that running transactions are dropping, since they may
+// abort.
+func (r *Refs) Shared(bn uint64) bool {
+	return r.Count(bn) > 0
+}
+
+// Commit applies the changes of a committed transaction: inc new
+// references per block, and a decrement for each block in dec.
+func (r *Refs) Commit(inc map[uint64]uint32, dec []uint64) {
+	r.mu.Lock()
+	for bn, n := range inc {
+		r.cnt[bn] += n
+	}
+	for _, bn := range dec {
+		if r.cnt[bn] == 0 {
+			panic("Refs.Commit: count below 0")
+		}
+		r.cnt[bn]--
+		if r.cnt[bn] == 0 {
+			delete(r.cnt, bn)
+		}
+	}
+	r.mu.Unlock()
+}
+
+// EncodeCount returns the table entry for count n.
+func EncodeCount(n uint32) []byte {
+	b := make([]byte, REFSZ)
+	binary.LittleEndian.PutUint32(b, n)
+	return b
+}
@@ -0,0 +1,79 @@
+package alloc
+
+//
+// Reservations.  A caller that is about to allocate first reserves the
+// numbers it needs, so that it learns that there aren't enough before
+// it changes anything, rather than halfway through.  The last pool
+// free numbers are kept for privileged reservations, such as those of
+// the shrinker and of removals, which free space and may need a little
+// to do it.
+//
+
+// SetPool sets the number of free numbers that only privileged
+// reservations may use.
+func (a *Alloc) SetPool(n uint64) {
+	a.mu.Lock()
+	a.pool = n
+	a.mu.Unlock()
+}
+
+// Pool returns the number of free numbers kept for privileged
+// reservations.
+func (a *Alloc) Pool() uint64 {
+	a.mu.Lock()
+	n := a.pool
+	a.mu.Unlock()
+	return n
+}
+
+// Reserve sets aside n free numbers for the caller and reports whether
+// there were enough.  It reserves all n or none.  Unless priv, it
+// leaves the pool alone.
+func (a *Alloc) Reserve(n uint64, priv bool) bool {
+	a.mu.Lock()
+	var avail uint64 = 0
+	free := a.nfree.Load()
+	if free > 0 && uint64(free) > a.held {
+		avail = uint64(free) - a.held
+	}
+	if !priv {
+		if avail > a.pool {
+			avail -= a.pool
+		} else {
+			avail = 0
+		}
+	}
+	ok := n <= avail
+	if ok {
+		a.held += n
+	}
+	a.mu.Unlock()
+	return ok
+}
+
+// Unreserve gives up n reserved numbers, because the caller allocated
+// them or doesn't need them.
+func (a *Alloc) Unreserve(n uint64) {
+	a.mu.Lock()
+	if n > a.held {
+		panic("Unreserve")
+	}
+	a.held -= n
+	a.mu.Unlock()
+}
+
+// NumAvail returns the number of free numbers that an unprivileged
+// reservation could get.
+func (a *Alloc) NumAvail() uint64 {
+	a.mu.Lock()
+	free := uint64(0)
+	if f := a.nfree.Load(); f > 0 {
+		free = uint64(f)
+	}
+	var avail uint64 = 0
+	if free > a.held+a.pool {
+		avail = free - a.held - a.pool
+	}
+	a.mu.Unlock()
+	return avail
+}
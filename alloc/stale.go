@@ -0,0 +1,69 @@
+package alloc
+
+//
+// Stale numbers.  A block that a committed transaction freed may still
+// have writes in the log that the log hasn't installed yet, and which
+// it would install over anything written to the block directly.  The
+// caller marks such blocks stale when it frees them, and a fence, which
+// waits for the log to install everything committed before the fence
+// began, makes the blocks it covers fresh again.  Allocating a number
+// leaves it stale; only a fence clears it.
+//
+
+func testBit(bm []byte, i uint64) bool {
+	return bm != nil && bm[i/8]&(1<<(i%8)) != 0
+}
+
+// MarkStale marks num as stale.
+func (a *Alloc) MarkStale(num uint64) {
+	g := a.groupOf(num)
+	g.mu.Lock()
+	if g.stale == nil {
+		g.stale = make([]byte, len(g.bitmap))
+	}
+	i := num - g.lo
+	g.stale[i/8] = g.stale[i/8] | (1 << (i % 8))
+	g.mu.Unlock()
+}
+
+// Stale reports whether num is stale.
+func (a *Alloc) Stale(num uint64) bool {
+	g := a.groupOf(num)
+	g.mu.Lock()
+	i := num - g.lo
+	stale := testBit(g.stale, i) || testBit(g.fenced, i)
+	g.mu.Unlock()
+	return stale
+}
+
+// BeginFence starts a fence, which covers the numbers marked stale so
+// far, including those of an earlier fence that didn't end.  It
+// reports whether there are any.
+func (a *Alloc) BeginFence() bool {
+	var any = false
+	for _, g := range a.getGroups() {
+		g.mu.Lock()
+		if g.fenced == nil {
+			g.fenced = g.stale
+		} else if g.stale != nil {
+			for i := range g.stale {
+				g.fenced[i] = g.fenced[i] | g.stale[i]
+			}
+		}
+		g.stale = nil
+		if g.fenced != nil {
+			any = true
+		}
+		g.mu.Unlock()
+	}
+	return any
+}
+
+// EndFence makes the numbers that the fence covers fresh.
+func (a *Alloc) EndFence() {
+	for _, g := range a.getGroups() {
+		g.mu.Lock()
+		g.fenced = nil
+		g.mu.Unlock()
+	}
+}
@@ -1,19 +1,24 @@
 package alloctxn
 
 import (
+	"sort"
+
+	"github.com/goose-lang/primitive/disk"
+
 	"github.com/mit-pdos/go-journal/addr"
-	"github.com/mit-pdos/go-journal/alloc"
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/obj"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
 	"github.com/mit-pdos/go-nfsd/super"
 )
 
 //
 // alloctxn implements transactions using buftxn.  It adds to buftxn
-// support for (1) block and inode allocation.
+// support for (1) block and inode allocation, and (2) checksums of the
+// blocks that the transaction reads and writes.
 //
 
 type AllocTxn struct {
@@ -21,23 +26,57 @@ type AllocTxn struct {
 	Op         *jrnl.Op
 	Balloc     *alloc.Alloc
 	Ialloc     *alloc.Alloc
+	Refs       *alloc.Refs
+	Quotas     *alloc.Quotas
 	allocInums []common.Inum
 	freeInums  []common.Inum
 	allocBnums []common.Bnum
 	freeBnums  []common.Bnum
+	wroteInums []common.Inum
+	incRefs    map[common.Bnum]uint32 // new references to shared blocks
+	decRefs    []common.Bnum          // dropped references
+	blocks     map[common.Bnum]bool   // blocks read or written
+	corrupt    bool                   // read a block or inode with a bad checksum
+	usage      map[alloc.QuotaId]*charge
+	limits     map[alloc.QuotaId]alloc.Limits // new limits to record
+	resBlocks  uint64                         // blocks reserved but not yet allocated
+	resInodes  uint64                         // inodes reserved but not yet allocated
+	priv       bool                           // may use the reserved pools
+	discard    bool                           // the disk discards freed blocks
+	fresh      map[common.Bnum]bool           // allocated blocks not yet written or zeroed
+	ordered    bool                           // may write new blocks directly
+	direct     map[common.Bnum][]byte         // blocks to write directly
+	sawStale   bool                           // couldn't write a block directly
+}
+
+// charge is the change the transaction makes to a quota's usage.
+type charge struct {
+	blocks int64
+	inodes int64
 }
 
 // Begin starts a new allocation transaction.
-func Begin(super *super.FsSuper, log *obj.Log, balloc *alloc.Alloc, ialloc *alloc.Alloc) *AllocTxn {
+func Begin(super *super.FsSuper, log *obj.Log, balloc *alloc.Alloc, ialloc *alloc.Alloc, refs *alloc.Refs, quotas *alloc.Quotas) *AllocTxn {
 	atxn := &AllocTxn{
 		Super:      super,
 		Op:         jrnl.Begin(log),
 		Ialloc:     ialloc,
 		Balloc:     balloc,
+		Refs:       refs,
+		Quotas:     quotas,
 		allocInums: make([]common.Inum, 0),
 		freeInums:  make([]common.Inum, 0),
 		allocBnums: make([]common.Bnum, 0),
 		freeBnums:  make([]common.Bnum, 0),
+		wroteInums: make([]common.Inum, 0),
+		incRefs:    make(map[common.Bnum]uint32),
+		decRefs:    make([]common.Bnum, 0),
+		blocks:     make(map[common.Bnum]bool),
+		usage:      make(map[alloc.QuotaId]*charge),
+		limits:     make(map[alloc.QuotaId]alloc.Limits),
+		discard:    CanDiscard(super.Disk),
+		fresh:      make(map[common.Bnum]bool),
+		direct:     make(map[common.Bnum][]byte),
 	}
 	return atxn
 }
@@ -47,58 +86,108 @@ func (atxn *AllocTxn) Id() *jrnl.Op {
 	return atxn.Op
 }
 
-// AllocINum allocates a free inode number.
-func (atxn *AllocTxn) AllocINum() common.Inum {
-	inum := common.Inum(atxn.Ialloc.AllocNum())
+// AllocINum allocates a free inode number, in near's allocation group
+// if near isn't NULLINUM, and otherwise in the next group.
+func (atxn *AllocTxn) AllocINum(near common.Inum) common.Inum {
+	var inum common.Inum
+	if !atxn.takeInodes() {
+		return common.NULLINUM
+	}
+	if near == common.NULLINUM {
+		inum = common.Inum(atxn.Ialloc.AllocNum())
+	} else {
+		inum = common.Inum(atxn.Ialloc.AllocGroup(atxn.Ialloc.Group(uint64(near))))
+	}
 	util.DPrintf(1, "AllocINum -> # %v\n", inum)
 	if inum != common.NULLINUM {
 		atxn.allocInums = append(atxn.allocInums, inum)
+		atxn.resInodes--
+		atxn.Ialloc.Unreserve(1)
 	}
 	return inum
 }
 
+// InodeWritten records that the transaction wrote inode inum.
+func (atxn *AllocTxn) InodeWritten(inum common.Inum) {
+	atxn.wroteInums = append(atxn.wroteInums, inum)
+}
+
+// WrittenInums returns the inodes the transaction wrote.
+func (atxn *AllocTxn) WrittenInums() []common.Inum {
+	return atxn.wroteInums
+}
+
 // FreeINum schedules an inode number to be freed on commit.
 func (atxn *AllocTxn) FreeINum(inum common.Inum) {
 	util.DPrintf(1, "FreeINum -> # %v\n", inum)
 	atxn.freeInums = append(atxn.freeInums, inum)
 }
 
-// WriteBits updates bitmap bits for allocation status.
-func (atxn *AllocTxn) WriteBits(nums []uint64, blk uint64, alloc bool) {
-	for _, n := range nums {
-		a := addr.MkBitAddr(blk, n)
-		var b = byte(1 << (n % 8))
-		if !alloc {
-			b = ^b
-		}
-		atxn.Op.OverWrite(a, 1, []byte{b})
+// WriteBit updates the bitmap bit at a for allocation status.
+func (atxn *AllocTxn) WriteBit(a addr.Addr, alloc bool) {
+	var b = byte(1 << (a.Off % 8))
+	if !alloc {
+		b = ^b
 	}
+	atxn.Op.OverWrite(a, 1, []byte{b})
+}
+
+// ReadBit returns the committed bitmap bit at a.
+func (atxn *AllocTxn) ReadBit(a addr.Addr) bool {
+	b := atxn.Op.ReadBuf(a, 1)
+	return b.Data[0]&(1<<(a.Off%8)) != 0
 }
 
-// Write allocated/free bits to the on-disk bit maps
+func (atxn *AllocTxn) writeInodeBits(inums []common.Inum, alloc bool) {
+	for _, inum := range inums {
+		atxn.WriteBit(atxn.Super.InodeBitAddr(inum), alloc)
+	}
+}
+
+func (atxn *AllocTxn) writeBlockBits(bnums []common.Bnum, alloc bool) {
+	for _, bn := range bnums {
+		atxn.WriteBit(atxn.Super.BlockBitAddr(bn), alloc)
+	}
+}
+
+// Write allocated/free bits to the on-disk bit maps, and the checksums
+// of the blocks the transaction wrote, and write the blocks that it
+// writes directly.
 func (atxn *AllocTxn) PreCommit() {
+	atxn.zeroFresh()
+	atxn.writeCsums()
+
 	util.DPrintf(1, "commitBitmaps: alloc inums %v blks %v\n", atxn.allocInums,
 		atxn.allocBnums)
 
-	atxn.WriteBits(atxn.allocInums, atxn.Super.BitmapInodeStart(), true)
-	atxn.WriteBits(atxn.allocBnums, atxn.Super.BitmapBlockStart(), true)
+	atxn.writeInodeBits(atxn.allocInums, true)
+	atxn.writeBlockBits(atxn.allocBnums, true)
 
 	util.DPrintf(1, "commitBitmaps: free inums %v blks %v\n", atxn.freeInums,
 		atxn.freeBnums)
 
-	atxn.WriteBits(atxn.freeInums, atxn.Super.BitmapInodeStart(), false)
-	atxn.WriteBits(atxn.freeBnums, atxn.Super.BitmapBlockStart(), false)
+	atxn.writeInodeBits(atxn.freeInums, false)
+	atxn.writeBlockBits(atxn.freeBnums, false)
+
+	atxn.writeDirect()
 }
 
-// On-disk bitmap has been updated; update in-memory state for free bits
-func (atxn *AllocTxn) PostCommit() {
+// On-disk bitmap has been updated; update in-memory state for free
+// bits.  If the commit is durable, discard the freed blocks first, so
+// that no other transaction can allocate them while they are discarded.
+func (atxn *AllocTxn) PostCommit(durable bool) {
 	util.DPrintf(1, "updateFree: inums %v blks %v\n", atxn.freeInums, atxn.freeBnums)
+	if durable && atxn.discard {
+		atxn.discardBlocks()
+	}
 	for _, inum := range atxn.freeInums {
 		atxn.Ialloc.FreeNum(uint64(inum))
 	}
 	for _, bn := range atxn.freeBnums {
+		atxn.Balloc.MarkStale(bn)
 		atxn.Balloc.FreeNum(bn)
 	}
+	atxn.unreserve()
 }
 
 // Abort: free allocated inums and bnums. Nothing to do for freed
@@ -111,6 +200,7 @@ func (atxn *AllocTxn) PostAbort() {
 	for _, bn := range atxn.allocBnums {
 		atxn.Balloc.FreeNum(bn)
 	}
+	atxn.unreserve()
 }
 
 // AssertValidBlock checks that blkno is within the valid data range.
@@ -122,43 +212,322 @@ func (atxn *AllocTxn) AssertValidBlock(blkno common.Bnum) {
 	}
 }
 
-// AllocBlock allocates a free disk block.
-func (atxn *AllocTxn) AllocBlock() common.Bnum {
-	util.DPrintf(5, "alloc block\n")
-	bn := common.Bnum(atxn.Balloc.AllocNum())
+// AllocBlock allocates a free disk block, as close after goal as
+// possible, and charges it to owner's quotas.
+func (atxn *AllocTxn) AllocBlock(owner alloc.Owner, goal common.Bnum) common.Bnum {
+	util.DPrintf(5, "alloc block (goal %v)\n", goal)
+	if atxn.takeBlocks(1) == 0 {
+		return common.NULLBNUM
+	}
+	bn := common.Bnum(atxn.Balloc.AllocNear(uint64(goal)))
 	atxn.AssertValidBlock(bn)
 	util.DPrintf(1, "alloc block -> %v\n", bn)
 	if bn != common.NULLBNUM {
 		atxn.allocBnums = append(atxn.allocBnums, bn)
+		atxn.blocks[bn] = true // no checksum to verify yet
+		atxn.fresh[bn] = true
+		atxn.resBlocks--
+		atxn.Balloc.Unreserve(1)
+		atxn.Charge(owner, 1, 0)
 	}
 	return bn
 }
 
-// FreeBlock schedules a block to be freed on commit.
-func (atxn *AllocTxn) FreeBlock(blkno common.Bnum) {
+// AllocBlocks allocates up to n contiguous free disk blocks, starting
+// at goal if goal is free. It returns the first block and the number
+// of blocks allocated, which is 0 if the disk is full.
+func (atxn *AllocTxn) AllocBlocks(owner alloc.Owner, goal common.Bnum, n uint64) (common.Bnum, uint64) {
+	avail := atxn.takeBlocks(n)
+	if avail == 0 {
+		return common.NULLBNUM, 0
+	}
+	start, cnt := atxn.Balloc.AllocRun(uint64(goal), avail)
+	atxn.resBlocks -= cnt
+	atxn.Balloc.Unreserve(cnt)
+	util.DPrintf(1, "alloc blocks %v (goal %v) -> %v %d\n", n, goal, start, cnt)
+	for bn := start; bn < start+cnt; bn++ {
+		atxn.AssertValidBlock(bn)
+		atxn.allocBnums = append(atxn.allocBnums, bn)
+		atxn.blocks[bn] = true
+		atxn.fresh[bn] = true
+	}
+	atxn.Charge(owner, int64(cnt), 0)
+	return start, cnt
+}
+
+// UnallocBlock returns a block that this transaction allocated, but
+// hasn't used, to the allocator.
+func (atxn *AllocTxn) UnallocBlock(owner alloc.Owner, blkno common.Bnum) {
+	util.DPrintf(1, "unalloc block %v\n", blkno)
+	for i, bn := range atxn.allocBnums {
+		if bn == blkno {
+			atxn.allocBnums = append(atxn.allocBnums[:i], atxn.allocBnums[i+1:]...)
+			delete(atxn.fresh, bn)
+			atxn.Balloc.FreeNum(bn)
+			atxn.Charge(owner, -1, 0)
+			return
+		}
+	}
+	panic("UnallocBlock")
+}
+
+// FreeBlock schedules a block to be freed on commit.  If other files
+// share the block, it drops the caller's reference instead, and the
+// commit frees the block if the other references are gone by then
+// (see RefCounts).  Either way, owner's quotas no longer count the
+// block.
+func (atxn *AllocTxn) FreeBlock(owner alloc.Owner, blkno common.Bnum) {
 	util.DPrintf(1, "free block %v\n", blkno)
 	atxn.AssertValidBlock(blkno)
 	if blkno == 0 {
 		return
 	}
-	atxn.ZeroBlock(blkno)
+	atxn.Charge(owner, -1, 0)
+	if atxn.incRefs[blkno] > 0 {
+		atxn.incRefs[blkno]--
+		return
+	}
+	if atxn.Refs.Shared(blkno) {
+		util.DPrintf(1, "unref block %v\n", blkno)
+		atxn.decRefs = append(atxn.decRefs, blkno)
+		return
+	}
+	atxn.freeBlock(blkno)
+}
+
+func (atxn *AllocTxn) freeBlock(blkno common.Bnum) {
+	delete(atxn.fresh, blkno)
+	delete(atxn.direct, blkno)
 	atxn.freeBnums = append(atxn.freeBnums, blkno)
 }
 
-// ReadBlock loads a block for read or modification.
+// NFreed returns the number of blocks the transaction frees or drops
+// a reference to.
+func (atxn *AllocTxn) NFreed() uint64 {
+	return uint64(len(atxn.freeBnums) + len(atxn.decRefs))
+}
+
+// ReadBlock loads a block for read or modification.  The first time
+// the transaction reads a block, ReadBlock checks the block's checksum;
+// if it doesn't match, ReadBlock marks the transaction as corrupt, so
+// that it can't commit, and returns the block zeroed.
 func (atxn *AllocTxn) ReadBlock(blkno common.Bnum) *buf.Buf {
+	b, _ := atxn.readBlock(blkno)
+	return b
+}
+
+// readBlock implements ReadBlock, and also reports whether it found
+// that the block fails its checksum.
+func (atxn *AllocTxn) readBlock(blkno common.Bnum) (*buf.Buf, bool) {
 	util.DPrintf(5, "ReadBlock %d\n", blkno)
 	atxn.AssertValidBlock(blkno)
+	atxn.settle(blkno)
 	addr := atxn.Super.Block2addr(blkno)
-	return atxn.Op.ReadBuf(addr, common.NBITBLOCK)
+	b := atxn.Op.ReadBuf(addr, common.NBITBLOCK)
+	if !atxn.blocks[blkno] {
+		atxn.blocks[blkno] = true
+		if !b.IsDirty() && !atxn.verify(blkno, b.Data) {
+			for i := range b.Data {
+				b.Data[i] = 0
+			}
+			return b, false
+		}
+	}
+	return b, true
+}
+
+// VerifyBlock reads block blkno, like ReadBlock, and reports whether
+// it matched its checksum.  A block that the transaction already read
+// or wrote counts as matching.
+func (atxn *AllocTxn) VerifyBlock(blkno common.Bnum) bool {
+	_, ok := atxn.readBlock(blkno)
+	return ok
+}
+
+// WriteBlock overwrites block blkno with data.
+func (atxn *AllocTxn) WriteBlock(blkno common.Bnum, data []byte) {
+	util.DPrintf(5, "WriteBlock %d\n", blkno)
+	atxn.AssertValidBlock(blkno)
+	atxn.blocks[blkno] = true
+	delete(atxn.fresh, blkno)
+	delete(atxn.direct, blkno)
+	atxn.Op.OverWrite(atxn.Super.Block2addr(blkno), common.NBITBLOCK, data)
+}
+
+func (atxn *AllocTxn) readCsum(blkno common.Bnum) uint32 {
+	b := atxn.Op.ReadBuf(atxn.Super.CsumAddr(blkno), super.CSUMSZ*8)
+	return super.DecodeCsum(b.Data)
+}
+
+func (atxn *AllocTxn) verify(blkno common.Bnum, data []byte) bool {
+	want := atxn.readCsum(blkno)
+	if want == super.Checksum(data) {
+		return true
+	}
+	atxn.Corrupted("block", blkno)
+	return false
+}
+
+// Corrupted records that the transaction read block or inode n, and
+// found that it doesn't match its checksum.
+func (atxn *AllocTxn) Corrupted(what string, n uint64) {
+	util.DPrintf(0, "integrity error: %s %d fails its checksum\n", what, n)
+	atxn.Super.IntegrityError()
+	atxn.corrupt = true
+}
+
+// Corrupt reports whether the transaction read a block or inode that
+// failed its checksum, in which case it must not commit.
+func (atxn *AllocTxn) Corrupt() bool {
+	return atxn.corrupt
+}
+
+// Changed reports whether the transaction wrote a block or inode,
+// allocated or freed anything, or changed a reference count, quota, or
+// reservation.
+func (atxn *AllocTxn) Changed() bool {
+	return atxn.Op.NDirty() > 0 || len(atxn.allocInums) > 0 ||
+		len(atxn.freeInums) > 0 || len(atxn.allocBnums) > 0 ||
+		len(atxn.freeBnums) > 0 || len(atxn.wroteInums) > 0 ||
+		len(atxn.incRefs) > 0 || len(atxn.decRefs) > 0 ||
+		len(atxn.usage) > 0 || len(atxn.limits) > 0 ||
+		atxn.resBlocks > 0 || atxn.resInodes > 0 ||
+		len(atxn.fresh) > 0 || len(atxn.direct) > 0
+}
+
+// dirtyBlocks returns the blocks that the transaction wrote.
+func (atxn *AllocTxn) dirtyBlocks() []common.Bnum {
+	var bns = make([]common.Bnum, 0)
+	for bn := range atxn.blocks {
+		b := atxn.Op.ReadBuf(atxn.Super.Block2addr(bn), common.NBITBLOCK)
+		if b.IsDirty() {
+			bns = append(bns, bn)
+		}
+	}
+	return bns
+}
+
+func (atxn *AllocTxn) writeCsums() {
+	bns := atxn.dirtyBlocks()
+	sort.Slice(bns, func(i, j int) bool { return bns[i] < bns[j] })
+	for _, bn := range bns {
+		b := atxn.Op.ReadBuf(atxn.Super.Block2addr(bn), common.NBITBLOCK)
+		atxn.Op.OverWrite(atxn.Super.CsumAddr(bn), super.CSUMSZ*8,
+			super.EncodeCsum(super.Checksum(b.Data)))
+	}
+	for bn, data := range atxn.direct {
+		atxn.Op.OverWrite(atxn.Super.CsumAddr(bn), super.CSUMSZ*8,
+			super.EncodeCsum(super.Checksum(data)))
+	}
+}
+
+// NCsumBlocks returns the number of checksum blocks that the
+// transaction will update.
+func (atxn *AllocTxn) NCsumBlocks() uint64 {
+	blks := make(map[uint64]bool)
+	for _, bn := range atxn.dirtyBlocks() {
+		blks[atxn.Super.CsumAddr(bn).Blkno] = true
+	}
+	for bn := range atxn.direct {
+		blks[atxn.Super.CsumAddr(bn).Blkno] = true
+	}
+	for bn := range atxn.fresh {
+		blks[atxn.Super.CsumAddr(bn).Blkno] = true
+	}
+	return uint64(len(blks))
 }
 
 // ZeroBlock zeros the specified block within the transaction.
 func (atxn *AllocTxn) ZeroBlock(blkno common.Bnum) {
 	util.DPrintf(5, "zero block %d\n", blkno)
-	buf := atxn.ReadBlock(blkno)
-	for i := range buf.Data {
-		buf.Data[i] = 0
+	atxn.WriteBlock(blkno, make(disk.Block, disk.BlockSize))
+}
+
+// RefBlock adds a reference to block blkno, which a file that the
+// caller has locked refers to, for another file to share it.  The
+// sharing file's owner is charged for the block, as if it were a copy.
+func (atxn *AllocTxn) RefBlock(owner alloc.Owner, blkno common.Bnum) {
+	atxn.AssertValidBlock(blkno)
+	atxn.incRefs[blkno]++
+	atxn.Charge(owner, 1, 0)
+}
+
+// Shared reports whether block blkno has more than one reference, so
+// that a file must copy it before writing it.
+func (atxn *AllocTxn) Shared(blkno common.Bnum) bool {
+	return atxn.incRefs[blkno] > 0 || atxn.Refs.Shared(blkno)
+}
+
+// RefCounts returns the new reference count of each block whose count
+// the transaction changes, and the blocks whose last reference it
+// drops, because the transactions that held the other references
+// committed dropping them.  The caller must hold the reference count
+// table's lock, so that no other transaction commits a change to the
+// counts until PostCommitRefs, and pass the last blocks to FreeLast.
+func (atxn *AllocTxn) RefCounts() (map[common.Bnum]uint32, []common.Bnum) {
+	cnts := make(map[common.Bnum]uint32)
+	var last = make([]common.Bnum, 0)
+	for bn, n := range atxn.incRefs {
+		if n > 0 {
+			cnts[bn] = atxn.Refs.Count(bn) + n
+		}
+	}
+	for _, bn := range atxn.decRefs {
+		if _, ok := cnts[bn]; !ok {
+			cnts[bn] = atxn.Refs.Count(bn)
+		}
+		if cnts[bn] == 0 {
+			last = append(last, bn)
+			continue
+		}
+		cnts[bn]--
+	}
+	for _, bn := range last {
+		if cnts[bn] == 0 && atxn.Refs.Count(bn) == 0 {
+			delete(cnts, bn)
+		}
 	}
-	buf.SetDirty()
+	return cnts, last
+}
+
+// FreeLast frees the blocks whose last reference the transaction
+// drops, which RefCounts returned, instead of dropping a reference.
+func (atxn *AllocTxn) FreeLast(last []common.Bnum) {
+	for _, bn := range last {
+		for i, dbn := range atxn.decRefs {
+			if dbn == bn {
+				atxn.decRefs = append(atxn.decRefs[:i], atxn.decRefs[i+1:]...)
+				break
+			}
+		}
+		util.DPrintf(1, "free last ref of block %v\n", bn)
+		atxn.freeBlock(bn)
+	}
+}
+
+// PostCommitRefs updates the in-memory reference counts after commit.
+func (atxn *AllocTxn) PostCommitRefs() {
+	atxn.Refs.Commit(atxn.incRefs, atxn.decRefs)
+}
+
+// NRefBlocks returns the number of blocks of the reference count table
+// that the transaction will update.
+func (atxn *AllocTxn) NRefBlocks() uint64 {
+	blks := make(map[common.Bnum]bool)
+	for bn := range atxn.incRefs {
+		blks[bn*alloc.REFSZ/disk.BlockSize] = true
+	}
+	for _, bn := range atxn.decRefs {
+		blks[bn*alloc.REFSZ/disk.BlockSize] = true
+	}
+	return uint64(len(blks))
+}
+
+// NDirty returns the number of blocks the transaction will write to
+// the log, counting blocks of the reference count and quota tables,
+// for which the table files may need a map block each, too, new blocks
+// that it will zero, and checksum blocks.
+func (atxn *AllocTxn) NDirty() uint64 {
+	return atxn.Op.NDirty() + 2*atxn.NRefBlocks() + 2*atxn.NQuotaBlocks() +
+		uint64(len(atxn.fresh)) + atxn.NCsumBlocks()
 }
@@ -0,0 +1,58 @@
+package alloctxn
+
+import (
+	"sort"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+)
+
+//
+// Discards.  If the disk can discard blocks, a transaction discards
+// the blocks it frees once it has committed durably.  A discarded
+// block may still read as its old contents, which is fine, since
+// allocating a block zeros it (see ordered.go).  Blocks that commits
+// that aren't durable free stay allocated on the disk until a trim.
+//
+
+// Discarder is a disk that can discard blocks: tell the storage under
+// it that the blocks hold no data, so that it may reclaim their space.
+// A discarded block may read as zeros or as its old contents until it
+// is written again.
+type Discarder interface {
+	Discard(a uint64, n uint64)
+}
+
+// Discard discards blocks [a, a+n) of d, if d is a Discarder, and
+// reports whether it is.
+func Discard(d disk.Disk, a uint64, n uint64) bool {
+	dd, ok := d.(Discarder)
+	if ok && n > 0 {
+		dd.Discard(a, n)
+	}
+	return ok
+}
+
+// CanDiscard reports whether d can discard blocks.
+func CanDiscard(d disk.Disk) bool {
+	_, ok := d.(Discarder)
+	return ok
+}
+
+// discardBlocks discards the blocks the transaction freed, a run of
+// contiguous blocks at a time.
+func (atxn *AllocTxn) discardBlocks() {
+	bns := append([]common.Bnum{}, atxn.freeBnums...)
+	sort.Slice(bns, func(i, j int) bool { return bns[i] < bns[j] })
+	for i := 0; i < len(bns); {
+		var n = 1
+		for i+n < len(bns) && bns[i+n] == bns[i]+uint64(n) {
+			n++
+		}
+		util.DPrintf(5, "discard [%d, %d)\n", bns[i], bns[i]+uint64(n))
+		Discard(atxn.Super.Disk, atxn.Super.Block2addr(bns[i]).Blkno, uint64(n))
+		i += n
+	}
+}
@@ -0,0 +1,86 @@
+package alloctxn
+
+import (
+	"sort"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+)
+
+//
+// Ordered data.  The log writes every block twice, once to the log and
+// once to its home location.  A transaction in ordered mode instead
+// writes whole new data blocks only to their home location, just
+// before it commits; the log's barrier before it commits the
+// transaction orders these writes before the metadata that refers to
+// them, as in ext3's ordered mode.  If the transaction never commits,
+// the blocks stay free, so a free block may hold garbage; allocating a
+// block therefore zeros it through the log, unless the transaction
+// overwrites the whole block anyway.
+//
+// A block that a committed transaction freed may still have writes in
+// the log that the log would install over the direct write, so
+// transactions log blocks that the allocator marks stale instead, and
+// report it (SawStale), for the caller to start a fence.
+//
+
+// SetOrdered lets the transaction write new data blocks directly.
+func (atxn *AllocTxn) SetOrdered() {
+	atxn.ordered = true
+}
+
+// SawStale reports whether the transaction logged a block that it
+// would have written directly, if the block hadn't been stale.
+func (atxn *AllocTxn) SawStale() bool {
+	return atxn.sawStale
+}
+
+// WriteData overwrites data block blkno with data, which is a whole
+// block.  In ordered mode, if the transaction allocated the block and
+// hasn't used it yet, it writes the block directly at commit rather
+// than through the log.
+func (atxn *AllocTxn) WriteData(blkno common.Bnum, data []byte) {
+	if !atxn.ordered || !atxn.fresh[blkno] {
+		atxn.WriteBlock(blkno, data)
+		return
+	}
+	if atxn.Balloc.Stale(blkno) {
+		atxn.sawStale = true
+		atxn.WriteBlock(blkno, data)
+		return
+	}
+	util.DPrintf(5, "WriteData %d directly\n", blkno)
+	delete(atxn.fresh, blkno)
+	atxn.direct[blkno] = append([]byte{}, data...)
+}
+
+// settle puts a new block that the transaction is about to read into
+// the log: zeros if it hasn't written the block yet, and otherwise the
+// data it was going to write directly.
+func (atxn *AllocTxn) settle(blkno common.Bnum) {
+	if atxn.fresh[blkno] {
+		atxn.ZeroBlock(blkno)
+	} else if data, ok := atxn.direct[blkno]; ok {
+		atxn.WriteBlock(blkno, data)
+	}
+}
+
+// zeroFresh zeros the new blocks that the transaction didn't write.
+func (atxn *AllocTxn) zeroFresh() {
+	for bn := range atxn.fresh {
+		atxn.ZeroBlock(bn)
+	}
+}
+
+// writeDirect writes the blocks that the transaction writes directly,
+// in order.
+func (atxn *AllocTxn) writeDirect() {
+	bns := make([]common.Bnum, 0, len(atxn.direct))
+	for bn := range atxn.direct {
+		bns = append(bns, bn)
+	}
+	sort.Slice(bns, func(i, j int) bool { return bns[i] < bns[j] })
+	for _, bn := range bns {
+		atxn.Super.Disk.Write(atxn.Super.Block2addr(bn).Blkno, atxn.direct[bn])
+	}
+}
@@ -0,0 +1,103 @@
+package alloctxn
+
+import (
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-nfsd/alloc"
+)
+
+//
+// Quotas.  A transaction adds up the blocks and inodes that it charges
+// to each user and group, and at commit the file system adds the
+// totals to the quota records, in the same transaction, and aborts it
+// if a total that grows exceeds its hard limit.
+//
+
+func (atxn *AllocTxn) charge1(id alloc.QuotaId, blocks int64, inodes int64) {
+	if id.Id == alloc.NOID || id.Id >= alloc.MAXQUOTAID {
+		return
+	}
+	c, ok := atxn.usage[id]
+	if !ok {
+		c = &charge{}
+		atxn.usage[id] = c
+	}
+	c.blocks += blocks
+	c.inodes += inodes
+}
+
+// Charge adds blocks and inodes, which may be negative, to the usage of
+// owner's user and group quotas.
+func (atxn *AllocTxn) Charge(owner alloc.Owner, blocks int64, inodes int64) {
+	atxn.charge1(alloc.QuotaId{Type: alloc.USRQUOTA, Id: owner.Uid}, blocks, inodes)
+	atxn.charge1(alloc.QuotaId{Type: alloc.GRPQUOTA, Id: owner.Gid}, blocks, inodes)
+}
+
+// SetLimits records new limits for quota id.
+func (atxn *AllocTxn) SetLimits(id alloc.QuotaId, l alloc.Limits) {
+	atxn.limits[id] = l
+}
+
+func add(n uint64, d int64) uint64 {
+	if d < 0 && uint64(-d) > n {
+		return 0
+	}
+	return uint64(int64(n) + d)
+}
+
+// QuotaUpdates returns the new record of each quota that the
+// transaction changes, and whether a usage that it increases exceeds
+// its hard limit.  The caller must hold the quota tables' locks, so
+// that no other transaction commits a change to the records until
+// PostCommitQuotas.
+func (atxn *AllocTxn) QuotaUpdates() (map[alloc.QuotaId]alloc.Quota, bool) {
+	recs := make(map[alloc.QuotaId]alloc.Quota)
+	var over = false
+	for id, c := range atxn.usage {
+		if c.blocks == 0 && c.inodes == 0 {
+			continue
+		}
+		q := atxn.Quotas.Get(id)
+		q.Blocks = add(q.Blocks, c.blocks)
+		q.Inodes = add(q.Inodes, c.inodes)
+		if (c.blocks > 0 && q.BlockHard != 0 && q.Blocks > q.BlockHard) ||
+			(c.inodes > 0 && q.InodeHard != 0 && q.Inodes > q.InodeHard) {
+			over = true
+		}
+		recs[id] = q
+	}
+	for id, l := range atxn.limits {
+		q, ok := recs[id]
+		if !ok {
+			q = atxn.Quotas.Get(id)
+		}
+		q.Limits = l
+		recs[id] = q
+	}
+	return recs, over
+}
+
+// PostCommitQuotas updates the in-memory quota records after commit.
+func (atxn *AllocTxn) PostCommitQuotas() {
+	recs, _ := atxn.QuotaUpdates()
+	atxn.Quotas.Commit(recs)
+}
+
+// NQuotaBlocks returns the number of blocks of the quota tables that
+// the transaction will update.
+func (atxn *AllocTxn) NQuotaBlocks() uint64 {
+	blks := make(map[alloc.QuotaId]bool)
+	note := func(id alloc.QuotaId) {
+		blks[alloc.QuotaId{Type: id.Type,
+			Id: uint32(uint64(id.Id) * alloc.QUOTASZ / disk.BlockSize)}] = true
+	}
+	for id, c := range atxn.usage {
+		if c.blocks != 0 || c.inodes != 0 {
+			note(id)
+		}
+	}
+	for id := range atxn.limits {
+		note(id)
+	}
+	return uint64(len(blks))
+}
@@ -0,0 +1,61 @@
+package alloctxn
+
+// Reserve makes sure that the transaction has nblocks blocks and
+// ninodes inodes reserved, so that its allocations of that many won't
+// fail, and reports whether there was enough free space.  A caller
+// reserves what an operation may allocate before the operation changes
+// anything, so that it can fail cleanly with NOSPC.  Allocations
+// without a reservation reserve as they go.  The transaction gives up
+// what it doesn't allocate when it commits or aborts.
+func (atxn *AllocTxn) Reserve(nblocks uint64, ninodes uint64) bool {
+	if nblocks > atxn.resBlocks {
+		if !atxn.Balloc.Reserve(nblocks-atxn.resBlocks, atxn.priv) {
+			return false
+		}
+		atxn.resBlocks = nblocks
+	}
+	if ninodes > atxn.resInodes {
+		if !atxn.Ialloc.Reserve(ninodes-atxn.resInodes, atxn.priv) {
+			return false
+		}
+		atxn.resInodes = ninodes
+	}
+	return true
+}
+
+// SetPrivileged lets the transaction use the free blocks and inodes
+// that the allocators keep for the shrinker, removals, and the file
+// system's own tables, which must make progress when the disk is full.
+func (atxn *AllocTxn) SetPrivileged() {
+	atxn.priv = true
+}
+
+// takeBlocks makes sure that the transaction has up to n blocks
+// reserved, reserving more if it has fewer, and returns how many it
+// has, which is 0 if there are no free blocks that it may use.
+func (atxn *AllocTxn) takeBlocks(n uint64) uint64 {
+	if atxn.resBlocks >= n {
+		return n
+	}
+	if atxn.Balloc.Reserve(n-atxn.resBlocks, atxn.priv) {
+		atxn.resBlocks = n
+	} else if atxn.resBlocks == 0 && atxn.Balloc.Reserve(1, atxn.priv) {
+		atxn.resBlocks = 1
+	}
+	return atxn.resBlocks
+}
+
+func (atxn *AllocTxn) takeInodes() bool {
+	if atxn.resInodes == 0 && atxn.Ialloc.Reserve(1, atxn.priv) {
+		atxn.resInodes = 1
+	}
+	return atxn.resInodes > 0
+}
+
+// unreserve gives up the transaction's remaining reservations.
+func (atxn *AllocTxn) unreserve() {
+	atxn.Balloc.Unreserve(atxn.resBlocks)
+	atxn.Ialloc.Unreserve(atxn.resInodes)
+	atxn.resBlocks = 0
+	atxn.resInodes = 0
+}
@@ -5,20 +5,24 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/zeldovich/go-rpcgen/rfc1057"
 	"github.com/zeldovich/go-rpcgen/rfc1813"
 	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-nfsd/fh"
 )
 
 var N time.Duration
+var getattr bool
 
 func pmap_client(host string, prog, vers uint32) *rfc1057.Client {
 	var cred rfc1057.Opaque_auth
 	cred.Flavor = rfc1057.AUTH_NONE
 
-	pmapc, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, rfc1057.PMAP_PORT))
+	pmapc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(rfc1057.PMAP_PORT))))
 	if err != nil {
 		panic(err)
 	}
@@ -36,7 +40,7 @@ func pmap_client(host string, prog, vers uint32) *rfc1057.Client {
 		panic(err)
 	}
 
-	svcc, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, res))
+	svcc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(res))))
 	if err != nil {
 		panic(err)
 	}
@@ -59,6 +63,21 @@ func (c *nfsclnt) null() {
 	}
 }
 
+// getattr asks for the attributes of the root directory, the cheapest
+// operation that runs a (read-only) transaction.
+func (c *nfsclnt) getattr() {
+	arg := rfc1813.GETATTR3args{Object: rfc1813.Nfs_fh3{Data: fh.MkRootFh3().Data}}
+	var res rfc1813.GETATTR3res
+
+	err := c.clnt.Call(rfc1813.NFSPROC3_GETATTR, c.cred, c.verf, &arg, &res)
+	if err != nil {
+		panic(err)
+	}
+	if res.Status != rfc1813.NFS3_OK {
+		panic(fmt.Sprintf("getattr: error %d", res.Status))
+	}
+}
+
 func client(cred_unix rfc1057.Opaque_auth) (n int, elapsed time.Duration) {
 	var cred_none rfc1057.Opaque_auth
 	cred_none.Flavor = rfc1057.AUTH_NONE
@@ -66,7 +85,11 @@ func client(cred_unix rfc1057.Opaque_auth) (n int, elapsed time.Duration) {
 	clnt := &nfsclnt{clnt: nfs, cred: cred_unix, verf: cred_none}
 	start := time.Now()
 	for {
-		clnt.null()
+		if getattr {
+			clnt.getattr()
+		} else {
+			clnt.null()
+		}
 		n++
 		elapsed = time.Now().Sub(start)
 		if elapsed >= N {
@@ -77,6 +100,7 @@ func client(cred_unix rfc1057.Opaque_auth) (n int, elapsed time.Duration) {
 
 func main() {
 	flag.DurationVar(&N, "benchtime", 10*time.Second, "time to run each iteration for")
+	flag.BoolVar(&getattr, "getattr", false, "call GETATTR on the root instead of NULL")
 	flag.Parse()
 
 	var err error
@@ -92,5 +116,9 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	n, elapsed := client(cred_unix)
-	fmt.Printf("null-bench: NULL takes %.1f us\n", float64(elapsed.Microseconds())/float64(n))
+	var proc = "NULL"
+	if getattr {
+		proc = "GETATTR"
+	}
+	fmt.Printf("null-bench: %s takes %.1f us\n", proc, float64(elapsed.Microseconds())/float64(n))
 }
@@ -21,7 +21,7 @@ func pmap_client(host string, prog, vers uint32) *rfc1057.Client {
 	var cred rfc1057.Opaque_auth
 	cred.Flavor = rfc1057.AUTH_NONE
 
-	pmapc, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, rfc1057.PMAP_PORT))
+	pmapc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(rfc1057.PMAP_PORT))))
 	if err != nil {
 		panic(err)
 	}
@@ -39,7 +39,7 @@ func pmap_client(host string, prog, vers uint32) *rfc1057.Client {
 		panic(err)
 	}
 
-	svcc, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, res))
+	svcc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(res))))
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+func pmap_client(host string, prog, vers uint32) *rfc1057.Client {
+	var cred rfc1057.Opaque_auth
+	cred.Flavor = rfc1057.AUTH_NONE
+
+	pmapc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(rfc1057.PMAP_PORT))))
+	if err != nil {
+		panic(err)
+	}
+	defer pmapc.Close()
+	pmap := rfc1057.MakeClient(pmapc, rfc1057.PMAP_PROG, rfc1057.PMAP_VERS)
+
+	arg := rfc1057.Mapping{
+		Prog: prog,
+		Vers: vers,
+		Prot: rfc1057.IPPROTO_TCP,
+	}
+	var res xdr.Uint32
+	err = pmap.Call(rfc1057.PMAPPROC_GETPORT, cred, cred, &arg, &res)
+	if err != nil {
+		panic(err)
+	}
+
+	svcc, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(res))))
+	if err != nil {
+		panic(err)
+	}
+	return rfc1057.MakeClient(svcc, prog, vers)
+}
+
+// admin_client connects to the admin service of the go-nfsd that
+// listens on the unix socket sock.
+func admin_client(sock string) *rfc1057.Client {
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		panic(err)
+	}
+	return rfc1057.MakeClient(c, nfstypes.ADMIN_PROGRAM, nfstypes.ADMIN_V1)
+}
+
+// lookup resolves path, relative to the root of the export, to a file
+// handle.
+func lookup(clnt *rfc1057.Client, cred rfc1057.Opaque_auth, p string) nfstypes.Nfs_fh3 {
+	var dir = fh.MkRootFh3()
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		args := nfstypes.LOOKUP3args{
+			What: nfstypes.Diropargs3{Dir: dir, Name: nfstypes.Filename3(name)},
+		}
+		var res nfstypes.LOOKUP3res
+		err := clnt.Call(nfstypes.NFSPROC3_LOOKUP, cred, cred, &args, &res)
+		if err != nil {
+			panic(err)
+		}
+		if res.Status != nfstypes.NFS3_OK {
+			fmt.Fprintf(os.Stderr, "lookup %s: error %d\n", p, res.Status)
+			os.Exit(1)
+		}
+		dir = res.Resok.Object
+	}
+	return dir
+}
+
+// fs-clone asks a running go-nfsd to clone a file, so that the copy
+// shares the original's data blocks until either one changes.  Paths
+// are relative to the root of the export.
+func main() {
+	var host string
+	flag.StringVar(&host, "host", "localhost", "server with the files")
+
+	var sock string
+	flag.StringVar(&sock, "admin", "/tmp/go-nfsd-admin.sock", "unix socket of the server's admin service")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-host host] [-admin sock] src dst\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	src := flag.Arg(0)
+	dst := path.Clean("/" + flag.Arg(1))
+
+	var cred rfc1057.Opaque_auth
+	cred.Flavor = rfc1057.AUTH_NONE
+	nfsc := pmap_client(host, nfstypes.NFS_PROGRAM, nfstypes.NFS_V3)
+	srcfh := lookup(nfsc, cred, src)
+	dirfh := lookup(nfsc, cred, path.Dir(dst))
+
+	clnt := admin_client(sock)
+	args := nfstypes.CLONEargs{
+		Src: srcfh,
+		Where: nfstypes.Diropargs3{
+			Dir:  dirfh,
+			Name: nfstypes.Filename3(path.Base(dst)),
+		},
+	}
+	var res nfstypes.CLONEres
+	err := clnt.Call(nfstypes.ADMINPROC_CLONE, cred, cred, &args, &res)
+	if err != nil {
+		panic(err)
+	}
+	if res.Status != nfstypes.NFS3_OK {
+		fmt.Fprintf(os.Stderr, "clone failed: error %d\n", res.Status)
+		os.Exit(1)
+	}
+}
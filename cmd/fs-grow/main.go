@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// admin_client connects to the admin service of the go-nfsd that
+// listens on the unix socket sock.
+func admin_client(sock string) *rfc1057.Client {
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		panic(err)
+	}
+	return rfc1057.MakeClient(c, nfstypes.ADMIN_PROGRAM, nfstypes.ADMIN_V1)
+}
+
+// fs-grow asks a running go-nfsd to grow its file system into the rest
+// of its disk.
+func main() {
+	var sock string
+	flag.StringVar(&sock, "admin", "/tmp/go-nfsd-admin.sock", "unix socket of the server's admin service")
+
+	var sizeMegabytes uint64
+	flag.Uint64Var(&sizeMegabytes, "size", 0, "new size of file system (in MB, 0 for the whole disk)")
+
+	var inodes uint64
+	flag.Uint64Var(&inodes, "inodes", 0, "number of inodes to add")
+	flag.Parse()
+
+	var cred rfc1057.Opaque_auth
+	cred.Flavor = rfc1057.AUTH_NONE
+	clnt := admin_client(sock)
+
+	args := nfstypes.GROWargs{
+		Size:   nfstypes.Uint64(sizeMegabytes * 1024 / 4),
+		Inodes: nfstypes.Uint64(inodes),
+	}
+	var res nfstypes.GROWres
+	err := clnt.Call(nfstypes.ADMINPROC_GROW, cred, cred, &args, &res)
+	if err != nil {
+		panic(err)
+	}
+	if res.Status != nfstypes.NFS3_OK {
+		fmt.Fprintf(os.Stderr, "grow failed: error %d\n", res.Status)
+		os.Exit(1)
+	}
+	fmt.Printf("size %d MB, %d inodes\n", res.Size*4/1024, res.Inodes)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// admin_client connects to the admin service of the go-nfsd that
+// listens on the unix socket sock.
+func admin_client(sock string) *rfc1057.Client {
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		panic(err)
+	}
+	return rfc1057.MakeClient(c, nfstypes.ADMIN_PROGRAM, nfstypes.ADMIN_V1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-admin sock] [-group] "+
+		"set id block-hard block-soft inode-hard inode-soft | get id | report\n",
+		os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func number(s string) uint64 {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad number %q\n", s)
+		os.Exit(2)
+	}
+	return n
+}
+
+func id(s string) nfstypes.Uint32 {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad id %q\n", s)
+		os.Exit(2)
+	}
+	return nfstypes.Uint32(n)
+}
+
+func show(q nfstypes.Quota3) {
+	fmt.Printf("%10d %12d %12d %12d %10d %10d %10d\n", q.Id,
+		q.Blocks, q.BlockSoft, q.BlockHard, q.Inodes, q.InodeSoft, q.InodeHard)
+}
+
+// fs-quota sets and reports the block and inode quotas of the users or
+// groups of a running go-nfsd.  Limits of 0 mean no limit.
+func main() {
+	var sock string
+	flag.StringVar(&sock, "admin", "/tmp/go-nfsd-admin.sock", "unix socket of the server's admin service")
+
+	var group bool
+	flag.BoolVar(&group, "group", false, "groups' quotas instead of users'")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	var t = nfstypes.QUOTA_USR
+	if group {
+		t = nfstypes.QUOTA_GRP
+	}
+
+	var cred rfc1057.Opaque_auth
+	cred.Flavor = rfc1057.AUTH_NONE
+	clnt := admin_client(sock)
+
+	var quotas []nfstypes.Quota3
+	var status nfstypes.Nfsstat3
+	var err error
+	switch flag.Arg(0) {
+	case "set":
+		if flag.NArg() != 6 {
+			usage()
+		}
+		args := nfstypes.SETQUOTAargs{
+			Type:      nfstypes.Uint32(t),
+			Id:        id(flag.Arg(1)),
+			BlockHard: nfstypes.Uint64(number(flag.Arg(2))),
+			BlockSoft: nfstypes.Uint64(number(flag.Arg(3))),
+			InodeHard: nfstypes.Uint64(number(flag.Arg(4))),
+			InodeSoft: nfstypes.Uint64(number(flag.Arg(5))),
+		}
+		var res nfstypes.QUOTAres
+		err = clnt.Call(nfstypes.ADMINPROC_SETQUOTA, cred, cred, &args, &res)
+		status = res.Status
+		quotas = []nfstypes.Quota3{res.Quota}
+	case "get":
+		if flag.NArg() != 2 {
+			usage()
+		}
+		args := nfstypes.GETQUOTAargs{Type: nfstypes.Uint32(t), Id: id(flag.Arg(1))}
+		var res nfstypes.QUOTAres
+		err = clnt.Call(nfstypes.ADMINPROC_GETQUOTA, cred, cred, &args, &res)
+		status = res.Status
+		quotas = []nfstypes.Quota3{res.Quota}
+	case "report":
+		if flag.NArg() != 1 {
+			usage()
+		}
+		args := nfstypes.REPQUOTAargs{Type: nfstypes.Uint32(t)}
+		var res nfstypes.REPQUOTAres
+		err = clnt.Call(nfstypes.ADMINPROC_REPQUOTA, cred, cred, &args, &res)
+		status = res.Status
+		quotas = res.Quotas
+	default:
+		usage()
+	}
+	if err != nil {
+		panic(err)
+	}
+	if status != nfstypes.NFS3_OK {
+		fmt.Fprintf(os.Stderr, "quota %s failed: error %d\n", flag.Arg(0), status)
+		os.Exit(1)
+	}
+	fmt.Printf("%10s %12s %12s %12s %10s %10s %10s\n", "id",
+		"blocks", "soft", "hard", "inodes", "soft", "hard")
+	for _, q := range quotas {
+		show(q)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// admin_client connects to the admin service of the go-nfsd that
+// listens on the unix socket sock.
+func admin_client(sock string) *rfc1057.Client {
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		panic(err)
+	}
+	return rfc1057.MakeClient(c, nfstypes.ADMIN_PROGRAM, nfstypes.ADMIN_V1)
+}
+
+var actions = map[string]uint32{
+	"status": nfstypes.SCRUB_STATUS,
+	"start":  nfstypes.SCRUB_START,
+	"pause":  nfstypes.SCRUB_PAUSE,
+	"resume": nfstypes.SCRUB_RESUME,
+	"stop":   nfstypes.SCRUB_STOP,
+	"rate":   nfstypes.SCRUB_RATE,
+}
+
+// fs-scrub controls the background scrub of a running go-nfsd, which
+// checks the file system's checksums and structure, and prints the
+// scrub's progress and the errors it found.
+func main() {
+	var sock string
+	flag.StringVar(&sock, "admin", "/tmp/go-nfsd-admin.sock", "unix socket of the server's admin service")
+
+	var rate uint64
+	flag.Uint64Var(&rate, "rate", 0, "blocks per second to scrub, for start and rate (0 for no limit)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-admin sock] [-rate n] "+
+			"[status|start|pause|resume|stop|rate]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var action = "status"
+	if flag.NArg() == 1 {
+		action = flag.Arg(0)
+	}
+	proc, ok := actions[action]
+	if !ok || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var cred rfc1057.Opaque_auth
+	cred.Flavor = rfc1057.AUTH_NONE
+	clnt := admin_client(sock)
+
+	args := nfstypes.SCRUBargs{
+		Action: nfstypes.Uint32(proc),
+		Rate:   nfstypes.Uint64(rate),
+	}
+	var res nfstypes.SCRUBres
+	err := clnt.Call(nfstypes.ADMINPROC_SCRUB, cred, cred, &args, &res)
+	if err != nil {
+		panic(err)
+	}
+	if res.Status != nfstypes.NFS3_OK {
+		fmt.Fprintf(os.Stderr, "scrub %s failed: error %d\n", action, res.Status)
+		os.Exit(1)
+	}
+	fmt.Printf("running %v paused %v rate %d passes %d at inode %d\n",
+		res.Running, res.Paused, res.Rate, res.Passes, res.Inum)
+	fmt.Printf("%d inodes %d blocks checked, %d checksum errors, %d other errors\n",
+		res.Inodes, res.Blocks, res.CsumErrors, res.Errors)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// admin_client connects to the admin service of the go-nfsd that
+// listens on the unix socket sock.
+func admin_client(sock string) *rfc1057.Client {
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		panic(err)
+	}
+	return rfc1057.MakeClient(c, nfstypes.ADMIN_PROGRAM, nfstypes.ADMIN_V1)
+}
+
+// fs-snapshot takes, deletes, and lists snapshots of a running
+// go-nfsd's file system.  Snapshots appear read-only under
+// /.snapshots.
+func main() {
+	var sock string
+	flag.StringVar(&sock, "admin", "/tmp/go-nfsd-admin.sock", "unix socket of the server's admin service")
+
+	var create string
+	flag.StringVar(&create, "create", "", "take a snapshot with this name")
+
+	var del string
+	flag.StringVar(&del, "delete", "", "delete the snapshot with this name")
+
+	var list bool
+	flag.BoolVar(&list, "list", false, "list the snapshots")
+	flag.Parse()
+
+	var cred rfc1057.Opaque_auth
+	cred.Flavor = rfc1057.AUTH_NONE
+	clnt := admin_client(sock)
+
+	if create != "" {
+		args := nfstypes.SNAPSHOTargs{Name: nfstypes.Snapname(create)}
+		var res nfstypes.SNAPSHOTres
+		err := clnt.Call(nfstypes.ADMINPROC_SNAPSHOT, cred, cred, &args, &res)
+		if err != nil {
+			panic(err)
+		}
+		if res.Status != nfstypes.NFS3_OK {
+			fmt.Fprintf(os.Stderr, "snapshot failed: error %d\n", res.Status)
+			os.Exit(1)
+		}
+	}
+	if del != "" {
+		args := nfstypes.DELSNAPSHOTargs{Name: nfstypes.Snapname(del)}
+		var res nfstypes.DELSNAPSHOTres
+		err := clnt.Call(nfstypes.ADMINPROC_DELSNAPSHOT, cred, cred, &args, &res)
+		if err != nil {
+			panic(err)
+		}
+		if res.Status != nfstypes.NFS3_OK {
+			fmt.Fprintf(os.Stderr, "delete failed: error %d\n", res.Status)
+			os.Exit(1)
+		}
+	}
+	if list {
+		var args xdr.Void
+		var res nfstypes.LISTSNAPSHOTSres
+		err := clnt.Call(nfstypes.ADMINPROC_LISTSNAPSHOTS, cred, cred, &args, &res)
+		if err != nil {
+			panic(err)
+		}
+		if res.Status != nfstypes.NFS3_OK {
+			fmt.Fprintf(os.Stderr, "list failed: error %d\n", res.Status)
+			os.Exit(1)
+		}
+		for _, name := range strings.Split(string(res.Names), "\x00") {
+			if name != "" {
+				fmt.Println(name)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// admin_client connects to the admin service of the go-nfsd that
+// listens on the unix socket sock.
+func admin_client(sock string) *rfc1057.Client {
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		panic(err)
+	}
+	return rfc1057.MakeClient(c, nfstypes.ADMIN_PROGRAM, nfstypes.ADMIN_V1)
+}
+
+// fs-trim discards the free blocks of a running go-nfsd's disk, so
+// that thin-provisioned storage can reclaim their space, and prints how
+// many blocks it discarded.
+func main() {
+	var sock string
+	flag.StringVar(&sock, "admin", "/tmp/go-nfsd-admin.sock", "unix socket of the server's admin service")
+
+	var minlen uint64
+	flag.Uint64Var(&minlen, "minlen", 1, "discard only runs of at least this many free blocks")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-admin sock] [-minlen n]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var cred rfc1057.Opaque_auth
+	cred.Flavor = rfc1057.AUTH_NONE
+	clnt := admin_client(sock)
+
+	args := nfstypes.TRIMargs{Minlen: nfstypes.Uint64(minlen)}
+	var res nfstypes.TRIMres
+	err := clnt.Call(nfstypes.ADMINPROC_TRIM, cred, cred, &args, &res)
+	if err != nil {
+		panic(err)
+	}
+	if res.Status != nfstypes.NFS3_OK {
+		fmt.Fprintf(os.Stderr, "trim failed: error %d\n", res.Status)
+		os.Exit(1)
+	}
+	fmt.Printf("discarded %d blocks\n", res.Blocks)
+}
@@ -16,8 +16,12 @@ import (
 	"github.com/zeldovich/go-rpcgen/xdr"
 
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/acl"
 	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/rpcsrv"
+	"github.com/mit-pdos/go-nfsd/util/crypt_disk"
+	"github.com/mit-pdos/go-nfsd/util/file_disk"
 	"github.com/mit-pdos/go-nfsd/util/timed_disk"
 )
 
@@ -61,6 +65,21 @@ func pmap_set_unset(prog, vers, port uint32, setit bool) error {
 	}
 }
 
+// listenAdmin listens on the unix socket path, which only the server's
+// user may connect to.
+func listenAdmin(path string) (net.Listener, error) {
+	// a socket left behind by a server that didn't shut down
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	// create the socket without permissions for anyone else, rather
+	// than changing them after others could connect
+	old := syscall.Umask(0077)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	return l, err
+}
+
 func main() {
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 
@@ -68,11 +87,44 @@ func main() {
 	flag.BoolVar(&unstable, "unstable", true, "use unstable writes if requested")
 
 	var filesizeMegabytes uint64
-	flag.Uint64Var(&filesizeMegabytes, "size", 400, "size of file system (in MB)")
+	flag.Uint64Var(&filesizeMegabytes, "size", 400, "size of disk (in MB); a new file system uses all of it")
+
+	var extents bool
+	flag.BoolVar(&extents, "extents", false, "map new files with extent trees")
+
+	var compress bool
+	flag.BoolVar(&compress, "compress", false, "compress the data of new files")
+
+	var sparse bool
+	flag.BoolVar(&sparse, "sparse", false, "store writes of zero blocks as holes")
+
+	var ordered bool
+	flag.BoolVar(&ordered, "ordered", false, "write new data blocks in place instead of through the log")
+
+	var gather bool
+	flag.BoolVar(&gather, "gather", false, "gather unstable writes in memory before writing them")
 
 	var diskfile string
 	flag.StringVar(&diskfile, "disk", "", "disk image (empty for MemDisk)")
 
+	var mkfs bool
+	flag.BoolVar(&mkfs, "mkfs", false, "make a new file system, erasing whatever is on the disk")
+
+	var encrypt bool
+	flag.BoolVar(&encrypt, "encrypt", false, "encrypt the disk image")
+
+	var keyfile string
+	flag.StringVar(&keyfile, "keyfile", "", "file with the encryption key (empty for $"+crypt_disk.KEYENV+")")
+
+	var scrub bool
+	flag.BoolVar(&scrub, "scrub", false, "scrub the file system in the background at startup")
+
+	var scrubRate uint64
+	flag.Uint64Var(&scrubRate, "scrubrate", 0, "blocks per second to scrub (0 for no limit)")
+
+	var adminSock string
+	flag.StringVar(&adminSock, "admin", "/tmp/go-nfsd-admin.sock", "unix socket for the admin service, which only the server's user may use")
+
 	var dumpStats bool
 	flag.BoolVar(&dumpStats, "stats", false, "dump stats to stderr at end")
 
@@ -115,25 +167,108 @@ func main() {
 	}
 	defer pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, port, false)
 
+	pmap_set_unset(nfstypes.NFS_ACL_PROGRAM, nfstypes.NFS_ACL_V3, 0, false)
+	err = pmap_set_unset(nfstypes.NFS_ACL_PROGRAM, nfstypes.NFS_ACL_V3, port, true)
+	if err != nil {
+		panic(err)
+	}
+	defer pmap_set_unset(nfstypes.NFS_ACL_PROGRAM, nfstypes.NFS_ACL_V3, port, false)
+
+	for _, vers := range []uint32{nfstypes.RQUOTAVERS, nfstypes.EXT_RQUOTAVERS} {
+		pmap_set_unset(nfstypes.RQUOTAPROG, vers, 0, false)
+		err = pmap_set_unset(nfstypes.RQUOTAPROG, vers, port, true)
+		if err != nil {
+			panic(err)
+		}
+		defer pmap_set_unset(nfstypes.RQUOTAPROG, vers, port, false)
+	}
+
+	var physBlocks = diskBlocks
+	if encrypt {
+		physBlocks = crypt_disk.PhysSize(diskBlocks)
+	}
 	var d disk.Disk
 	if diskfile == "" {
-		d = disk.NewMemDisk(diskBlocks)
+		d = disk.NewMemDisk(physBlocks)
 	} else {
-		d, err = disk.NewFileDisk(diskfile, diskBlocks)
+		d, err = file_disk.New(diskfile, physBlocks)
 		if err != nil {
 			panic(fmt.Errorf("could not create disk: %w", err))
 		}
 	}
+	if encrypt {
+		key, err := crypt_disk.LoadKey(keyfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load key: %v\n", err)
+			os.Exit(1)
+		}
+		d, err = crypt_disk.New(d, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open encrypted disk: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	if dumpStats {
 		d = timed_disk.New(d)
 	}
-	server := go_nfs.MakeNfs(d)
+	server, err := go_nfs.OpenNfs(d, mkfs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v (use -mkfs to make a new file system)\n", err)
+		os.Exit(1)
+	}
 	server.Unstable = unstable
+	server.Extents = extents
+	server.Compress = compress
+	server.Sparse = sparse
+	server.Ordered = ordered
+	server.Gather = gather
 	defer server.ShutdownNfs()
+	if scrub {
+		server.Scrubber().Start(scrubRate)
+	}
+
+	// each request runs on behalf of the caller's AUTH_UNIX
+	// credentials
+	as := func(cred rfc1057.Auth_unix) *go_nfs.Nfs {
+		return server.As(acl.Cred{Uid: cred.Uid, Gid: cred.Gid, Gids: cred.Gids})
+	}
+	srv := rpcsrv.MakeServer()
+	srv.Register(func(cred rfc1057.Auth_unix) []xdr.ProcRegistration {
+		return nfstypes.MOUNT_PROGRAM_MOUNT_V3_regs(as(cred))
+	})
+	srv.Register(func(cred rfc1057.Auth_unix) []xdr.ProcRegistration {
+		return nfstypes.NFS_PROGRAM_NFS_V3_regs(as(cred))
+	})
+	srv.Register(func(cred rfc1057.Auth_unix) []xdr.ProcRegistration {
+		return nfstypes.NFS_ACL_PROGRAM_NFS_ACL_V3_regs(as(cred))
+	})
+	srv.Register(func(cred rfc1057.Auth_unix) []xdr.ProcRegistration {
+		return nfstypes.RQUOTAPROG_RQUOTAVERS_regs(as(cred))
+	})
+	srv.Register(func(cred rfc1057.Auth_unix) []xdr.ProcRegistration {
+		return nfstypes.RQUOTAPROG_EXT_RQUOTAVERS_regs(as(cred))
+	})
 
-	srv := rfc1057.MakeServer()
-	srv.RegisterMany(nfstypes.MOUNT_PROGRAM_MOUNT_V3_regs(server))
-	srv.RegisterMany(nfstypes.NFS_PROGRAM_NFS_V3_regs(server))
+	// the admin service can change the whole file system, so it
+	// doesn't listen on the network: only local processes that can
+	// open its socket can use it
+	admin, err := listenAdmin(adminSock)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not listen for admin: %v\n", err)
+		os.Exit(1)
+	}
+	defer os.Remove(adminSock)
+	adminSrv := rfc1057.MakeServer()
+	adminSrv.RegisterMany(nfstypes.ADMIN_PROGRAM_ADMIN_V1_regs(server))
+	go func() {
+		for {
+			conn, err := admin.Accept()
+			if err != nil {
+				return
+			}
+			go adminSrv.Run(conn)
+		}
+	}()
 
 	interruptSig := make(chan os.Signal, 1)
 	shutdown := false
@@ -141,9 +276,11 @@ func main() {
 	go func() {
 		<-interruptSig
 		shutdown = true
+		admin.Close()
 		listener.Close()
 		if dumpStats {
 			server.WriteOpStats(os.Stderr)
+			server.WriteScrubStats(os.Stderr)
 			d.(*timed_disk.Disk).WriteStats(os.Stderr)
 		}
 	}()
@@ -156,6 +293,7 @@ func main() {
 				<-statSig
 				server.WriteOpStats(os.Stderr)
 				server.ResetOpStats()
+				server.WriteScrubStats(os.Stderr)
 				d := d.(*timed_disk.Disk)
 				d.WriteStats(os.Stderr)
 				d.ResetStats()
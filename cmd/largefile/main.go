@@ -72,5 +72,14 @@ func largeFile() {
 	tput := float64(FILESIZE/MB) / elapsed.Seconds()
 	fmt.Printf("largefile: %v MB throughput %.2f MB/s\n", FILESIZE/MB, tput)
 
+	start = time.Now()
+	clone := clnt.CloneOp(fh, dir, name+"-clone")
+	if clone.Status != nfstypes.NFS3_OK {
+		panic("clone")
+	}
+	elapsed = time.Since(start)
+	fmt.Printf("largefile: clone %v MB in %d usec\n", FILESIZE/MB, elapsed.Microseconds())
+
+	clnt.RemoveOp(dir, name+"-clone")
 	clnt.RemoveOp(dir, name)
 }
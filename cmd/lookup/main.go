@@ -16,6 +16,8 @@ import (
 const BENCHDISKSZ uint64 = 100 * 1000
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+var benchtime = flag.Duration("benchtime", 1*time.Second, "time to run each benchmark for")
+var nthread = flag.Int("threads", 4, "run with 1 up to this many threads")
 
 func main() {
 	flag.Parse()
@@ -28,6 +30,7 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 	PLookup()
+	PGetattr()
 }
 
 func Lookup(clnt *go_nfs.NfsClient, dirfh nfstypes.Nfs_fh3, name string) {
@@ -42,10 +45,11 @@ func Lookup(clnt *go_nfs.NfsClient, dirfh nfstypes.Nfs_fh3, name string) {
 	}
 }
 
-func PLookup() {
-	const N = 1 * time.Second
-	const NTHREAD = 4
-	for i := 1; i <= NTHREAD; i++ {
+// run runs op in a loop on a file of its own in each of 1 up to
+// nthread threads, and prints the throughput.
+func run(what string, op func(clnt *go_nfs.NfsClient, dirfh nfstypes.Nfs_fh3, name string)) {
+	N := *benchtime
+	for i := 1; i <= *nthread; i++ {
 		res := go_nfs.Parallel(i, BENCHDISKSZ,
 			func(clnt *go_nfs.NfsClient, dirfh nfstypes.Nfs_fh3) int {
 				s := strconv.Itoa(i)
@@ -54,7 +58,7 @@ func PLookup() {
 				start := time.Now()
 				i := 0
 				for true {
-					Lookup(clnt, dirfh, name)
+					op(clnt, dirfh, name)
 					i++
 					t := time.Now()
 					elapsed := t.Sub(start)
@@ -64,8 +68,24 @@ func PLookup() {
 				}
 				return i
 			})
-		fmt.Printf("Lookup: %d file in %d usec with %d threads\n",
-			res, N.Nanoseconds()/1e3, i)
-
+		fmt.Printf("%s: %d ops in %d usec with %d threads (%.2f usec/op)\n",
+			what, res, N.Nanoseconds()/1e3, i,
+			float64(N.Nanoseconds())/1e3*float64(i)/float64(res))
 	}
 }
+
+// PLookup measures LOOKUP followed by GETATTR of the file found.
+func PLookup() {
+	run("Lookup", Lookup)
+}
+
+// PGetattr measures GETATTR alone, the cheapest read-only operation
+// that locks an inode.
+func PGetattr() {
+	run("Getattr", func(clnt *go_nfs.NfsClient, dirfh nfstypes.Nfs_fh3, name string) {
+		attr := clnt.GetattrOp(dirfh)
+		if attr.Status != nfstypes.NFS3_OK {
+			panic("Getattr")
+		}
+	})
+}
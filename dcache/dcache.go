@@ -1,45 +1,68 @@
 package dcache
 
 import (
+	"sync"
+
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
 )
 
-// Dentry holds a cached directory entry mapping a name to an inode and offset.
+// DCACHESZ bounds the number of names cached per directory.
+const DCACHESZ = 1024
+
+// Dentry holds a cached directory entry mapping a name to an inode and
+// its file type.
 type Dentry struct {
 	Inum common.Inum
-	Off  uint64
+	Kind nfstypes.Ftype3
 }
 
-// Dcache caches directory lookups for a single directory.
+// Dcache caches directory lookups for a single directory. It holds
+// some of the directory's names, at most DCACHESZ of them.  Lookups
+// that share the directory's lock may fill it concurrently.
 type Dcache struct {
-	cache   map[string]Dentry
-	Lastoff uint64
+	mu    *sync.Mutex
+	cache map[string]Dentry
 }
 
 // MkDcache creates an empty directory cache.
 func MkDcache() *Dcache {
 	return &Dcache{
-		cache:   make(map[string]Dentry),
-		Lastoff: uint64(0),
+		mu:    new(sync.Mutex),
+		cache: make(map[string]Dentry),
 	}
 }
 
-// Add inserts a name with its inode and offset into the cache.
-func (dc *Dcache) Add(name string, inum common.Inum, off uint64) {
-	dc.cache[name] = Dentry{Inum: inum, Off: off}
+// Add inserts a name with its inode and file type into the cache,
+// evicting another name if the cache is full.
+func (dc *Dcache) Add(name string, inum common.Inum, kind nfstypes.Ftype3) {
+	dc.mu.Lock()
+	_, ok := dc.cache[name]
+	if !ok && len(dc.cache) >= DCACHESZ {
+		for n := range dc.cache {
+			delete(dc.cache, n)
+			break
+		}
+	}
+	dc.cache[name] = Dentry{Inum: inum, Kind: kind}
+	dc.mu.Unlock()
 }
 
 // Lookup retrieves the cached entry for name.
 func (dc *Dcache) Lookup(name string) (Dentry, bool) {
+	dc.mu.Lock()
 	d, ok := dc.cache[name]
+	dc.mu.Unlock()
 	return d, ok
 }
 
 // Del removes a name from the cache and reports whether it was present.
 func (dc *Dcache) Del(name string) bool {
+	dc.mu.Lock()
 	_, ok := dc.cache[name]
 	if ok {
 		delete(dc.cache, name)
 	}
+	dc.mu.Unlock()
 	return ok
 }
@@ -0,0 +1,526 @@
+package dir
+
+import (
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+)
+
+//
+// A directory is a B+-tree of directory entries, keyed by a hash of
+// the name, stored in the directory's own blocks:
+//
+//   block 0: | dir header | root node |
+//   block n: | node |
+//
+// The dir header records the number of entries, the head of the list
+// of free node blocks, and the total size of the entries. The root node stays in block 0; when it
+// splits, its entries move to two new blocks and the root becomes an
+// interior node over them. Leaves hold variable-length dirEnts sorted
+// by hash, and entries with the same hash always share a leaf, so a
+// directory holds only as many names with one hash as fit in a node
+// (see AddNameErr). Interior nodes hold (hash, block) pairs: child i
+// holds the hashes from key i up to key i+1. Node blocks that become
+// empty go on the free list, for reuse by later splits.
+//
+
+const (
+	DIRHDRSZ  uint64 = 64 // dir header at the start of block 0
+	NODEHDRSZ uint64 = 16 // level and count
+	IDXENTSZ  uint64 = 16 // hash and child block of an interior entry
+
+	freeLevel uint64 = ^uint64(0) // level of a node on the free list
+)
+
+// nameHash returns the 64-bit FNV-1a hash of name, which orders name
+// in its directory. It is never 0, so that READDIR cookie 0 precedes
+// every entry.
+func nameHash(name string) uint64 {
+	var h uint64 = 14695981039346656037
+	for i := 0; i < len(name); i++ {
+		h = (h ^ uint64(name[i])) * 1099511628211
+	}
+	if h == 0 {
+		return 1
+	}
+	return h
+}
+
+type node struct {
+	lblk  uint64 // logical block of the node in the directory
+	base  uint64 // byte offset of the node in its block
+	level uint64 // 0 for leaves
+	next  uint64 // next free block, for a free node
+	ents  []*dirEnt
+	keys  []uint64
+	kids  []uint64
+}
+
+func (n *node) isLeaf() bool {
+	return n.level == 0
+}
+
+func (n *node) count() uint64 {
+	if n.isLeaf() {
+		return uint64(len(n.ents))
+	}
+	return uint64(len(n.kids))
+}
+
+func entsSize(ents []*dirEnt) uint64 {
+	var sz uint64
+	for _, de := range ents {
+		sz += de.size()
+	}
+	return sz
+}
+
+// fitsIn reports whether n's entries fit in a node at offset base of
+// its block.
+func (n *node) fitsIn(base uint64) bool {
+	room := disk.BlockSize - base - NODEHDRSZ
+	if n.isLeaf() {
+		return entsSize(n.ents) <= room
+	}
+	return n.count()*IDXENTSZ <= room
+}
+
+// route returns the index of the child of interior node n that holds
+// hash h.
+func (n *node) route(h uint64) int {
+	var i = len(n.keys) - 1
+	for i > 0 && n.keys[i] > h {
+		i--
+	}
+	return i
+}
+
+func encodeNode(n *node) []byte {
+	enc := marshal.NewEnc(disk.BlockSize - n.base)
+	enc.PutInt(n.level)
+	if n.level == freeLevel {
+		enc.PutInt(n.next)
+		return enc.Finish()
+	}
+	enc.PutInt(n.count())
+	if n.isLeaf() {
+		for _, de := range n.ents {
+			encodeDirEnt(enc, de)
+		}
+	} else {
+		for i := range n.kids {
+			enc.PutInt(n.keys[i])
+			enc.PutInt(n.kids[i])
+		}
+	}
+	return enc.Finish()
+}
+
+func decodeNode(data []byte, lblk uint64, base uint64) *node {
+	dec := marshal.NewDec(data)
+	n := &node{lblk: lblk, base: base}
+	n.level = dec.GetInt()
+	cnt := dec.GetInt()
+	if n.level == freeLevel {
+		n.next = cnt
+		return n
+	}
+	for i := uint64(0); i < cnt; i++ {
+		if n.isLeaf() {
+			n.ents = append(n.ents, decodeDirEnt(dec))
+		} else {
+			n.keys = append(n.keys, dec.GetInt())
+			n.kids = append(n.kids, dec.GetInt())
+		}
+	}
+	return n
+}
+
+// dirTx caches the header and nodes of a directory for one operation
+// on it, and writes the ones the operation changed back with flush.
+type dirTx struct {
+	dip     *inode.Inode
+	op      *fstxn.FsTxn
+	nent    uint64
+	free    uint64
+	nbytes  uint64
+	nblk    uint64
+	nodes   map[uint64]*node
+	dirty   map[uint64]bool
+	hdr     bool // header dirty?
+	compact bool // drop freed nodes instead of putting them on the free list
+}
+
+func beginDir(dip *inode.Inode, op *fstxn.FsTxn) *dirTx {
+	dt := &dirTx{
+		dip:   dip,
+		op:    op,
+		nblk:  util.RoundUp(dip.Size, disk.BlockSize),
+		nodes: make(map[uint64]*node),
+		dirty: make(map[uint64]bool),
+	}
+	if dt.nblk > 0 {
+		data, _ := dip.Read(op.Atxn, 0, disk.BlockSize)
+		dec := marshal.NewDec(data)
+		dt.nent = dec.GetInt()
+		dt.free = dec.GetInt()
+		dt.nbytes = dec.GetInt()
+		dt.nodes[0] = decodeNode(data[DIRHDRSZ:], 0, DIRHDRSZ)
+	}
+	return dt
+}
+
+// initDir sets up an empty directory: the header and an empty root leaf.
+func (dt *dirTx) initDir() {
+	dt.nblk = 1
+	dt.nent = 0
+	dt.free = 0
+	dt.nbytes = 0
+	dt.hdr = true
+	dt.nodes[0] = &node{lblk: 0, base: DIRHDRSZ}
+	dt.dirty[0] = true
+}
+
+func (dt *dirTx) getNode(lblk uint64) *node {
+	n, ok := dt.nodes[lblk]
+	if ok {
+		return n
+	}
+	var base uint64 = 0
+	if lblk == 0 {
+		base = DIRHDRSZ
+	}
+	data, _ := dt.dip.Read(dt.op.Atxn, lblk*disk.BlockSize+base, disk.BlockSize-base)
+	n = decodeNode(data, lblk, base)
+	dt.nodes[lblk] = n
+	return n
+}
+
+func (dt *dirTx) root() *node {
+	return dt.getNode(0)
+}
+
+func (dt *dirTx) markDirty(n *node) {
+	dt.dirty[n.lblk] = true
+}
+
+// allocNode returns a new node at level, reusing a free node block if
+// there is one.
+func (dt *dirTx) allocNode(level uint64) *node {
+	var lblk = dt.free
+	if lblk != 0 {
+		dt.free = dt.getNode(lblk).next
+	} else {
+		lblk = dt.nblk
+		dt.nblk++
+	}
+	dt.hdr = true
+	n := &node{lblk: lblk, level: level}
+	dt.nodes[lblk] = n
+	dt.markDirty(n)
+	return n
+}
+
+func (dt *dirTx) freeNode(n *node) {
+	if dt.compact {
+		delete(dt.dirty, n.lblk)
+		return
+	}
+	n.level = freeLevel
+	n.next = dt.free
+	n.ents = nil
+	n.keys = nil
+	n.kids = nil
+	dt.free = n.lblk
+	dt.hdr = true
+	dt.markDirty(n)
+}
+
+// flush writes the header and the dirty nodes, in block order so that
+// the directory grows without holes.
+func (dt *dirTx) flush() bool {
+	for lblk := uint64(0); lblk < dt.nblk; lblk++ {
+		if !dt.dirty[lblk] {
+			continue
+		}
+		n := dt.nodes[lblk]
+		data := encodeNode(n)
+		off := lblk*disk.BlockSize + n.base
+		cnt, _ := dt.dip.Write(dt.op.Atxn, off, uint64(len(data)), data)
+		if cnt != uint64(len(data)) {
+			return false
+		}
+	}
+	if dt.hdr {
+		enc := marshal.NewEnc(3 * 8)
+		enc.PutInt(dt.nent)
+		enc.PutInt(dt.free)
+		enc.PutInt(dt.nbytes)
+		cnt, _ := dt.dip.Write(dt.op.Atxn, 0, 3*8, enc.Finish())
+		if cnt != 3*8 {
+			return false
+		}
+	}
+	return true
+}
+
+// path records the nodes from the root to a leaf, and the child index
+// taken at each interior node.
+type path struct {
+	nodes []*node
+	idx   []int
+}
+
+func (dt *dirTx) descend(h uint64) *path {
+	p := &path{}
+	var n = dt.root()
+	for !n.isLeaf() {
+		i := n.route(h)
+		p.nodes = append(p.nodes, n)
+		p.idx = append(p.idx, i)
+		n = dt.getNode(n.kids[i])
+	}
+	p.nodes = append(p.nodes, n)
+	return p
+}
+
+func (dt *dirTx) lookup(name string) *dirEnt {
+	h := nameHash(name)
+	p := dt.descend(h)
+	leaf := p.nodes[len(p.nodes)-1]
+	for _, de := range leaf.ents {
+		if de.hash == h && de.name == name {
+			return de
+		}
+	}
+	return nil
+}
+
+// splitPoint returns an index near the middle of ents, by size, at
+// which the hash changes and after which both halves fit in a node
+// block of their own.  If there is none, it returns the last index at
+// which the hash changes and before which the entries fit, leaving the
+// rest for another split, or 0 if even the entries with the first hash
+// don't fit.
+func splitPoint(ents []*dirEnt) int {
+	total := entsSize(ents)
+	var mid = 0
+	var sz uint64 = 0
+	for mid < len(ents) && 2*sz < total {
+		sz += ents[mid].size()
+		mid++
+	}
+	room := disk.BlockSize - NODEHDRSZ
+	for d := 0; d <= len(ents); d++ {
+		for _, k := range []int{mid - d, mid + d} {
+			if k > 0 && k < len(ents) && ents[k-1].hash != ents[k].hash &&
+				entsSize(ents[:k]) <= room && entsSize(ents[k:]) <= room {
+				return k
+			}
+		}
+	}
+	var k = 0
+	for i := 1; i < len(ents); i++ {
+		if ents[i-1].hash != ents[i].hash && entsSize(ents[:i]) <= room {
+			k = i
+		}
+	}
+	return k
+}
+
+// splitRoot moves the contents of the root into two new nodes, split
+// at index k, and makes the root an interior node over them.  It
+// returns the first hash of the right node.
+func (dt *dirTx) splitRoot(k int) uint64 {
+	r := dt.root()
+	left := dt.allocNode(r.level)
+	right := dt.allocNode(r.level)
+	var sep uint64
+	if r.isLeaf() {
+		left.ents = append([]*dirEnt{}, r.ents[:k]...)
+		right.ents = append([]*dirEnt{}, r.ents[k:]...)
+		sep = right.ents[0].hash
+	} else {
+		left.keys = append([]uint64{}, r.keys[:k]...)
+		left.kids = append([]uint64{}, r.kids[:k]...)
+		right.keys = append([]uint64{}, r.keys[k:]...)
+		right.kids = append([]uint64{}, r.kids[k:]...)
+		sep = right.keys[0]
+	}
+	r.level = r.level + 1
+	r.ents = nil
+	r.keys = []uint64{0, sep}
+	r.kids = []uint64{left.lblk, right.lblk}
+	dt.markDirty(r)
+	return sep
+}
+
+// split splits the overfull node at depth d of p, inserting the new
+// node into its parent, which may split in turn.  It returns the first
+// hash of the new node, which may itself be overfull if n is a leaf.
+func (dt *dirTx) split(p *path, d int) (uint64, bool) {
+	n := p.nodes[d]
+	var k int
+	if n.isLeaf() {
+		k = splitPoint(n.ents)
+		if k == 0 {
+			return 0, false // too many names with the same hash
+		}
+	} else {
+		k = len(n.kids) / 2
+	}
+	if d == 0 {
+		return dt.splitRoot(k), true
+	}
+	right := dt.allocNode(n.level)
+	var sep uint64
+	if n.isLeaf() {
+		right.ents = append([]*dirEnt{}, n.ents[k:]...)
+		n.ents = n.ents[:k]
+		sep = right.ents[0].hash
+	} else {
+		right.keys = append([]uint64{}, n.keys[k:]...)
+		right.kids = append([]uint64{}, n.kids[k:]...)
+		n.keys = n.keys[:k]
+		n.kids = n.kids[:k]
+		sep = right.keys[0]
+	}
+	dt.markDirty(n)
+	parent := p.nodes[d-1]
+	i := p.idx[d-1] + 1
+	parent.keys = append(parent.keys[:i], append([]uint64{sep}, parent.keys[i:]...)...)
+	parent.kids = append(parent.kids[:i], append([]uint64{right.lblk}, parent.kids[i:]...)...)
+	dt.markDirty(parent)
+	if !parent.fitsIn(parent.base) {
+		if _, ok := dt.split(p, d-1); !ok {
+			return 0, false
+		}
+	}
+	return sep, true
+}
+
+// insert adds de to the tree.  It fails if de's leaf can't split so
+// that the entries with de's hash fit in a node (see hashFull); dt is
+// then of no further use.
+func (dt *dirTx) insert(de *dirEnt) bool {
+	p := dt.descend(de.hash)
+	d := len(p.nodes) - 1
+	leaf := p.nodes[d]
+	var i = len(leaf.ents)
+	for i > 0 && leaf.ents[i-1].hash > de.hash {
+		i--
+	}
+	leaf.ents = append(leaf.ents[:i], append([]*dirEnt{de}, leaf.ents[i:]...)...)
+	dt.markDirty(leaf)
+	// each split leaves a left part that fits, and perhaps a right
+	// part that is still too big
+	for !leaf.fitsIn(leaf.base) {
+		h, ok := dt.split(p, d)
+		if !ok {
+			return false
+		}
+		p = dt.descend(h)
+		d = len(p.nodes) - 1
+		leaf = p.nodes[d]
+	}
+	dt.nent++
+	dt.nbytes += de.size()
+	dt.hdr = true
+	return true
+}
+
+// hashFull reports whether the entries with de's hash and de together
+// are too big for a node, which no split can fix.
+func (dt *dirTx) hashFull(de *dirEnt) bool {
+	p := dt.descend(de.hash)
+	leaf := p.nodes[len(p.nodes)-1]
+	var sz = de.size()
+	for _, e := range leaf.ents {
+		if e.hash == de.hash {
+			sz += e.size()
+		}
+	}
+	return sz > disk.BlockSize-NODEHDRSZ
+}
+
+// collapse pulls the only child of an interior root into the root, as
+// long as it fits.
+func (dt *dirTx) collapse() {
+	r := dt.root()
+	for !r.isLeaf() && len(r.kids) <= 1 {
+		if len(r.kids) == 0 {
+			r.level = 0
+			r.keys = nil
+			r.kids = nil
+			dt.markDirty(r)
+			return
+		}
+		c := dt.getNode(r.kids[0])
+		if !c.fitsIn(r.base) {
+			return
+		}
+		r.level = c.level
+		r.ents = c.ents
+		r.keys = c.keys
+		r.kids = c.kids
+		dt.markDirty(r)
+		dt.freeNode(c)
+	}
+}
+
+func (dt *dirTx) remove(name string) *dirEnt {
+	h := nameHash(name)
+	p := dt.descend(h)
+	var d = len(p.nodes) - 1
+	leaf := p.nodes[d]
+	var found *dirEnt
+	for i, de := range leaf.ents {
+		if de.hash == h && de.name == name {
+			found = de
+			leaf.ents = append(leaf.ents[:i], leaf.ents[i+1:]...)
+			break
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	dt.markDirty(leaf)
+	dt.nent--
+	dt.nbytes -= found.size()
+	dt.hdr = true
+
+	// free empty nodes below the root, removing them from their parents
+	for d > 0 && p.nodes[d].count() == 0 {
+		dt.freeNode(p.nodes[d])
+		parent := p.nodes[d-1]
+		i := p.idx[d-1]
+		parent.keys = append(parent.keys[:i], parent.keys[i+1:]...)
+		parent.kids = append(parent.kids[:i], parent.kids[i+1:]...)
+		dt.markDirty(parent)
+		d--
+	}
+	dt.collapse()
+	return found
+}
+
+// walk calls f on the entries of the subtree at n with hashes at least
+// h, in hash order, until f returns false. It returns false if f did.
+func (dt *dirTx) walk(n *node, h uint64, f func(*dirEnt) bool) bool {
+	if n.isLeaf() {
+		for _, de := range n.ents {
+			if de.hash >= h && !f(de) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := n.route(h); i < len(n.kids); i++ {
+		if !dt.walk(dt.getNode(n.kids[i]), h, f) {
+			return false
+		}
+	}
+	return true
+}
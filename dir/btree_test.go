@@ -0,0 +1,66 @@
+package dir
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mkEnt returns an entry whose name is n bytes long and whose hash is
+// hash, rather than the name's.
+func mkEnt(i int, n int, hash uint64) *dirEnt {
+	pre := fmt.Sprintf("%d-", i)
+	return &dirEnt{inum: 1, name: pre + strings.Repeat("x", n-len(pre)), hash: hash}
+}
+
+// checkTree checks that the nodes of the subtree at n fit in their
+// blocks, and returns the number of entries and leaves in it.
+func checkTree(t *testing.T, dt *dirTx, n *node) (int, int) {
+	assert.True(t, n.fitsIn(n.base), "node %d overfull", n.lblk)
+	if n.isLeaf() {
+		return len(n.ents), 1
+	}
+	var nent, nleaf = 0, 0
+	for _, k := range n.kids {
+		e, l := checkTree(t, dt, dt.getNode(k))
+		nent += e
+		nleaf += l
+	}
+	return nent, nleaf
+}
+
+// A leaf with a small name on either side of many names with one hash
+// has no split into two parts that fit, so it splits into three, and a
+// name that the hash's leaf can't hold fails to insert, as hashFull
+// reports.
+func TestSplitSameHash(t *testing.T) {
+	dt := &dirTx{nodes: make(map[uint64]*node), dirty: make(map[uint64]bool)}
+	dt.initDir()
+	assert.True(t, dt.insert(mkEnt(0, 3, 1)))
+	assert.True(t, dt.insert(mkEnt(1, 3, 9)))
+	// 3810 bytes with hash 5, which with one more name of 255 bytes
+	// leaves less room in a node than either small name takes
+	for i := 0; i < 18; i++ {
+		var n = 202
+		if i >= 12 {
+			n = 201
+		}
+		assert.True(t, dt.insert(mkEnt(2+i, n, 5)))
+	}
+	nent, nleaf := checkTree(t, dt, dt.root())
+	assert.Equal(t, 20, nent)
+	assert.Equal(t, 1, nleaf)
+
+	big := mkEnt(20, 255, 5)
+	assert.False(t, dt.hashFull(big))
+	assert.True(t, dt.insert(big))
+	nent, nleaf = checkTree(t, dt, dt.root())
+	assert.Equal(t, 21, nent)
+	assert.Equal(t, 3, nleaf)
+
+	assert.True(t, dt.hashFull(mkEnt(21, 3, 5)))
+	assert.False(t, dt.hashFull(mkEnt(21, 3, 9)))
+	assert.False(t, dt.insert(mkEnt(21, 3, 5)))
+}
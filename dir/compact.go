@@ -0,0 +1,167 @@
+package dir
+
+import (
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+)
+
+//
+// Compaction of a directory after many removes. Removing entries frees
+// only node blocks that become empty, and the directory never shrinks,
+// so a directory that once held many names stays large and sparse.
+// Compaction merges neighboring nodes that fit in one block, moves the
+// nodes at the end of the directory into the blocks that are no longer
+// in use, and truncates the directory after its last node. It runs in
+// bounded steps, each in its own transaction. Entries keep their
+// hashes, so READDIR cookies stay valid across compaction.
+//
+// A compaction step drops the free list: nodes that aren't reachable
+// from the root are unused, whether they were on the free list or
+// freed by the step.
+//
+
+const (
+	NCOMPACT   uint64 = 64 // # node blocks a compaction step may write or truncate
+	COMPACTMIN uint64 = 8  // # blocks below which a directory isn't worth compacting
+)
+
+// NeedsCompact reports whether dip's entries fill less than a quarter
+// of its blocks.
+func NeedsCompact(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	dt := beginDir(dip, op)
+	return dt.nblk >= COMPACTMIN && 4*dt.nbytes < dt.nblk*disk.BlockSize
+}
+
+func mergeFits(a *node, b *node) bool {
+	room := disk.BlockSize - a.base - NODEHDRSZ
+	if a.isLeaf() {
+		return entsSize(a.ents)+entsSize(b.ents) <= room
+	}
+	return (a.count()+b.count())*IDXENTSZ <= room
+}
+
+// merge merges neighboring children of n, and then of its descendants,
+// while budget lasts.
+func (dt *dirTx) merge(n *node, budget *uint64) {
+	if n.isLeaf() {
+		return
+	}
+	var i = 0
+	for i+1 < len(n.kids) && *budget > 0 {
+		a := dt.getNode(n.kids[i])
+		b := dt.getNode(n.kids[i+1])
+		if !mergeFits(a, b) {
+			i++
+			continue
+		}
+		if a.isLeaf() {
+			a.ents = append(a.ents, b.ents...)
+		} else {
+			// b's first child holds the hashes from n's key for b
+			a.keys = append(a.keys, n.keys[i+1])
+			a.keys = append(a.keys, b.keys[1:]...)
+			a.kids = append(a.kids, b.kids...)
+		}
+		n.keys = append(n.keys[:i+1], n.keys[i+2:]...)
+		n.kids = append(n.kids[:i+1], n.kids[i+2:]...)
+		dt.markDirty(a)
+		dt.markDirty(n)
+		dt.freeNode(b)
+		*budget--
+	}
+	for _, k := range n.kids {
+		if *budget == 0 {
+			return
+		}
+		dt.merge(dt.getNode(k), budget)
+	}
+}
+
+// nodeRef is a node in use and where its parent points to it.
+type nodeRef struct {
+	n      *node
+	parent *node
+	idx    int
+}
+
+func (dt *dirTx) collect(n *node, parent *node, idx int, refs []nodeRef) []nodeRef {
+	refs = append(refs, nodeRef{n: n, parent: parent, idx: idx})
+	if !n.isLeaf() {
+		for i, k := range n.kids {
+			refs = dt.collect(dt.getNode(k), n, i, refs)
+		}
+	}
+	return refs
+}
+
+// relocate moves nodes in use at or after block nlive, the number of
+// nodes in use, into the unused blocks before it, while budget lasts.
+// It returns nlive and whether all nodes are before it.
+func (dt *dirTx) relocate(budget *uint64) (uint64, bool) {
+	refs := dt.collect(dt.root(), nil, 0, nil)
+	nlive := uint64(len(refs))
+	inuse := make(map[uint64]bool)
+	for _, r := range refs {
+		inuse[r.n.lblk] = true
+	}
+	var dst uint64 = 0
+	for _, r := range refs {
+		if r.n.lblk < nlive {
+			continue
+		}
+		if *budget < 2 {
+			return nlive, false
+		}
+		for inuse[dst] {
+			dst++
+		}
+		util.DPrintf(5, "relocate # %v: node %d to %d\n", dt.dip.Inum, r.n.lblk, dst)
+		delete(dt.dirty, r.n.lblk)
+		inuse[dst] = true
+		r.n.lblk = dst
+		dt.nodes[dst] = r.n
+		dt.markDirty(r.n)
+		r.parent.kids[r.idx] = dst
+		dt.markDirty(r.parent)
+		*budget -= 2
+	}
+	return nlive, true
+}
+
+// CompactStep does one bounded step of compacting dip. It returns
+// whether more steps are needed, and whether truncating dip requires
+// the shrinker.
+func CompactStep(dip *inode.Inode, op *fstxn.FsTxn) (bool, bool) {
+	dt := beginDir(dip, op)
+	dt.compact = true
+	dt.free = 0
+	dt.hdr = true
+	var budget = NCOMPACT
+	dt.merge(dt.root(), &budget)
+	dt.collapse()
+	var more = budget == 0
+	var shrink = false
+	if !more {
+		nlive, done := dt.relocate(&budget)
+		more = !done
+		if done {
+			var nblk = nlive
+			if dt.nblk > nlive+NCOMPACT {
+				nblk = dt.nblk - NCOMPACT
+				more = true
+			}
+			dt.nblk = nblk
+		}
+	}
+	if !dt.flush() {
+		panic("CompactStep")
+	}
+	if dt.nblk*disk.BlockSize < dip.Size {
+		util.DPrintf(1, "CompactStep # %v: truncate to %d blocks\n", dip.Inum, dt.nblk)
+		shrink = dip.Resize(op.Atxn, dt.nblk*disk.BlockSize)
+	}
+	return more, shrink
+}
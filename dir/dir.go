@@ -10,12 +10,26 @@ import (
 	"github.com/mit-pdos/go-nfsd/nfstypes"
 )
 
-const DIRENTSZ uint64 = 128
-const MAXNAMELEN = DIRENTSZ - 16 // uint64 for inum + uint64 for len(name)
+// A directory entry is stored as its inode number, the file type of
+// the inode, the length of the name, and the name itself.
+const DIRENTHDRSZ uint64 = 8 + 1 + 1
+const MAXNAMELEN uint64 = 255
 
 type dirEnt struct {
 	inum common.Inum
+	kind nfstypes.Ftype3
 	name string // <= MAXNAMELEN
+	hash uint64 // nameHash(name), not stored on disk
+}
+
+func (de *dirEnt) size() uint64 {
+	return DIRENTHDRSZ + uint64(len(de.name))
+}
+
+// NameTooLong reports whether name is longer than a directory entry
+// can hold.
+func NameTooLong(name nfstypes.Filename3) bool {
+	return uint64(len(name)) > MAXNAMELEN
 }
 
 // IllegalName reports whether name is "." or "..".
@@ -25,99 +39,85 @@ func IllegalName(name nfstypes.Filename3) bool {
 }
 
 // ScanName searches dip for name without using the directory cache.
-func ScanName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, uint64) {
+// It returns the inode number and the file type of the entry.
+func ScanName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, nfstypes.Ftype3) {
 	if dip.Kind != nfstypes.NF3DIR {
 		return common.NULLINUM, 0
 	}
-	var inum = common.NULLINUM
-	var finalOffset uint64 = 0
-	for off := uint64(0); off < dip.Size; off += DIRENTSZ {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		if uint64(len(data)) != DIRENTSZ {
-			break
-		}
-		de := decodeDirEnt(data)
-		if de.inum == common.NULLINUM {
-			continue
-		}
-		if de.name == string(name) {
-			inum = de.inum
-			finalOffset = off
-			break
-		}
+	de := beginDir(dip, op).lookup(string(name))
+	if de == nil {
+		return common.NULLINUM, 0
 	}
-	return inum, finalOffset
+	return de.inum, de.kind
 }
 
-// AddNameDir writes a directory entry directly to dip at or after lastoff.
+// ADDBLOCKS is about how many blocks adding a name to a directory
+// allocates at most: a node for each level of a deep tree and a new
+// root, and the index blocks that map them.
+const ADDBLOCKS uint64 = 16
+
+// AddNameDir inserts a directory entry into dip, returning its cookie.
 func AddNameDir(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum,
-	name nfstypes.Filename3, lastoff uint64) (uint64, bool) {
-	var finalOff uint64
-
-	for off := uint64(lastoff); off < dip.Size; off += DIRENTSZ {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		if de.inum == common.NULLINUM {
-			finalOff = off
-			break
-		}
+	kind nfstypes.Ftype3, name nfstypes.Filename3) (uint64, bool) {
+	de := &dirEnt{inum: inum, kind: kind, name: string(name), hash: nameHash(string(name))}
+	util.DPrintf(5, "AddNameDir # %v: %v %v\n", dip.Inum, name, de)
+	dt := beginDir(dip, op)
+	if !dt.insert(de) {
+		return 0, false
 	}
-	if finalOff == 0 {
-		finalOff = dip.Size
+	return de.hash, dt.flush()
+}
+
+// AddNameErr returns the error for a failed AddName of name to dip:
+// NFS3ERR_INVAL if dip has so many names with name's hash that no node
+// can hold them and name, which another name may avoid, and otherwise
+// NFS3ERR_NOSPC.
+func AddNameErr(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) nfstypes.Nfsstat3 {
+	de := &dirEnt{name: string(name), hash: nameHash(string(name))}
+	if beginDir(dip, op).hashFull(de) {
+		return nfstypes.NFS3ERR_INVAL
 	}
-	de := &dirEnt{inum: inum, name: string(name)}
-	ent := encodeDirEnt(de)
-	util.DPrintf(5, "AddNameDir # %v: %v %v %v off %d\n", dip.Inum, name, de, ent, finalOff)
-	n, _ := dip.Write(op.Atxn, finalOff, DIRENTSZ, ent)
-	return finalOff, n == DIRENTSZ
+	return nfstypes.NFS3ERR_NOSPC
 }
 
-// RemNameDir removes a directory entry for name from dip.
+// RemNameDir removes the directory entry for name from dip.
 func RemNameDir(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (uint64, bool) {
-	inum, off := LookupName(dip, op, name)
-	if inum == common.NULLINUM {
+	dt := beginDir(dip, op)
+	de := dt.remove(string(name))
+	if de == nil {
 		return 0, false
 	}
-	util.DPrintf(5, "RemNameDir # %v: %v %v off %d\n", dip.Inum, name, inum, off)
-	de := &dirEnt{inum: common.NULLINUM, name: ""}
-	ent := encodeDirEnt(de)
-	n, _ := dip.Write(op.Atxn, off, DIRENTSZ, ent)
-	return off, n == DIRENTSZ
+	util.DPrintf(5, "RemNameDir # %v: %v %v\n", dip.Inum, name, de.inum)
+	return de.hash, dt.flush()
 }
 
 // IsDirEmpty reports whether dip contains only "." and "..".
 func IsDirEmpty(dip *inode.Inode, op *fstxn.FsTxn) bool {
-	var empty bool = true
-
-	// check all entries after . and ..
-	for off := uint64(2 * DIRENTSZ); off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
-			continue
-		}
-		empty = false
-		break
-	}
+	empty := beginDir(dip, op).nent <= 2
 	util.DPrintf(10, "IsDirEmpty: %v -> %v\n", dip, empty)
 	return empty
 }
 
+func initDir(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	dt := beginDir(dip, op)
+	dt.initDir()
+	return dt.flush()
+}
+
 // InitDir initializes dip as a directory with entries for "." and its parent.
 func InitDir(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
-	if !AddName(dip, op, dip.Inum, ".") {
+	if !initDir(dip, op) {
 		return false
 	}
-	return AddName(dip, op, parent, "..")
+	if !AddName(dip, op, dip.Inum, nfstypes.NF3DIR, ".") {
+		return false
+	}
+	return AddName(dip, op, parent, nfstypes.NF3DIR, "..")
 }
 
 // MkRootDir initializes dip as the filesystem root directory.
 func MkRootDir(dip *inode.Inode, op *fstxn.FsTxn) bool {
-	if !AddName(dip, op, dip.Inum, ".") {
-		return false
-	}
-	return AddName(dip, op, dip.Inum, "..")
+	return InitDir(dip, op, dip.Inum)
 }
 
 const fattr3XDRsize uint64 = 4 + 4 + 4 + // type, mode, nlink
@@ -155,29 +155,34 @@ func dirEntrySize(name string) uint64 {
 	return 8 + 4 + uint64(l) + pad4(l) + 8 + 4
 }
 
-// Apply iterates over directory entries starting at start and invokes f for each.
+// Apply iterates over the directory entries after cookie start, in
+// cookie order, and invokes f for each. It stops once the reply is
+// full, but never between entries with the same cookie, so that the
+// next call can resume after the last cookie returned.
 // XXX inode locking order violated
 func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 	dircount uint64, maxcount uint64,
 	f func(*inode.Inode, string, common.Inum, uint64)) bool {
 	var eof bool = true
 	var ip *inode.Inode
-	var begin = uint64(start)
-	if begin != 0 {
-		begin += DIRENTSZ
-	}
 	// Track the size of the XDR reply. Start with the fixed portion of the
 	// READDIRPLUS response as described in RFC 1813.
 	var n uint64 = readdirBase
 	// Size of the directory portion (fileid, name, cookie, and pointer).
 	var dirbytes uint64 = 0
-	for off := begin; off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
-		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
-			continue
+	var last uint64 = start
+	if start == ^uint64(0) {
+		return true
+	}
+	dt := beginDir(dip, op)
+	dt.walk(dt.root(), start+1, func(de *dirEnt) bool {
+		util.DPrintf(5, "Apply: # %v %v\n", dip.Inum, de)
+		// dircount only accounts for the directory entry portion
+		// (as returned by READDIR), while maxcount includes the full
+		// XDR reply with attributes and file handles.
+		if (dirbytes >= dircount || n >= maxcount) && de.hash != last {
+			eof = false
+			return false
 		}
 
 		// Lock inode, if this transaction doesn't own it already
@@ -190,24 +195,18 @@ func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 
 		}
 
-		f(ip, de.name, de.inum, off)
+		f(ip, de.name, de.inum, de.hash)
 
 		// Release inode early, if this trans didn't own it before.
 		if !own {
 			op.ReleaseInode(ip)
 		}
 
-		off = off + DIRENTSZ
-		// dircount only accounts for the directory entry portion
-		// (as returned by READDIR), while maxcount includes the full
-		// XDR reply with attributes and file handles.
+		last = de.hash
 		dirbytes += dirEntrySize(de.name)
 		n += entryplus3Baggage + uint64(len(de.name)) + pad4(len(de.name))
-		if dirbytes >= dircount || n >= maxcount {
-			eof = false
-			break
-		}
-	}
+		return true
+	})
 	return eof
 }
 
@@ -215,50 +214,65 @@ func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 func ApplyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64, count uint64,
 	f func(string, common.Inum, uint64)) bool {
 	var eof bool = true
-	var begin = uint64(start)
-	if begin != 0 {
-		begin += DIRENTSZ
-	}
 	// Track the encoded size of the READDIR reply. Start with the fixed
 	// portion of the response (attributes, cookie verifier, pointer, EOF).
 	var n uint64 = readdirBase
-	for off := begin; off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
-		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
-			continue
+	var last uint64 = start
+	if start == ^uint64(0) {
+		return true
+	}
+	dt := beginDir(dip, op)
+	dt.walk(dt.root(), start+1, func(de *dirEnt) bool {
+		util.DPrintf(5, "ApplyEnts: # %v %v\n", dip.Inum, de)
+		if n >= count && de.hash != last {
+			eof = false
+			return false
 		}
-		f(de.name, de.inum, off)
+		f(de.name, de.inum, de.hash)
 
-		off = off + DIRENTSZ
+		last = de.hash
 		// Each entry contributes its XDR-encoded directory fields.
 		n += dirEntrySize(de.name)
-		if n >= count {
-			eof = false
-			break
-		}
-	}
+		return true
+	})
 	return eof
 }
 
-// Caller must ensure de.Name fits
-func encodeDirEnt(de *dirEnt) []byte {
-	enc := marshal.NewEnc(DIRENTSZ)
+// Entry is a directory entry.
+type Entry struct {
+	Name string
+	Inum common.Inum
+	Kind nfstypes.Ftype3
+}
+
+// Entries returns the entries of dip other than "." and "..".
+func Entries(dip *inode.Inode, op *fstxn.FsTxn) []Entry {
+	var ents []Entry
+	dt := beginDir(dip, op)
+	dt.walk(dt.root(), 0, func(de *dirEnt) bool {
+		if de.name != "." && de.name != ".." {
+			ents = append(ents, Entry{Name: de.name, Inum: de.inum, Kind: de.kind})
+		}
+		return true
+	})
+	return ents
+}
+
+// Caller must ensure de.name fits
+func encodeDirEnt(enc marshal.Enc, de *dirEnt) {
 	enc.PutInt(uint64(de.inum))
-	enc.PutInt(uint64(len(de.name)))
+	enc.PutBytes([]byte{byte(de.kind), byte(len(de.name))})
 	enc.PutBytes([]byte(de.name))
-	return enc.Finish()
 }
 
-func decodeDirEnt(d []byte) *dirEnt {
-	dec := marshal.NewDec(d)
+func decodeDirEnt(dec marshal.Dec) *dirEnt {
 	inum := dec.GetInt()
-	l := dec.GetInt()
-	name := string(dec.GetBytes(l))
+	hdr := dec.GetBytes(2)
+	name := string(dec.GetBytes(uint64(hdr[1])))
 	return &dirEnt{
 		inum: common.Inum(inum),
+		kind: nfstypes.Ftype3(hdr[0]),
 		name: name,
+		hash: nameHash(name),
 	}
 }
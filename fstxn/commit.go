@@ -1,28 +1,284 @@
 package fstxn
 
+import (
+	"sort"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+// writeRefs writes the reference counts that op changes to the
+// reference count table, and frees the blocks whose last reference op
+// drops.  It locks the table's inode, which it holds until op's commit
+// has its place in the log (see commitLog), so that transactions commit
+// their changes to the counts one at a time, and only one of them finds that it dropped a block's last
+// reference.  It returns false if the table has no space.
+func (op *FsTxn) writeRefs() bool {
+	if cnts, last := op.Atxn.RefCounts(); len(cnts) == 0 && len(last) == 0 {
+		return true
+	}
+	refinum := op.Fs.Super.RefInum()
+	if refinum == common.NULLINUM {
+		panic("writeRefs: no table")
+	}
+	ip := op.lookupInode(refinum)
+	if ip == nil {
+		ip = op.GetInodeLocked(refinum)
+		if ip == nil {
+			return false
+		}
+	}
+	cnts, last := op.Atxn.RefCounts() // with the table locked
+	op.Atxn.FreeLast(last)
+	bns := make([]common.Bnum, 0, len(cnts))
+	for bn := range cnts {
+		bns = append(bns, bn)
+	}
+	sort.Slice(bns, func(i, j int) bool { return bns[i] < bns[j] })
+	for _, bn := range bns {
+		util.DPrintf(5, "writeRefs: %d -> %d\n", bn, cnts[bn])
+		_, ok := ip.Write(op.Atxn, bn*alloc.REFSZ, alloc.REFSZ,
+			alloc.EncodeCount(cnts[bn]))
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// writeQuotas writes the quota records that op changes to the quota
+// tables, locking the tables' inodes as writeRefs locks the reference
+// count table's.  It returns false, and marks op as over quota, if op
+// grows a usage beyond its hard limit, unless op belongs to the thread
+// that froze the file system, which takes snapshots regardless of
+// quotas.  It also returns false if a table has no space.
+func (op *FsTxn) writeQuotas() bool {
+	if recs, _ := op.Atxn.QuotaUpdates(); len(recs) == 0 {
+		return true
+	}
+	usr := op.lockTable(super.USRQUOTAINUM)
+	if usr == nil {
+		return false
+	}
+	grp := op.lockTable(super.GRPQUOTAINUM)
+	if grp == nil {
+		return false
+	}
+	recs, over := op.Atxn.QuotaUpdates() // with the tables locked
+	if over && !op.frozen {
+		op.over = true
+		return false
+	}
+	ids := make([]alloc.QuotaId, 0, len(recs))
+	for id := range recs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Type < ids[j].Type ||
+			(ids[i].Type == ids[j].Type && ids[i].Id < ids[j].Id)
+	})
+	for _, id := range ids {
+		var ip = usr
+		if id.Type == alloc.GRPQUOTA {
+			ip = grp
+		}
+		util.DPrintf(5, "writeQuotas: %v -> %v\n", id, recs[id])
+		_, ok := ip.Write(op.Atxn, uint64(id.Id)*alloc.QUOTASZ, alloc.QUOTASZ,
+			recs[id].Encode())
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lockTable locks the inode of a quota table, unless op holds it.
+func (op *FsTxn) lockTable(inum common.Inum) *inode.Inode {
+	ip := op.lookupInode(inum)
+	if ip == nil {
+		ip = op.GetInodeLocked(inum)
+	}
+	return ip
+}
+
+// OverQuota reports whether op failed to commit because it exceeded a
+// quota.
+func (op *FsTxn) OverQuota() bool {
+	return op.over
+}
+
+// Corrupt reports whether op read a block or inode that failed its
+// checksum, in which case op can't commit.
+func (op *FsTxn) Corrupt() bool {
+	return op.Atxn.Corrupt()
+}
+
 // putInodes may free an inode so must be done before commit
-func (op *FsTxn) preCommit() {
+func (op *FsTxn) preCommit() bool {
+	if op.Corrupt() {
+		return false
+	}
+	// the tables may grow even if the disk is full
+	op.Atxn.SetPrivileged()
+	if !op.writeRefs() {
+		return false
+	}
+	if !op.writeQuotas() {
+		return false
+	}
 	op.Atxn.PreCommit()
+	return true
+}
+
+// commitLog commits op to the log, and, if wait, waits until the commit
+// is durable.  It updates the in-memory counts and quota records and
+// releases the tables once the commit has its place in the log, before
+// it waits, so that transactions that change counts or usage, which
+// include every create and allocating write, don't hold each other up
+// for a log flush each.
+func (op *FsTxn) commitLog(wait bool) bool {
+	if !op.Atxn.Op.CommitWait(false) {
+		return false
+	}
+	op.Atxn.PostCommitRefs()
+	op.Atxn.PostCommitQuotas()
+	for _, inum := range []common.Inum{op.Fs.Super.RefInum(),
+		super.USRQUOTAINUM, super.GRPQUOTAINUM} {
+		if ip := op.lookupInode(inum); ip != nil {
+			op.ReleaseInode(ip)
+		}
+	}
+	if wait {
+		return op.Fs.Txn.Flush()
+	}
+	return true
 }
 
-func (op *FsTxn) postCommit() {
+func (op *FsTxn) postCommit(durable bool) {
 	op.releaseInodes()
-	op.Atxn.PostCommit()
+	op.Atxn.PostCommit(durable)
+	op.finish()
+}
+
+// committed records a commit that wrote inums.  A durable commit
+// also flushed the commits before seq0, the number of commits when it
+// started.
+func (st *FsState) committed(inums []common.Inum, durable bool, seq0 uint64) {
+	st.mu.Lock()
+	st.seq++
+	if durable {
+		st.flushedTo(seq0)
+	} else {
+		for _, inum := range inums {
+			st.unstable[inum] = st.seq
+		}
+	}
+	st.mu.Unlock()
+}
+
+// flushedTo records that the first seq commits are durable.  Caller
+// holds st.mu.
+func (st *FsState) flushedTo(seq uint64) {
+	if seq <= st.flushed {
+		return
+	}
+	st.flushed = seq
+	for inum, s := range st.unstable {
+		if s <= seq {
+			delete(st.unstable, inum)
+		}
+	}
+}
+
+// commitSeq returns the number of commits so far.
+func (st *FsState) commitSeq() uint64 {
+	st.mu.Lock()
+	seq := st.seq
+	st.mu.Unlock()
+	return seq
 }
 
 func (op *FsTxn) commitWait(wait bool) bool {
-	op.preCommit()
-	ok := op.Atxn.Op.CommitWait(wait)
-	op.postCommit()
+	if op.readonly {
+		return op.commitRead()
+	}
+	if !op.preCommit() {
+		op.Abort()
+		return false
+	}
+	seq0 := op.Fs.commitSeq()
+	ok := op.commitLog(wait)
+	if ok {
+		op.Fs.committed(op.Atxn.WrittenInums(), wait, seq0)
+	}
+	op.postCommit(ok && wait)
+	if op.Atxn.SawStale() {
+		op.Fs.StartFence()
+	}
 	return ok
 }
 
+// CommitNext commits op durably, like Commit, and returns a
+// transaction that continues it, for a change that takes several
+// transactions.  The new transaction holds the inodes in keep, which
+// op locked, so that no other transaction sees them in between, and
+// Freeze waits for it as if op were still running.  CommitNext returns
+// nil, with everything released, if the commit fails.
+func (op *FsTxn) CommitNext(keep ...*inode.Inode) *FsTxn {
+	if op.readonly {
+		panic("CommitNext: read-only transaction")
+	}
+	if !op.preCommit() {
+		op.Abort()
+		return nil
+	}
+	seq0 := op.Fs.commitSeq()
+	if !op.commitLog(true) {
+		op.postCommit(false)
+		return nil
+	}
+	op.Fs.committed(op.Atxn.WrittenInums(), true, seq0)
+	next := begin(op.Fs, op.frozen, false)
+	for _, ip := range keep {
+		op.doneInode(ip)
+		next.addInode(ip)
+	}
+	next.active = op.active
+	op.active = false
+	op.postCommit(true)
+	if op.Atxn.SawStale() {
+		op.Fs.StartFence()
+	}
+	return next
+}
+
+// commitRead finishes a read-only transaction, which has nothing to
+// write, so it releases its inodes without going through the log.  It
+// fails if the transaction read a block or inode that failed its
+// checksum.
+func (op *FsTxn) commitRead() bool {
+	if op.Atxn.Changed() {
+		panic("commitRead: read-only transaction changed the file system")
+	}
+	if op.Corrupt() {
+		op.Abort()
+		return false
+	}
+	op.releaseInodes()
+	op.finish()
+	return true
+}
+
 func (op *FsTxn) Commit() bool {
 	return op.commitWait(true)
 }
 
-// Commit data, but will also commit everything else, since we don't
-// support log-by-pass writes.
+// Commit data.  In ordered mode, the transaction's new data blocks
+// are already in place by the time the log commits it, but the map to
+// them is in the log, so this commits everything else, too.
 func (op *FsTxn) CommitData() bool {
 	return op.Commit()
 }
@@ -32,19 +288,52 @@ func (op *FsTxn) CommitUnstable() bool {
 	return op.commitWait(false)
 }
 
-// Flush log. We don't have to flush data from other file handles, but
-// that is only an option if we do log-by-pass writes.
+// CommitFh makes the earlier commits that wrote op's inodes durable,
+// which flushes the log, unless they already are.
 func (op *FsTxn) CommitFh() bool {
-	op.preCommit()
-	ok := op.Fs.Txn.Flush()
-	op.postCommit()
+	if !op.preCommit() {
+		op.Abort()
+		return false
+	}
+	st := op.Fs
+	st.mu.Lock()
+	var dirty = false
+	for inum := range op.inodes {
+		if st.unstable[inum] > st.flushed {
+			dirty = true
+		}
+	}
+	seq0 := st.seq
+	st.mu.Unlock()
+	var ok = true
+	if dirty {
+		ok = st.Txn.Flush()
+		st.mu.Lock()
+		st.flushedTo(seq0)
+		st.mu.Unlock()
+	}
+	op.postCommit(ok)
 	return ok
 }
 
+// evictWritten drops the in-memory copies of the inodes the
+// transaction wrote, so that the next transaction that uses them reads
+// them back from disk, without the aborted changes.
+func (op *FsTxn) evictWritten() {
+	for _, inum := range op.Atxn.WrittenInums() {
+		if op.OwnInum(inum) {
+			cslot := op.Fs.Icache.LookupSlot(uint64(inum))
+			cslot.Obj = nil
+		}
+	}
+}
+
 // An aborted transaction may free an inode, which results in dirty
 // buffers that need to be written to log. So, call commit.
 func (op *FsTxn) Abort() bool {
+	op.evictWritten()
 	op.releaseInodes()
 	op.Atxn.PostAbort()
+	op.finish()
 	return true
 }
@@ -0,0 +1,137 @@
+package fstxn
+
+import (
+	"sync"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-journal/wal"
+)
+
+//
+// Fences.  A fence waits until the log has installed every transaction
+// that committed before the fence began, so that the blocks those
+// transactions freed can't get writes from the log anymore, and marks
+// them fresh (see alloc/stale.go).  The log doesn't say how far it has
+// installed, but its headers on disk do: the first holds the end of the
+// log and the second the position up to which it has installed.  The
+// log runs on a LogDisk, which notes the headers as the log writes them
+// and wakes the fences that wait for them.
+//
+
+func logPos(blk disk.Block) uint64 {
+	return marshal.NewDec(blk).GetInt()
+}
+
+// LogDisk is the disk that the log writes to, which tracks the log's
+// headers.
+type LogDisk struct {
+	disk.Disk
+	mu        *sync.Mutex
+	cond      *sync.Cond
+	end       uint64 // the end of the log on disk
+	installed uint64 // the log is installed up to here
+	stopped   bool
+}
+
+// MkLogDisk wraps d, which holds the log, so that fences can wait for
+// it.  The caller opens the log on the LogDisk.
+func MkLogDisk(d disk.Disk) *LogDisk {
+	mu := new(sync.Mutex)
+	return &LogDisk{
+		Disk:      d,
+		mu:        mu,
+		cond:      sync.NewCond(mu),
+		end:       logPos(d.Read(wal.LOGHDR)),
+		installed: logPos(d.Read(wal.LOGHDR2)),
+	}
+}
+
+func (d *LogDisk) Write(a uint64, v disk.Block) {
+	d.Disk.Write(a, v)
+	if a != wal.LOGHDR && a != wal.LOGHDR2 {
+		return
+	}
+	d.mu.Lock()
+	if a == wal.LOGHDR {
+		d.end = logPos(v)
+	} else {
+		d.installed = logPos(v)
+		d.cond.Broadcast()
+	}
+	d.mu.Unlock()
+}
+
+// waitInstalled waits until the log is installed up to the end that
+// its header holds now.  It returns false if stop ends the wait first.
+func (d *LogDisk) waitInstalled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	end := d.end
+	for d.installed < end {
+		if d.stopped {
+			return false
+		}
+		d.cond.Wait()
+	}
+	return true
+}
+
+// stop ends the waits of waitInstalled, for good.
+func (d *LogDisk) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// waitInstalled waits until the log has installed every transaction
+// that committed before the call.  It returns false if the file system
+// stopped fences first.
+func (st *FsState) waitInstalled() bool {
+	st.Txn.Flush()
+	return st.LogDisk.waitInstalled()
+}
+
+// Fence waits until the log has installed the transactions that
+// committed until now, and makes the blocks they freed fresh.
+func (st *FsState) Fence() {
+	fenced := st.Balloc.BeginFence()
+	if st.waitInstalled() && fenced {
+		st.Balloc.EndFence()
+	}
+}
+
+// StartFence starts a fence in the background, unless one is running.
+func (st *FsState) StartFence() {
+	st.mu.Lock()
+	start := !st.fencing && !st.stopped
+	if start {
+		st.fencing = true
+	}
+	st.mu.Unlock()
+	if start {
+		go func() {
+			util.DPrintf(1, "fence\n")
+			st.Fence()
+			st.mu.Lock()
+			st.fencing = false
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		}()
+	}
+}
+
+// StopFences waits for a running fence to finish, and stops new ones
+// from starting.  The caller must call it before shutting down the log.
+func (st *FsState) StopFences() {
+	st.mu.Lock()
+	st.stopped = true
+	st.LogDisk.stop()
+	for st.fencing {
+		st.cond.Wait()
+	}
+	st.mu.Unlock()
+}
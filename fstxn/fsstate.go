@@ -1,48 +1,201 @@
 package fstxn
 
 import (
-	"github.com/mit-pdos/go-journal/alloc"
+	"sync"
+
+	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/common"
-	"github.com/mit-pdos/go-journal/lockmap"
 	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-nfsd/alloc"
 	"github.com/mit-pdos/go-nfsd/cache"
 	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/lockmap"
 	"github.com/mit-pdos/go-nfsd/super"
 )
 
 const ICACHESZ uint64 = 100
 
+// The allocators keep 1/BRESERVE of the data blocks and 1/IRESERVE of
+// the inodes for privileged transactions (see AllocTxn.SetPrivileged).
+const (
+	BRESERVE uint64 = 100
+	IRESERVE uint64 = 1000
+)
+
 type FsState struct {
 	Super   *super.FsSuper
 	Txn     *obj.Log
+	LogDisk *LogDisk
 	Icache  *cache.Cache[*inode.Inode]
 	Lockmap *lockmap.LockMap
 	Balloc  *alloc.Alloc
 	Ialloc  *alloc.Alloc
+	Refs    *alloc.Refs
+	Quotas  *alloc.Quotas
+
+	// transactions that hold an inode's lock shared may both fill
+	// its cache slot
+	slotMu *sync.Mutex
+
+	// Freeze stops transactions from locking inodes until Thaw
+	mu      *sync.Mutex
+	cond    *sync.Cond
+	nactive uint64 // # running transactions that lock inodes
+	frozen  bool
+
+	// see fence.go
+	fencing bool
+	stopped bool
+
+	// see CommitFh
+	seq      uint64                 // # commits
+	flushed  uint64                 // commits up to here are durable
+	unstable map[common.Inum]uint64 // last commit that wrote the inode
 }
 
-func readBitmap(super *super.FsSuper, start common.Bnum, len uint64) []byte {
+// ReadBitmap reads n bitmap blocks, the k-th of which is block(start+k).
+// It reads through the log, because after a crash the log may hold
+// committed updates to the bitmaps that aren't installed yet.
+func ReadBitmap(log *obj.Log, block func(uint64) common.Bnum, start uint64, n uint64) []byte {
 	var bitmap []byte
-	for i := uint64(0); i < len; i++ {
-		blk := super.Disk.Read(uint64(start) + i)
-		bitmap = append(bitmap, blk...)
+	for k := start; k < start+n; k++ {
+		buf := log.Load(addr.MkAddr(block(k), 0), common.NBITBLOCK)
+		bitmap = append(bitmap, buf.Data...)
 	}
 	return bitmap
 }
 
-func MkFsState(super *super.FsSuper, log *obj.Log) *FsState {
-	balloc := alloc.MkAlloc(readBitmap(super, super.BitmapBlockStart(),
-		super.NBlockBitmap))
-	ialloc := alloc.MkAlloc(readBitmap(super, super.BitmapInodeStart(),
-		super.NInodeBitmap))
+func MkFsState(fs *super.FsSuper, log *obj.Log, ld *LogDisk) *FsState {
+	balloc := alloc.MkAlloc(ReadBitmap(log, fs.BlockBitmapBlock, 0,
+		fs.NBlockBitmap()), super.BGROUPSZ)
+	ialloc := alloc.MkAlloc(ReadBitmap(log, fs.InodeBitmapBlock, 0,
+		fs.NInodeBitmap()), super.IGROUPSZ)
 	icache := cache.MkCache[*inode.Inode](ICACHESZ)
+	mu := new(sync.Mutex)
 	st := &FsState{
-		Super:   super,
-		Txn:     log,
-		Icache:  icache,
-		Lockmap: lockmap.MkLockMap(),
-		Balloc:  balloc,
-		Ialloc:  ialloc,
+		Super:    fs,
+		Txn:      log,
+		LogDisk:  ld,
+		Icache:   icache,
+		Lockmap:  lockmap.MkLockMap(),
+		Balloc:   balloc,
+		Ialloc:   ialloc,
+		Refs:     alloc.MkRefs(nil),
+		Quotas:   alloc.MkQuotas(nil, nil),
+		slotMu:   new(sync.Mutex),
+		mu:       mu,
+		cond:     sync.NewCond(mu),
+		unstable: make(map[common.Inum]uint64),
 	}
+	if fs.RefInum() != common.NULLINUM {
+		st.Refs = alloc.MkRefs(readRefs(st))
+	}
+	st.Quotas = alloc.MkQuotas(readTable(st, super.USRQUOTAINUM),
+		readTable(st, super.GRPQUOTAINUM))
+	st.SetReserve()
+	// blocks that are free may have writes in the log that recovery
+	// found
+	st.waitInstalled()
 	return st
 }
+
+// SetReserve sizes the reserved pools of free blocks and inodes for
+// the size of the file system.
+func (st *FsState) SetReserve() {
+	st.Balloc.SetPool((st.Super.MaxBnum() - st.Super.DataStart()) / BRESERVE)
+	st.Ialloc.SetPool(st.Super.NInode() / IRESERVE)
+}
+
+// readTable reads the quota table in inode inum, which is empty until
+// mkfs has made the file system's root directory.
+func readTable(st *FsState, inum common.Inum) []byte {
+	op := Begin(st)
+	ip := op.GetInodeLocked(inum)
+	if ip == nil {
+		panic("readTable: quota table inode is corrupt")
+	}
+	var table []byte
+	if ip.Kind != inode.NF3FREE {
+		table, _ = ip.Read(op.Atxn, 0, ip.Size)
+	}
+	if op.Corrupt() {
+		panic("readTable: quota table is corrupt")
+	}
+	op.Abort()
+	return table
+}
+
+// readRefs reads the reference count table.
+func readRefs(st *FsState) []byte {
+	op := Begin(st)
+	ip := op.GetInodeLocked(st.Super.RefInum())
+	if ip == nil {
+		panic("readRefs: reference count table inode is corrupt")
+	}
+	table, _ := ip.Read(op.Atxn, 0, ip.Size)
+	if op.Corrupt() {
+		panic("readRefs: reference count table is corrupt")
+	}
+	op.Abort()
+	return table
+}
+
+// slotInode returns the inode in cslot, nil if it isn't read yet.
+func (st *FsState) slotInode(cslot *cache.Cslot[*inode.Inode]) *inode.Inode {
+	st.slotMu.Lock()
+	ip := cslot.Obj
+	st.slotMu.Unlock()
+	return ip
+}
+
+// fillSlot puts ip in cslot, unless another transaction did first, and
+// returns the inode in cslot.
+func (st *FsState) fillSlot(cslot *cache.Cslot[*inode.Inode], ip *inode.Inode) *inode.Inode {
+	st.slotMu.Lock()
+	if cslot.Obj == nil {
+		cslot.Obj = ip
+	}
+	r := cslot.Obj
+	st.slotMu.Unlock()
+	return r
+}
+
+func (st *FsState) begin(frozen bool) {
+	st.mu.Lock()
+	for st.frozen && !frozen {
+		st.cond.Wait()
+	}
+	st.nactive++
+	st.mu.Unlock()
+}
+
+func (st *FsState) end() {
+	st.mu.Lock()
+	st.nactive--
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// Freeze waits for running transactions that lock inodes to finish,
+// and stops new ones from locking inodes until Thaw, except for those
+// that BeginFrozen starts.  The caller must not have a transaction
+// running.
+func (st *FsState) Freeze() {
+	st.mu.Lock()
+	for st.frozen {
+		st.cond.Wait()
+	}
+	st.frozen = true
+	for st.nactive > 0 {
+		st.cond.Wait()
+	}
+	st.mu.Unlock()
+}
+
+// Thaw lets transactions start again after Freeze.
+func (st *FsState) Thaw() {
+	st.mu.Lock()
+	st.frozen = false
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
@@ -3,11 +3,13 @@ package fstxn
 import (
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
 	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/cache"
 	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
 )
 
 //
@@ -16,21 +18,55 @@ import (
 //
 
 type FsTxn struct {
-	Fs     *FsState
-	Atxn   *alloctxn.AllocTxn
-	inodes map[common.Inum]*inode.Inode
+	Fs       *FsState
+	Atxn     *alloctxn.AllocTxn
+	inodes   map[common.Inum]*inode.Inode
+	frozen   bool // started by the thread that froze the file system
+	readonly bool // only reads (see BeginReadOnly)
+	active   bool // counted as running by Fs
+	over     bool // exceeded a quota at commit
 }
 
-func Begin(fsstate *FsState) *FsTxn {
+func begin(fsstate *FsState, frozen bool, readonly bool) *FsTxn {
 	op := &FsTxn{
 		Fs: fsstate,
 		Atxn: alloctxn.Begin(fsstate.Super, fsstate.Txn, fsstate.Balloc,
-			fsstate.Ialloc),
-		inodes: make(map[common.Inum]*inode.Inode),
+			fsstate.Ialloc, fsstate.Refs, fsstate.Quotas),
+		inodes:   make(map[common.Inum]*inode.Inode),
+		frozen:   frozen,
+		readonly: readonly,
 	}
 	return op
 }
 
+// Begin starts a transaction.  While the file system is frozen, the
+// transaction waits before it locks its first inode.
+func Begin(fsstate *FsState) *FsTxn {
+	return begin(fsstate, false, false)
+}
+
+// BeginReadOnly starts a transaction that only reads.  It locks
+// inodes shared with other read-only transactions, and its commit
+// releases them without going through the log.  It must not change the
+// inodes it locks or the blocks it reads.
+func BeginReadOnly(fsstate *FsState) *FsTxn {
+	return begin(fsstate, false, true)
+}
+
+// BeginFrozen starts a transaction of the thread that froze the file
+// system.
+func BeginFrozen(fsstate *FsState) *FsTxn {
+	return begin(fsstate, true, false)
+}
+
+// finish marks op as committed or aborted.
+func (op *FsTxn) finish() {
+	if op.active {
+		op.active = false
+		op.Fs.end()
+	}
+}
+
 func (op *FsTxn) addInode(ip *inode.Inode) {
 	op.inodes[ip.Inum] = ip
 }
@@ -55,18 +91,30 @@ func (op *FsTxn) releaseInodes() {
 	}
 }
 
-func (op *FsTxn) AllocInode(kind nfstypes.Ftype3) *inode.Inode {
+// AllocInode allocates an inode of kind in directory parent, and
+// charges it to owner's quotas.  Files go near their parent;
+// directories are spread over the allocation groups, so that work in
+// different directories uses different groups.
+func (op *FsTxn) AllocInode(kind nfstypes.Ftype3, parent common.Inum, owner alloc.Owner) *inode.Inode {
 	var ip *inode.Inode
-	inum := op.Atxn.AllocINum()
+	var near = parent
+	if kind == nfstypes.NF3DIR {
+		near = common.NULLINUM
+	}
+	inum := op.Atxn.AllocINum(near)
 	if inum != common.NULLINUM {
 		ip = op.GetInodeLocked(inum)
+		if ip == nil {
+			return nil
+		}
 		if ip.Kind != inode.NF3FREE {
 			panic("AllocInode")
 		}
 		if !ip.IsShrinking() {
 			util.DPrintf(1, "AllocInode -> # %v\n", inum)
-			ip.InitInode(inum, kind)
+			ip.InitInode(inum, kind, owner)
 			ip.WriteInode(op.Atxn)
+			op.Atxn.Charge(owner, 0, 1)
 		}
 	}
 	return ip
@@ -79,7 +127,15 @@ func (op *FsTxn) ReleaseInode(ip *inode.Inode) {
 }
 
 func (op *FsTxn) LockInode(inum common.Inum) *cache.Cslot[*inode.Inode] {
-	op.Fs.Lockmap.Acquire(inum)
+	if !op.active {
+		op.Fs.begin(op.frozen)
+		op.active = true
+	}
+	if op.readonly {
+		op.Fs.Lockmap.AcquireShared(inum)
+	} else {
+		op.Fs.Lockmap.Acquire(inum)
+	}
 	cslot := op.Fs.Icache.LookupSlot(uint64(inum))
 	if cslot == nil {
 		panic("GetInodeLocked")
@@ -87,16 +143,23 @@ func (op *FsTxn) LockInode(inum common.Inum) *cache.Cslot[*inode.Inode] {
 	return cslot
 }
 
+// GetInodeLocked locks inode inum and returns it.  It returns nil, and
+// marks the transaction as corrupt, if the inode fails its checksum.
 func (op *FsTxn) GetInodeLocked(inum common.Inum) *inode.Inode {
 	cslot := op.LockInode(inum)
-	if cslot.Obj == nil {
+	var ip = op.Fs.slotInode(cslot)
+	if ip == nil {
 		addr := op.Fs.Super.Inum2Addr(inum)
-		buf := op.Atxn.Op.ReadBuf(addr, common.INODESZ*8)
+		buf := op.Atxn.Op.ReadBuf(addr, super.INODESZ*8)
+		if !buf.IsDirty() && !super.VerifyInode(buf.Data) {
+			op.Atxn.Corrupted("inode", uint64(inum))
+			op.Fs.Lockmap.Release(inum)
+			return nil
+		}
 		i := inode.Decode(buf, inum)
 		util.DPrintf(1, "GetInodeLocked # %v: read inode from disk\n", inum)
-		cslot.Obj = i
+		ip = op.Fs.fillSlot(cslot, i)
 	}
-	ip := cslot.Obj
 	op.addInode(ip)
 	util.DPrintf(1, "%p: GetInodeLocked %v\n", op.Atxn.Id(), ip)
 	return ip
@@ -124,6 +187,9 @@ func (op *FsTxn) GetInodeInum(inum common.Inum) *inode.Inode {
 
 func (op *FsTxn) GetInodeFh(fh3 nfstypes.Nfs_fh3) *inode.Inode {
 	fh := fh.MakeFh(fh3)
+	if op.Fs.Super.IsSysInum(fh.Ino) {
+		return nil
+	}
 	ip := op.GetInodeInum(fh.Ino)
 	if ip == nil {
 		return nil
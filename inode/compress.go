@@ -0,0 +1,396 @@
+package inode
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+)
+
+//
+// Compressed files.  An inode with INODE_COMPRESS stores its data in
+// clusters of NCLUSTER logical blocks, mapped with the blks array.  A
+// cluster that compresses into fewer blocks than it has non-zero blocks
+// holds a header and the DEFLATE stream of the cluster in the blocks
+// that its first logical blocks map, and the rest of its logical
+// blocks are holes; the block number of its first logical block has
+// CBIT set.  Any other cluster is stored plainly, with holes for zero
+// blocks.  Writing a cluster reads it, and stores it anew, reusing the
+// cluster's blocks unless other files share them.  Blocks counts the
+// data blocks, which NFS reports as the file's used space.
+//
+
+const (
+	NCLUSTER  uint64      = 8 // # logical blocks per cluster
+	CLUSTERSZ uint64      = NCLUSTER * disk.BlockSize
+	CHDRSZ    uint64      = 4       // length of the DEFLATE stream
+	CBIT      common.Bnum = 1 << 63 // marks a compressed cluster
+)
+
+// Compressed reports whether ip stores its data compressed.
+func (ip *Inode) Compressed() bool {
+	return ip.compressed()
+}
+
+func (ip *Inode) compressed() bool {
+	return ip.Flags&INODE_COMPRESS != 0
+}
+
+// UseCompression switches an empty inode to storing its data
+// compressed.
+func (ip *Inode) UseCompression(atxn *alloctxn.AllocTxn) {
+	if ip.Size != 0 || ip.IsShrinking() || ip.Flags&INODE_EXTENTS != 0 {
+		panic("UseCompression")
+	}
+	ip.Flags = ip.Flags | INODE_COMPRESS
+	ip.WriteInode(atxn)
+}
+
+// physBlock returns the block that a block map entry refers to.
+func physBlock(blkno common.Bnum) common.Bnum {
+	return blkno &^ CBIT
+}
+
+// freeData frees data block blkno, which the block map refers to.
+func (ip *Inode) freeData(atxn *alloctxn.AllocTxn, blkno common.Bnum) {
+	if blkno == common.NULLBNUM {
+		return
+	}
+	atxn.FreeBlock(ip.Owner(), physBlock(blkno))
+	ip.Blocks--
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func deflate(data []byte) []byte {
+	var z bytes.Buffer
+	w, err := flate.NewWriter(&z, flate.BestSpeed)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+	w.Close()
+	return z.Bytes()
+}
+
+func inflate(z []byte, n uint64) ([]byte, bool) {
+	r := flate.NewReader(bytes.NewReader(z))
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	r.Close()
+	return data, err == nil
+}
+
+// blkSet maps logical block bn to blkno, which may be NULLBNUM.  If
+// alloc is set, blkSet allocates the index blocks on the way to bn that
+// don't exist, and returns false if the disk is full; otherwise, bn
+// must have index blocks unless blkno is NULLBNUM.
+func (ip *Inode) blkSet(atxn *alloctxn.AllocTxn, bn uint64, blkno common.Bnum, alloc bool) bool {
+	if bn < NDIRECT {
+		ip.blks[bn] = blkno
+		return true
+	}
+	level, off0 := indLevel(bn)
+	root := indRoot(level)
+	if ip.blks[root] == common.NULLBNUM {
+		if blkno == common.NULLBNUM {
+			return true
+		}
+		ip.blks[root] = ip.allocIndex(atxn, alloc)
+		if ip.blks[root] == common.NULLBNUM {
+			return false
+		}
+	}
+	var off = off0
+	var blk = ip.blks[root]
+	for l := level; l > 1; l-- {
+		divisor := pow(l - 1)
+		buf := atxn.ReadBlock(blk)
+		o := (off / divisor) * 8
+		off = off % divisor
+		var next = buf.BnumGet(o)
+		if next == common.NULLBNUM {
+			if blkno == common.NULLBNUM {
+				return true
+			}
+			next = ip.allocIndex(atxn, alloc)
+			if next == common.NULLBNUM {
+				return false
+			}
+			buf.BnumPut(o, next)
+		}
+		blk = next
+	}
+	atxn.ReadBlock(blk).BnumPut(off*8, blkno)
+	return true
+}
+
+func (ip *Inode) allocIndex(atxn *alloctxn.AllocTxn, alloc bool) common.Bnum {
+	if !alloc {
+		panic("blkSet")
+	}
+	blk := atxn.AllocBlock(ip.Owner(), ip.allocGoal(atxn))
+	if blk != common.NULLBNUM {
+		ip.lastBlk = blk
+	}
+	return blk
+}
+
+// readCluster returns the data of cluster c.  If a compressed cluster
+// is corrupt, it marks the transaction as corrupt, and returns zeros.
+func (ip *Inode) readCluster(atxn *alloctxn.AllocTxn, c uint64) []byte {
+	bn := c * NCLUSTER
+	data := make([]byte, CLUSTERSZ)
+	first := ip.blkLookup(atxn, bn)
+	if first&CBIT == 0 {
+		for i := uint64(0); i < NCLUSTER; i++ {
+			blkno := ip.blkLookup(atxn, bn+i)
+			if blkno != common.NULLBNUM {
+				copy(data[i*disk.BlockSize:], atxn.ReadBlock(blkno).Data)
+			}
+		}
+		return data
+	}
+	var z = make([]byte, 0, CLUSTERSZ)
+	z = append(z, atxn.ReadBlock(physBlock(first)).Data...)
+	n := uint64(binary.LittleEndian.Uint32(z[:CHDRSZ]))
+	nblk := util.RoundUp(CHDRSZ+n, disk.BlockSize)
+	for i := uint64(1); i < nblk && i < NCLUSTER; i++ {
+		blkno := ip.blkLookup(atxn, bn+i)
+		if blkno == common.NULLBNUM {
+			break
+		}
+		z = append(z, atxn.ReadBlock(blkno).Data...)
+	}
+	if atxn.Corrupt() { // a block failed its checksum
+		return data
+	}
+	if CHDRSZ+n > uint64(len(z)) {
+		atxn.Corrupted("compressed cluster at block", uint64(physBlock(first)))
+		return data
+	}
+	out, ok := inflate(z[CHDRSZ:CHDRSZ+n], CLUSTERSZ)
+	if !ok {
+		atxn.Corrupted("compressed cluster at block", uint64(physBlock(first)))
+		return data
+	}
+	return out
+}
+
+// packCluster returns the blocks to store data, a cluster of up to
+// NCLUSTER blocks, in: one per block of data, nil for a hole.  It also
+// reports whether the blocks hold the cluster compressed.
+func packCluster(data []byte) ([][]byte, bool) {
+	nb := uint64(len(data)) / disk.BlockSize
+	blocks := make([][]byte, nb)
+	var n uint64 = 0
+	for i := uint64(0); i < nb; i++ {
+		b := data[i*disk.BlockSize : (i+1)*disk.BlockSize]
+		if !isZero(b) {
+			blocks[i] = b
+			n++
+		}
+	}
+	if n <= 1 { // compressing can't save a block
+		return blocks, false
+	}
+	z := deflate(data)
+	nz := util.RoundUp(CHDRSZ+uint64(len(z)), disk.BlockSize)
+	if nz >= n {
+		return blocks, false
+	}
+	packed := make([]byte, nz*disk.BlockSize)
+	binary.LittleEndian.PutUint32(packed, uint32(len(z)))
+	copy(packed[CHDRSZ:], z)
+	blocks = make([][]byte, nb)
+	for i := uint64(0); i < nz; i++ {
+		blocks[i] = packed[i*disk.BlockSize : (i+1)*disk.BlockSize]
+	}
+	return blocks, true
+}
+
+// writeCluster stores data, whose length is a multiple of the block
+// size up to CLUSTERSZ, as cluster c; the cluster's logical blocks
+// past the data become holes.  It returns false, leaving the cluster
+// as it was, if the disk is full.
+func (ip *Inode) writeCluster(atxn *alloctxn.AllocTxn, c uint64, data []byte) bool {
+	bn := c * NCLUSTER
+	blocks, packed := packCluster(data)
+
+	// the cluster's blocks, and those that it may overwrite in place
+	var slots = make([]common.Bnum, NCLUSTER)
+	var old []common.Bnum
+	var reuse []common.Bnum
+	for i := uint64(0); i < NCLUSTER; i++ {
+		slots[i] = ip.blkLookup(atxn, bn+i)
+		blkno := physBlock(slots[i])
+		if blkno != common.NULLBNUM {
+			old = append(old, blkno)
+			if !atxn.Shared(blkno) {
+				reuse = append(reuse, blkno)
+			}
+		}
+	}
+
+	// map the new blocks, allocating index blocks as needed, and undo
+	// that if the disk is full
+	var newblks = make([]common.Bnum, NCLUSTER)
+	var allocated []common.Bnum
+	var fail = false
+	var i uint64
+	for i = 0; i < uint64(len(blocks)); i++ {
+		if blocks[i] == nil {
+			continue
+		}
+		if len(reuse) > 0 {
+			newblks[i] = reuse[0]
+			reuse = reuse[1:]
+		} else {
+			newblks[i] = atxn.AllocBlock(ip.Owner(), ip.allocGoal(atxn))
+			if newblks[i] == common.NULLBNUM {
+				fail = true
+				break
+			}
+			ip.lastBlk = newblks[i]
+			allocated = append(allocated, newblks[i])
+		}
+		var blkno = newblks[i]
+		if i == 0 && packed {
+			blkno = blkno | CBIT
+		}
+		if !ip.blkSet(atxn, bn+i, blkno, true) {
+			fail = true
+			break
+		}
+	}
+	if fail {
+		for j := uint64(0); j < i; j++ {
+			ip.blkSet(atxn, bn+j, slots[j], false)
+		}
+		for _, blkno := range allocated {
+			atxn.UnallocBlock(ip.Owner(), blkno)
+		}
+		return false
+	}
+
+	used := make(map[common.Bnum]bool)
+	var n uint64 = 0
+	for i := uint64(0); i < NCLUSTER; i++ {
+		if newblks[i] == common.NULLBNUM {
+			ip.blkSet(atxn, bn+i, common.NULLBNUM, false)
+			continue
+		}
+		used[newblks[i]] = true
+		atxn.WriteBlock(newblks[i], blocks[i])
+		n++
+	}
+	for _, blkno := range old {
+		if !used[blkno] {
+			atxn.FreeBlock(ip.Owner(), blkno)
+		}
+	}
+	ip.Blocks = ip.Blocks + n - uint64(len(old))
+	util.DPrintf(5, "writeCluster # %d: cluster %d in %d blocks (packed %v)\n",
+		ip.Inum, c, n, packed)
+	return true
+}
+
+// readCompressed reads count bytes at offset, which are within the
+// file.
+func (ip *Inode) readCompressed(atxn *alloctxn.AllocTxn, offset uint64, count uint64) []byte {
+	data := make([]byte, 0, count)
+	var off = offset
+	for off < offset+count {
+		start := off % CLUSTERSZ
+		n := util.Min(CLUSTERSZ-start, offset+count-off)
+		cluster := ip.readCluster(atxn, off/CLUSTERSZ)
+		data = append(data, cluster[start:start+n]...)
+		off += n
+	}
+	return data
+}
+
+// writeCompressed writes count bytes of data at offset, a cluster at a
+// time.
+func (ip *Inode) writeCompressed(atxn *alloctxn.AllocTxn, offset uint64, count uint64, data []byte) (uint64, bool) {
+	var cnt uint64 = 0
+	for cnt < count {
+		off := offset + cnt
+		start := off % CLUSTERSZ
+		n := util.Min(CLUSTERSZ-start, count-cnt)
+		c := off / CLUSTERSZ
+		cluster := ip.readCluster(atxn, c)
+		copy(cluster[start:start+n], data[cnt:cnt+n])
+		if !ip.writeCluster(atxn, c, cluster) {
+			break
+		}
+		cnt += n
+	}
+	if cnt == 0 && count > 0 {
+		return 0, false
+	}
+	if offset+cnt > ip.Size {
+		ip.Size = offset + cnt
+	}
+	ip.WriteInode(atxn)
+	return cnt, true
+}
+
+// cutCluster stores the cluster in which a file of sz bytes ends as if
+// the file ended there, so that shrinking the file to sz bytes, which
+// frees the blocks past sz, leaves the cluster intact.  It returns
+// false if the disk is full.
+func (ip *Inode) cutCluster(atxn *alloctxn.AllocTxn, sz uint64) bool {
+	c := sz / CLUSTERSZ
+	end := sz % CLUSTERSZ
+	data := ip.readCluster(atxn, c)
+	for i := end; i < CLUSTERSZ; i++ {
+		data[i] = 0
+	}
+	return ip.writeCluster(atxn, c, data[:util.RoundUp(end, disk.BlockSize)*disk.BlockSize])
+}
+
+// shareCompressed implements Share for a compressed source: it makes
+// ip compressed too, and copies src's block map a cluster at a time.
+func (ip *Inode) shareCompressed(atxn *alloctxn.AllocTxn, src *Inode, bn uint64) (uint64, bool) {
+	if !ip.compressed() {
+		ip.Flags = (ip.Flags &^ (INODE_INLINE | INODE_EXTENTS)) | INODE_COMPRESS
+		ip.inline = nil
+		ip.ext = nil
+	}
+	nblk := util.RoundUp(src.Size, disk.BlockSize)
+	var next = bn
+	for next < nblk && atxn.NDirty()+2*NCLUSTER+NINDLEVEL+8 < jrnl.LogBlocks {
+		for i := uint64(0); i < NCLUSTER; i++ {
+			blkno := src.blkLookup(atxn, next+i)
+			if blkno == common.NULLBNUM {
+				continue
+			}
+			if !ip.blkSet(atxn, next+i, blkno, true) {
+				return next, false
+			}
+			atxn.RefBlock(ip.Owner(), physBlock(blkno))
+			ip.Blocks++
+		}
+		next += NCLUSTER
+	}
+	util.DPrintf(5, "Share # %d from # %d: [%d, %d)\n", ip.Inum, src.Inum, bn, next)
+	ip.Size = util.Min(src.Size, next*disk.BlockSize)
+	ip.ShrinkSize = util.RoundUp(ip.Size, disk.BlockSize)
+	ip.WriteInode(atxn)
+	return next, true
+}
@@ -0,0 +1,361 @@
+package inode
+
+import (
+	"fmt"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+)
+
+//
+// Extent-based block mapping.  An inode with INODE_EXTENTS maps its
+// data with a B+-tree of extents keyed by logical block number,
+// instead of with the blks array.  The root node of the tree lives in
+// the inode's map area; the other nodes are blocks.  A leaf node
+// (depth 0) holds extents, each mapping a run of logical blocks to a
+// run of contiguous physical blocks.  An index node holds for each
+// child the first logical block the child maps and the child's block
+// number.  The first entry of an index node may have a smaller
+// logical block than its child's first extent, so that every key at
+// or after it belongs to some child.
+//
+
+const (
+	EXTHDRSZ uint64 = 8  // # entries and depth of a node
+	EXTENTSZ uint64 = 24 // on-disk size of an extent or index entry
+	NEXTROOT uint64 = (MAPSZ - EXTHDRSZ) / EXTENTSZ
+	NEXTBLK  uint64 = (disk.BlockSize - EXTHDRSZ) / EXTENTSZ
+
+	// # blocks Shrink frees per step of an extent inode
+	NEXTSHRINK uint64 = 64
+)
+
+type extent struct {
+	lblk uint64      // first logical block
+	pblk common.Bnum // first physical block, or child in an index node
+	len  uint64      // # blocks, 0 in an index node
+}
+
+func (e extent) end() uint64 {
+	return e.lblk + e.len
+}
+
+type extNode struct {
+	blkno common.Bnum // NULLBNUM for the root
+	depth uint64
+	ents  []extent
+}
+
+func (n *extNode) String() string {
+	return fmt.Sprintf("d %d %v", n.depth, n.ents)
+}
+
+func (n *extNode) capacity() uint64 {
+	if n.blkno == common.NULLBNUM {
+		return NEXTROOT
+	}
+	return NEXTBLK
+}
+
+// find returns the index of the last entry of n at or before logical
+// block bn, or -1 if there is none.
+func (n *extNode) find(bn uint64) int {
+	var i = len(n.ents) - 1
+	for i >= 0 && n.ents[i].lblk > bn {
+		i--
+	}
+	return i
+}
+
+func insertExtent(ents []extent, i int, e extent) []extent {
+	r := make([]extent, 0, len(ents)+1)
+	r = append(r, ents[:i]...)
+	r = append(r, e)
+	return append(r, ents[i:]...)
+}
+
+func encodeExtNode(n *extNode, sz uint64) []byte {
+	enc := marshal.NewEnc(sz)
+	enc.PutInt32(uint32(len(n.ents)))
+	enc.PutInt32(uint32(n.depth))
+	for _, e := range n.ents {
+		enc.PutInt(e.lblk)
+		enc.PutInt(e.pblk)
+		enc.PutInt(e.len)
+	}
+	return enc.Finish()
+}
+
+func decodeExtNode(data []byte, blkno common.Bnum) *extNode {
+	dec := marshal.NewDec(data)
+	nent := uint64(dec.GetInt32())
+	depth := uint64(dec.GetInt32())
+	ents := make([]extent, nent)
+	for i := range ents {
+		ents[i].lblk = dec.GetInt()
+		ents[i].pblk = dec.GetInt()
+		ents[i].len = dec.GetInt()
+	}
+	return &extNode{blkno: blkno, depth: depth, ents: ents}
+}
+
+// UseExtents switches an empty inode to extent-based block mapping.
+func (ip *Inode) UseExtents(atxn *alloctxn.AllocTxn) {
+	if ip.Size != 0 || ip.IsShrinking() {
+		panic("UseExtents")
+	}
+	ip.Flags = ip.Flags | INODE_EXTENTS
+	if !ip.IsInline() { // else the extent tree starts when data spills
+		ip.ext = &extNode{}
+	}
+	ip.cacheExt(extent{})
+	ip.WriteInode(atxn)
+}
+
+// cachedExt returns the extent most recently looked up.
+func (ip *Inode) cachedExt() extent {
+	ip.cacheMu.Lock()
+	e := ip.lastExt
+	ip.cacheMu.Unlock()
+	return e
+}
+
+// cacheExt remembers e as the extent most recently looked up; an empty
+// extent forgets it, which changes to the tree must do.
+func (ip *Inode) cacheExt(e extent) {
+	ip.cacheMu.Lock()
+	ip.lastExt = e
+	ip.cacheMu.Unlock()
+}
+
+func (ip *Inode) readExtNode(atxn *alloctxn.AllocTxn, blkno common.Bnum) *extNode {
+	buf := atxn.ReadBlock(blkno)
+	return decodeExtNode(buf.Data, blkno)
+}
+
+// writeExtNode updates n on disk; the root is written with the inode.
+func (ip *Inode) writeExtNode(atxn *alloctxn.AllocTxn, n *extNode) {
+	if n.blkno == common.NULLBNUM {
+		ip.ext = n
+		return
+	}
+	buf := atxn.ReadBlock(n.blkno)
+	copy(buf.Data, encodeExtNode(n, disk.BlockSize))
+	buf.SetDirty()
+}
+
+// extLookup maps logical block bn to a physical block, or NULLBNUM
+// if bn is in a hole.  It also returns the number of blocks from bn to
+// the end of its extent or hole, and, for a hole, the physical block
+// that would continue the preceding extent, which is a good place to
+// allocate bn.
+func (ip *Inode) extLookup(atxn *alloctxn.AllocTxn, bn uint64) (common.Bnum, uint64, common.Bnum) {
+	e := ip.cachedExt()
+	if e.len > 0 && bn >= e.lblk && bn < e.end() {
+		return e.pblk + (bn - e.lblk), e.end() - bn, common.NULLBNUM
+	}
+	var n = ip.ext
+	var limit = MaxFileSize() / disk.BlockSize
+	for {
+		i := n.find(bn)
+		if i+1 < len(n.ents) && n.ents[i+1].lblk < limit {
+			limit = n.ents[i+1].lblk
+		}
+		if i < 0 {
+			return common.NULLBNUM, limit - bn, common.NULLBNUM
+		}
+		if n.depth == 0 {
+			e := n.ents[i]
+			if bn < e.end() {
+				ip.cacheExt(e)
+				return e.pblk + (bn - e.lblk), e.end() - bn, common.NULLBNUM
+			}
+			return common.NULLBNUM, limit - bn, e.pblk + (bn - e.lblk)
+		}
+		n = ip.readExtNode(atxn, n.ents[i].pblk)
+	}
+}
+
+// extSplits returns the number of node blocks inserting an extent at
+// bn may allocate: one for each full node on the path to its leaf.
+func (ip *Inode) extSplits(atxn *alloctxn.AllocTxn, bn uint64) uint64 {
+	var need uint64 = 0
+	var n = ip.ext
+	for {
+		if uint64(len(n.ents)) >= n.capacity() {
+			need++
+		}
+		if n.depth == 0 {
+			break
+		}
+		var i = n.find(bn)
+		if i < 0 {
+			i = 0
+		}
+		n = ip.readExtNode(atxn, n.ents[i].pblk)
+	}
+	return need
+}
+
+// extSplit splits the overfull node n using a block from spare.  A
+// split root moves its entries into a new child, and becomes an index
+// node one level deeper.  Otherwise, it returns the new right sibling
+// of n, which the caller adds to n's parent.
+func (ip *Inode) extSplit(atxn *alloctxn.AllocTxn, n *extNode, spare *[]common.Bnum) *extNode {
+	blkno := (*spare)[0]
+	*spare = (*spare)[1:]
+	if n.blkno == common.NULLBNUM {
+		child := &extNode{blkno: blkno, depth: n.depth, ents: n.ents}
+		ip.writeExtNode(atxn, child)
+		ip.ext = &extNode{
+			blkno: common.NULLBNUM,
+			depth: n.depth + 1,
+			ents:  []extent{{lblk: child.ents[0].lblk, pblk: blkno}},
+		}
+		return nil
+	}
+	half := len(n.ents) / 2
+	right := &extNode{blkno: blkno, depth: n.depth}
+	right.ents = append([]extent{}, n.ents[half:]...)
+	n.ents = append([]extent{}, n.ents[:half]...)
+	ip.writeExtNode(atxn, n)
+	ip.writeExtNode(atxn, right)
+	return right
+}
+
+// extInsert inserts e into the subtree rooted at n, merging it with
+// the preceding extent if they are contiguous.  If n overflows, it is
+// split and extInsert returns n's new right sibling.
+func (ip *Inode) extInsert(atxn *alloctxn.AllocTxn, n *extNode, e extent, spare *[]common.Bnum) *extNode {
+	var i = n.find(e.lblk)
+	if n.depth == 0 {
+		if i >= 0 && n.ents[i].end() == e.lblk &&
+			n.ents[i].pblk+n.ents[i].len == e.pblk {
+			n.ents[i].len += e.len
+			ip.writeExtNode(atxn, n)
+			return nil
+		}
+		n.ents = insertExtent(n.ents, i+1, e)
+	} else {
+		if i < 0 {
+			i = 0
+			n.ents[0].lblk = e.lblk
+		}
+		child := ip.readExtNode(atxn, n.ents[i].pblk)
+		right := ip.extInsert(atxn, child, e, spare)
+		if right != nil {
+			n.ents = insertExtent(n.ents, i+1,
+				extent{lblk: right.ents[0].lblk, pblk: right.blkno})
+		}
+	}
+	if uint64(len(n.ents)) > n.capacity() {
+		return ip.extSplit(atxn, n, spare)
+	}
+	ip.writeExtNode(atxn, n)
+	return nil
+}
+
+// extBmap maps logical block bn, allocating a run of up to want blocks
+// if bn is in a hole.  It returns NULLBNUM if the disk is full.
+func (ip *Inode) extBmap(atxn *alloctxn.AllocTxn, bn uint64, want uint64) (common.Bnum, bool) {
+	blkno, n, goal := ip.extLookup(atxn, bn)
+	if blkno != common.NULLBNUM {
+		return blkno, false
+	}
+	var cnt = util.Min(want, n)
+	if cnt == 0 {
+		cnt = 1
+	}
+
+	// allocate blocks for the nodes that may split before changing
+	// the tree, so that a full disk leaves it untouched.
+	if goal == common.NULLBNUM {
+		goal = ip.allocGoal(atxn)
+	}
+	need := ip.extSplits(atxn, bn)
+	var spare = make([]common.Bnum, 0, need)
+	for uint64(len(spare)) < need {
+		b := atxn.AllocBlock(ip.Owner(), goal)
+		if b == common.NULLBNUM {
+			break
+		}
+		spare = append(spare, b)
+	}
+	var start = common.NULLBNUM
+	if uint64(len(spare)) == need {
+		start, cnt = atxn.AllocBlocks(ip.Owner(), goal, cnt)
+	}
+	if start == common.NULLBNUM {
+		for _, b := range spare {
+			atxn.UnallocBlock(ip.Owner(), b)
+		}
+		return common.NULLBNUM, false
+	}
+
+	util.DPrintf(5, "extBmap # %d: %d -> [%d, %d)\n", ip.Inum, bn, start, start+cnt)
+	ip.cacheExt(extent{})
+	ip.lastBlk = start + cnt - 1
+	ip.extInsert(atxn, ip.ext, extent{lblk: bn, pblk: start, len: cnt}, &spare)
+	ip.Blocks += cnt
+	for _, b := range spare {
+		atxn.UnallocBlock(ip.Owner(), b)
+	}
+	return start, true
+}
+
+// extShrink frees up to max blocks at the end of the last extent that
+// extend past logical block target.  It returns the end of the
+// remaining blocks, or target if none remain past it.
+func (ip *Inode) extShrink(atxn *alloctxn.AllocTxn, target uint64, max uint64) uint64 {
+	ip.cacheExt(extent{})
+	var path = []*extNode{ip.ext}
+	for path[len(path)-1].depth > 0 {
+		n := path[len(path)-1]
+		path = append(path, ip.readExtNode(atxn, n.ents[len(n.ents)-1].pblk))
+	}
+	leaf := path[len(path)-1]
+	if len(leaf.ents) == 0 {
+		return target
+	}
+	e := &leaf.ents[len(leaf.ents)-1]
+	if e.end() <= target {
+		return target
+	}
+	var lo = e.lblk
+	if target > lo {
+		lo = target
+	}
+	nfree := util.Min(e.end()-lo, max)
+	for k := uint64(0); k < nfree; k++ {
+		atxn.FreeBlock(ip.Owner(), e.pblk+e.len-1-k)
+	}
+	e.len -= nfree
+	ip.Blocks -= nfree
+	var end = e.end()
+	if e.len == 0 {
+		end = e.lblk
+		leaf.ents = leaf.ents[:len(leaf.ents)-1]
+	}
+
+	// free nodes that became empty, bottom up
+	var level = len(path) - 1
+	for level > 0 && len(path[level].ents) == 0 {
+		atxn.FreeBlock(ip.Owner(), path[level].blkno)
+		parent := path[level-1]
+		parent.ents = parent.ents[:len(parent.ents)-1]
+		level--
+	}
+	if len(path[0].ents) == 0 {
+		ip.ext = &extNode{}
+	} else {
+		ip.writeExtNode(atxn, path[level])
+	}
+	if end < target {
+		return target
+	}
+	return end
+}
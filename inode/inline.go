@@ -0,0 +1,107 @@
+package inode
+
+import (
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// Inline data. A new file or symlink keeps its data in the inode
+// itself, in the space that otherwise maps its blocks and the unused
+// space after it, so that small files and symlinks need no data block.
+// Bytes of the inline area past Size are always zero. When a write or
+// resize makes the data outgrow the inline area, the data moves to a
+// block ("spills") and the inode maps blocks from then on.
+//
+
+// # bytes of the on-disk inode before the block map: kind, nlink,
+// gen, size, shrink size, atime, mtime, flags, xattr block, uid, and
+// gid
+const INODEHDRSZ uint64 = 4 + 4 + 8 + 8 + 8 + 4*4 + 8 + 8 + 4 + 4
+
+// INLINESZ is the most data an inode holds inline: the space between
+// the header and the inode's checksum.
+const INLINESZ uint64 = super.INODESZ - INODEHDRSZ - super.CSUMSZ
+
+// IsInline reports whether ip's data is stored inline.
+func (ip *Inode) IsInline() bool {
+	return ip.Flags&INODE_INLINE != 0
+}
+
+func (ip *Inode) initInline() {
+	ip.Flags = ip.Flags | INODE_INLINE
+	ip.inline = make([]byte, INLINESZ)
+}
+
+func (ip *Inode) readInline(offset uint64, count uint64) []byte {
+	data := make([]byte, count)
+	copy(data, ip.inline[offset:offset+count])
+	return data
+}
+
+func (ip *Inode) writeInline(atxn *alloctxn.AllocTxn, offset uint64, count uint64, data []byte) (uint64, bool) {
+	copy(ip.inline[offset:], data[:count])
+	if offset+count > ip.Size {
+		ip.Size = offset + count
+	}
+	ip.WriteInode(atxn)
+	return count, true
+}
+
+// spill moves ip's inline data to a block, and switches ip to mapping
+// blocks. It returns false, leaving ip inline, if there is no free
+// block.
+func (ip *Inode) spill(atxn *alloctxn.AllocTxn) bool {
+	util.DPrintf(5, "spill # %d: %d bytes\n", ip.Inum, ip.Size)
+	inline := ip.inline
+	ip.Flags = ip.Flags & ^INODE_INLINE
+	ip.inline = nil
+	if ip.Flags&INODE_EXTENTS != 0 {
+		ip.ext = &extNode{}
+		ip.cacheExt(extent{})
+	}
+	if ip.Size > 0 {
+		blkno, _ := ip.bmap(atxn, 0, 1)
+		if blkno == common.NULLBNUM {
+			ip.Flags = ip.Flags | INODE_INLINE
+			ip.inline = inline
+			ip.ext = nil
+			return false
+		}
+		blk := make(disk.Block, disk.BlockSize)
+		copy(blk, inline[:ip.Size])
+		atxn.WriteBlock(blkno, blk)
+	}
+	ip.WriteInode(atxn)
+	return true
+}
+
+// PrepareSize makes room for ip to grow to sz bytes, moving its inline
+// data to a block if sz doesn't fit inline, and prepares a compressed
+// file to shrink to sz bytes. It returns false if there is no free
+// block for the data.
+func (ip *Inode) PrepareSize(atxn *alloctxn.AllocTxn, sz uint64) bool {
+	if ip.IsInline() {
+		if sz <= INLINESZ {
+			return true
+		}
+		return ip.spill(atxn)
+	}
+	if ip.compressed() && sz < ip.Size && sz%CLUSTERSZ != 0 {
+		return ip.cutCluster(atxn, sz)
+	}
+	return true
+}
+
+func (ip *Inode) resizeInline(atxn *alloctxn.AllocTxn, sz uint64) {
+	for i := sz; i < ip.Size; i++ {
+		ip.inline[i] = 0
+	}
+	ip.Size = sz
+	ip.ShrinkSize = 0
+	ip.WriteInode(atxn)
+}
@@ -2,6 +2,7 @@ package inode
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/goose-lang/primitive/disk"
@@ -10,22 +11,41 @@ import (
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
 	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/dcache"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
 )
 
 const NF3FREE nfstypes.Ftype3 = 0
 
+// The last NINDLEVEL entries of an inode's blks array are the roots of
+// indirect trees of depth 1 (INDIRECT) through NINDLEVEL. With 4 KiB
+// blocks, the quadruple-indirect tree alone maps 256 TiB.
 const (
-	NBLKINO   uint64 = 10 // # blk in an inode's blks array
-	NDIRECT   uint64 = NBLKINO - 2
-	INDIRECT  uint64 = NBLKINO - 2
-	DINDIRECT uint64 = NBLKINO - 1
+	NBLKINO   uint64 = 10                 // # blk in an inode's blks array
+	NINDLEVEL uint64 = 4                  // # levels of indirection
 	NBLKBLK   uint64 = disk.BlockSize / 8 // # blkno per block
-	NINDLEVEL uint64 = 2                  // # levels of indirection
+	NDIRECT   uint64 = NBLKINO - NINDLEVEL
+	INDIRECT  uint64 = NDIRECT
+	DINDIRECT uint64 = NDIRECT + 1
+	TINDIRECT uint64 = NDIRECT + 2
+	QINDIRECT uint64 = NDIRECT + 3
 )
 
+// Inode flags
+const (
+	INODE_EXTENTS  uint64 = 1 << 0 // data is mapped by an extent tree
+	INODE_INLINE   uint64 = 1 << 1 // data is stored in the inode
+	INODE_RDONLY   uint64 = 1 << 2 // inode belongs to a snapshot
+	INODE_COMPRESS uint64 = 1 << 3 // data is stored in compressed clusters
+)
+
+// MAPSZ is the size of the area of the on-disk inode that maps the
+// inode's data: either the blks array or the root of an extent tree.
+const MAPSZ uint64 = 128
+
 // Inode represents an on-disk inode with some in-memory metadata.
 type Inode struct {
 	// in-memory info:
@@ -42,9 +62,24 @@ type Inode struct {
 	// of shrinking to Size. ShrinkSize is in block units
 	ShrinkSize uint64
 
-	Atime nfstypes.Nfstime3
-	Mtime nfstypes.Nfstime3
-	blks  []common.Bnum
+	Atime  nfstypes.Nfstime3
+	Mtime  nfstypes.Nfstime3
+	Flags  uint64
+	Xattr  common.Bnum // block holding the extended attributes, or 0
+	Uid    uint32      // owner, whose quotas count the inode and its blocks
+	Gid    uint32
+	blks   []common.Bnum
+	ext    *extNode // root of the extent tree, if Flags has INODE_EXTENTS
+	inline []byte   // INLINESZ bytes of data, if Flags has INODE_INLINE
+	Blocks uint64   // # data blocks
+
+	// in-memory: guards Dcache and lastExt, which transactions that
+	// hold the inode's lock shared may update together
+	cacheMu *sync.Mutex
+	// in-memory: the extent most recently looked up
+	lastExt extent
+	// in-memory: the block most recently mapped, to allocate near
+	lastBlk common.Bnum
 }
 
 func NfstimeNow() nfstypes.Nfstime3 {
@@ -56,24 +91,71 @@ func NfstimeNow() nfstypes.Nfstime3 {
 	return t
 }
 
-func (ip *Inode) InitInode(inum common.Inum, kind nfstypes.Ftype3) {
+func (ip *Inode) InitInode(inum common.Inum, kind nfstypes.Ftype3, owner alloc.Owner) {
 	util.DPrintf(1, "initInode: inode # %d\n", inum)
 	ip.Inum = inum
 	ip.Kind = kind
+	ip.Uid = owner.Uid
+	ip.Gid = owner.Gid
+	ip.Dcache = nil
+	ip.Flags = 0
+	ip.Xattr = common.NULLBNUM
+	ip.ext = nil
+	ip.inline = nil
+	ip.Blocks = 0
+	if ip.blks == nil {
+		ip.blks = make([]common.Bnum, NBLKINO)
+	}
+	if kind == nfstypes.NF3REG || kind == nfstypes.NF3LNK {
+		ip.initInline()
+	}
+	ip.cacheExt(extent{})
+	ip.lastBlk = common.NULLBNUM
 	ip.Nlink = 1
 	ip.Gen = ip.Gen + 1
 	ip.Atime = NfstimeNow()
 	ip.Mtime = NfstimeNow()
 }
 
+// DirCache returns the directory's cache of names.
+func (ip *Inode) DirCache() *dcache.Dcache {
+	ip.cacheMu.Lock()
+	if ip.Dcache == nil {
+		ip.Dcache = dcache.MkDcache()
+	}
+	dc := ip.Dcache
+	ip.cacheMu.Unlock()
+	return dc
+}
+
 func MkRootInode() *Inode {
 	ip := new(Inode)
+	ip.cacheMu = new(sync.Mutex)
 	ip.blks = make([]common.Bnum, NBLKINO)
-	ip.InitInode(common.ROOTINUM, nfstypes.NF3DIR)
+	ip.InitInode(common.ROOTINUM, nfstypes.NF3DIR, alloc.Owner{Uid: 0, Gid: 0})
 	return ip
 }
 
+// Owner returns the user and group whose quotas count ip.
+func (ip *Inode) Owner() alloc.Owner {
+	return alloc.Owner{Uid: ip.Uid, Gid: ip.Gid}
+}
+
+// Chown gives ip to owner, and moves the charges for ip and its blocks
+// from the old owner's quotas to owner's.
+func (ip *Inode) Chown(atxn *alloctxn.AllocTxn, owner alloc.Owner) {
+	n := int64(ip.CountBlocks(atxn))
+	atxn.Charge(ip.Owner(), -n, -1)
+	ip.Uid = owner.Uid
+	ip.Gid = owner.Gid
+	atxn.Charge(owner, n, 1)
+	ip.WriteInode(atxn)
+}
+
 func (ip *Inode) String() string {
+	if ip.Flags&INODE_EXTENTS != 0 {
+		return fmt.Sprintf("# %d k %d n %d g %d sz %d ssz %d ext %v", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Size, ip.ShrinkSize, ip.ext)
+	}
 	return fmt.Sprintf("# %d k %d n %d g %d sz %d ssz %d %v", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Size, ip.ShrinkSize, ip.blks)
 }
 
@@ -82,10 +164,10 @@ func (ip *Inode) MkFattr() nfstypes.Fattr3 {
 		Ftype: ip.Kind,
 		Mode:  0777,
 		Nlink: 1,
-		Uid:   nfstypes.Uid3(0),
-		Gid:   nfstypes.Gid3(0),
+		Uid:   nfstypes.Uid3(ip.Uid),
+		Gid:   nfstypes.Gid3(ip.Gid),
 		Size:  nfstypes.Size3(ip.Size),
-		Used:  nfstypes.Size3(ip.Size),
+		Used:  nfstypes.Size3(ip.used()),
 		Rdev: nfstypes.Specdata3{Specdata1: nfstypes.Uint32(0),
 			Specdata2: nfstypes.Uint32(0)},
 		Fsid:   nfstypes.Uint64(0),
@@ -97,8 +179,26 @@ func (ip *Inode) MkFattr() nfstypes.Fattr3 {
 	}
 }
 
+// used returns the # bytes of disk space ip's data takes.  A sparse
+// file's holes take none.
+func (ip *Inode) used() uint64 {
+	if ip.IsInline() {
+		return ip.Size
+	}
+	return ip.Blocks * disk.BlockSize
+}
+
+func (ip *Inode) encodeMap() []byte {
+	if ip.Flags&INODE_EXTENTS != 0 {
+		return encodeExtNode(ip.ext, MAPSZ)
+	}
+	enc := marshal.NewEnc(MAPSZ)
+	enc.PutInts(ip.blks)
+	return enc.Finish()
+}
+
 func (ip *Inode) Encode() []byte {
-	enc := marshal.NewEnc(common.INODESZ)
+	enc := marshal.NewEnc(super.INODESZ)
 	enc.PutInt32(uint32(ip.Kind))
 	enc.PutInt32(ip.Nlink)
 	enc.PutInt(ip.Gen)
@@ -108,12 +208,24 @@ func (ip *Inode) Encode() []byte {
 	enc.PutInt32(uint32(ip.Atime.Nseconds))
 	enc.PutInt32(uint32(ip.Mtime.Seconds))
 	enc.PutInt32(uint32(ip.Mtime.Nseconds))
-	enc.PutInts(ip.blks)
-	return enc.Finish()
+	enc.PutInt(ip.Flags)
+	enc.PutInt(ip.Xattr)
+	enc.PutInt32(ip.Uid)
+	enc.PutInt32(ip.Gid)
+	if ip.IsInline() {
+		enc.PutBytes(ip.inline)
+	} else {
+		enc.PutBytes(ip.encodeMap())
+		enc.PutInt(ip.Blocks)
+	}
+	d := enc.Finish()
+	super.SealInode(d)
+	return d
 }
 
 func Decode(buf *buf.Buf, inum common.Inum) *Inode {
 	ip := new(Inode)
+	ip.cacheMu = new(sync.Mutex)
 	dec := marshal.NewDec(buf.Data)
 	ip.Inum = inum
 	ip.Kind = nfstypes.Ftype3(dec.GetInt32())
@@ -125,24 +237,66 @@ func Decode(buf *buf.Buf, inum common.Inum) *Inode {
 	ip.Atime.Nseconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Mtime.Seconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Mtime.Nseconds = nfstypes.Uint32(dec.GetInt32())
-	ip.blks = dec.GetInts(NBLKINO)
+	ip.Flags = dec.GetInt()
+	ip.Xattr = dec.GetInt()
+	ip.Uid = dec.GetInt32()
+	ip.Gid = dec.GetInt32()
+	if ip.Flags&INODE_INLINE != 0 {
+		ip.inline = make([]byte, INLINESZ)
+		copy(ip.inline, dec.GetBytes(INLINESZ))
+		ip.blks = make([]common.Bnum, NBLKINO)
+		return ip
+	}
+	m := dec.GetBytes(MAPSZ)
+	if ip.Flags&INODE_EXTENTS != 0 {
+		ip.ext = decodeExtNode(m, common.NULLBNUM)
+	} else {
+		ip.blks = marshal.NewDec(m).GetInts(NBLKINO)
+	}
+	ip.Blocks = dec.GetInt()
 	return ip
 }
 
+// pow returns the number of blocks mapped by an indirect tree of
+// depth level.
 func pow(level uint64) uint64 {
-	if level == 0 {
-		return 1
-	}
-	var p uint64 = NBLKBLK
-	for i := uint64(1); i < level; i++ {
-		p = p * p
+	var p uint64 = 1
+	for i := uint64(0); i < level; i++ {
+		p = p * NBLKBLK
 	}
 	return p
 }
 
+// indRoot returns the index in blks of the root of the tree of depth
+// level.
+func indRoot(level uint64) uint64 {
+	return NDIRECT + level - 1
+}
+
+// levelStart returns the first logical block mapped by the tree of
+// depth level.
+func levelStart(level uint64) uint64 {
+	var bn = NDIRECT
+	for l := uint64(1); l < level; l++ {
+		bn += pow(l)
+	}
+	return bn
+}
+
+// indLevel returns the depth of the indirect tree that maps logical
+// block bn (which must be >= NDIRECT) and bn's offset in that tree.
+func indLevel(bn uint64) (uint64, uint64) {
+	var level uint64 = 1
+	var off = bn - NDIRECT
+	for level < NINDLEVEL && off >= pow(level) {
+		off -= pow(level)
+		level++
+	}
+	return level, off
+}
+
 func MaxFileSize() uint64 {
-	maxblks := pow(NINDLEVEL)
-	return (NDIRECT + maxblks) * disk.BlockSize
+	return levelStart(NINDLEVEL+1) * disk.BlockSize
 }
 
 func (ip *Inode) WriteInode(atxn *alloctxn.AllocTxn) {
@@ -150,11 +304,20 @@ func (ip *Inode) WriteInode(atxn *alloctxn.AllocTxn) {
 		panic("WriteInode")
 	}
 	d := ip.Encode()
-	atxn.Op.OverWrite(atxn.Super.Inum2Addr(ip.Inum), common.INODESZ*8, d)
+	atxn.Op.OverWrite(atxn.Super.Inum2Addr(ip.Inum), super.INODESZ*8, d)
+	atxn.InodeWritten(ip.Inum)
 	util.DPrintf(1, "WriteInode %v\n", ip)
 }
 
+// FreeInode frees ip, and its extended attribute block.  The caller
+// must have resized ip to 0, which frees its data blocks.  ip keeps its
+// owner, whose quotas the shrinker credits with the blocks it frees.
 func (ip *Inode) FreeInode(atxn *alloctxn.AllocTxn) {
+	if ip.Xattr != common.NULLBNUM {
+		atxn.FreeBlock(ip.Owner(), ip.Xattr)
+		ip.Xattr = common.NULLBNUM
+	}
+	atxn.Charge(ip.Owner(), 0, -1)
 	ip.Kind = NF3FREE
 	ip.Gen = ip.Gen + 1
 	ip.WriteInode(atxn)
@@ -166,6 +329,13 @@ func (ip *Inode) FreeInode(atxn *alloctxn.AllocTxn) {
 // transaction, if shrinking involves freeing many blocks.  ShrinkSize
 // tracks shrinking progress, and is initialized with the old size.
 func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
+	if ip.IsInline() {
+		if sz > INLINESZ {
+			panic("Resize: inline") // caller must PrepareSize
+		}
+		ip.resizeInline(atxn, sz)
+		return false
+	}
 	var newSz = sz
 	var doshrink = false
 	oldsz := util.RoundUp(ip.Size, disk.BlockSize)
@@ -195,10 +365,14 @@ func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
 func (ip *Inode) indbmap(atxn *alloctxn.AllocTxn, root_ common.Bnum, level uint64, off uint64) (common.Bnum, common.Bnum) {
 	var root = root_
 	if root == common.NULLBNUM { // no root?
-		root = atxn.AllocBlock()
+		root = atxn.AllocBlock(ip.Owner(), ip.allocGoal(atxn))
 		if root == common.NULLBNUM {
 			return root, root
 		}
+		ip.lastBlk = root
+		if level == 0 {
+			ip.Blocks++
+		}
 	}
 	if level == 0 { // leaf?
 		return root, root
@@ -221,41 +395,48 @@ func (ip *Inode) indbmap(atxn *alloctxn.AllocTxn, root_ common.Bnum, level uint6
 	return blkno, root
 }
 
+// allocGoal returns the block to allocate ip's next block near: after
+// the block it mapped last, or else in its inode group's part of the
+// disk.
+func (ip *Inode) allocGoal(atxn *alloctxn.AllocTxn) common.Bnum {
+	if ip.lastBlk != common.NULLBNUM {
+		return ip.lastBlk + 1
+	}
+	return atxn.Super.InodeGoal(ip.Inum)
+}
+
 // Map logical block number bn to a physical block number, allocating
-// blocks if no block exists for bn.
-func (ip *Inode) bmap(atxn *alloctxn.AllocTxn, bn uint64) (common.Bnum, bool) {
+// blocks if no block exists for bn.  want is the number of blocks
+// starting at bn that the caller is about to access, which an extent
+// inode allocates as one run.
+func (ip *Inode) bmap(atxn *alloctxn.AllocTxn, bn uint64, want uint64) (common.Bnum, bool) {
 	var blkno = common.NULLBNUM
 	var alloc = false
+	if ip.Flags&INODE_EXTENTS != 0 {
+		return ip.extBmap(atxn, bn, want)
+	}
 	if bn < NDIRECT {
 		if ip.blks[bn] == common.NULLBNUM {
-			ip.blks[bn] = atxn.AllocBlock()
+			ip.blks[bn] = atxn.AllocBlock(ip.Owner(), ip.allocGoal(atxn))
 			if ip.blks[bn] != common.NULLBNUM {
 				alloc = true
+				ip.Blocks++
 			}
 		}
 		blkno = ip.blks[bn]
 	} else {
-		var off = bn - NDIRECT
-		var root = common.NULLBNUM
-		if off < NBLKBLK {
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[INDIRECT], 1, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[INDIRECT] = root
-			}
-		} else {
-			off -= NBLKBLK
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[DINDIRECT], 2, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[DINDIRECT] = root
-			}
+		level, off := indLevel(bn)
+		root := ip.blks[indRoot(level)]
+		newBlkno, newRoot := ip.indbmap(atxn, root, level, off)
+		blkno = newBlkno
+		alloc = newRoot != root
+		if alloc {
+			ip.blks[indRoot(level)] = newRoot
 		}
 	}
+	if blkno != common.NULLBNUM {
+		ip.lastBlk = blkno
+	}
 	return blkno, alloc
 }
 
@@ -272,22 +453,23 @@ func (ip *Inode) Read(atxn *alloctxn.AllocTxn, offset uint64, bytesToRead uint64
 		count = ip.Size - offset
 	}
 	util.DPrintf(5, "Read: off %d cnt %d\n", offset, count)
+	if ip.IsInline() {
+		return ip.readInline(offset, count), false
+	}
+	if ip.compressed() {
+		return ip.readCompressed(atxn, offset, count), false
+	}
 	var data = make([]byte, 0)
 	var off = offset
 	for boff := off / disk.BlockSize; n < count; boff++ {
 		byteoff := off % disk.BlockSize
 		nbytes := util.Min(disk.BlockSize-byteoff, count-n)
-		blkno, alloc := ip.bmap(atxn, boff)
-		if blkno == common.NULLBNUM {
-			break
-		}
-		if alloc { // fill in a hole
-			ip.WriteInode(atxn)
-		}
-		buf := atxn.ReadBlock(blkno)
-
-		for b := uint64(0); b < nbytes; b++ {
-			data = append(data, buf.Data[byteoff+b])
+		blkno, _ := ip.lookupRun(atxn, boff, 1)
+		if blkno == common.NULLBNUM { // a hole reads as zeros
+			data = append(data, make([]byte, nbytes)...)
+		} else {
+			buf := atxn.ReadBlock(blkno)
+			data = append(data, buf.Data[byteoff:byteoff+nbytes]...)
 		}
 		n += nbytes
 		off += nbytes
@@ -310,9 +492,21 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 	if offset+count > MaxFileSize() {
 		return 0, false
 	}
+	if ip.IsInline() {
+		if offset+count <= INLINESZ {
+			return ip.writeInline(atxn, offset, count, data)
+		}
+		if !ip.spill(atxn) {
+			return 0, false
+		}
+	}
+	if ip.compressed() {
+		return ip.writeCompressed(atxn, offset, count, data)
+	}
 	for boff := off / disk.BlockSize; n > uint64(0); boff++ {
-		blkno, new := ip.bmap(atxn, boff)
-		if blkno == common.NULLBNUM {
+		want := util.RoundUp(off%disk.BlockSize+n, disk.BlockSize)
+		blkno0, new := ip.bmap(atxn, boff, want)
+		if blkno0 == common.NULLBNUM {
 			ok = false
 			break
 		}
@@ -324,9 +518,17 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 		if n < nbytes {
 			nbytes = n
 		}
+		var blkno = blkno0
+		if atxn.Shared(blkno) {
+			blkno = ip.unshare(atxn, boff, blkno, nbytes < disk.BlockSize)
+			if blkno == common.NULLBNUM {
+				ok = false
+				break
+			}
+			alloc = true
+		}
 		if byteoff == 0 && nbytes == disk.BlockSize { // block overwrite?
-			addr := atxn.Super.Block2addr(blkno)
-			atxn.Op.OverWrite(addr, common.NBITBLOCK, data[0:nbytes])
+			atxn.WriteData(blkno, data[0:nbytes])
 		} else {
 			buffer := atxn.ReadBlock(blkno)
 			for b := uint64(0); b < nbytes; b++ {
@@ -350,6 +552,57 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 	return cnt, ok
 }
 
+// WriteBlocks returns about how many blocks Write(offset, count)
+// allocates, for the caller to reserve up front: one for each hole and
+// shared block in the range, and index blocks to map them.  For an
+// inline file that spills, or a compressed one, it counts every block
+// of the clusters in the range.
+func (ip *Inode) WriteBlocks(atxn *alloctxn.AllocTxn, offset uint64, count uint64) uint64 {
+	if count == 0 || (ip.IsInline() && offset+count <= INLINESZ) {
+		return 0
+	}
+	var start = offset / disk.BlockSize
+	var end = util.RoundUp(offset+count, disk.BlockSize)
+	var need uint64 = 0
+	if ip.IsInline() || ip.compressed() {
+		start = start / NCLUSTER * NCLUSTER
+		end = util.RoundUp(end, NCLUSTER) * NCLUSTER
+		need = end - start
+	} else {
+		for bn := start; bn < end; {
+			blkno, n := ip.lookupRun(atxn, bn, end-bn)
+			for i := uint64(0); i < n; i++ {
+				if blkno == common.NULLBNUM || atxn.Shared(blkno+i) {
+					need++
+				}
+			}
+			bn += n
+		}
+	}
+	if need == 0 {
+		return 0
+	}
+	return need + need/NBLKBLK + NINDLEVEL
+}
+
+// ReadOnly reports whether ip belongs to a snapshot, or is a clone
+// that is not complete yet, which clients may not change.
+func (ip *Inode) ReadOnly() bool {
+	return ip.Flags&INODE_RDONLY != 0
+}
+
+// SetReadOnly marks ip as belonging to a snapshot.
+func (ip *Inode) SetReadOnly(atxn *alloctxn.AllocTxn) {
+	ip.Flags = ip.Flags | INODE_RDONLY
+	ip.WriteInode(atxn)
+}
+
+// ClearReadOnly makes a completed clone writable.
+func (ip *Inode) ClearReadOnly(atxn *alloctxn.AllocTxn) {
+	ip.Flags = ip.Flags &^ INODE_RDONLY
+	ip.WriteInode(atxn)
+}
+
 func (ip *Inode) DecLink(atxn *alloctxn.AllocTxn) bool {
 	ip.Nlink = ip.Nlink - 1
 	ip.WriteInode(atxn)
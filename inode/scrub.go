@@ -0,0 +1,304 @@
+package inode
+
+import (
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Scrubbing.  The scrubber checks an inode's fields, and visits the
+// blocks that the inode refers to, NSCRUB logical blocks per step, so
+// that it holds the inode's lock only briefly.  A step visits an
+// index block or extent tree node in the step that reaches the first
+// logical block the node maps, so that it visits each block once.  A
+// step starts at the first logical block from where the last one
+// stopped that a block or node maps, so that holes cost nothing, and
+// it looks for that block only in the index blocks and extent tree
+// nodes that earlier steps visited, skipping the subtrees that don't
+// exist.
+//
+
+// # logical blocks Scrub walks per step
+const NSCRUB uint64 = 64
+
+// Check returns a description of an inconsistency in ip's fields, or
+// "" if it finds none.
+func (ip *Inode) Check() string {
+	if ip.Kind > nfstypes.NF3FIFO {
+		return "bad file type"
+	}
+	if ip.Kind == NF3FREE {
+		return ""
+	}
+	if ip.Nlink == 0 {
+		return "no links"
+	}
+	if ip.Size > MaxFileSize() {
+		return "size too large"
+	}
+	if ip.IsInline() && ip.Size > INLINESZ {
+		return "inline data too large"
+	}
+	if ip.compressed() && ip.Flags&INODE_EXTENTS != 0 {
+		return "compressed file with extents"
+	}
+	if ip.ShrinkSize > MaxFileSize()/disk.BlockSize {
+		return "bad shrink size"
+	}
+	return ""
+}
+
+// validBlock reports whether blkno is in the data area.
+func validBlock(atxn *alloctxn.AllocTxn, blkno common.Bnum) bool {
+	return blkno >= atxn.Super.DataStart() && blkno < atxn.Super.MaxBnum()
+}
+
+// Scrub calls visit for the blocks that map ip's logical blocks from
+// bn on, for up to NSCRUB blocks, and for the extended attribute block
+// in the first step.  visit reports whether the block is fit to read;
+// Scrub doesn't read an index block or extent tree node that isn't.
+// Scrub returns the logical block at which to continue, or 0 if it
+// visited the last block.
+func (ip *Inode) Scrub(atxn *alloctxn.AllocTxn, bn uint64, visit func(common.Bnum) bool) uint64 {
+	if bn == 0 && ip.Xattr != common.NULLBNUM {
+		visit(ip.Xattr)
+	}
+	if ip.IsInline() {
+		return 0
+	}
+	nblk := ip.scrubEnd()
+	var next uint64
+	if ip.Flags&INODE_EXTENTS != 0 {
+		next = ip.extNext(atxn, ip.ext, 0, ^uint64(0), bn)
+	} else {
+		next = ip.blkNext(atxn, bn)
+	}
+	if next >= nblk {
+		return 0
+	}
+	hi := util.Min(next+NSCRUB, nblk)
+	ip.scrubRange(atxn, bn, hi, visit)
+	if hi >= nblk {
+		return 0
+	}
+	return hi
+}
+
+// blkNext returns the first logical block from bn on that a block of
+// the blks array maps, or at which an index block starts, or ^0 if
+// there is none.  It reads only index blocks that start before bn.
+func (ip *Inode) blkNext(atxn *alloctxn.AllocTxn, bn uint64) uint64 {
+	for b := bn; b < NDIRECT; b++ {
+		if ip.blks[b] != common.NULLBNUM {
+			return b
+		}
+	}
+	for level := uint64(1); level <= NINDLEVEL; level++ {
+		start := levelStart(level)
+		if start+pow(level) <= bn {
+			continue
+		}
+		if n, ok := ip.indNext(atxn, ip.blks[indRoot(level)], level, start, bn); ok {
+			return n
+		}
+	}
+	return ^uint64(0)
+}
+
+// indNext returns the first logical block from bn on that the tree of
+// depth level rooted at root, which maps logical blocks from start on,
+// maps or has a node start at.
+func (ip *Inode) indNext(atxn *alloctxn.AllocTxn, root common.Bnum, level uint64, start uint64, bn uint64) (uint64, bool) {
+	if root == common.NULLBNUM {
+		return 0, false
+	}
+	if start >= bn {
+		return start, true
+	}
+	root = physBlock(root)
+	if level == 0 || !validBlock(atxn, root) {
+		return 0, false
+	}
+	divisor := pow(level - 1)
+	buf := atxn.ReadBlock(root)
+	for i := uint64(0); i < NBLKBLK; i++ {
+		s := start + i*divisor
+		if s+divisor <= bn {
+			continue
+		}
+		if n, ok := ip.indNext(atxn, buf.BnumGet(i*8), level-1, s, bn); ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// extNext returns the first logical block from bn on that extent tree
+// node n, which maps logical blocks [from, to), maps or has a child
+// start at, or ^0 if there is none.
+func (ip *Inode) extNext(atxn *alloctxn.AllocTxn, n *extNode, from uint64, to uint64, bn uint64) uint64 {
+	if n.depth == 0 {
+		for _, e := range n.ents {
+			if e.end() > bn && e.lblk > bn {
+				return e.lblk
+			}
+			if e.end() > bn {
+				return bn
+			}
+		}
+		return ^uint64(0)
+	}
+	for i, e := range n.ents {
+		var start = from
+		if i > 0 {
+			start = e.lblk
+		}
+		var end = to
+		if i+1 < len(n.ents) {
+			end = n.ents[i+1].lblk
+		}
+		if end <= bn {
+			continue
+		}
+		if start >= bn {
+			return start
+		}
+		if !validBlock(atxn, e.pblk) {
+			continue
+		}
+		if next := ip.extNext(atxn, ip.readExtNode(atxn, e.pblk), start, end, bn); next != ^uint64(0) {
+			return next
+		}
+	}
+	return ^uint64(0)
+}
+
+// scrubEnd returns the logical block after the last one that ip may
+// map.
+func (ip *Inode) scrubEnd() uint64 {
+	var nblk = util.RoundUp(ip.Size, disk.BlockSize)
+	if ip.ShrinkSize > nblk {
+		nblk = ip.ShrinkSize
+	}
+	return nblk
+}
+
+// scrubRange visits the blocks that map logical blocks [lo, hi).
+func (ip *Inode) scrubRange(atxn *alloctxn.AllocTxn, lo uint64, hi uint64, visit func(common.Bnum) bool) {
+	if ip.Flags&INODE_EXTENTS != 0 {
+		ip.extScrub(atxn, ip.ext, 0, ^uint64(0), lo, hi, visit)
+	} else {
+		ip.blkScrub(atxn, lo, hi, visit)
+	}
+}
+
+// CountBlocks returns the number of blocks that ip refers to, which
+// its owner's quotas count.  It walks only the index blocks and extent
+// tree nodes that exist, so that a large sparse file takes no longer
+// than a small one.
+func (ip *Inode) CountBlocks(atxn *alloctxn.AllocTxn) uint64 {
+	var n uint64 = 0
+	if ip.Xattr != common.NULLBNUM {
+		n++
+	}
+	if ip.IsInline() {
+		return n
+	}
+	ip.scrubRange(atxn, 0, ip.scrubEnd(), func(common.Bnum) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// blkScrub visits the blocks that map logical blocks [lo, hi) with
+// the blks array.
+func (ip *Inode) blkScrub(atxn *alloctxn.AllocTxn, lo uint64, hi uint64, visit func(common.Bnum) bool) {
+	for bn := lo; bn < hi && bn < NDIRECT; bn++ {
+		if ip.blks[bn] != common.NULLBNUM {
+			visit(physBlock(ip.blks[bn]))
+		}
+	}
+	for level := uint64(1); level <= NINDLEVEL; level++ {
+		start := levelStart(level)
+		if start >= hi || start+pow(level) <= lo {
+			continue
+		}
+		ip.indScrub(atxn, ip.blks[indRoot(level)], level, start, lo, hi, visit)
+	}
+}
+
+// indScrub visits the blocks of the tree of depth level rooted at
+// root, which maps logical blocks from start on, that map logical
+// blocks [lo, hi).
+func (ip *Inode) indScrub(atxn *alloctxn.AllocTxn, root common.Bnum, level uint64, start uint64, lo uint64, hi uint64, visit func(common.Bnum) bool) {
+	if root == common.NULLBNUM {
+		return
+	}
+	root = physBlock(root) // a data block may start a compressed cluster
+	if start >= lo {
+		if !visit(root) {
+			return
+		}
+	} else if !validBlock(atxn, root) {
+		return
+	}
+	if level == 0 {
+		return
+	}
+	divisor := pow(level - 1)
+	buf := atxn.ReadBlock(root)
+	for i := uint64(0); i < NBLKBLK; i++ {
+		s := start + i*divisor
+		if s >= hi {
+			break
+		}
+		if s+divisor <= lo {
+			continue
+		}
+		ip.indScrub(atxn, buf.BnumGet(i*8), level-1, s, lo, hi, visit)
+	}
+}
+
+// extScrub visits the blocks of the extent tree node n, which maps
+// logical blocks [from, to), that map logical blocks [lo, hi).
+func (ip *Inode) extScrub(atxn *alloctxn.AllocTxn, n *extNode, from uint64, to uint64, lo uint64, hi uint64, visit func(common.Bnum) bool) {
+	if n.depth == 0 {
+		for _, e := range n.ents {
+			var s = e.lblk
+			if s < lo {
+				s = lo
+			}
+			t := util.Min(e.end(), hi)
+			for b := s; b < t; b++ {
+				visit(e.pblk + (b - e.lblk))
+			}
+		}
+		return
+	}
+	for i, e := range n.ents {
+		var start = from
+		if i > 0 {
+			start = e.lblk
+		}
+		var end = to
+		if i+1 < len(n.ents) {
+			end = n.ents[i+1].lblk
+		}
+		if start >= hi || end <= lo {
+			continue
+		}
+		if start >= lo {
+			if !visit(e.pblk) {
+				continue
+			}
+		} else if !validBlock(atxn, e.pblk) {
+			continue
+		}
+		ip.extScrub(atxn, ip.readExtNode(atxn, e.pblk), start, end, lo, hi, visit)
+	}
+}
@@ -0,0 +1,235 @@
+package inode
+
+import (
+	"github.com/goose-lang/primitive/disk"
+	"github.com/mit-pdos/go-journal/jrnl"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+)
+
+//
+// Shared blocks.  Files may share data blocks, copy-on-write: Share
+// makes a new file map the same blocks as another one, and adds a
+// reference to each block in the allocator's reference counts.  Write
+// copies a shared block to a new block before writing it ("unshares"
+// it), and freeing a shared block drops a reference instead.  Only
+// data blocks are shared; each file has its own index blocks and
+// extent tree nodes.
+//
+
+// # blocks Share maps per step: the blocks whose counts one block of
+// the reference count table holds
+const NSHARE uint64 = disk.BlockSize / alloc.REFSZ
+
+// blkLookup maps logical block bn of an inode that maps blocks with
+// the blks array, without allocating.  It returns NULLBNUM for a hole.
+func (ip *Inode) blkLookup(atxn *alloctxn.AllocTxn, bn uint64) common.Bnum {
+	if bn < NDIRECT {
+		return ip.blks[bn]
+	}
+	level, off0 := indLevel(bn)
+	var off = off0
+	var blk = ip.blks[indRoot(level)]
+	for l := level; l > 0 && blk != common.NULLBNUM; l-- {
+		divisor := pow(l - 1)
+		buf := atxn.ReadBlock(blk)
+		blk = buf.BnumGet((off / divisor) * 8)
+		off = off % divisor
+	}
+	return blk
+}
+
+// blkRemap maps logical block bn, which is mapped, to blkno.
+func (ip *Inode) blkRemap(atxn *alloctxn.AllocTxn, bn uint64, blkno common.Bnum) {
+	if bn < NDIRECT {
+		ip.blks[bn] = blkno
+		return
+	}
+	level, off0 := indLevel(bn)
+	var off = off0
+	var blk = ip.blks[indRoot(level)]
+	for l := level; l > 0; l-- {
+		divisor := pow(l - 1)
+		buf := atxn.ReadBlock(blk)
+		o := (off / divisor) * 8
+		if l == 1 {
+			buf.BnumPut(o, blkno)
+			return
+		}
+		blk = buf.BnumGet(o)
+		off = off % divisor
+	}
+}
+
+// lookupRun maps logical block bn without allocating.  It returns the
+// physical block, or NULLBNUM for a hole, and the number of blocks
+// from bn, up to max, that map to contiguous blocks or are in the hole.
+func (ip *Inode) lookupRun(atxn *alloctxn.AllocTxn, bn uint64, max uint64) (common.Bnum, uint64) {
+	if ip.Flags&INODE_EXTENTS != 0 {
+		blkno, n, _ := ip.extLookup(atxn, bn)
+		return blkno, util.Min(n, max)
+	}
+	blkno := ip.blkLookup(atxn, bn)
+	var n uint64 = 1
+	for n < max {
+		next := ip.blkLookup(atxn, bn+n)
+		if (blkno == common.NULLBNUM && next != common.NULLBNUM) ||
+			(blkno != common.NULLBNUM && next != blkno+n) {
+			break
+		}
+		n++
+	}
+	return blkno, n
+}
+
+// extSpares allocates enough blocks to split nodes while inserting two
+// extents into the tree, or returns nil if the disk is full.
+func (ip *Inode) extSpares(atxn *alloctxn.AllocTxn) []common.Bnum {
+	need := 2 * (ip.ext.depth + 2)
+	var spare = make([]common.Bnum, 0, need)
+	for uint64(len(spare)) < need {
+		b := atxn.AllocBlock(ip.Owner(), ip.allocGoal(atxn))
+		if b == common.NULLBNUM {
+			for _, b := range spare {
+				atxn.UnallocBlock(ip.Owner(), b)
+			}
+			return nil
+		}
+		spare = append(spare, b)
+	}
+	return spare
+}
+
+// extRemap maps logical block bn, which is mapped, to blkno, splitting
+// the extent that maps bn.  It returns false, without changing the
+// tree, if there is no free block to split a node with.
+func (ip *Inode) extRemap(atxn *alloctxn.AllocTxn, bn uint64, blkno common.Bnum) bool {
+	spare := ip.extSpares(atxn)
+	if spare == nil {
+		return false
+	}
+	ip.cacheExt(extent{})
+	var n = ip.ext
+	for n.depth > 0 {
+		var i = n.find(bn)
+		if i < 0 {
+			i = 0
+		}
+		n = ip.readExtNode(atxn, n.ents[i].pblk)
+	}
+	i := n.find(bn)
+	e := n.ents[i]
+	mid := extent{lblk: bn, pblk: blkno, len: 1}
+	var inserts []extent
+	if bn > e.lblk {
+		n.ents[i].len = bn - e.lblk
+		inserts = append(inserts, mid)
+	} else {
+		n.ents[i] = mid
+	}
+	if bn+1 < e.end() {
+		inserts = append(inserts, extent{lblk: bn + 1,
+			pblk: e.pblk + (bn + 1 - e.lblk), len: e.end() - bn - 1})
+	}
+	ip.writeExtNode(atxn, n)
+	for _, e := range inserts {
+		ip.extInsert(atxn, ip.ext, e, &spare)
+	}
+	for _, b := range spare {
+		atxn.UnallocBlock(ip.Owner(), b)
+	}
+	return true
+}
+
+// unshare copies shared block blkno, which logical block bn maps, to a
+// new block, and maps bn to the new block instead.  It copies the
+// contents only if keep is set, since otherwise the caller overwrites
+// the whole block.  It returns the new block, or NULLBNUM if the disk
+// is full.
+func (ip *Inode) unshare(atxn *alloctxn.AllocTxn, bn uint64, blkno common.Bnum, keep bool) common.Bnum {
+	newblk := atxn.AllocBlock(ip.Owner(), ip.allocGoal(atxn))
+	if newblk == common.NULLBNUM {
+		return newblk
+	}
+	if ip.Flags&INODE_EXTENTS != 0 {
+		if !ip.extRemap(atxn, bn, newblk) {
+			atxn.UnallocBlock(ip.Owner(), newblk)
+			return common.NULLBNUM
+		}
+	} else {
+		ip.blkRemap(atxn, bn, newblk)
+	}
+	util.DPrintf(5, "unshare # %d: %d %d -> %d\n", ip.Inum, bn, blkno, newblk)
+	if keep {
+		data := make(disk.Block, disk.BlockSize)
+		copy(data, atxn.ReadBlock(blkno).Data)
+		atxn.WriteBlock(newblk, data)
+	}
+	atxn.FreeBlock(ip.Owner(), blkno)
+	ip.lastBlk = newblk
+	return newblk
+}
+
+// extAdd adds extent e after the extents of the tree.  It returns false
+// if there is no free block to split a node with.
+func (ip *Inode) extAdd(atxn *alloctxn.AllocTxn, e extent) bool {
+	spare := ip.extSpares(atxn)
+	if spare == nil {
+		return false
+	}
+	ip.cacheExt(extent{})
+	ip.extInsert(atxn, ip.ext, e, &spare)
+	for _, b := range spare {
+		atxn.UnallocBlock(ip.Owner(), b)
+	}
+	return true
+}
+
+// Share makes ip, a new file, share the data of src from logical block
+// bn on, as much as fits in the transaction; the caller continues in a
+// new transaction from the block Share returns.  Share switches ip to
+// extent mapping, unless src's data is inline, in which case it copies
+// the data.  ip's size grows to cover the data it shares.  Share
+// returns false if the disk is full.  The copy of a compressed file is
+// compressed, with the same clusters.
+func (ip *Inode) Share(atxn *alloctxn.AllocTxn, src *Inode, bn uint64) (uint64, bool) {
+	if src.IsInline() {
+		ip.inline = make([]byte, INLINESZ)
+		copy(ip.inline, src.inline)
+		ip.Size = src.Size
+		ip.WriteInode(atxn)
+		return util.RoundUp(src.Size, disk.BlockSize), true
+	}
+	if src.compressed() {
+		return ip.shareCompressed(atxn, src, bn)
+	}
+	if ip.Flags&INODE_EXTENTS == 0 {
+		ip.UseExtents(atxn)
+	}
+	if ip.IsInline() && !ip.spill(atxn) {
+		return bn, false
+	}
+	nblk := util.RoundUp(src.Size, disk.BlockSize)
+	var next = bn
+	for next < nblk && atxn.NDirty()+2*(ip.ext.depth+2)+8 < jrnl.LogBlocks {
+		blkno, n := src.lookupRun(atxn, next, util.Min(nblk-next, NSHARE))
+		if blkno != common.NULLBNUM {
+			if !ip.extAdd(atxn, extent{lblk: next, pblk: blkno, len: n}) {
+				return next, false
+			}
+			for k := uint64(0); k < n; k++ {
+				atxn.RefBlock(ip.Owner(), blkno+k)
+			}
+			ip.Blocks += n
+		}
+		next += n
+	}
+	util.DPrintf(5, "Share # %d from # %d: [%d, %d)\n", ip.Inum, src.Inum, bn, next)
+	ip.Size = util.Min(src.Size, next*disk.BlockSize)
+	ip.ShrinkSize = util.RoundUp(ip.Size, disk.BlockSize)
+	ip.WriteInode(atxn)
+	return next, true
+}
@@ -16,8 +16,11 @@ import (
 // Shrink() is responsible for starting another shrink transaction.
 //
 
+// shrinkFits reports whether a shrink step that dirties nblk more
+// blocks fits in the transaction.  Freed blocks count, too, to keep
+// steps short.
 func (ip *Inode) shrinkFits(op *alloctxn.AllocTxn, nblk uint64) bool {
-	return op.Op.NDirty()+nblk < jrnl.LogBlocks
+	return op.NDirty()+op.NFreed()+nblk < jrnl.LogBlocks
 }
 
 func (ip *Inode) IsShrinking() bool {
@@ -27,18 +30,22 @@ func (ip *Inode) IsShrinking() bool {
 }
 
 func (ip *Inode) freeIndex(op *alloctxn.AllocTxn, index uint64) {
-	op.FreeBlock(ip.blks[index])
+	if index < NDIRECT {
+		ip.freeData(op, ip.blks[index])
+	} else {
+		op.FreeBlock(ip.Owner(), ip.blks[index])
+	}
 	ip.blks[index] = 0
 }
 
-// Frees indirect bn.  Assumes if bn is cleared, then all blocks > bn
-// have been cleared
-func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) common.Bnum {
-	if root == common.NULLBNUM {
-		return 0
-	}
+// Frees offset bn of the tree of depth level rooted at root, assuming
+// that all offsets > bn have been freed already.  Returns the offset
+// below which the tree may still map blocks: a hole in the tree is
+// skipped as a whole, so that shrinking a sparse file doesn't visit
+// every block of it.  If it returns 0, the caller must free root.
+func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) uint64 {
 	if level == 0 {
-		return root
+		return 0
 	}
 	divisor := pow(level - 1)
 	off := (bn / divisor)
@@ -46,46 +53,60 @@ func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64
 	boff := off * 8
 	b := op.ReadBlock(root)
 	nxtroot := b.BnumGet(boff)
-	op.AssertValidBlock(nxtroot)
-	if nxtroot != 0 {
-		freeroot := ip.indshrink(op, nxtroot, level-1, ind)
-		if freeroot != 0 {
-			b.BnumPut(boff, 0)
-			op.FreeBlock(freeroot)
-		}
+	op.AssertValidBlock(physBlock(nxtroot))
+	if nxtroot == common.NULLBNUM {
+		return off * divisor
 	}
-	if off == 0 && ind == 0 {
-		return root
-	} else {
-		return common.NULLBNUM
+	lo := ip.indshrink(op, nxtroot, level-1, ind)
+	if lo == 0 {
+		b.BnumPut(boff, 0)
+		if level == 1 {
+			ip.freeData(op, nxtroot)
+		} else {
+			op.FreeBlock(ip.Owner(), nxtroot)
+		}
 	}
+	return off*divisor + lo
 }
 
 // Frees as many blocks as possible, and returns if more shrinking is necessary.
-// 5: inode block, 2xbitmap block, indirect block, double indirect
+// NINDLEVEL+4: inode block, 2xbitmap block, an index block per level,
+// and the data block
 func (ip *Inode) Shrink(op *alloctxn.AllocTxn) bool {
 	util.DPrintf(1, "Shrink: from %d to %d\n", ip.ShrinkSize,
 		util.RoundUp(ip.Size, disk.BlockSize))
-	for ip.IsShrinking() && ip.shrinkFits(op, 5) {
-		ip.ShrinkSize -= 1
-		if ip.ShrinkSize < NDIRECT {
-			ip.freeIndex(op, ip.ShrinkSize)
+	if ip.Flags&INODE_EXTENTS != 0 {
+		return ip.shrinkExtents(op)
+	}
+	for ip.IsShrinking() && ip.shrinkFits(op, NINDLEVEL+4) {
+		bn := ip.ShrinkSize - 1
+		if bn < NDIRECT {
+			ip.freeIndex(op, bn)
+			ip.ShrinkSize = bn
 		} else {
-			var off = ip.ShrinkSize - NDIRECT
-			if off < NBLKBLK {
-				freeroot := ip.indshrink(op, ip.blks[INDIRECT], 1, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, INDIRECT)
-				}
-			} else {
-				off = off - NBLKBLK
-				freeroot := ip.indshrink(op, ip.blks[DINDIRECT], 2, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, DINDIRECT)
+			level, off := indLevel(bn)
+			var lo uint64 = 0
+			if ip.blks[indRoot(level)] != common.NULLBNUM {
+				lo = ip.indshrink(op, ip.blks[indRoot(level)], level, off)
+				if lo == 0 {
+					ip.freeIndex(op, indRoot(level))
 				}
 			}
+			ip.ShrinkSize = levelStart(level) + lo
 		}
 	}
 	ip.WriteInode(op)
 	return ip.IsShrinking()
 }
+
+// shrinkExtents frees blocks of an extent inode, NEXTSHRINK at a time.
+// Besides those, a step may write the inode block, 2xbitmap block, and
+// a node per level of the tree.
+func (ip *Inode) shrinkExtents(op *alloctxn.AllocTxn) bool {
+	target := util.RoundUp(ip.Size, disk.BlockSize)
+	for ip.IsShrinking() && ip.shrinkFits(op, NEXTSHRINK+ip.ext.depth+4) {
+		ip.ShrinkSize = ip.extShrink(op, target, NEXTSHRINK)
+	}
+	ip.WriteInode(op)
+	return ip.IsShrinking()
+}
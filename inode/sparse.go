@@ -0,0 +1,87 @@
+package inode
+
+import (
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+)
+
+//
+// Sparse writes.  WriteSparse stores a whole block of zeros as a hole
+// instead of in a block, and frees the block that the file had there,
+// if any.  Reads return zeros for holes without allocating, so a
+// sparse file takes only the blocks of its non-zero data.  A compressed
+// file already stores zero blocks as holes.  An extent file keeps
+// blocks that it has, since unmapping one would split its extent.
+//
+
+// punch makes logical block bn of ip, which maps blocks with the blks
+// array, a hole, freeing the block that it maps.
+func (ip *Inode) punch(atxn *alloctxn.AllocTxn, bn uint64) {
+	blkno := ip.blkLookup(atxn, bn)
+	if blkno == common.NULLBNUM {
+		return
+	}
+	util.DPrintf(5, "punch # %d: %d (%d)\n", ip.Inum, bn, blkno)
+	ip.blkRemap(atxn, bn, common.NULLBNUM)
+	ip.freeData(atxn, blkno)
+}
+
+// zeroBlock reports whether the part of data at offset off (relative
+// to data's start at offset start) is a whole block of zeros.
+func zeroBlock(data []byte, start uint64, off uint64) bool {
+	if off%disk.BlockSize != 0 || off+disk.BlockSize > start+uint64(len(data)) {
+		return false
+	}
+	return isZero(data[off-start : off-start+disk.BlockSize])
+}
+
+// WriteSparse writes like Write, but leaves a hole for each whole block
+// of zeros in data.  It returns the number of bytes written and false
+// if it ran out of space before writing all of them.
+func (ip *Inode) WriteSparse(atxn *alloctxn.AllocTxn, offset uint64,
+	count uint64, data []byte) (uint64, bool) {
+	if ip.IsInline() || ip.compressed() || offset+count > MaxFileSize() {
+		return ip.Write(atxn, offset, count, data)
+	}
+	extents := ip.Flags&INODE_EXTENTS != 0
+	var off = offset
+	var from = offset // start of the data not yet written
+	end := offset + count
+	for off < end {
+		if !zeroBlock(data, offset, off) {
+			off = util.Min(off-off%disk.BlockSize+disk.BlockSize, end)
+			continue
+		}
+		bn := off / disk.BlockSize
+		blkno, _ := ip.lookupRun(atxn, bn, 1)
+		if extents && blkno != common.NULLBNUM {
+			off += disk.BlockSize // write the zeros
+			continue
+		}
+		if from < off {
+			n, ok := ip.Write(atxn, from, off-from, data[from-offset:off-offset])
+			if n < off-from {
+				return from - offset + n, ok
+			}
+		}
+		if !extents {
+			ip.punch(atxn, bn)
+		}
+		off += disk.BlockSize
+		from = off
+	}
+	if from < end {
+		n, ok := ip.Write(atxn, from, end-from, data[from-offset:])
+		if n < end-from {
+			return from - offset + n, ok
+		}
+	}
+	if end > ip.Size {
+		ip.Size = end
+	}
+	ip.WriteInode(atxn)
+	return count, true
+}
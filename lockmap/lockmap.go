@@ -0,0 +1,130 @@
+// lockmap is a sharded map of shared/exclusive locks.
+//
+// The API is as if LockMap consisted of a readers-writer lock for every
+// possible uint64; LockMap.Acquire(a) acquires the lock associated with
+// a exclusively, LockMap.AcquireShared(a) acquires it shared, and
+// LockMap.Release(a) releases it in whichever mode it was acquired.
+//
+// Like go-journal's lockmap, the implementation maintains a fixed
+// collection of shards, so that shard i is responsible for the lock
+// state of all a such that a % NSHARD = i.  A lock that exclusive
+// waiters wait for isn't granted shared to new callers, so that a
+// stream of readers cannot starve a writer.  Waiting behind a waiting
+// writer adds no cycle that exclusive locks alone wouldn't have, since
+// the writer itself waits only for the lock's holders.
+package lockmap
+
+import (
+	"sync"
+)
+
+type lockState struct {
+	held     bool   // held exclusively
+	readers  uint64 // # shared holders
+	cond     *sync.Cond
+	waiters  uint64
+	xwaiters uint64 // # of waiters that want the lock exclusively
+}
+
+type lockShard struct {
+	mu    *sync.Mutex
+	state map[uint64]*lockState
+}
+
+func mkLockShard() *lockShard {
+	state := make(map[uint64]*lockState)
+	mu := new(sync.Mutex)
+	a := &lockShard{
+		mu:    mu,
+		state: state,
+	}
+	return a
+}
+
+func (lmap *lockShard) getState(addr uint64) *lockState {
+	state, ok := lmap.state[addr]
+	if !ok {
+		state = &lockState{cond: sync.NewCond(lmap.mu)}
+		lmap.state[addr] = state
+	}
+	return state
+}
+
+func (lmap *lockShard) acquire(addr uint64, shared bool) {
+	lmap.mu.Lock()
+	state := lmap.getState(addr)
+	for {
+		if shared && !state.held && state.xwaiters == 0 {
+			state.readers += 1
+			break
+		}
+		if !shared && !state.held && state.readers == 0 {
+			state.held = true
+			break
+		}
+		state.waiters += 1
+		if !shared {
+			state.xwaiters += 1
+		}
+		state.cond.Wait()
+		state.waiters -= 1
+		if !shared {
+			state.xwaiters -= 1
+		}
+	}
+	lmap.mu.Unlock()
+}
+
+func (lmap *lockShard) release(addr uint64) {
+	lmap.mu.Lock()
+	state := lmap.state[addr]
+	if state.readers > 0 {
+		state.readers -= 1
+	} else {
+		state.held = false
+	}
+	if state.waiters > 0 {
+		// waiters wait for different things; let them all check
+		state.cond.Broadcast()
+	} else if state.readers == 0 {
+		delete(lmap.state, addr)
+	}
+	lmap.mu.Unlock()
+}
+
+const NSHARD uint64 = 65537
+
+type LockMap struct {
+	shards []*lockShard
+}
+
+func MkLockMap() *LockMap {
+	var shards []*lockShard
+	for i := uint64(0); i < NSHARD; i++ {
+		shards = append(shards, mkLockShard())
+	}
+	a := &LockMap{
+		shards: shards,
+	}
+	return a
+}
+
+// Acquire acquires the lock of flataddr exclusively.
+func (lmap *LockMap) Acquire(flataddr uint64) {
+	shard := lmap.shards[flataddr%NSHARD]
+	shard.acquire(flataddr, false)
+}
+
+// AcquireShared acquires the lock of flataddr shared with other
+// AcquireShared callers.
+func (lmap *LockMap) AcquireShared(flataddr uint64) {
+	shard := lmap.shards[flataddr%NSHARD]
+	shard.acquire(flataddr, true)
+}
+
+// Release releases the lock of flataddr, which the caller acquired
+// exclusively or shared.
+func (lmap *LockMap) Release(flataddr uint64) {
+	shard := lmap.shards[flataddr%NSHARD]
+	shard.release(flataddr)
+}
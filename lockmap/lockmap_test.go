@@ -0,0 +1,71 @@
+package lockmap
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShared(t *testing.T) {
+	lm := MkLockMap()
+	lm.AcquireShared(1)
+	lm.AcquireShared(1) // readers share the lock
+	lm.Acquire(2)       // other locks are independent
+
+	got := make(chan bool)
+	go func() {
+		lm.Acquire(1)
+		got <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-got:
+		t.Fatal("writer acquired a lock that readers hold")
+	default:
+	}
+
+	// a waiting writer keeps new readers out
+	rgot := make(chan bool)
+	go func() {
+		lm.AcquireShared(1)
+		rgot <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-rgot:
+		t.Fatal("reader overtook a waiting writer")
+	default:
+	}
+
+	lm.Release(1)
+	lm.Release(1)
+	<-got
+	lm.Release(1)
+	<-rgot
+	lm.Release(1)
+	lm.Release(2)
+}
+
+func TestExclusive(t *testing.T) {
+	lm := MkLockMap()
+	var wg sync.WaitGroup
+	var n = 0
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			for i := 0; i < 1000; i++ {
+				lm.Acquire(7)
+				n++
+				lm.Release(7)
+				lm.AcquireShared(7)
+				_ = n
+				lm.Release(7)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 8000, n)
+}
@@ -0,0 +1,194 @@
+package nfs
+
+import (
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/acl"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+const fileMode uint32 = 0777
+
+// perm returns the permissions ip's access ACL grants to the caller.
+// The ACL binds root like any other caller.
+func (nfs *Nfs) perm(op *fstxn.FsTxn, ip *inode.Inode) uint32 {
+	if ip.Xattr == common.NULLBNUM { // no ACL
+		return acl.READ | acl.WRITE | acl.EXECUTE
+	}
+	a := acl.GetAccess(ip, op.Atxn)
+	if a == nil {
+		a = acl.FromMode(fileMode)
+	}
+	return a.Perm(ip.Uid, ip.Gid, nfs.cred)
+}
+
+// permit reports whether ip's access ACL grants want to the caller.
+func (nfs *Nfs) permit(op *fstxn.FsTxn, ip *inode.Inode, want uint32) bool {
+	return nfs.perm(op, ip)&want == want
+}
+
+// owns reports whether the caller may change ip's ACL: whether it is
+// ip's owner or root.
+func (nfs *Nfs) owns(ip *inode.Inode) bool {
+	return nfs.cred.Uid == 0 || nfs.cred.Uid == ip.Uid
+}
+
+// mayChown reports whether the caller may give ip to owner, which
+// follows POSIX: root may give a file to anyone, and its owner may
+// change only its group, to one of the owner's groups.
+func (nfs *Nfs) mayChown(ip *inode.Inode, owner alloc.Owner) bool {
+	if nfs.cred.Uid == 0 {
+		return true
+	}
+	return nfs.cred.Uid == ip.Uid && owner.Uid == ip.Uid &&
+		(owner.Gid == ip.Gid || nfs.cred.InGroup(owner.Gid))
+}
+
+// accessBits returns the NFSv3 access bits that ip's ACL grants to the
+// caller.
+func (nfs *Nfs) accessBits(op *fstxn.FsTxn, ip *inode.Inode) uint32 {
+	p := nfs.perm(op, ip)
+	var access uint32 = 0
+	if p&acl.READ != 0 {
+		access = access | nfstypes.ACCESS3_READ
+	}
+	if ip.Kind == nfstypes.NF3DIR {
+		if p&acl.EXECUTE != 0 {
+			access = access | nfstypes.ACCESS3_LOOKUP
+			if p&acl.WRITE != 0 {
+				access = access | nfstypes.ACCESS3_MODIFY |
+					nfstypes.ACCESS3_EXTEND | nfstypes.ACCESS3_DELETE
+			}
+		}
+		return access
+	}
+	if p&acl.WRITE != 0 {
+		access = access | nfstypes.ACCESS3_MODIFY | nfstypes.ACCESS3_EXTEND
+	}
+	if p&acl.EXECUTE != 0 {
+		access = access | nfstypes.ACCESS3_EXECUTE
+	}
+	// whether a file may be deleted depends on its directory
+	return access | nfstypes.ACCESS3_DELETE
+}
+
+func aclToXdr(a acl.Acl, tagflag uint32, entries bool) nfstypes.Posix_acl {
+	xa := nfstypes.Posix_acl{Count: nfstypes.Uint32(len(a))}
+	if !entries {
+		return xa
+	}
+	for _, e := range a {
+		xa.Entries = append(xa.Entries, nfstypes.Posix_acl_entry{
+			Tag:  nfstypes.Uint32(e.Tag | tagflag),
+			Id:   nfstypes.Uint32(e.Id),
+			Perm: nfstypes.Uint32(e.Perm),
+		})
+	}
+	return xa
+}
+
+// aclFromXdr returns the ACL in xa, or nil if xa has no entries, which
+// removes the ACL.
+func aclFromXdr(xa nfstypes.Posix_acl) acl.Acl {
+	if len(xa.Entries) == 0 {
+		return nil
+	}
+	a := make(acl.Acl, 0, len(xa.Entries))
+	for _, e := range xa.Entries {
+		a = append(a, acl.Entry{
+			Tag:  uint32(e.Tag) &^ nfstypes.NFS_ACL_DEFAULT,
+			Id:   uint32(e.Id),
+			Perm: uint32(e.Perm),
+		})
+	}
+	return a
+}
+
+// ACLPROC3_NULL handles the NULL RPC for the NFSACL service.
+func (nfs *Nfs) ACLPROC3_NULL() {
+	util.DPrintf(1, "NFSACL Null\n")
+}
+
+// ACLPROC3_GETACL returns a file's access ACL and, for a directory,
+// its default ACL.  A file without an access ACL reports the ACL its
+// mode implies.
+func (nfs *Nfs) ACLPROC3_GETACL(args nfstypes.GETACL3args) nfstypes.GETACL3res {
+	var reply nfstypes.GETACL3res
+	util.DPrintf(1, "NFSACL GetAcl %v\n", args)
+	nfs.writeBack(args.Fh)
+	mask := uint32(args.Mask)
+	if mask&^(nfstypes.NFS_ACL|nfstypes.NFS_ACLCNT|nfstypes.NFS_DFACL|nfstypes.NFS_DFACLCNT) != 0 {
+		reply.Status = nfstypes.NFS3ERR_INVAL
+		return reply
+	}
+	op := fstxn.BeginReadOnly(nfs.fsstate)
+	ip := op.GetInodeFh(args.Fh)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	a := acl.GetAccess(ip, op.Atxn)
+	if a == nil {
+		a = acl.FromMode(fileMode)
+	}
+	var dfa acl.Acl
+	if ip.Kind == nfstypes.NF3DIR {
+		dfa = acl.GetDefault(ip, op.Atxn)
+	}
+	reply.Resok.Attr.Attributes_follow = true
+	reply.Resok.Attr.Attributes = ip.MkFattr()
+	reply.Resok.Mask = args.Mask
+	reply.Resok.Acl = aclToXdr(a, 0, mask&nfstypes.NFS_ACL != 0)
+	reply.Resok.Dfacl = aclToXdr(dfa, nfstypes.NFS_ACL_DEFAULT,
+		mask&nfstypes.NFS_DFACL != 0)
+	commitReply(op, &reply.Status)
+	return reply
+}
+
+// ACLPROC3_SETACL sets a file's access ACL and, for a directory, its
+// default ACL.  An ACL without entries removes the ACL.
+func (nfs *Nfs) ACLPROC3_SETACL(args nfstypes.SETACL3args) nfstypes.SETACL3res {
+	var reply nfstypes.SETACL3res
+	util.DPrintf(1, "NFSACL SetAcl %v\n", args)
+	nfs.writeBack(args.Fh)
+	mask := uint32(args.Mask)
+	if mask&^(nfstypes.NFS_ACL|nfstypes.NFS_DFACL) != 0 {
+		reply.Status = nfstypes.NFS3ERR_INVAL
+		return reply
+	}
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Fh)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	if ip.ReadOnly() {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ROFS)
+		return reply
+	}
+	if !nfs.owns(ip) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_PERM)
+		return reply
+	}
+	if mask&nfstypes.NFS_ACL != 0 {
+		err := acl.SetAccess(ip, op.Atxn, aclFromXdr(args.Acl))
+		if err != nfstypes.NFS3_OK {
+			errRet(op, &reply.Status, err)
+			return reply
+		}
+	}
+	if mask&nfstypes.NFS_DFACL != 0 {
+		err := acl.SetDefault(ip, op.Atxn, aclFromXdr(args.Dfacl))
+		if err != nfstypes.NFS3_OK {
+			errRet(op, &reply.Status, err)
+			return reply
+		}
+	}
+	reply.Resok.Attr.Attributes_follow = true
+	reply.Resok.Attr.Attributes = ip.MkFattr()
+	commitReply(op, &reply.Status)
+	return reply
+}
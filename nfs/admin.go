@@ -0,0 +1,171 @@
+package nfs
+
+import (
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// ADMINPROC_NULL handles the NULL RPC for the admin service.
+func (nfs *Nfs) ADMINPROC_NULL() {
+	util.DPrintf(1, "ADMIN Null\n")
+}
+
+// ADMINPROC_GROW grows the file system; see Grow.
+func (nfs *Nfs) ADMINPROC_GROW(args nfstypes.GROWargs) nfstypes.GROWres {
+	var reply nfstypes.GROWres
+	util.DPrintf(1, "ADMIN Grow %v\n", args)
+	reply.Status = nfs.Grow(uint64(args.Size), uint64(args.Inodes))
+	reply.Size = nfstypes.Uint64(nfs.fsstate.Super.MaxBnum())
+	reply.Inodes = nfstypes.Uint64(nfs.fsstate.Super.NInode())
+	return reply
+}
+
+// ADMINPROC_GETXATTR returns the value of an extended attribute.
+func (nfs *Nfs) ADMINPROC_GETXATTR(args nfstypes.GETXATTRargs) nfstypes.GETXATTRres {
+	var reply nfstypes.GETXATTRres
+	util.DPrintf(1, "ADMIN GetXattr %v\n", args)
+	reply.Value, reply.Status = nfs.GetXattr(args.Object, string(args.Name))
+	return reply
+}
+
+// ADMINPROC_SETXATTR sets an extended attribute.
+func (nfs *Nfs) ADMINPROC_SETXATTR(args nfstypes.SETXATTRargs) nfstypes.SETXATTRres {
+	var reply nfstypes.SETXATTRres
+	util.DPrintf(1, "ADMIN SetXattr %v\n", args)
+	reply.Status = nfs.SetXattr(args.Object, string(args.Name), args.Value,
+		uint32(args.Flags))
+	return reply
+}
+
+// ADMINPROC_LISTXATTR lists the names of the extended attributes.
+func (nfs *Nfs) ADMINPROC_LISTXATTR(args nfstypes.LISTXATTRargs) nfstypes.LISTXATTRres {
+	var reply nfstypes.LISTXATTRres
+	util.DPrintf(1, "ADMIN ListXattr %v\n", args)
+	names, status := nfs.ListXattr(args.Object)
+	reply.Status = status
+	for _, name := range names {
+		reply.Names = append(reply.Names, name...)
+		reply.Names = append(reply.Names, 0)
+	}
+	return reply
+}
+
+// ADMINPROC_REMOVEXATTR removes an extended attribute.
+func (nfs *Nfs) ADMINPROC_REMOVEXATTR(args nfstypes.REMOVEXATTRargs) nfstypes.REMOVEXATTRres {
+	var reply nfstypes.REMOVEXATTRres
+	util.DPrintf(1, "ADMIN RemoveXattr %v\n", args)
+	reply.Status = nfs.RemoveXattr(args.Object, string(args.Name))
+	return reply
+}
+
+// ADMINPROC_SNAPSHOT takes a snapshot; see Snapshot.
+func (nfs *Nfs) ADMINPROC_SNAPSHOT(args nfstypes.SNAPSHOTargs) nfstypes.SNAPSHOTres {
+	var reply nfstypes.SNAPSHOTres
+	util.DPrintf(1, "ADMIN Snapshot %v\n", args)
+	reply.Status = nfs.Snapshot(string(args.Name))
+	return reply
+}
+
+// ADMINPROC_DELSNAPSHOT deletes a snapshot.
+func (nfs *Nfs) ADMINPROC_DELSNAPSHOT(args nfstypes.DELSNAPSHOTargs) nfstypes.DELSNAPSHOTres {
+	var reply nfstypes.DELSNAPSHOTres
+	util.DPrintf(1, "ADMIN DelSnapshot %v\n", args)
+	reply.Status = nfs.DeleteSnapshot(string(args.Name))
+	return reply
+}
+
+// ADMINPROC_LISTSNAPSHOTS lists the names of the snapshots.
+func (nfs *Nfs) ADMINPROC_LISTSNAPSHOTS() nfstypes.LISTSNAPSHOTSres {
+	var reply nfstypes.LISTSNAPSHOTSres
+	util.DPrintf(1, "ADMIN ListSnapshots\n")
+	names, status := nfs.ListSnapshots()
+	reply.Status = status
+	for _, name := range names {
+		reply.Names = append(reply.Names, name...)
+		reply.Names = append(reply.Names, 0)
+	}
+	return reply
+}
+
+// ADMINPROC_CLONE clones a file; see Clone.
+func (nfs *Nfs) ADMINPROC_CLONE(args nfstypes.CLONEargs) nfstypes.CLONEres {
+	var reply nfstypes.CLONEres
+	util.DPrintf(1, "ADMIN Clone %v\n", args)
+	reply.Obj, reply.Status = nfs.Clone(args.Src, args.Where.Dir, args.Where.Name)
+	return reply
+}
+
+// ADMINPROC_SCRUB starts, pauses, resumes or stops the background
+// scrub, or changes its rate limit, and returns its statistics.
+func (nfs *Nfs) ADMINPROC_SCRUB(args nfstypes.SCRUBargs) nfstypes.SCRUBres {
+	var reply nfstypes.SCRUBres
+	util.DPrintf(1, "ADMIN Scrub %v\n", args)
+	reply.Status = nfstypes.NFS3_OK
+	switch uint32(args.Action) {
+	case nfstypes.SCRUB_STATUS:
+	case nfstypes.SCRUB_START:
+		nfs.scrubber.Start(uint64(args.Rate))
+	case nfstypes.SCRUB_PAUSE:
+		nfs.scrubber.Pause()
+	case nfstypes.SCRUB_RESUME:
+		nfs.scrubber.Resume()
+	case nfstypes.SCRUB_STOP:
+		nfs.scrubber.Stop()
+	case nfstypes.SCRUB_RATE:
+		nfs.scrubber.SetRate(uint64(args.Rate))
+	default:
+		reply.Status = nfstypes.NFS3ERR_INVAL
+	}
+	st := nfs.scrubber.Stats()
+	reply.Running = st.Running
+	reply.Paused = st.Paused
+	reply.Rate = nfstypes.Uint64(st.Rate)
+	reply.Passes = nfstypes.Uint64(st.Passes)
+	reply.Inum = nfstypes.Uint64(st.Inum)
+	reply.Inodes = nfstypes.Uint64(st.Inodes)
+	reply.Blocks = nfstypes.Uint64(st.Blocks)
+	reply.CsumErrors = nfstypes.Uint64(st.CsumErrors)
+	reply.Errors = nfstypes.Uint64(st.Errors)
+	return reply
+}
+
+// ADMINPROC_SETQUOTA sets the limits of a quota; see SetQuota.
+func (nfs *Nfs) ADMINPROC_SETQUOTA(args nfstypes.SETQUOTAargs) nfstypes.QUOTAres {
+	var reply nfstypes.QUOTAres
+	util.DPrintf(1, "ADMIN SetQuota %v\n", args)
+	reply.Quota, reply.Status = nfs.SetQuota(uint32(args.Type), uint32(args.Id),
+		alloc.Limits{
+			BlockHard: uint64(args.BlockHard),
+			BlockSoft: uint64(args.BlockSoft),
+			InodeHard: uint64(args.InodeHard),
+			InodeSoft: uint64(args.InodeSoft),
+		})
+	return reply
+}
+
+// ADMINPROC_GETQUOTA returns a quota's limits and usage.
+func (nfs *Nfs) ADMINPROC_GETQUOTA(args nfstypes.GETQUOTAargs) nfstypes.QUOTAres {
+	var reply nfstypes.QUOTAres
+	util.DPrintf(1, "ADMIN GetQuota %v\n", args)
+	reply.Quota, reply.Status = nfs.GetQuota(uint32(args.Type), uint32(args.Id))
+	return reply
+}
+
+// ADMINPROC_REPQUOTA reports the quotas of users or of groups.
+func (nfs *Nfs) ADMINPROC_REPQUOTA(args nfstypes.REPQUOTAargs) nfstypes.REPQUOTAres {
+	var reply nfstypes.REPQUOTAres
+	util.DPrintf(1, "ADMIN RepQuota %v\n", args)
+	reply.Quotas, reply.Status = nfs.RepQuota(uint32(args.Type))
+	return reply
+}
+
+// ADMINPROC_TRIM discards free blocks; see Trim.
+func (nfs *Nfs) ADMINPROC_TRIM(args nfstypes.TRIMargs) nfstypes.TRIMres {
+	var reply nfstypes.TRIMres
+	util.DPrintf(1, "ADMIN Trim %v\n", args)
+	n, err := nfs.Trim(uint64(args.Minlen))
+	reply.Status = err
+	reply.Blocks = nfstypes.Uint64(n)
+	return reply
+}
@@ -0,0 +1,167 @@
+package nfs
+
+import (
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/acl"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Clones.  A clone is a new file that shares the data blocks of
+// another file, copy-on-write, like the files of a snapshot, so cloning
+// a file takes no data blocks and doesn't copy the data.  A large clone
+// takes several transactions, which hold the source and the clone
+// locked throughout (see CommitNext), so that the clone is a copy of
+// the source at one point in time.  The clone is read-only until the
+// last one, so that if the server crashes before then, the clone
+// remains, read-only, with a prefix of the source's data.
+//
+
+// lockPair locks the inodes of file handles fh1 and fh2, in inode
+// order, and returns them in the order of the handles.  It aborts op
+// and returns nil if either handle is stale.
+func lockPair(op *fstxn.FsTxn, fh1 fh.Fh, fh2 fh.Fh) []*inode.Inode {
+	if op.Fs.Super.IsSysInum(fh1.Ino) || op.Fs.Super.IsSysInum(fh2.Ino) {
+		op.Abort()
+		return nil
+	}
+	inodes := lockInodes(op, twoInums(fh1.Ino, fh2.Ino))
+	if inodes == nil {
+		return nil
+	}
+	if inodes[0].Gen != fh1.Gen || inodes[1].Gen != fh2.Gen {
+		op.Abort()
+		return nil
+	}
+	return inodes
+}
+
+// cloneCreate creates the clone of src in directory dfh, named name,
+// empty and read-only.  It returns the op, with the source and the
+// clone locked, or an error.
+func (nfs *Nfs) cloneCreate(src fh.Fh, dfh fh.Fh, name nfstypes.Filename3) (*fstxn.FsTxn, *inode.Inode, *inode.Inode, nfstypes.Nfsstat3) {
+	for {
+		op := fstxn.Begin(nfs.fsstate)
+		inodes := lockPair(op, src, dfh)
+		if inodes == nil {
+			return nil, nil, nil, nfstypes.NFS3ERR_STALE
+		}
+		sip := inodes[0]
+		dip := inodes[1]
+		var err = nfstypes.NFS3_OK
+		if sip.Kind != nfstypes.NF3REG {
+			err = nfstypes.NFS3ERR_INVAL
+		} else if dip.Kind != nfstypes.NF3DIR {
+			err = nfstypes.NFS3ERR_NOTDIR
+		} else if dip.ReadOnly() {
+			err = nfstypes.NFS3ERR_ROFS
+		} else if !nfs.permit(op, sip, acl.READ) ||
+			!nfs.permit(op, dip, acl.WRITE|acl.EXECUTE) {
+			err = nfstypes.NFS3ERR_ACCES
+		}
+		if err != nfstypes.NFS3_OK {
+			op.Abort()
+			return nil, nil, nil, err
+		}
+		if dip.IsShrinking() {
+			dinum := dip.Inum
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(dinum) {
+				return nil, nil, nil, nfstypes.NFS3ERR_SERVERFAULT
+			}
+			continue
+		}
+		inum, _ := dir.LookupName(dip, op, name)
+		if inum != common.NULLINUM {
+			op.Abort()
+			return nil, nil, nil, nfstypes.NFS3ERR_EXIST
+		}
+		ip := op.AllocInode(nfstypes.NF3REG, dip.Inum, nfs.owner())
+		if ip == nil {
+			op.Abort()
+			return nil, nil, nil, nfstypes.NFS3ERR_NOSPC
+		}
+		if ip.IsShrinking() {
+			inum := ip.Inum
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(inum) {
+				return nil, nil, nil, nfstypes.NFS3ERR_SERVERFAULT
+			}
+			continue
+		}
+		if err := acl.Inherit(dip, ip, op.Atxn); err != nfstypes.NFS3_OK {
+			op.Abort()
+			return nil, nil, nil, err
+		}
+		ip.SetReadOnly(op.Atxn)
+		if !dir.AddName(dip, op, ip.Inum, nfstypes.NF3REG, name) {
+			err := dir.AddNameErr(dip, op, name)
+			op.Abort()
+			return nil, nil, nil, err
+		}
+		return op, sip, ip, nfstypes.NFS3_OK
+	}
+}
+
+// Clone creates a file named name in directory dfh that shares the
+// data of file src, copy-on-write, and returns its file handle.
+func (nfs *Nfs) Clone(src nfstypes.Nfs_fh3, dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (nfstypes.Nfs_fh3, nfstypes.Nfsstat3) {
+	var none nfstypes.Nfs_fh3
+	if dir.IllegalName(name) {
+		return none, nfstypes.NFS3ERR_INVAL
+	}
+	if dir.NameTooLong(name) {
+		return none, nfstypes.NFS3ERR_NAMETOOLONG
+	}
+	if err := nfs.ensureRefs(); err != nfstypes.NFS3_OK {
+		return none, err
+	}
+	nfs.writeBack(src)
+	srcfh := fh.MakeFh(src)
+	dirfh := fh.MakeFh(dfh)
+	if srcfh.Ino == dirfh.Ino {
+		return none, nfstypes.NFS3ERR_INVAL
+	}
+	op, sip, ip, err := nfs.cloneCreate(srcfh, dirfh, name)
+	if err != nfstypes.NFS3_OK {
+		return none, err
+	}
+	clone := fh.Fh{Ino: ip.Inum, Gen: ip.Gen}
+	var bn uint64 = 0
+	for {
+		next, ok := ip.Share(op.Atxn, sip, bn)
+		if !ok {
+			op.Abort()
+			err = nfstypes.NFS3ERR_NOSPC
+			break
+		}
+		if next >= util.RoundUp(sip.Size, disk.BlockSize) {
+			ip.ClearReadOnly(op.Atxn)
+			if op.Commit() {
+				util.DPrintf(1, "Clone # %d to # %d\n", srcfh.Ino, clone.Ino)
+				return clone.MakeFh3(), nfstypes.NFS3_OK
+			}
+			err = commitErr(op)
+			break
+		}
+		nop := op.CommitNext(sip, ip)
+		if nop == nil {
+			err = commitErr(op)
+			break
+		}
+		op = nop
+		bn = next
+	}
+	if bn > 0 {
+		// remove the partial clone that earlier transactions committed
+		nfs.removeName(dirfh.Ino, string(name), clone.Ino)
+	}
+	return none, err
+}
@@ -0,0 +1,28 @@
+package nfs
+
+import (
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// CompactDir compacts directory dfh and shrinks it to the blocks its
+// entries need. REMOVE starts compaction in the background once a
+// directory becomes sparse; CompactDir runs it right away.
+func (nfs *Nfs) CompactDir(dfh nfstypes.Nfs_fh3) nfstypes.Nfsstat3 {
+	op := fstxn.Begin(nfs.fsstate)
+	dip := op.GetInodeFh(dfh)
+	if dip == nil {
+		op.Abort()
+		return nfstypes.NFS3ERR_STALE
+	}
+	if dip.Kind != nfstypes.NF3DIR {
+		op.Abort()
+		return nfstypes.NFS3ERR_NOTDIR
+	}
+	inum := dip.Inum
+	op.Abort()
+	if !nfs.shrinkst.DoCompact(inum) {
+		return nfstypes.NFS3ERR_SERVERFAULT
+	}
+	return nfstypes.NFS3_OK
+}
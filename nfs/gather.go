@@ -0,0 +1,303 @@
+package nfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Write gathering.  With Gather set, an UNSTABLE WRITE to a file that
+// was just written copies its data into the file's write-back buffer
+// and returns, instead of running a transaction.  The buffer merges
+// adjacent and overlapping writes, and writes them back in a few large
+// transactions when the client commits, when the file's buffer fills
+// up, GATHERDELAY after the first write it holds, and before any other
+// operation that may look at the file's data or remove it; LOOKUP and
+// READDIRPLUS instead report the size that the buffered writes give
+// the file, as WRITE did.  The first write of a run goes
+// through a transaction, which checks that the file exists and that
+// its caller may write it; an operation that could change that writes
+// the buffer back first, and the next write starts a new run.  Only
+// writes with the first write's credentials join its run, and the
+// write-back runs on its caller's behalf.
+//
+// Like unstable transactions in the log, buffered writes are lost in a
+// crash, which changes the write verifier, so that clients resend the
+// writes they haven't committed.  A write-back that fails loses writes
+// that were acknowledged, and changes the verifier too.
+//
+
+const (
+	GATHERFILE  uint64 = WRITEMAX      // write back a file's buffer at this size
+	GATHERMAX   uint64 = 16 * WRITEMAX // buffer no more than this in all
+	GATHERDELAY        = time.Second   // write back a buffer this long after its first write
+)
+
+// wseg is a run of buffered bytes.
+type wseg struct {
+	off  uint64
+	data []byte
+}
+
+func (s wseg) end() uint64 {
+	return s.off + uint64(len(s.data))
+}
+
+// gathered is the write-back buffer of a file.
+type gathered struct {
+	fh3      nfstypes.Nfs_fh3
+	as       *Nfs   // the caller whose writes the buffer holds
+	segs     []wseg // sorted, neither overlapping nor adjacent
+	nbytes   uint64
+	attr     nfstypes.Fattr3 // the file's attributes with the writes
+	flushing bool
+	timer    *time.Timer
+}
+
+type gatherSt struct {
+	mu      *sync.Mutex
+	cond    *sync.Cond
+	files   map[fh.Fh]*gathered
+	nbytes  uint64 // # bytes buffered in all files
+	verf    uint64
+	stopped bool
+}
+
+func mkGatherSt() *gatherSt {
+	mu := new(sync.Mutex)
+	return &gatherSt{
+		mu:    mu,
+		cond:  sync.NewCond(mu),
+		files: make(map[fh.Fh]*gathered),
+		verf:  uint64(time.Now().UnixNano()),
+	}
+}
+
+// writeVerf returns the write verifier, which changes when the server
+// loses unstable writes.
+func (nfs *Nfs) writeVerf() nfstypes.Writeverf3 {
+	nfs.wb.mu.Lock()
+	enc := marshal.NewEnc(uint64(nfstypes.NFS3_WRITEVERFSIZE))
+	enc.PutInt(nfs.wb.verf)
+	nfs.wb.mu.Unlock()
+	var verf nfstypes.Writeverf3
+	copy(verf[:], enc.Finish())
+	return verf
+}
+
+// insertSeg merges s into segs, over the bytes already there.  It
+// returns the new segments and the number of bytes they grew by.
+func insertSeg(segs []wseg, s wseg) ([]wseg, uint64) {
+	var i = 0
+	for i < len(segs) && segs[i].end() < s.off {
+		i++
+	}
+	var j = i
+	var lo = s.off
+	var hi = s.end()
+	var old uint64 = 0
+	for j < len(segs) && segs[j].off <= s.end() {
+		lo = util.Min(lo, segs[j].off)
+		if segs[j].end() > hi {
+			hi = segs[j].end()
+		}
+		old += uint64(len(segs[j].data))
+		j++
+	}
+	var data = make([]byte, hi-lo)
+	for _, o := range segs[i:j] {
+		copy(data[o.off-lo:], o.data)
+	}
+	copy(data[s.off-lo:], s.data)
+	r := make([]wseg, 0, len(segs)-(j-i)+1)
+	r = append(r, segs[:i]...)
+	r = append(r, wseg{off: lo, data: data})
+	r = append(r, segs[j:]...)
+	return r, uint64(len(data)) - old
+}
+
+// gatherWrite buffers an UNSTABLE write of data at off, if the file
+// has a write-back buffer and there is room.  It returns the file's
+// attributes with the write.
+func (nfs *Nfs) gatherWrite(fh3 nfstypes.Nfs_fh3, off uint64, data []byte) (nfstypes.Fattr3, bool) {
+	key := fh.MakeFh(fh3)
+	wb := nfs.wb
+	wb.mu.Lock()
+	g := wb.files[key]
+	if g == nil || wb.stopped || !g.as.cred.Equal(nfs.cred) ||
+		wb.nbytes+uint64(len(data)) > GATHERMAX ||
+		off+uint64(len(data)) > inode.MaxFileSize() {
+		wb.mu.Unlock()
+		return nfstypes.Fattr3{}, false
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	segs, grown := insertSeg(g.segs, wseg{off: off, data: buf})
+	g.segs = segs
+	g.nbytes += grown
+	wb.nbytes += grown
+	if uint64(g.attr.Size) < off+uint64(len(data)) {
+		g.attr.Size = nfstypes.Size3(off + uint64(len(data)))
+	}
+	if g.timer == nil {
+		g.timer = time.AfterFunc(GATHERDELAY, func() {
+			nfs.writeBack(fh3)
+		})
+	}
+	attr := g.attr
+	full := g.nbytes >= GATHERFILE
+	wb.mu.Unlock()
+	util.DPrintf(5, "gatherWrite %v off %d cnt %d\n", key, off, len(data))
+	if full {
+		nfs.writeBack(fh3)
+	}
+	return attr, true
+}
+
+// startGather gives a file a write-back buffer, which gathers the
+// caller's next UNSTABLE writes.  attr are the file's attributes.
+func (nfs *Nfs) startGather(fh3 nfstypes.Nfs_fh3, attr nfstypes.Fattr3) {
+	key := fh.MakeFh(fh3)
+	wb := nfs.wb
+	wb.mu.Lock()
+	if !wb.stopped && wb.files[key] == nil {
+		wb.files[key] = &gathered{fh3: fh3, as: nfs, attr: attr}
+	}
+	wb.mu.Unlock()
+}
+
+// writeBack writes the file's buffered writes, if any, in UNSTABLE
+// transactions, and drops its write-back buffer unless more writes
+// arrived meanwhile.  It returns the error that stopped it.
+func (nfs *Nfs) writeBack(fh3 nfstypes.Nfs_fh3) nfstypes.Nfsstat3 {
+	key := fh.MakeFh(fh3)
+	wb := nfs.wb
+	wb.mu.Lock()
+	var g *gathered
+	for {
+		g = wb.files[key]
+		if g == nil {
+			wb.mu.Unlock()
+			return nfstypes.NFS3_OK
+		}
+		if !g.flushing {
+			break
+		}
+		wb.cond.Wait()
+	}
+	segs := g.segs
+	g.segs = nil
+	wb.nbytes -= g.nbytes
+	g.nbytes = 0
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	g.flushing = true
+	wb.mu.Unlock()
+
+	var status = nfstypes.NFS3_OK
+	for _, s := range segs {
+		n, _, err := g.as.write(g.fh3, s.off, s.data, nfstypes.UNSTABLE)
+		if err != nfstypes.NFS3_OK {
+			status = err
+			break
+		}
+		if n < uint64(len(s.data)) {
+			status = nfstypes.NFS3ERR_IO
+			break
+		}
+	}
+
+	wb.mu.Lock()
+	g.flushing = false
+	if len(g.segs) == 0 {
+		delete(wb.files, key)
+	}
+	if status != nfstypes.NFS3_OK {
+		util.DPrintf(0, "writeBack %v: lost writes %v\n", key, status)
+		wb.verf++
+	}
+	wb.cond.Broadcast()
+	wb.mu.Unlock()
+	return status
+}
+
+// writeBackName writes back the buffer of the file that name refers
+// to in directory dfh, if it has one, before an operation that may
+// remove the file.
+func (nfs *Nfs) writeBackName(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) {
+	wb := nfs.wb
+	wb.mu.Lock()
+	n := len(wb.files)
+	wb.mu.Unlock()
+	if n == 0 {
+		return
+	}
+	op, inodes, err := nfs.getInodesLocked(fstxn.BeginReadOnly, dfh, name)
+	if err != nfstypes.NFS3_OK {
+		op.Abort()
+		return
+	}
+	fh3 := fh.Fh{Ino: inodes[0].Inum, Gen: inodes[0].Gen}.MakeFh3()
+	op.Commit()
+	nfs.writeBack(fh3)
+}
+
+// gatheredAttr returns attr, the attributes of file fh3, with the size
+// that its buffered writes give it.
+func (nfs *Nfs) gatheredAttr(fh3 nfstypes.Nfs_fh3, attr nfstypes.Fattr3) nfstypes.Fattr3 {
+	wb := nfs.wb
+	wb.mu.Lock()
+	g := wb.files[fh.MakeFh(fh3)]
+	if g != nil && g.attr.Size > attr.Size {
+		attr.Size = g.attr.Size
+	}
+	wb.mu.Unlock()
+	return attr
+}
+
+// writeBackAll writes back the buffers of all files.
+func (nfs *Nfs) writeBackAll() {
+	wb := nfs.wb
+	wb.mu.Lock()
+	var fhs []nfstypes.Nfs_fh3
+	for _, g := range wb.files {
+		fhs = append(fhs, g.fh3)
+	}
+	wb.mu.Unlock()
+	for _, fh3 := range fhs {
+		nfs.writeBack(fh3)
+	}
+}
+
+// stopGather stops gathering writes and waits for write-backs that are
+// running.  If drop is set, it discards the writes still buffered, as
+// a crash would.
+func (nfs *Nfs) stopGather(drop bool) {
+	wb := nfs.wb
+	wb.mu.Lock()
+	wb.stopped = true
+	for key, g := range wb.files {
+		for g.flushing {
+			wb.cond.Wait()
+		}
+		if g.timer != nil {
+			g.timer.Stop()
+			g.timer = nil
+		}
+		if drop {
+			wb.nbytes -= g.nbytes
+			delete(wb.files, key)
+		}
+	}
+	wb.mu.Unlock()
+}
@@ -0,0 +1,108 @@
+package nfs
+
+import (
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+// Grow grows the file system to size blocks, or to the whole disk if
+// size is 0, while the server is running.  It also adds ninode inodes,
+// rounded up to a multiple of an inode bitmap block's worth.
+//
+// The new space starts with a region holding the bitmap blocks for
+// the new blocks and the new inode bitmap and inode blocks.  Since the
+// region is outside the file system, Grow writes it directly, and
+// then commits the new super block and frees the new blocks in the
+// old block bitmap in one transaction.  If the server crashes before
+// the commit, the file system keeps its old size.
+func (nfs *Nfs) Grow(size uint64, ninode uint64) nfstypes.Nfsstat3 {
+	nfs.growMu.Lock()
+	defer nfs.growMu.Unlock()
+
+	fs := nfs.fsstate.Super
+	old := fs.Layout()
+	if size == 0 {
+		size = fs.Disk.Size()
+	}
+	util.DPrintf(1, "Grow %d -> %d, %d inodes\n", old.Maxaddr, size, ninode)
+	if size < old.Maxaddr || size > fs.Disk.Size() {
+		return nfstypes.NFS3ERR_INVAL
+	}
+	if size == old.Maxaddr && ninode == 0 {
+		return nfstypes.NFS3_OK
+	}
+
+	nbb := fs.NBlockBitmap()
+	covered := nbb * common.NBITBLOCK
+	var newbb uint64 = 0
+	if size > covered {
+		newbb = util.RoundUp(size-covered, common.NBITBLOCK)
+	}
+	r := super.Region{
+		Start:        common.Bnum(old.Maxaddr),
+		NBlockBitmap: newbb,
+		NInodeBitmap: util.RoundUp(ninode, common.NBITBLOCK),
+	}
+	if uint64(r.End()) > size {
+		return nfstypes.NFS3ERR_NOSPC
+	}
+	if r.Len() > 0 && uint64(len(old.Regions)) >= super.MAXREGION {
+		return nfstypes.NFS3ERR_NOSPC
+	}
+	lay := old.Grow(size, r)
+
+	// write the new region
+	var bitmap []byte
+	for k := uint64(0); k < newbb; k++ {
+		blk := make(disk.Block, disk.BlockSize)
+		for i := uint64(0); i < common.NBITBLOCK; i++ {
+			bn := (nbb+k)*common.NBITBLOCK + i
+			if bn < uint64(r.End()) || bn >= size {
+				blk[i/8] = blk[i/8] | 1<<(i%8)
+			}
+		}
+		fs.Disk.Write(uint64(r.Start)+k, blk)
+		bitmap = append(bitmap, blk...)
+	}
+	zero := make(disk.Block, disk.BlockSize)
+	for bn := uint64(r.Start) + newbb; bn < uint64(r.End()); bn++ {
+		fs.Disk.Write(bn, zero)
+	}
+	fs.Disk.Barrier()
+
+	// the old bitmap marks the blocks from the old size to the end
+	// of the blocks it covers as used
+	var end = size
+	if end > covered {
+		end = covered
+	}
+	op := fstxn.Begin(nfs.fsstate)
+	op.Atxn.Op.OverWrite(addr.MkAddr(fs.SuperBlock(), 0), disk.BlockSize*8,
+		lay.Encode())
+	for bn := uint64(r.End()); bn < end; bn++ {
+		op.Atxn.WriteBit(fs.BlockBitAddr(bn), false)
+	}
+	if !op.Commit() {
+		return nfstypes.NFS3ERR_SERVERFAULT
+	}
+
+	fs.SetLayout(lay)
+	for bn := uint64(r.End()); bn < end; bn++ {
+		nfs.fsstate.Balloc.FreeNum(bn)
+	}
+	if newbb > 0 {
+		nfs.fsstate.Balloc.Extend(bitmap)
+	}
+	if r.NInodeBitmap > 0 {
+		nfs.fsstate.Ialloc.Extend(make([]byte, r.NInodeBitmap*disk.BlockSize))
+	}
+	nfs.fsstate.SetReserve()
+	util.DPrintf(1, "Grow: size %d inodes %d\n", fs.MaxBnum(), fs.NInode())
+	return nfstypes.NFS3_OK
+}
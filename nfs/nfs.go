@@ -1,69 +1,152 @@
 package nfs
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/goose-lang/primitive/disk"
 
+	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/obj"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/acl"
+	"github.com/mit-pdos/go-nfsd/alloc"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/scrub"
 	"github.com/mit-pdos/go-nfsd/shrinker"
 	"github.com/mit-pdos/go-nfsd/super"
 	"github.com/mit-pdos/go-nfsd/util/stats"
 )
 
-// Nfs provides the main NFS server state and helper threads.
+// Nfs provides the main NFS server state and helper threads, and runs
+// operations on behalf of a caller (see As).
 type Nfs struct {
+	*server
+	// the caller, whose credentials check access to files and own
+	// the files it creates
+	cred acl.Cred
+}
+
+type server struct {
 	fsstate  *fstxn.FsState
 	shrinkst *shrinker.ShrinkerSt
+	scrubber *scrub.Scrubber
 	// support unstable writes
 	Unstable bool
+	// map new regular files with extent trees
+	Extents bool
+	// compress the data of new regular files
+	Compress bool
+	// store writes of whole blocks of zeros as holes
+	Sparse bool
+	// write new data blocks directly instead of through the log
+	Ordered bool
+	// gather UNSTABLE writes in write-back buffers (see gather.go)
+	Gather bool
+	wb     *gatherSt
+	// serializes Grow and other updates of the super block
+	growMu *sync.Mutex
+	// serializes taking and deleting snapshots
+	snapMu *sync.Mutex
 	// statistics
 	stats [NUM_NFS_OPS]stats.Op
 }
 
-// MakeNfs initializes a new NFS server backed by disk d.
+// MakeNfs initializes a new NFS server backed by disk d, making a new
+// file system if d is blank.  It panics if d holds anything else it
+// can't open.
 func MakeNfs(d disk.Disk) *Nfs {
+	nfs, err := OpenNfs(d, false)
+	if err != nil {
+		panic(err)
+	}
+	return nfs
+}
+
+// OpenNfs initializes a new NFS server backed by disk d.  It makes a
+// new file system if d is blank or if mkfs is set, and otherwise fails
+// unless d holds a file system of this version, so that it never
+// overwrites a disk that it doesn't understand unless asked to.
+func OpenNfs(d disk.Disk, mkfs bool) (*Nfs, error) {
 	// run first so that disk is initialized before mkLog
-	super := super.MkFsSuper(d)
+	fs := super.MkFsSuper(d)
+
+	ld := fstxn.MkLogDisk(d)
+	log := obj.MkLog(ld) // runs recovery
+
+	if !mkfs {
+		// read the super block through the log, which may hold a
+		// committed update to it
+		sb := log.Load(addr.MkAddr(fs.SuperBlock(), 0), common.NBITBLOCK)
+		err := fs.Load(sb.Data)
+		if err == super.ErrBlank {
+			mkfs = true
+		} else if err != nil {
+			log.Shutdown()
+			return nil, fmt.Errorf("cannot open file system: %w", err)
+		}
+	}
+	if mkfs { // make a new file system?
+		makeFs(fs)
+	}
 	util.DPrintf(1, "Super: "+
 		"Size %d NBlockBitmap %d NInodeBitmap %d Maxaddr %d\n",
-		d.Size(),
-		super.NBlockBitmap, super.NInodeBitmap, super.Maxaddr)
-
-	log := obj.MkLog(d) // runs recovery
+		d.Size(), fs.NBlockBitmap(), fs.NInodeBitmap(), fs.MaxBnum())
 
-	i := readRootInode(super)
-	if i.Kind == 0 { // make a new file system?
-		makeFs(super)
-	}
-
-	st := fstxn.MkFsState(super, log)
-	nfs := &Nfs{
+	st := fstxn.MkFsState(fs, log, ld)
+	nfs := &Nfs{server: &server{
 		fsstate:  st,
 		shrinkst: shrinker.MkShrinkerSt(st),
+		scrubber: scrub.MkScrubber(st),
 		Unstable: true,
-	}
-	if i.Kind == 0 {
+		growMu:   new(sync.Mutex),
+		snapMu:   new(sync.Mutex),
+		wb:       mkGatherSt(),
+	}, cred: RootCred}
+	if mkfs {
 		nfs.makeRootDir()
 	}
-	return nfs
+	return nfs, nil
+}
+
+// RootCred are the credentials of root, on whose behalf the Nfs that
+// MakeNfs and OpenNfs return run operations.
+var RootCred = acl.Cred{Uid: 0, Gid: 0}
+
+// As returns an Nfs for the same server that runs operations on behalf
+// of the caller with credentials cred, such as the AUTH_UNIX
+// credentials of an RPC.
+func (nfs *Nfs) As(cred acl.Cred) *Nfs {
+	return &Nfs{server: nfs.server, cred: cred}
+}
+
+// owner returns the owner of the files the caller creates.
+func (nfs *Nfs) owner() alloc.Owner {
+	return alloc.Owner{Uid: nfs.cred.Uid, Gid: nfs.cred.Gid}
 }
 
 // ShutdownNfs cleanly shuts down the server and background threads.
 func (nfs *Nfs) ShutdownNfs() {
 	util.DPrintf(1, "Shutdown\n")
+	nfs.stopGather(false)
+	nfs.writeBackAll()
+	nfs.scrubber.Stop()
 	nfs.shrinkst.Shutdown()
+	nfs.fsstate.StopFences()
 	nfs.fsstate.Txn.Shutdown()
 	util.DPrintf(1, "Shutdown done\n")
 }
 
-// Crash terminates the shrinker and shuts down without waiting.
+// Crash drops gathered writes, terminates the shrinker, and shuts down
+// without waiting.
 func (nfs *Nfs) Crash() {
 	util.DPrintf(0, "Crash: terminate shrinker\n")
+	nfs.stopGather(true)
 	nfs.shrinkst.Crash()
 	nfs.ShutdownNfs()
 }
@@ -75,31 +158,60 @@ func (nfs *Nfs) makeRootDir() {
 		panic("makeRootDir")
 	}
 	dir.MkRootDir(ip, op)
+	op.Atxn.Charge(ip.Owner(), 0, 1) // mkfs wrote the inode
+	for _, inum := range []common.Inum{super.USRQUOTAINUM, super.GRPQUOTAINUM} {
+		qip := op.GetInodeInumFree(inum)
+		if qip == nil {
+			panic("makeRootDir")
+		}
+		qip.InitInode(inum, nfstypes.NF3REG, alloc.NOOWNER)
+		qip.WriteInode(op.Atxn)
+	}
 	ok := op.Commit()
 	if !ok {
 		panic("makeRootDir")
 	}
 }
 
-// Make an empty file system
-func makeFs(super *super.FsSuper) {
+// Make an empty file system.  The disk may hold another file system,
+// or a file system that an earlier makeFs didn't finish, so clear all
+// of the metadata first; this also makes the stored checksum of every
+// block 0, the checksum of a block that was never written.
+func makeFs(fs *super.FsSuper) {
 	util.DPrintf(1, "mkfs")
 
+	// clear the super block first, so that a crash leaves a blank
+	// disk rather than a file system with some of its metadata
+	// cleared
+	zero := make(disk.Block, disk.BlockSize)
+	fs.Disk.Write(uint64(fs.SuperBlock()), zero)
+	fs.Disk.Barrier()
+	r := fs.Layout().Regions[0]
+	for bn := r.Start; bn < r.End(); bn++ {
+		fs.Disk.Write(uint64(bn), zero)
+	}
+
 	root := inode.MkRootInode()
 	util.DPrintf(1, "root %v\n", root)
-	raddr := super.Inum2Addr(common.ROOTINUM)
+	raddr := fs.Inum2Addr(common.ROOTINUM)
 	rootblk := root.Encode()
-	rootbuf := buf.MkBuf(raddr, common.INODESZ*8, rootblk)
-	rootbuf.WriteDirect(super.Disk)
+	rootbuf := buf.MkBuf(raddr, super.INODESZ*8, rootblk)
+	rootbuf.WriteDirect(fs.Disk)
+
+	markAlloc(fs, fs.DataStart(), fs.MaxBnum())
 
-	markAlloc(super, super.DataStart(), super.MaxBnum())
+	// write the super block last, since it marks the file system
+	// as made
+	fs.Disk.Barrier()
+	fs.Disk.Write(uint64(fs.SuperBlock()), fs.Layout().Encode())
+	fs.Disk.Barrier()
 }
 
-func markAlloc(super *super.FsSuper, n common.Bnum, m common.Bnum) {
+func markAlloc(fs *super.FsSuper, n common.Bnum, m common.Bnum) {
 	util.DPrintf(1, "markAlloc: [0, %d) and [%d,%d)\n", n, m,
-		super.NBlockBitmap*common.NBITBLOCK)
+		fs.NBlockBitmap()*common.NBITBLOCK)
 	if n >= common.Bnum(common.NBITBLOCK) ||
-		m >= common.Bnum(common.NBITBLOCK*super.NBlockBitmap) ||
+		m >= common.Bnum(common.NBITBLOCK*fs.NBlockBitmap()) ||
 		m < n {
 		panic("markAlloc: configuration makes no sense")
 	}
@@ -109,11 +221,11 @@ func markAlloc(super *super.FsSuper, n common.Bnum, m common.Bnum) {
 		bit := bn % 8
 		blk[byte] = blk[byte] | 1<<bit
 	}
-	super.Disk.Write(uint64(super.BitmapBlockStart()), blk)
+	fs.Disk.Write(uint64(fs.BlockBitmapBlock(0)), blk)
 
 	var blk1 = blk
-	blkno := m/common.Bnum(common.NBITBLOCK) + super.BitmapBlockStart()
-	if blkno > super.BitmapBlockStart() {
+	k := m / common.Bnum(common.NBITBLOCK)
+	if k > 0 {
 		blk1 = make(disk.Block, disk.BlockSize)
 	}
 	for bn := uint64(m) % common.NBITBLOCK; bn < common.NBITBLOCK; bn++ {
@@ -121,19 +233,13 @@ func markAlloc(super *super.FsSuper, n common.Bnum, m common.Bnum) {
 		bit := bn % 8
 		blk1[byte] = blk1[byte] | 1<<bit
 	}
-	super.Disk.Write(uint64(blkno), blk1)
+	fs.Disk.Write(uint64(fs.BlockBitmapBlock(k)), blk1)
 
-	// mark inode 0 and 1 as allocated
+	// mark inode 0, the root directory's, and the quota tables' as
+	// allocated
 	blk2 := make(disk.Block, disk.BlockSize)
-	blk2[0] = blk2[0] | 1<<0
-	blk2[0] = blk2[0] | 1<<1
-	super.Disk.Write(uint64(super.BitmapInodeStart()), blk2)
-}
-
-func readRootInode(super *super.FsSuper) *inode.Inode {
-	addr := super.Inum2Addr(common.ROOTINUM)
-	blk := super.Disk.Read(uint64(addr.Blkno))
-	buf := buf.MkBufLoad(addr, common.INODESZ*8, blk)
-	i := inode.Decode(buf, common.ROOTINUM)
-	return i
+	for inum := uint64(0); inum < super.NRESERVED; inum++ {
+		blk2[0] = blk2[0] | 1<<inum
+	}
+	fs.Disk.Write(uint64(fs.InodeBitmapBlock(0)), blk2)
 }
@@ -151,6 +151,17 @@ func (clnt *NfsClient) SetattrOp(fh nfstypes.Nfs_fh3, sz uint64) nfstypes.SETATT
 	return reply
 }
 
+// ChownOp sets the owner and group of a file.
+func (clnt *NfsClient) ChownOp(fh nfstypes.Nfs_fh3, uid uint32, gid uint32) nfstypes.SETATTR3res {
+	attr := nfstypes.Sattr3{
+		Uid: nfstypes.Set_uid3{Set_it: true, Uid: nfstypes.Uid3(uid)},
+		Gid: nfstypes.Set_gid3{Set_it: true, Gid: nfstypes.Gid3(gid)},
+	}
+	args := nfstypes.SETATTR3args{Object: fh, New_attributes: attr}
+	reply := clnt.srv.NFSPROC3_SETATTR(args)
+	return reply
+}
+
 // ReadDirPlusOp issues a READDIRPLUS request for directory listings.
 func (clnt *NfsClient) ReadDirPlusOp(dir nfstypes.Nfs_fh3, cnt uint64) nfstypes.READDIRPLUS3res {
 	args := nfstypes.READDIRPLUS3args{Dir: dir, Dircount: nfstypes.Count3(100), Maxcount: nfstypes.Count3(cnt)}
@@ -185,3 +196,13 @@ func Parallel(nthread int, disksz uint64,
 	clnt.Shutdown()
 	return n
 }
+
+// CloneOp clones file src into directory dir, as name, through the
+// admin program.
+func (clnt *NfsClient) CloneOp(src nfstypes.Nfs_fh3, dir nfstypes.Nfs_fh3, name string) nfstypes.CLONEres {
+	args := nfstypes.CLONEargs{
+		Src:   src,
+		Where: nfstypes.Diropargs3{Dir: dir, Name: nfstypes.Filename3(name)},
+	}
+	return clnt.srv.ADMINPROC_CLONE(args)
+}
@@ -3,9 +3,11 @@ package nfs
 import (
 	"time"
 
+	"github.com/goose-lang/primitive/disk"
+
 	"github.com/mit-pdos/go-journal/common"
-	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/acl"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/fstxn"
@@ -23,18 +25,35 @@ import (
 // lock order).
 //
 
+// errRet aborts op and returns err, or NFS3ERR_IO if op ran into a
+// block or inode that failed its checksum, which is likely the cause
+// of err.
 func errRet(op *fstxn.FsTxn, status *nfstypes.Nfsstat3, err nfstypes.Nfsstat3) {
+	if op.Corrupt() {
+		err = nfstypes.NFS3ERR_IO
+	}
 	*status = err
 	util.DPrintf(2, "errRet %v", err)
 	op.Abort()
 }
 
+// commitErr returns the error for op failing to commit.
+func commitErr(op *fstxn.FsTxn) nfstypes.Nfsstat3 {
+	if op.Corrupt() {
+		return nfstypes.NFS3ERR_IO
+	}
+	if op.OverQuota() {
+		return nfstypes.NFS3ERR_DQUOT
+	}
+	return nfstypes.NFS3ERR_SERVERFAULT
+}
+
 func commitReply(op *fstxn.FsTxn, status *nfstypes.Nfsstat3) {
 	ok := op.Commit()
 	if ok {
 		*status = nfstypes.NFS3_OK
 	} else {
-		*status = nfstypes.NFS3ERR_SERVERFAULT
+		*status = commitErr(op)
 	}
 }
 
@@ -48,7 +67,8 @@ func (nfs *Nfs) NFSPROC3_GETATTR(args nfstypes.GETATTR3args) nfstypes.GETATTR3re
 	defer nfs.recordOp(nfstypes.NFSPROC3_GETATTR, time.Now())
 	var reply nfstypes.GETATTR3res
 	util.DPrintf(1, "NFS GetAttr %v\n", args)
-	op := fstxn.Begin(nfs.fsstate)
+	nfs.writeBack(args.Object)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
 	ip := op.GetInodeFh(args.Object)
 	if ip == nil {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
@@ -79,12 +99,12 @@ func (nfs *Nfs) getShrink(fh nfstypes.Nfs_fh3) (*fstxn.FsTxn, *inode.Inode, nfst
 		util.DPrintf(1, "getShrink: abort to shrink")
 		op.Abort()
 		ok = nfs.shrinkst.DoShrink(inum)
-		op = fstxn.Begin(nfs.fsstate)
 		if !ok {
+			op = fstxn.Begin(nfs.fsstate)
 			err = nfstypes.NFS3ERR_SERVERFAULT
 			break
 		}
-		util.DPrintf(1, "getShrink: retry %p\n", op.Atxn.Id())
+		util.DPrintf(1, "getShrink: retry # %v\n", inum)
 	}
 	return op, ip, err
 }
@@ -95,23 +115,48 @@ func (nfs *Nfs) NFSPROC3_SETATTR(args nfstypes.SETATTR3args) nfstypes.SETATTR3re
 	var reply nfstypes.SETATTR3res
 
 	util.DPrintf(1, "NFS SetAttr %v\n", args)
+	nfs.writeBack(args.Object)
 	op, ip, err := nfs.getShrink(args.Object)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 
 	}
+	if ip.ReadOnly() {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ROFS)
+		return reply
+	}
 	if args.New_attributes.Mode.Set_it {
 		util.DPrintf(1, "NFS SetAttr ignore mode %v\n", args)
 		err = nfstypes.NFS3_OK
 	}
-	if args.New_attributes.Uid.Set_it {
-		util.DPrintf(1, "NFS SetAttr uid not supported %v\n", args)
-	}
-	if args.New_attributes.Gid.Set_it {
-		util.DPrintf(1, "NFS SetAttr gid not supported %v\n", args)
+	if args.New_attributes.Uid.Set_it || args.New_attributes.Gid.Set_it {
+		util.DPrintf(1, "NFS SetAttr owner %v\n", args)
+		owner := ip.Owner()
+		if args.New_attributes.Uid.Set_it {
+			owner.Uid = uint32(args.New_attributes.Uid.Uid)
+		}
+		if args.New_attributes.Gid.Set_it {
+			owner.Gid = uint32(args.New_attributes.Gid.Gid)
+		}
+		if !nfs.mayChown(ip, owner) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_PERM)
+			return reply
+		}
+		if owner != ip.Owner() {
+			ip.Chown(op.Atxn, owner)
+		}
+		err = nfstypes.NFS3_OK
 	}
 	if args.New_attributes.Size.Set_it {
+		if !nfs.permit(op, ip, acl.WRITE) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+			return reply
+		}
+		if !ip.PrepareSize(op.Atxn, uint64(args.New_attributes.Size.Size)) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
+			return reply
+		}
 		shrink := ip.Resize(op.Atxn, uint64(args.New_attributes.Size.Size))
 		if shrink {
 			nfs.shrinkst.StartShrinker(ip.Inum)
@@ -159,15 +204,16 @@ func twoInodes(ino1, ino2 *inode.Inode) []*inode.Inode {
 
 // Lock the inode for dfh and the inode for name.  name may be a
 // directory (e.g., "."). We must lock directories in ascending inum
-// order.
-func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (*fstxn.FsTxn, []*inode.Inode, nfstypes.Nfsstat3) {
+// order.  begin starts the transaction, and each retry; with
+// fstxn.BeginReadOnly the locks are shared.
+func (nfs *Nfs) getInodesLocked(begin func(*fstxn.FsState) *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (*fstxn.FsTxn, []*inode.Inode, nfstypes.Nfsstat3) {
 	var err nfstypes.Nfsstat3 = nfstypes.NFS3_OK
 	var inodes []*inode.Inode
 	var ip *inode.Inode
 	var op *fstxn.FsTxn
 
 	for ip == nil {
-		op = fstxn.Begin(nfs.fsstate)
+		op = begin(nfs.fsstate)
 		util.DPrintf(1, "getInodesLocked %v %v\n", dfh, name)
 		dip := op.GetInodeFh(dfh)
 		if dip == nil {
@@ -175,6 +221,10 @@ func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (
 			err = nfstypes.NFS3ERR_STALE
 			break
 		}
+		if !nfs.permit(op, dip, acl.EXECUTE) {
+			err = nfstypes.NFS3ERR_ACCES
+			break
+		}
 		inodes = []*inode.Inode{dip}
 		inum, _ := dir.LookupName(dip, op, name)
 		if inum == common.NULLINUM {
@@ -189,8 +239,14 @@ func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (
 				// Abort. Try to lock inodes in order
 				op.Abort()
 				parent := fh.MakeFh(dfh)
-				op = fstxn.Begin(nfs.fsstate)
+				op = begin(nfs.fsstate)
 				inodes = lookupOrdered(op, name, parent, inum)
+				if inodes == nil && op.Corrupt() {
+					// lookupOrdered aborted op
+					op = begin(nfs.fsstate)
+					err = nfstypes.NFS3ERR_IO
+					break
+				}
 				if inodes == nil {
 					ip = nil
 				} else {
@@ -198,6 +254,10 @@ func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (
 				}
 			} else {
 				ip = op.GetInodeLocked(inum)
+				if ip == nil {
+					err = nfstypes.NFS3ERR_IO
+					break
+				}
 				inodes = twoInodes(ip, dip)
 			}
 		}
@@ -212,7 +272,7 @@ func (nfs *Nfs) NFSPROC3_LOOKUP(args nfstypes.LOOKUP3args) nfstypes.LOOKUP3res {
 	var reply nfstypes.LOOKUP3res
 
 	util.DPrintf(1, "NFS Lookup %v\n", args)
-	op, inodes, err := nfs.getInodesLocked(args.What.Dir, args.What.Name)
+	op, inodes, err := nfs.getInodesLocked(fstxn.BeginReadOnly, args.What.Dir, args.What.Name)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -223,6 +283,8 @@ func (nfs *Nfs) NFSPROC3_LOOKUP(args nfstypes.LOOKUP3args) nfstypes.LOOKUP3res {
 	reply.Resok.Obj_attributes.Attributes_follow = true
 	reply.Resok.Obj_attributes.Attributes = i.MkFattr()
 	commitReply(op, &reply.Status)
+	reply.Resok.Obj_attributes.Attributes = nfs.gatheredAttr(reply.Resok.Object,
+		reply.Resok.Obj_attributes.Attributes)
 	return reply
 }
 
@@ -231,14 +293,21 @@ func (nfs *Nfs) NFSPROC3_ACCESS(args nfstypes.ACCESS3args) nfstypes.ACCESS3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_ACCESS, time.Now())
 	var reply nfstypes.ACCESS3res
 	util.DPrintf(1, "NFS Access %v\n", args)
-	reply.Status = nfstypes.NFS3_OK
-	reply.Resok.Access = nfstypes.Uint32(nfstypes.ACCESS3_READ | nfstypes.ACCESS3_LOOKUP | nfstypes.ACCESS3_MODIFY | nfstypes.ACCESS3_EXTEND | nfstypes.ACCESS3_DELETE | nfstypes.ACCESS3_EXECUTE)
+	nfs.writeBack(args.Object)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
+	ip := op.GetInodeFh(args.Object)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	reply.Resok.Access = nfstypes.Uint32(nfs.accessBits(op, ip))
+	commitReply(op, &reply.Status)
 	return reply
 }
 
 func (nfs *Nfs) doRead(fh nfstypes.Nfs_fh3, kind nfstypes.Ftype3, offset, count uint64) (*fstxn.FsTxn, []byte, bool, nfstypes.Nfsstat3) {
 	var readCount = count
-	op := fstxn.Begin(nfs.fsstate)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
 	ip := op.GetInodeFh(fh)
 	if ip == nil {
 		return op, nil, false, nfstypes.NFS3ERR_STALE
@@ -248,6 +317,8 @@ func (nfs *Nfs) doRead(fh nfstypes.Nfs_fh3, kind nfstypes.Ftype3, offset, count
 	}
 	if ip.Kind == nfstypes.NF3LNK {
 		readCount = ip.Size
+	} else if !nfs.permit(op, ip, acl.READ) {
+		return op, nil, false, nfstypes.NFS3ERR_ACCES
 	}
 	data, eof := ip.Read(op.Atxn, offset, readCount)
 	return op, data, eof, nfstypes.NFS3_OK
@@ -258,6 +329,7 @@ func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_READ, time.Now())
 	var reply nfstypes.READ3res
 	util.DPrintf(1, "NFS Read %v %d %d\n", args.File, args.Offset, args.Count)
+	nfs.writeBack(args.File)
 	op, data, eof, err := nfs.doRead(args.File, nfstypes.NF3REG,
 		uint64(args.Offset), uint64(args.Count))
 	if err != nfstypes.NFS3_OK {
@@ -271,46 +343,74 @@ func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	return reply
 }
 
-// XXX Mtime
-// NFSPROC3_WRITE implements the NFSv3 _WRITE RPC.
-func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
-	defer nfs.recordOp(nfstypes.NFSPROC3_WRITE, time.Now())
-	var reply nfstypes.WRITE3res
-	var ok = true
-
-	util.DPrintf(1, "NFS Write %v off %d cnt %d how %d\n", args.File, args.Offset,
-		args.Count, args.Stable)
-
-	op, ip, err := nfs.getShrink(args.File)
-	if err != nfstypes.NFS3_OK {
-		errRet(op, &reply.Status, err)
-		return reply
+// Writes larger than WRITECHUNK are split into several transactions,
+// since one transaction must fit in the log together with the metadata
+// it updates.  WRITECHUNK leaves half of the log for metadata, and
+// WRITEMAX bounds the size of a single WRITE.
+const (
+	WRITECHUNK uint64 = 256 * disk.BlockSize
+	WRITEMAX   uint64 = 4 * WRITECHUNK
+)
 
+// writeChunk writes data at off in its own transaction, which it
+// commits according to stable.  It returns the number of bytes written
+// and the file's attributes after the write.
+func (nfs *Nfs) writeChunk(fh nfstypes.Nfs_fh3, off uint64, data []byte, stable nfstypes.Stable_how) (uint64, nfstypes.Fattr3, nfstypes.Nfsstat3) {
+	var op *fstxn.FsTxn
+	var ip *inode.Inode
+	var count uint64
+	var status nfstypes.Nfsstat3
+	for {
+		var err nfstypes.Nfsstat3
+		op, ip, err = nfs.getShrink(fh)
+		if err != nfstypes.NFS3_OK {
+			errRet(op, &status, err)
+			return 0, nfstypes.Fattr3{}, status
+		}
+		if ip.Kind != nfstypes.NF3REG {
+			errRet(op, &status, nfstypes.NFS3ERR_INVAL)
+			return 0, nfstypes.Fattr3{}, status
+		}
+		if ip.ReadOnly() {
+			errRet(op, &status, nfstypes.NFS3ERR_ROFS)
+			return 0, nfstypes.Fattr3{}, status
+		}
+		if !nfs.permit(op, ip, acl.WRITE) {
+			errRet(op, &status, nfstypes.NFS3ERR_ACCES)
+			return 0, nfstypes.Fattr3{}, status
+		}
+		if nfs.Ordered {
+			op.Atxn.SetOrdered()
+		}
+		cnt := uint64(len(data))
+		need := ip.WriteBlocks(op.Atxn, off, cnt)
+		if op.Atxn.Reserve(need, 0) {
+			var n uint64
+			var writeOk bool
+			if nfs.Sparse {
+				n, writeOk = ip.WriteSparse(op.Atxn, off, cnt, data)
+			} else {
+				n, writeOk = ip.Write(op.Atxn, off, cnt, data)
+			}
+			if writeOk {
+				count = n
+				break
+			}
+		}
+		// Shrinker threads may be about to free blocks; if so,
+		// wait for them and retry.
+		errRet(op, &status, nfstypes.NFS3ERR_NOSPC)
+		if !nfs.shrinkst.Wait() {
+			return 0, nfstypes.Fattr3{}, status
+		}
 	}
-	if ip.Kind != nfstypes.NF3REG {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
-		return reply
-	}
-	if uint64(args.Count) >= jrnl.LogBytes {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
-		return reply
-	}
-	count, writeOk := ip.Write(op.Atxn, uint64(args.Offset), uint64(args.Count),
-		args.Data)
-	if !writeOk {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
-		return reply
-	}
-	// if not supporting unstable writes, upgrade stability
-	if !nfs.Unstable {
-		args.Stable = nfstypes.FILE_SYNC
-	}
-	if args.Stable == nfstypes.FILE_SYNC {
+	var ok bool
+	if stable == nfstypes.FILE_SYNC {
 		// RFC: "FILE_SYNC, the server must commit the
 		// data written plus all file system metadata
 		// to stable storage before returning results."
 		ok = op.Commit()
-	} else if args.Stable == nfstypes.DATA_SYNC {
+	} else if stable == nfstypes.DATA_SYNC {
 		// RFC: "DATA_SYNC, then the server must commit
 		// all of the data to stable storage and
 		// enough of the metadata to retrieve the data
@@ -331,15 +431,105 @@ func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 		// less than that requested by the client."
 		ok = op.CommitUnstable()
 	}
-	if ok {
-		reply.Status = nfstypes.NFS3_OK
-		reply.Resok.Count = nfstypes.Count3(count)
-		reply.Resok.Committed = args.Stable
-		reply.Resok.File_wcc.After.Attributes_follow = true
-		reply.Resok.File_wcc.After.Attributes = ip.MkFattr()
-	} else {
+	if !ok {
 		util.DPrintf(1, "Write transaction failed")
-		reply.Status = nfstypes.NFS3ERR_SERVERFAULT
+		return 0, nfstypes.Fattr3{}, commitErr(op)
+	}
+	return count, ip.MkFattr(), nfstypes.NFS3_OK
+}
+
+// write writes data at off, in a transaction per WRITECHUNK, and
+// commits the last one according to stable.  It returns the number of
+// bytes written, the file's attributes after the write, and the error
+// that stopped it, if any.
+func (nfs *Nfs) write(fh nfstypes.Nfs_fh3, off uint64, data []byte, stable nfstypes.Stable_how) (uint64, nfstypes.Fattr3, nfstypes.Nfsstat3) {
+	// All chunks but the last commit unstably; committing the last
+	// one stably flushes the log, and with it the earlier chunks.
+	end := off + uint64(len(data))
+	var count uint64
+	var attr nfstypes.Fattr3
+	var status = nfstypes.NFS3_OK
+	for {
+		pos := off + count
+		next := util.Min(end, pos-pos%disk.BlockSize+WRITECHUNK)
+		var how = nfstypes.UNSTABLE
+		if next == end {
+			how = stable
+		}
+		n, a, err := nfs.writeChunk(fh, pos,
+			data[count:next-off], how)
+		if err != nfstypes.NFS3_OK {
+			status = err
+			break
+		}
+		count += n
+		attr = a
+		if n < next-pos || next == end {
+			break
+		}
+	}
+	return count, attr, status
+}
+
+// XXX Mtime
+// NFSPROC3_WRITE implements the NFSv3 _WRITE RPC.
+func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
+	defer nfs.recordOp(nfstypes.NFSPROC3_WRITE, time.Now())
+	var reply nfstypes.WRITE3res
+
+	util.DPrintf(1, "NFS Write %v off %d cnt %d how %d\n", args.File, args.Offset,
+		args.Count, args.Stable)
+
+	if uint64(args.Count) > WRITEMAX || uint64(args.Count) > uint64(len(args.Data)) {
+		reply.Status = nfstypes.NFS3ERR_INVAL
+		return reply
+	}
+	// if not supporting unstable writes, upgrade stability
+	if !nfs.Unstable {
+		args.Stable = nfstypes.FILE_SYNC
+	}
+
+	if nfs.Gather && args.Stable == nfstypes.UNSTABLE {
+		attr, ok := nfs.gatherWrite(args.File, uint64(args.Offset),
+			args.Data[:args.Count])
+		if ok {
+			reply.Status = nfstypes.NFS3_OK
+			reply.Resok.Count = args.Count
+			reply.Resok.Committed = nfstypes.UNSTABLE
+			reply.Resok.File_wcc.After.Attributes_follow = true
+			reply.Resok.File_wcc.After.Attributes = attr
+			reply.Resok.Verf = nfs.writeVerf()
+			return reply
+		}
+	}
+	// earlier gathered writes to the file go first
+	nfs.writeBack(args.File)
+
+	off := uint64(args.Offset)
+	end := off + uint64(args.Count)
+	count, attr, status := nfs.write(args.File, off, args.Data[:args.Count],
+		args.Stable)
+	if count == 0 && status != nfstypes.NFS3_OK {
+		// nothing was written
+		reply.Status = status
+		return reply
+	}
+	// A short write is not an error; report the bytes that the
+	// earlier chunks wrote, at the stability the client asked for.
+	if off+count < end && args.Stable != nfstypes.UNSTABLE {
+		if !nfs.fsstate.Txn.Flush() {
+			reply.Status = nfstypes.NFS3ERR_IO
+			return reply
+		}
+	}
+	reply.Status = nfstypes.NFS3_OK
+	reply.Resok.Count = nfstypes.Count3(count)
+	reply.Resok.Committed = args.Stable
+	reply.Resok.File_wcc.After.Attributes_follow = true
+	reply.Resok.File_wcc.After.Attributes = attr
+	reply.Resok.Verf = nfs.writeVerf()
+	if nfs.Gather && args.Stable == nfstypes.UNSTABLE && off+count == end {
+		nfs.startGather(args.File, attr)
 	}
 	return reply
 }
@@ -356,12 +546,32 @@ func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Fi
 			err = nfstypes.NFS3ERR_STALE
 			break
 		}
+		if dip.ReadOnly() {
+			err = nfstypes.NFS3ERR_ROFS
+			break
+		}
+		if !nfs.permit(op, dip, acl.WRITE|acl.EXECUTE) {
+			err = nfstypes.NFS3ERR_ACCES
+			break
+		}
+		if dip.IsShrinking() {
+			// a compacted directory; finish shrinking before it grows
+			dinum := dip.Inum
+			op.Abort()
+			ok := nfs.shrinkst.DoShrink(dinum)
+			op = fstxn.Begin(nfs.fsstate)
+			if !ok {
+				err = nfstypes.NFS3ERR_SERVERFAULT
+				break
+			}
+			continue
+		}
 		inum, _ := dir.LookupName(dip, op, name)
 		if inum != common.NULLINUM {
 			err = nfstypes.NFS3ERR_EXIST
 			break
 		}
-		ip = op.AllocInode(kind)
+		ip = op.AllocInode(kind, dip.Inum, nfs.owner())
 		if ip == nil {
 			err = nfstypes.NFS3ERR_NOSPC
 			break
@@ -394,9 +604,32 @@ func (nfs *Nfs) doDecLink(op *fstxn.FsTxn, ip *inode.Inode) {
 	}
 }
 
+// createBlocks returns about how many blocks creating a file of kind
+// allocates, for doCreate to reserve up front.
+func createBlocks(kind nfstypes.Ftype3, data []byte) uint64 {
+	var n = dir.ADDBLOCKS
+	if kind == nfstypes.NF3DIR {
+		n += dir.ADDBLOCKS // for InitDir
+	}
+	if kind == nfstypes.NF3LNK {
+		n += util.RoundUp(uint64(len(data)), disk.BlockSize)
+	}
+	return n
+}
+
 func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfstypes.Ftype3,
 	data []byte) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3) {
 	beginOp := fstxn.Begin(nfs.fsstate)
+	if dir.NameTooLong(name) {
+		op = beginOp
+		err = nfstypes.NFS3ERR_NAMETOOLONG
+		return
+	}
+	if !beginOp.Atxn.Reserve(createBlocks(kind, data), 1) {
+		op = beginOp
+		err = nfstypes.NFS3ERR_NOSPC
+		return
+	}
 	var dip, ip *inode.Inode
 	op, dip, ip, err = nfs.getAlloc(beginOp, dfh, name, kind)
 	if err != nfstypes.NFS3_OK {
@@ -416,6 +649,16 @@ func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfs
 		dip.Nlink = dip.Nlink + 1 // for ..
 		dip.WriteInode(op.Atxn)
 	}
+	if kind == nfstypes.NF3REG && nfs.Compress {
+		ip.UseCompression(op.Atxn)
+	} else if kind == nfstypes.NF3REG && nfs.Extents {
+		ip.UseExtents(op.Atxn)
+	}
+	err = acl.Inherit(dip, ip, op.Atxn)
+	if err != nfstypes.NFS3_OK {
+		nfs.doDecLink(op, ip)
+		return
+	}
 	if kind == nfstypes.NF3LNK {
 		_, ok := ip.Write(op.Atxn, uint64(0), uint64(len(data)), data)
 		if !ok {
@@ -424,10 +667,10 @@ func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfs
 			return
 		}
 	}
-	ok := dir.AddName(dip, op, ip.Inum, name)
+	ok := dir.AddName(dip, op, ip.Inum, kind, name)
 	if !ok {
 		nfs.doDecLink(op, ip)
-		err = nfstypes.NFS3ERR_IO
+		err = dir.AddNameErr(dip, op, name)
 		return
 	}
 	err = nfstypes.NFS3_OK
@@ -534,10 +777,18 @@ func (nfs *Nfs) doRemove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bo
 		util.DPrintf(0, "Remove inval name\n")
 		return nil, nfstypes.NFS3ERR_INVAL
 	}
-	op, inodes, err := nfs.getInodesLocked(dfh, name)
+	op, inodes, err := nfs.getInodesLocked(fstxn.Begin, dfh, name)
 	if err != nfstypes.NFS3_OK {
 		return op, err
 	}
+	// removing frees space, and may use the reserve to do it
+	op.Atxn.SetPrivileged()
+	if inodes[1].ReadOnly() {
+		return op, nfstypes.NFS3ERR_ROFS
+	}
+	if !nfs.permit(op, inodes[1], acl.WRITE) {
+		return op, nfstypes.NFS3ERR_ACCES
+	}
 	if isdir && inodes[0].Kind != nfstypes.NF3DIR {
 		util.DPrintf(0, "Remove not a directory %v\n", inodes[0].Kind)
 		return op, nfstypes.NFS3ERR_INVAL
@@ -551,6 +802,10 @@ func (nfs *Nfs) doRemove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bo
 		return op, nfstypes.NFS3ERR_IO
 	}
 	nfs.doDecLink(op, inodes[0])
+	if dir.NeedsCompact(inodes[1], op) {
+		// runs once this transaction releases the directory
+		nfs.shrinkst.StartCompactor(inodes[1].Inum)
+	}
 	return op, nfstypes.NFS3_OK
 }
 
@@ -559,6 +814,7 @@ func (nfs *Nfs) NFSPROC3_REMOVE(args nfstypes.REMOVE3args) nfstypes.REMOVE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_REMOVE, time.Now())
 	var reply nfstypes.REMOVE3res
 	util.DPrintf(1, "NFS Remove %v\n", args)
+	nfs.writeBackName(args.Object.Dir, args.Object.Name)
 	op, err := nfs.doRemove(args.Object.Dir, args.Object.Name, false)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
@@ -622,10 +878,13 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 	var op *fstxn.FsTxn
 	var inodes []*inode.Inode
 	var frominum common.Inum
+	var fromkind nfstypes.Ftype3
 	var toinum common.Inum
 	var success bool = false
 	var done bool = false
 
+	// the rename may remove a file that has gathered writes
+	nfs.writeBackName(args.To.Dir, args.To.Name)
 	for !success {
 		op = fstxn.Begin(nfs.fsstate)
 		util.DPrintf(1, "NFS Rename %v\n", args)
@@ -639,6 +898,12 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 			break
 		}
 
+		if dir.NameTooLong(args.To.Name) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_NAMETOOLONG)
+			done = true
+			break
+		}
+
 		if fh.Equal(args.From.Dir, args.To.Dir) {
 			dipfrom = op.GetInodeFh(args.From.Dir)
 			if dipfrom == nil {
@@ -661,8 +926,34 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 
 		util.DPrintf(3, "from %v to %v\n", dipfrom, dipto)
 
-		frominumLookup, _ := dir.LookupName(dipfrom, op, args.From.Name)
+		if dipfrom.ReadOnly() || dipto.ReadOnly() {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_ROFS)
+			done = true
+			break
+		}
+
+		if !nfs.permit(op, dipfrom, acl.WRITE|acl.EXECUTE) ||
+			!nfs.permit(op, dipto, acl.WRITE|acl.EXECUTE) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+			done = true
+			break
+		}
+
+		if dipto.IsShrinking() {
+			inum := dipto.Inum
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(inum) {
+				op = fstxn.Begin(nfs.fsstate)
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_SERVERFAULT)
+				done = true
+				break
+			}
+			continue
+		}
+
+		frominumLookup, fromkindLookup := dir.LookupName(dipfrom, op, args.From.Name)
 		frominum = frominumLookup
+		fromkind = fromkindLookup
 		if frominum == common.NULLINUM {
 			errRet(op, &reply.Status, nfstypes.NFS3ERR_NOENT)
 			done = true
@@ -743,14 +1034,18 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 	if done {
 		return reply
 	}
+	if !op.Atxn.Reserve(dir.ADDBLOCKS, 0) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
+		return reply
+	}
 	ok := dir.RemName(dipfrom, op, args.From.Name)
 	if !ok {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
 		return reply
 	}
-	ok1 := dir.AddName(dipto, op, frominum, args.To.Name)
+	ok1 := dir.AddName(dipto, op, frominum, fromkind, args.To.Name)
 	if !ok1 {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
+		errRet(op, &reply.Status, dir.AddNameErr(dipto, op, args.To.Name))
 		return reply
 	}
 	commitReply(op, &reply.Status)
@@ -771,7 +1066,7 @@ func (nfs *Nfs) NFSPROC3_LINK(args nfstypes.LINK3args) nfstypes.LINK3res {
 func (nfs *Nfs) NFSPROC3_READDIR(args nfstypes.READDIR3args) nfstypes.READDIR3res {
 	var reply nfstypes.READDIR3res
 	util.DPrintf(1, "NFS ReadDir %v\n", args)
-	op := fstxn.Begin(nfs.fsstate)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
 	ip := op.GetInodeFh(args.Dir)
 	if ip == nil {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
@@ -781,6 +1076,10 @@ func (nfs *Nfs) NFSPROC3_READDIR(args nfstypes.READDIR3args) nfstypes.READDIR3re
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
+	if !nfs.permit(op, ip, acl.READ) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
 	dirlist := Readdir3(ip, op, args.Cookie, args.Count)
 	reply.Resok.Reply = dirlist
 	commitReply(op, &reply.Status)
@@ -792,7 +1091,7 @@ func (nfs *Nfs) NFSPROC3_READDIRPLUS(args nfstypes.READDIRPLUS3args) nfstypes.RE
 	defer nfs.recordOp(nfstypes.NFSPROC3_READDIRPLUS, time.Now())
 	var reply nfstypes.READDIRPLUS3res
 	util.DPrintf(1, "NFS ReadDirPlus %v\n", args)
-	op := fstxn.Begin(nfs.fsstate)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
 	ip := op.GetInodeFh(args.Dir)
 	if ip == nil {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
@@ -802,9 +1101,17 @@ func (nfs *Nfs) NFSPROC3_READDIRPLUS(args nfstypes.READDIRPLUS3args) nfstypes.RE
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
+	if !nfs.permit(op, ip, acl.READ) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
 	dirlist := Ls3(ip, op, args.Cookie, args.Dircount, args.Maxcount)
 	reply.Resok.Reply = dirlist
 	commitReply(op, &reply.Status)
+	for e := dirlist.Entries; e != nil; e = e.Nextentry {
+		e.Name_attributes.Attributes = nfs.gatheredAttr(e.Name_handle.Handle,
+			e.Name_attributes.Attributes)
+	}
 	return reply
 }
 
@@ -820,12 +1127,12 @@ func (nfs *Nfs) NFSPROC3_FSSTAT(args nfstypes.FSSTAT3args) nfstypes.FSSTAT3res {
 func (nfs *Nfs) NFSPROC3_FSINFO(args nfstypes.FSINFO3args) nfstypes.FSINFO3res {
 	var reply nfstypes.FSINFO3res
 	util.DPrintf(1, "NFS FsInfo %v\n", args)
-	op := fstxn.Begin(nfs.fsstate)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
 	reply.Resok.Rtmax = 16 * 4096
 	reply.Resok.Rtmult = 4096
 	reply.Resok.Rtpref = reply.Resok.Rtmax
-	reply.Resok.Wtmax = nfstypes.Uint32(jrnl.LogBytes)
-	reply.Resok.Wtpref = 16 * 4096
+	reply.Resok.Wtmax = nfstypes.Uint32(WRITEMAX)
+	reply.Resok.Wtpref = nfstypes.Uint32(WRITECHUNK)
 	reply.Resok.Wtmult = 4096
 	reply.Resok.Dtpref = 16 * 4096
 	reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxFileSize())
@@ -854,6 +1161,10 @@ func (nfs *Nfs) NFSPROC3_COMMIT(args nfstypes.COMMIT3args) nfstypes.COMMIT3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_COMMIT, time.Now())
 	var reply nfstypes.COMMIT3res
 	util.DPrintf(1, "NFS Commit %v\n", args)
+	if err := nfs.writeBack(args.File); err != nfstypes.NFS3_OK {
+		reply.Status = err
+		return reply
+	}
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(args.File)
 	if ip == nil {
@@ -871,6 +1182,7 @@ func (nfs *Nfs) NFSPROC3_COMMIT(args nfstypes.COMMIT3args) nfstypes.COMMIT3res {
 	ok := op.CommitFh()
 	if ok {
 		reply.Status = nfstypes.NFS3_OK
+		reply.Resok.Verf = nfs.writeVerf()
 	} else {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
 	}
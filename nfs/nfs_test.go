@@ -1,6 +1,8 @@
 package nfs
 
 import (
+	"bytes"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,7 +11,10 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/goose-lang/primitive/disk"
 	"github.com/stretchr/testify/require"
@@ -17,10 +22,17 @@ import (
 	"testing"
 
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/wal"
+	"github.com/mit-pdos/go-nfsd/acl"
+	"github.com/mit-pdos/go-nfsd/alloc"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
+	"github.com/mit-pdos/go-nfsd/util/crypt_disk"
+	"github.com/mit-pdos/go-nfsd/util/file_disk"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -282,7 +294,7 @@ func TestOneFile(t *testing.T) {
 	sz := uint64(8192)
 	ts.Create("x")
 	attr := ts.GetattrDir(fh.MkRootFh3())
-	assert.Equal(t, 3*dir.DIRENTSZ, uint64(attr.Size))
+	assert.Equal(t, disk.BlockSize, uint64(attr.Size))
 	fh := ts.Lookup("x", true)
 	ts.Getattr(fh, 0)
 	data := mkdata(sz)
@@ -572,6 +584,40 @@ func TestFileHole(t *testing.T) {
 	ts.readcheck(fh, 0, null)
 }
 
+func TestSparse(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	balloc := ts.clnt.srv.fsstate.Balloc
+	empty := balloc.NumFree()
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdata(disk.BlockSize)
+	off := 100 * disk.BlockSize
+	ts.WriteOff(x, off, data, nfstypes.FILE_SYNC)
+	attr := ts.Getattr(x, off+disk.BlockSize)
+	assert.Equal(t, nfstypes.Size3(disk.BlockSize), attr.Used)
+
+	// reading holes allocates nothing
+	nfree := balloc.NumFree()
+	ts.readcheck(x, 0, mkdataval(0, off))
+	assert.Equal(t, nfree, balloc.NumFree())
+	assert.Equal(t, nfstypes.Size3(disk.BlockSize), ts.Getattr(x, off+disk.BlockSize).Used)
+
+	// zero blocks become holes
+	ts.clnt.srv.Sparse = true
+	zero := mkdataval(0, 4*disk.BlockSize)
+	ts.WriteOff(x, off, zero, nfstypes.FILE_SYNC)
+	attr = ts.Getattr(x, off+4*disk.BlockSize)
+	assert.Equal(t, nfstypes.Size3(0), attr.Used)
+	ts.readcheck(x, off, zero)
+	ts.WriteOff(x, 1, zero, nfstypes.FILE_SYNC)
+	ts.readcheck(x, 0, mkdataval(0, off))
+	assert.Equal(t, nfstypes.Size3(2*disk.BlockSize), ts.Getattr(x, off+4*disk.BlockSize).Used)
+	ts.Remove("x")
+	assert.Equal(t, empty, balloc.NumFree())
+}
+
 func TestManyHoles(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -704,13 +750,48 @@ func TestBigWrite(t *testing.T) {
 	ts.Write(x, data, nfstypes.UNSTABLE)
 	ts.Commit(x, sz)
 
-	// Too big
+	// Bigger than one transaction
 	ts.Create("y")
 	sz = uint64(4096 * (common.HDRADDRS + 10))
 	y := ts.Lookup("y", true)
-	data = mkdataval(byte(0), sz)
+	data = mkdata(sz)
+	ts.WriteOff(y, 10, data, nfstypes.FILE_SYNC)
+	ts.readcheck(y, 10, data)
+	ts.WriteOff(y, 0, data, nfstypes.UNSTABLE)
+	ts.Commit(y, sz)
+	ts.readcheck(y, 0, data)
+
+	// Too big
+	data = mkdataval(byte(0), WRITEMAX+disk.BlockSize)
 	ts.WriteErr(y, data, nfstypes.UNSTABLE, nfstypes.NFS3ERR_INVAL)
-	ts.CommitErr(y, sz, nfstypes.NFS3ERR_INVAL)
+}
+
+func TestBigWritePartial(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const uid = 1000
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	reply := ts.clnt.ChownOp(x, uid, 0)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	base := uint64(ts.quota(nfstypes.QUOTA_USR, uid).Blocks)
+	_, err := ts.clnt.srv.SetQuota(nfstypes.QUOTA_USR, uid,
+		alloc.Limits{BlockHard: base + WRITECHUNK/disk.BlockSize + 8})
+	assert.Equal(t, nfstypes.NFS3_OK, err)
+
+	// the first chunk fits in the quota, but the second doesn't
+	data := mkdata(2 * WRITECHUNK)
+	res := ts.clnt.WriteOp(x, 0, data, nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3_OK, res.Status)
+	assert.Equal(t, nfstypes.Count3(WRITECHUNK), res.Resok.Count)
+	assert.Equal(t, nfstypes.FILE_SYNC, res.Resok.Committed)
+	assert.Equal(t, nfstypes.Size3(WRITECHUNK), res.Resok.File_wcc.After.Attributes.Size)
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	ts.readcheck(x, 0, data[:WRITECHUNK])
+	ts.ReadEof(x, WRITECHUNK, disk.BlockSize)
 }
 
 func TestBigUnlink(t *testing.T) {
@@ -782,7 +863,8 @@ func TestInodeExhaust(t *testing.T) {
 				break
 			}
 		}
-		assert.GreaterOrEqual(ts.t, uint64(i), common.NBITBLOCK*common.NINODEBITMAP-2)
+		ninode := common.NBITBLOCK * common.NINODEBITMAP
+		assert.GreaterOrEqual(ts.t, uint64(i), ninode-super.NRESERVED-ninode/fstxn.IRESERVE)
 		i--
 		for ; i >= 0; i-- {
 			s := strconv.Itoa(i)
@@ -805,6 +887,58 @@ func TestRestartPersist(t *testing.T) {
 	ts.Lookup("y", true)
 }
 
+// mkBaselineDisk returns a disk with a file system as the server made
+// it before there was a super block: the block bitmap started right
+// after the log, where the super block is now, with the bits of the
+// metadata blocks set.
+func mkBaselineDisk(sz uint64) disk.Disk {
+	d := disk.NewMemDisk(sz)
+	nbitmap := sz/common.NBITBLOCK + 1
+	ninodeblk := common.NINODEBITMAP * common.NBITBLOCK * common.INODESZ / disk.BlockSize
+	datastart := common.LOGSIZE + nbitmap + common.NINODEBITMAP + ninodeblk
+	blk := make(disk.Block, disk.BlockSize)
+	for bn := uint64(0); bn < datastart; bn++ {
+		blk[bn/8] |= 1 << (bn % 8)
+	}
+	d.Write(common.LOGSIZE, blk)
+	return d
+}
+
+func TestOpenBaseline(t *testing.T) {
+	checkFlags()
+	d := mkBaselineDisk(DISKSZ)
+	blk := d.Read(common.LOGSIZE)
+
+	_, err := OpenNfs(d, false)
+	assert.ErrorIs(t, err, super.ErrUnknown)
+	assert.Panics(t, func() { MakeNfs(d) })
+	assert.Equal(t, blk, d.Read(common.LOGSIZE), "refused disk was changed")
+
+	nfs, err := OpenNfs(d, true)
+	require.NoError(t, err)
+	ts := &TestState{t: t, clnt: &NfsClient{srv: nfs}}
+	defer ts.Close()
+	ts.Create("x")
+	ts.clnt.Shutdown()
+	ts.clnt.srv, err = OpenNfs(d, false)
+	require.NoError(t, err)
+	ts.Lookup("x", true)
+}
+
+func TestOpenOldVersion(t *testing.T) {
+	checkFlags()
+	d := disk.NewMemDisk(DISKSZ)
+	MakeNfs(d).ShutdownNfs()
+	sbn := super.MkFsSuper(d).SuperBlock()
+	blk := d.Read(uint64(sbn))
+	blk[0]-- // the magic number is little-endian; drop the version by one
+	d.Write(uint64(sbn), blk)
+
+	_, err := OpenNfs(d, false)
+	assert.ErrorContains(t, err, "unsupported file system version")
+	assert.Equal(t, blk, d.Read(uint64(sbn)), "refused disk was changed")
+}
+
 func TestAbortRestart(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -856,3 +990,1493 @@ func TestRestartReclaim(t *testing.T) {
 	fhx3 = ts.Lookup("y", true)
 	ts.Getattr(fhx3, sz)
 }
+
+// Write beyond the reach of the double-indirect tree, and shrink the
+// (sparse) file back to nothing.
+func TestHugeSparseFile(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	assert.Greater(t, inode.MaxFileSize(), uint64(4)<<40)
+
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	data := mkdata(8192)
+	off := uint64(3)<<40 + 100
+	ts.WriteOff(fh, off, data, nfstypes.FILE_SYNC)
+	ts.Getattr(fh, off+uint64(len(data)))
+	ts.readcheck(fh, off, data)
+
+	ts.Setattr(fh, 4096)
+	ts.Getattr(fh, 4096)
+	ts.ReadEof(fh, off, uint64(len(data)))
+	ts.Remove("x")
+}
+
+func TestExtents(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.clnt.srv.Extents = true
+	nfree := ts.clnt.srv.fsstate.Balloc.NumFree()
+
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	data := mkdata(64 * 1024)
+	var off uint64
+	for i := 0; i < 64; i++ {
+		ts.WriteOff(fh, off, data, nfstypes.FILE_SYNC)
+		off += uint64(len(data))
+	}
+	hole := uint64(1)<<40 + 4000
+	ts.WriteOff(fh, hole, data, nfstypes.FILE_SYNC)
+	ts.Getattr(fh, hole+uint64(len(data)))
+
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = MakeNfs(d)
+	ts.clnt.srv.Extents = true
+
+	ts.readcheck(fh, 0, data)
+	ts.readcheck(fh, off-uint64(len(data)), data)
+	ts.readcheck(fh, hole, data)
+	ts.readcheck(fh, off, make([]byte, 4096))
+
+	ts.Setattr(fh, off/2+100)
+	ts.Getattr(fh, off/2+100)
+	ts.readcheck(fh, off/2-uint64(len(data)), data)
+	ts.ReadEof(fh, off/2+100, 4096)
+
+	ts.Remove("x")
+	ts.clnt.srv.shrinkst.Wait()
+	assert.Equal(t, nfree, ts.clnt.srv.fsstate.Balloc.NumFree())
+}
+
+// Directories are spread over the inode allocation groups, and files
+// are allocated in their directory's group.
+func TestAllocGroups(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	names := []string{"d0", "d1", "d2", "d3"}
+	groups := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for _, n := range names {
+		ts.MkDir(n)
+		dfh3 := ts.Lookup(n, true)
+		g := fh.MakeFh(dfh3).Ino / super.IGROUPSZ
+		assert.False(t, groups[g], "directories should be in different groups")
+		groups[g] = true
+		wg.Add(1)
+		go func(dfh3 nfstypes.Nfs_fh3, g uint64) {
+			for i := 0; i < 10; i++ {
+				s := strconv.Itoa(i)
+				ts.CreateFh(dfh3, s)
+				fh3 := ts.LookupFh(dfh3, s)
+				assert.Equal(t, g, fh.MakeFh(fh3).Ino/super.IGROUPSZ)
+			}
+			wg.Done()
+		}(dfh3, g)
+	}
+	wg.Wait()
+}
+
+// Fill the file system, extend its disk, and grow it into the new
+// space, including a new block bitmap block and new inodes.
+func TestGrow(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.maketoolargefile("x", 50)
+	ninode := ts.clnt.srv.fsstate.Super.NInode()
+	ts.clnt.Shutdown()
+
+	const NEWSZ = 5 * DISKSZ
+	d := ts.clnt.srv.fsstate.Super.Disk
+	d1 := disk.NewMemDisk(NEWSZ)
+	for bn := uint64(0); bn < DISKSZ; bn++ {
+		d1.Write(bn, d.Read(bn))
+	}
+	ts.clnt.srv = MakeNfs(d1)
+	assert.Equal(t, common.Bnum(DISKSZ), ts.clnt.srv.fsstate.Super.MaxBnum(),
+		"file system should keep its size")
+
+	reply := ts.clnt.srv.ADMINPROC_GROW(nfstypes.GROWargs{Inodes: 1})
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Uint64(NEWSZ), reply.Size)
+	assert.Equal(t, nfstypes.Uint64(ninode+common.NBITBLOCK), reply.Inodes)
+	reply = ts.clnt.srv.ADMINPROC_GROW(nfstypes.GROWargs{Size: nfstypes.Uint64(DISKSZ)})
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, reply.Status, "should not shrink")
+	nfree := ts.clnt.srv.fsstate.Balloc.NumFree()
+
+	ts.Create("y")
+	fh := ts.Lookup("y", true)
+	data := mkdata(64 * 1024)
+	for i := uint64(0); i < 32; i++ {
+		ts.WriteOff(fh, i*uint64(len(data)), data, nfstypes.FILE_SYNC)
+	}
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(d1)
+	assert.Equal(t, common.Bnum(NEWSZ), ts.clnt.srv.fsstate.Super.MaxBnum())
+	assert.Equal(t, ninode+common.NBITBLOCK, ts.clnt.srv.fsstate.Super.NInode())
+	assert.Greater(t, nfree, uint64(3*DISKSZ))
+	assert.Less(t, ts.clnt.srv.fsstate.Balloc.NumFree(), nfree)
+	ts.readcheck(fh, 31*uint64(len(data)), data)
+	ts.Remove("x")
+}
+
+// Fill a directory with enough names to split its index several
+// levels deep, then page through it with READDIR and empty it.
+func TestBigDir(t *testing.T) {
+	const N = 8000
+	ts := newTest(t)
+	defer ts.Close()
+
+	for i := 0; i < N; i++ {
+		ts.Create("f" + strconv.Itoa(i))
+	}
+	for i := 0; i < N; i += 97 {
+		ts.Lookup("f"+strconv.Itoa(i), true)
+	}
+	ts.Lookup("f"+strconv.Itoa(N), false)
+
+	seen := make(map[string]bool)
+	var cookie nfstypes.Cookie3
+	for {
+		args := nfstypes.READDIR3args{Dir: fh.MkRootFh3(), Cookie: cookie, Count: 1024}
+		reply := ts.clnt.srv.NFSPROC3_READDIR(args)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+			assert.False(t, seen[string(e.Name)], "duplicate entry %s", e.Name)
+			seen[string(e.Name)] = true
+			cookie = e.Cookie
+		}
+		if reply.Resok.Reply.Eof {
+			break
+		}
+	}
+	assert.Equal(t, N+2, len(seen))
+
+	for i := 0; i < N; i++ {
+		ts.Remove("f" + strconv.Itoa(i))
+	}
+	dl := ts.ReadDirPlus()
+	var n = 0
+	for e := dl.Entries; e != nil; e = e.Nextentry {
+		n++
+	}
+	assert.Equal(t, 2, n, "only . and .. should be left")
+	ts.Create("g")
+	ts.Lookup("g", true)
+}
+
+func TestLongNames(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	reply := ts.clnt.srv.NFSPROC3_PATHCONF(nfstypes.PATHCONF3args{Object: fh.MkRootFh3()})
+	assert.Equal(t, nfstypes.Uint32(255), reply.Resok.Name_max)
+
+	long := func(i int) string {
+		s := strconv.Itoa(i)
+		return strings.Repeat("n", 255-len(s)) + s
+	}
+	const N = 200
+	for i := 0; i < N; i++ {
+		ts.Create(long(i))
+	}
+	for i := 0; i < N; i++ {
+		ts.Lookup(long(i), true)
+	}
+	ts.Create("short")
+
+	cr := ts.clnt.CreateOp(fh.MkRootFh3(), long(0)+"x")
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, cr.Status)
+	status := ts.clnt.RenameOp(fh.MkRootFh3(), "short", fh.MkRootFh3(), long(0)+"x")
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, status)
+	ts.Rename("short", long(N))
+	ts.Lookup(long(N), true)
+
+	for i := 0; i <= N; i++ {
+		ts.Remove(long(i))
+	}
+	ts.MkDir(long(0))
+	ts.RmDir(long(0), nfstypes.NFS3_OK)
+}
+
+// Remove most names of a big directory, which compacts and shrinks it
+// in the background, and check that a READDIR cookie from before
+// compaction still continues the listing.
+func TestCompactDir(t *testing.T) {
+	const N = 3000
+	ts := newTest(t)
+	defer ts.Close()
+
+	for i := 0; i < N; i++ {
+		ts.Create("f" + strconv.Itoa(i))
+	}
+	big := ts.GetattrDir(fh.MkRootFh3()).Size
+
+	args := nfstypes.READDIR3args{Dir: fh.MkRootFh3(), Count: 1024}
+	reply := ts.clnt.srv.NFSPROC3_READDIR(args)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	var page []string
+	for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		page = append(page, string(e.Name))
+		args.Cookie = e.Cookie
+	}
+
+	kept := make(map[string]bool)
+	for i := 0; i < N; i++ {
+		name := "f" + strconv.Itoa(i)
+		if i%100 == 0 {
+			kept[name] = true
+			continue
+		}
+		ts.Remove(name)
+	}
+	kept["."] = true
+	kept[".."] = true
+	ts.clnt.srv.shrinkst.Wait()
+	small := ts.GetattrDir(fh.MkRootFh3()).Size
+	assert.Less(t, uint64(small)*10, uint64(big), "directory should shrink")
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.srv.CompactDir(fh.MkRootFh3()))
+	assert.Equal(t, small, ts.GetattrDir(fh.MkRootFh3()).Size)
+
+	seen := make(map[string]bool)
+	for _, name := range page {
+		if kept[name] {
+			seen[name] = true
+		}
+	}
+	for {
+		reply = ts.clnt.srv.NFSPROC3_READDIR(args)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+			assert.False(t, seen[string(e.Name)], "duplicate entry %s", e.Name)
+			seen[string(e.Name)] = true
+			args.Cookie = e.Cookie
+		}
+		if reply.Resok.Reply.Eof {
+			break
+		}
+	}
+	assert.Equal(t, kept, seen)
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	for name := range kept {
+		if name != "." && name != ".." {
+			ts.Lookup(name, true)
+		}
+	}
+	ts.Create("g")
+	ts.Lookup("g", true)
+}
+
+// Small files and symlinks keep their data in the inode, and move it
+// to a block once it outgrows the inode.
+func TestInline(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	nfree := ts.clnt.srv.fsstate.Balloc.NumFree()
+	target := strings.Repeat("d/", 40)
+	ts.SymLink("l", target)
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	data := mkdata(100)
+	end := inode.INLINESZ
+	ts.WriteOff(fh, 0, data, nfstypes.FILE_SYNC)
+	ts.WriteOff(fh, end-50, data[:50], nfstypes.FILE_SYNC)
+	ts.Getattr(fh, end)
+	assert.Equal(t, nfree, ts.clnt.srv.fsstate.Balloc.NumFree(),
+		"inline data should not use blocks")
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	assert.Equal(t, target, ts.ReadLink(ts.Lookup("l", true)))
+	ts.readcheck(fh, 0, data)
+	ts.readcheck(fh, 100, make([]byte, end-150))
+	ts.readcheck(fh, end-50, data[:50])
+
+	ts.Setattr(fh, 120)
+	ts.Setattr(fh, 4096)
+	ts.readcheck(fh, 0, data)
+	ts.readcheck(fh, 100, make([]byte, 4096-100))
+	assert.Greater(t, nfree, ts.clnt.srv.fsstate.Balloc.NumFree(),
+		"growing past the inode should spill to a block")
+	ts.WriteOff(fh, 8192, data, nfstypes.FILE_SYNC)
+	ts.readcheck(fh, 0, data)
+	ts.readcheck(fh, 8192, data)
+
+	ts.clnt.srv.Extents = true
+	ts.Create("y")
+	fh = ts.Lookup("y", true)
+	ts.WriteOff(fh, 0, data, nfstypes.FILE_SYNC)
+	ts.WriteOff(fh, 1000, data, nfstypes.FILE_SYNC)
+	ts.readcheck(fh, 0, data)
+	ts.readcheck(fh, 1000, data)
+
+	ts.Remove("x")
+	ts.Remove("y")
+	ts.Remove("l")
+	ts.clnt.srv.shrinkst.Wait()
+	assert.Equal(t, nfree, ts.clnt.srv.fsstate.Balloc.NumFree())
+}
+
+func TestXattr(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	nfree := ts.clnt.srv.fsstate.Balloc.NumFree()
+	ts.Create("x")
+	fh := ts.Lookup("x", true)
+	srv := ts.clnt.srv
+
+	_, err := srv.GetXattr(fh, "user.a")
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, err)
+	assert.Equal(t, nfstypes.NFS3_OK, srv.SetXattr(fh, "user.a", []byte("1"), 0))
+	assert.Equal(t, nfstypes.NFS3_OK, srv.SetXattr(fh, "user.b", mkdata(1000), 0))
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST,
+		srv.SetXattr(fh, "user.a", []byte("2"), nfstypes.XATTR_CREATE))
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT,
+		srv.SetXattr(fh, "user.c", []byte("2"), nfstypes.XATTR_REPLACE))
+	assert.Equal(t, nfstypes.NFS3_OK,
+		srv.SetXattr(fh, "user.a", []byte("22"), nfstypes.XATTR_REPLACE))
+	assert.Equal(t, nfstypes.NFS3ERR_NOSPC, srv.SetXattr(fh, "user.c", mkdata(3500), 0))
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG,
+		srv.SetXattr(fh, strings.Repeat("n", 256), nil, 0))
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	srv = ts.clnt.srv
+	v, err := srv.GetXattr(fh, "user.a")
+	assert.Equal(t, nfstypes.NFS3_OK, err)
+	assert.Equal(t, []byte("22"), v)
+	v, _ = srv.GetXattr(fh, "user.b")
+	assert.Equal(t, mkdata(1000), v)
+	reply := srv.ADMINPROC_LISTXATTR(nfstypes.LISTXATTRargs{Object: fh})
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, "user.a\x00user.b\x00", string(reply.Names))
+
+	assert.Equal(t, nfstypes.NFS3_OK, srv.RemoveXattr(fh, "user.a"))
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, srv.RemoveXattr(fh, "user.a"))
+	assert.Equal(t, nfstypes.NFS3_OK, srv.RemoveXattr(fh, "user.b"))
+	assert.Equal(t, nfree, srv.fsstate.Balloc.NumFree(),
+		"removing the last attribute should free its block")
+
+	// removing the file frees its attributes
+	assert.Equal(t, nfstypes.NFS3_OK, srv.SetXattr(fh, "user.a", []byte("1"), 0))
+	ts.Remove("x")
+	assert.Equal(t, nfree, srv.fsstate.Balloc.NumFree())
+	_, err = srv.GetXattr(fh, "user.a")
+	assert.Equal(t, nfstypes.NFS3ERR_STALE, err)
+}
+
+func mkacl(user, group, other uint32, tagflag uint32) nfstypes.Posix_acl {
+	return nfstypes.Posix_acl{
+		Count: 3,
+		Entries: []nfstypes.Posix_acl_entry{
+			{Tag: nfstypes.Uint32(acl.USER_OBJ | tagflag), Perm: nfstypes.Uint32(user)},
+			{Tag: nfstypes.Uint32(acl.GROUP_OBJ | tagflag), Perm: nfstypes.Uint32(group)},
+			{Tag: nfstypes.Uint32(acl.OTHER | tagflag), Perm: nfstypes.Uint32(other)},
+		},
+	}
+}
+
+func (ts *TestState) SetAcl(fh nfstypes.Nfs_fh3, mask uint32, a, dfa nfstypes.Posix_acl) nfstypes.Nfsstat3 {
+	reply := ts.clnt.srv.ACLPROC3_SETACL(nfstypes.SETACL3args{
+		Fh: fh, Mask: nfstypes.Uint32(mask), Acl: a, Dfacl: dfa})
+	return reply.Status
+}
+
+func (ts *TestState) GetAcl(fh nfstypes.Nfs_fh3) (nfstypes.Posix_acl, nfstypes.Posix_acl) {
+	reply := ts.clnt.srv.ACLPROC3_GETACL(nfstypes.GETACL3args{
+		Fh: fh, Mask: nfstypes.Uint32(nfstypes.NFS_ACL | nfstypes.NFS_DFACL)})
+	assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+	return reply.Resok.Acl, reply.Resok.Dfacl
+}
+
+func TestAcl(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	a, dfa := ts.GetAcl(fhx)
+	assert.Equal(t, mkacl(7, 7, 7, 0), a, "no ACL reports the mode")
+	assert.Equal(t, nfstypes.Uint32(0), dfa.Count)
+
+	ro := mkacl(acl.READ, acl.READ, 0, 0)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.SetAcl(fhx, nfstypes.NFS_ACL, ro, nfstypes.Posix_acl{}))
+	ts.WriteErr(fhx, mkdata(10), nfstypes.FILE_SYNC, nfstypes.NFS3ERR_ACCES)
+	access := ts.clnt.srv.NFSPROC3_ACCESS(nfstypes.ACCESS3args{Object: fhx})
+	assert.Equal(t, nfstypes.Uint32(nfstypes.ACCESS3_READ|nfstypes.ACCESS3_DELETE),
+		access.Resok.Access)
+	ts.ReadEof(fhx, 0, 10)
+
+	bad := mkacl(7, 7, 7, 0)
+	bad.Entries = bad.Entries[:2]
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, ts.SetAcl(fhx, nfstypes.NFS_ACL, bad, nfstypes.Posix_acl{}))
+	assert.Equal(t, nfstypes.NFS3ERR_NOTDIR,
+		ts.SetAcl(fhx, nfstypes.NFS_DFACL, nfstypes.Posix_acl{}, ro))
+
+	// new files and directories inherit a directory's default ACL
+	ts.MkDir("d")
+	fhd := ts.Lookup("d", true)
+	rx := mkacl(acl.READ|acl.EXECUTE, acl.READ|acl.EXECUTE, 0, nfstypes.NFS_ACL_DEFAULT)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.SetAcl(fhd, nfstypes.NFS_DFACL, nfstypes.Posix_acl{}, rx))
+	ts.CreateFh(fhd, "y")
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.MkDirOp(fhd, "e").Status)
+	fhy := ts.LookupFh(fhd, "y")
+	fhe := ts.LookupFh(fhd, "e")
+	a, _ = ts.GetAcl(fhy)
+	assert.Equal(t, mkacl(acl.READ|acl.EXECUTE, acl.READ|acl.EXECUTE, 0, 0), a)
+	a, dfa = ts.GetAcl(fhe)
+	assert.Equal(t, mkacl(acl.READ|acl.EXECUTE, acl.READ|acl.EXECUTE, 0, 0), a)
+	assert.Equal(t, rx, dfa)
+	reply := ts.clnt.CreateOp(fhe, "z")
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, reply.Status, "e isn't writable")
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	a, _ = ts.GetAcl(fhx)
+	assert.Equal(t, ro, a)
+	a, dfa = ts.GetAcl(fhe)
+	assert.Equal(t, rx, dfa)
+
+	// an empty ACL removes the ACL
+	assert.Equal(t, nfstypes.NFS3_OK, ts.SetAcl(fhx, nfstypes.NFS_ACL, nfstypes.Posix_acl{}, nfstypes.Posix_acl{}))
+	ts.Write(fhx, mkdata(10), nfstypes.FILE_SYNC)
+}
+
+// Named USER and GROUP entries and the OTHER entry apply to callers
+// by their credentials, and only a file's owner or root may change its
+// ACL.
+func TestAclCred(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	fhx := ts.Lookup("x", true)
+	a := nfstypes.Posix_acl{
+		Count: 6,
+		Entries: []nfstypes.Posix_acl_entry{
+			{Tag: nfstypes.Uint32(acl.USER_OBJ), Perm: nfstypes.Uint32(acl.READ | acl.WRITE)},
+			{Tag: nfstypes.Uint32(acl.USER), Id: 1000, Perm: nfstypes.Uint32(acl.READ | acl.WRITE)},
+			{Tag: nfstypes.Uint32(acl.GROUP_OBJ), Perm: nfstypes.Uint32(acl.READ)},
+			{Tag: nfstypes.Uint32(acl.GROUP), Id: 200, Perm: nfstypes.Uint32(acl.READ | acl.WRITE)},
+			{Tag: nfstypes.Uint32(acl.MASK), Perm: nfstypes.Uint32(acl.READ | acl.WRITE)},
+			{Tag: nfstypes.Uint32(acl.OTHER), Perm: nfstypes.Uint32(0)},
+		},
+	}
+	assert.Equal(t, nfstypes.NFS3_OK, ts.SetAcl(fhx, nfstypes.NFS_ACL, a, nfstypes.Posix_acl{}))
+
+	user := func(uid uint32, gids ...uint32) *NfsClient {
+		return &NfsClient{srv: ts.clnt.srv.As(acl.Cred{Uid: uid, Gid: 100, Gids: gids})}
+	}
+	data := mkdata(10)
+	w := user(1000).WriteOp(fhx, 0, data, nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3_OK, w.Status, "named user")
+	w = user(1001, 200).WriteOp(fhx, 0, data, nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3_OK, w.Status, "named group")
+	w = user(1001).WriteOp(fhx, 0, data, nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, w.Status, "other")
+	r := user(1001).ReadOp(fhx, 0, 10)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, r.Status, "other")
+	access := user(1001).srv.NFSPROC3_ACCESS(nfstypes.ACCESS3args{Object: fhx})
+	assert.Equal(t, nfstypes.Uint32(nfstypes.ACCESS3_DELETE), access.Resok.Access)
+
+	// a write doesn't join another caller's gathered writes
+	ts.clnt.srv.Gather = true
+	w = user(1000).WriteOp(fhx, 0, data, nfstypes.UNSTABLE)
+	assert.Equal(t, nfstypes.NFS3_OK, w.Status)
+	w = user(1001).WriteOp(fhx, 0, data, nfstypes.UNSTABLE)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, w.Status, "other, gathering")
+
+	sa := user(1000).srv.ACLPROC3_SETACL(nfstypes.SETACL3args{
+		Fh: fhx, Mask: nfstypes.Uint32(nfstypes.NFS_ACL), Acl: mkacl(7, 7, 7, 0)})
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, sa.Status, "only the owner may set the ACL")
+	got, _ := ts.GetAcl(fhx)
+	assert.Equal(t, a, got)
+}
+
+// Snapshot a tree, change it, and check that the snapshot keeps the
+// old contents, read-only, across a restart, and that deleting the
+// snapshot frees only the blocks that the live files no longer use.
+func TestSnapshot(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const N = 200 // past the direct blocks
+	old := mkdataval(1, disk.BlockSize)
+	x := ts.writeLargeFile("x", N)
+	ts.MkDir("d")
+	dfh := ts.Lookup("d", true)
+	ts.CreateFh(dfh, "y")
+	y := ts.LookupFh(dfh, "y")
+	ts.WriteOff(y, 0, []byte("small"), nfstypes.FILE_SYNC)
+	ts.clnt.srv.shrinkst.Wait()
+	nfree := ts.clnt.srv.fsstate.Balloc.NumFree()
+
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.srv.Snapshot("s0"))
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, ts.clnt.srv.Snapshot("s0"))
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, ts.clnt.srv.Snapshot(".s1"))
+	used := nfree - ts.clnt.srv.fsstate.Balloc.NumFree()
+	assert.Less(t, used, uint64(N/2), "snapshot should share data blocks")
+
+	ts.WriteOff(x, disk.BlockSize+10, []byte("new"), nfstypes.FILE_SYNC)
+	ts.WriteOff(y, 0, []byte("SMALL"), nfstypes.FILE_SYNC)
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+
+	names, err := ts.clnt.srv.ListSnapshots()
+	assert.Equal(t, nfstypes.NFS3_OK, err)
+	assert.Equal(t, []string{"s0"}, names)
+	sd := ts.LookupFh(ts.Lookup(SNAPDIR, true), "s0")
+	sx := ts.LookupFh(sd, "x")
+	ts.readcheck(sx, disk.BlockSize, old)
+	ts.readcheck(sx, (N-1)*disk.BlockSize, mkdataval(byte(N-1), disk.BlockSize))
+	sy := ts.LookupFh(ts.LookupFh(sd, "d"), "y")
+	ts.readcheck(sy, 0, []byte("small"))
+	ts.readcheck(x, disk.BlockSize+10, []byte("new"))
+	ts.readcheck(y, 0, []byte("SMALL"))
+
+	reply := ts.clnt.WriteOp(sx, 0, []byte("no"), nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3ERR_ROFS, reply.Status)
+	status := ts.clnt.RemoveOp(sd, "x")
+	assert.Equal(t, nfstypes.NFS3ERR_ROFS, status.Status)
+
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.srv.DeleteSnapshot("s0"))
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, ts.clnt.srv.DeleteSnapshot("s0"))
+	ts.clnt.srv.shrinkst.Wait()
+	lr := ts.clnt.LookupOp(ts.Lookup(SNAPDIR, true), "s0")
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, lr.Status)
+	ts.readcheck(x, (N-1)*disk.BlockSize, mkdataval(byte(N-1), disk.BlockSize))
+	ts.readcheck(x, 0, mkdataval(0, disk.BlockSize))
+
+	ts.Remove("x")
+	ts.clnt.srv.shrinkst.Wait()
+	assert.Greater(t, ts.clnt.srv.fsstate.Balloc.NumFree(), nfree)
+}
+
+// Snapshot a file with two links, which the server makes itself since
+// it doesn't implement LINK, and check that the snapshot has one copy
+// of the file, with both names.
+func TestSnapshotLinks(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.WriteOff(x, 0, []byte("linked"), nfstypes.FILE_SYNC)
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	root := op.GetInodeInum(common.ROOTINUM)
+	ip := op.GetInodeInum(fh.MakeFh(x).Ino)
+	assert.True(t, dir.AddName(root, op, ip.Inum, nfstypes.NF3REG, "z"))
+	ip.Nlink = ip.Nlink + 1
+	ip.WriteInode(op.Atxn)
+	assert.True(t, op.Commit())
+
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.srv.Snapshot("s0"))
+	sd := ts.LookupFh(ts.Lookup(SNAPDIR, true), "s0")
+	sx := ts.LookupFh(sd, "x")
+	sz := ts.LookupFh(sd, "z")
+	assert.Equal(t, fh.MakeFh(sx).Ino, fh.MakeFh(sz).Ino)
+	assert.NotEqual(t, fh.MakeFh(x).Ino, fh.MakeFh(sx).Ino)
+	ts.readcheck(sz, 0, []byte("linked"))
+	op = fstxn.Begin(ts.clnt.srv.fsstate)
+	ip = op.GetInodeInum(fh.MakeFh(sz).Ino)
+	assert.Equal(t, uint32(2), ip.Nlink)
+	op.Abort()
+}
+
+// Clone a file whose counts span several blocks of the reference count
+// table, and check that writes to the clone and to the source don't
+// show in the other.
+func TestClone(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const N = 2*inode.NSHARE + 16
+	data := mkdata(64 * 1024)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	for off := uint64(0); off < N*disk.BlockSize; off += uint64(len(data)) {
+		ts.WriteOff(x, off, data, nfstypes.UNSTABLE)
+	}
+	ts.Commit(x, N*disk.BlockSize)
+	ts.Create("small")
+	small := ts.Lookup("small", true)
+	ts.Write(small, []byte("inline"), nfstypes.FILE_SYNC)
+	nfree := ts.clnt.srv.fsstate.Balloc.NumFree()
+
+	reply := ts.clnt.CloneOp(x, fh.MkRootFh3(), "y")
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	y := reply.Obj
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, ts.clnt.CloneOp(x, fh.MkRootFh3(), "y").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, ts.clnt.CloneOp(fh.MkRootFh3(), fh.MkRootFh3(), "z").Status)
+	reply = ts.clnt.CloneOp(small, fh.MkRootFh3(), "small2")
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	ts.readcheck(reply.Obj, 0, []byte("inline"))
+	used := nfree - ts.clnt.srv.fsstate.Balloc.NumFree()
+	assert.Less(t, used, uint64(N/10), "clone should share data blocks")
+
+	ts.Getattr(y, N*disk.BlockSize)
+	ts.readcheck(y, (N-16)*disk.BlockSize, data)
+	ts.WriteOff(y, 10, []byte("clone"), nfstypes.FILE_SYNC)
+	ts.WriteOff(x, 2*disk.BlockSize, []byte("source"), nfstypes.FILE_SYNC)
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	ts.readcheck(x, 0, data[:disk.BlockSize])
+	ts.readcheck(y, 10, []byte("clone"))
+	ts.readcheck(y, 2*disk.BlockSize, data[2*disk.BlockSize:3*disk.BlockSize])
+	ts.readcheck(x, 2*disk.BlockSize, []byte("source"))
+
+	ts.Remove("x")
+	ts.clnt.srv.shrinkst.Wait()
+	ts.readcheck(y, (N-16)*disk.BlockSize, data)
+	ts.Remove("y")
+	ts.clnt.srv.shrinkst.Wait()
+	assert.Greater(t, ts.clnt.srv.fsstate.Balloc.NumFree(), nfree)
+}
+
+// A clone that exceeds its owner's quota fails, and leaves no partial
+// clone behind.
+func TestCloneQuota(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const uid, gid = 1000, 100
+	const N = 2*inode.NSHARE + 16
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdata(64 * 1024)
+	for off := uint64(0); off < N*disk.BlockSize; off += uint64(len(data)) {
+		ts.WriteOff(x, off, data, nfstypes.UNSTABLE)
+	}
+	ts.Commit(x, N*disk.BlockSize)
+	_, err := ts.clnt.srv.SetQuota(nfstypes.QUOTA_USR, uid, alloc.Limits{BlockHard: N - 1})
+	assert.Equal(t, nfstypes.NFS3_OK, err)
+
+	user := &NfsClient{srv: ts.clnt.srv.As(acl.Cred{Uid: uid, Gid: gid})}
+	reply := user.CloneOp(x, fh.MkRootFh3(), "y")
+	assert.Equal(t, nfstypes.NFS3ERR_DQUOT, reply.Status)
+	ts.Lookup("y", false)
+	assert.Equal(t, nfstypes.Uint64(0), ts.quota(nfstypes.QUOTA_USR, uid).Blocks)
+}
+
+// A transaction that drops a reference to a shared block and aborts
+// must not let another transaction free the block while it runs.
+func TestRefsAbort(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	data := mkdata(8 * disk.BlockSize)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.WriteOff(x, 0, data, nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.CloneOp(x, fh.MkRootFh3(), "y").Status)
+
+	// unshare x's first block, and remove y while that is uncommitted
+	st := ts.clnt.srv.fsstate
+	op := fstxn.Begin(st)
+	ip := op.GetInodeLocked(fh.MakeFh(x).Ino)
+	require.NotNil(t, ip)
+	_, ok := ip.Write(op.Atxn, 0, 1, []byte{1})
+	require.True(t, ok)
+	ts.Remove("y")
+	ts.clnt.srv.shrinkst.Wait()
+	op.Abort()
+
+	ts.readcheck(x, 0, data)
+	res := ts.scrub()
+	assert.Equal(t, nfstypes.Uint64(0), res.Errors, "x's blocks should stay allocated")
+}
+
+// A transaction that CommitNext continues keeps the inodes it was
+// given locked, so that a large clone's source can't change between its
+// transactions, and a freeze waits for it.
+func TestCommitNext(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	st := ts.clnt.srv.fsstate
+	op := fstxn.Begin(st)
+	ip := op.GetInodeLocked(fh.MakeFh(x).Ino)
+	require.NotNil(t, ip)
+	next := op.CommitNext(ip)
+	require.NotNil(t, next)
+
+	wrote := make(chan bool)
+	go func() {
+		ts.WriteOff(x, 0, []byte("x"), nfstypes.FILE_SYNC)
+		wrote <- true
+	}()
+	froze := make(chan bool)
+	go func() {
+		st.Freeze()
+		st.Thaw()
+		froze <- true
+	}()
+	select {
+	case <-wrote:
+		assert.Fail(t, "write should wait for the continued transaction")
+	case <-froze:
+		assert.Fail(t, "freeze should wait for the continued transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.True(t, next.Commit())
+	<-wrote
+	<-froze
+	ts.readcheck(x, 0, []byte("x"))
+}
+
+// Flip bits of a data block and of an inode on disk, and check that
+// reading them fails with NFS3ERR_IO and counts integrity errors,
+// while the rest of the file system still works.
+func TestChecksum(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	pattern := mkdataval('C', disk.BlockSize)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.WriteOff(x, 0, mkdata(disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.WriteOff(x, disk.BlockSize, pattern, nfstypes.FILE_SYNC)
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.WriteOff(y, 0, mkdata(8192), nfstypes.FILE_SYNC)
+
+	// install the log, so the disk has the blocks
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(d)
+	ts.clnt.Shutdown()
+	var found = false
+	for bn := uint64(0); bn < DISKSZ; bn++ {
+		blk := d.Read(bn)
+		if string(blk) == string(pattern) {
+			blk[100] = blk[100] ^ 1
+			d.Write(bn, blk)
+			found = true
+		}
+	}
+	assert.True(t, found, "data block should be on disk")
+	ts.clnt.srv = MakeNfs(d)
+
+	// write y's inode with a bit flipped, bypassing its checksum
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	a := ts.clnt.srv.fsstate.Super.Inum2Addr(fh.MakeFh(y).Ino)
+	ino := append([]byte{}, op.Atxn.Op.ReadBuf(a, super.INODESZ*8).Data...)
+	ino[8] = ino[8] ^ 0x10
+	op.Atxn.Op.OverWrite(a, super.INODESZ*8, ino)
+	assert.True(t, op.Commit())
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(d)
+
+	reply := ts.clnt.ReadOp(x, disk.BlockSize, disk.BlockSize)
+	assert.Equal(t, nfstypes.NFS3ERR_IO, reply.Status)
+	ts.readcheck(x, 0, mkdata(disk.BlockSize))
+	attr := ts.clnt.GetattrOp(y)
+	assert.Equal(t, nfstypes.NFS3ERR_IO, attr.Status)
+	lookup := ts.clnt.LookupOp(fh.MkRootFh3(), "y")
+	assert.Equal(t, nfstypes.NFS3ERR_IO, lookup.Status)
+	assert.Equal(t, uint64(3), ts.clnt.srv.fsstate.Super.NIntegrityErrors())
+
+	// rewriting the block fixes it
+	ts.WriteOff(x, disk.BlockSize, pattern, nfstypes.FILE_SYNC)
+	ts.readcheck(x, disk.BlockSize, pattern)
+	ts.Create("z")
+	ts.Remove("x")
+}
+
+// scrub runs a pass of the background scrub and waits for it.
+func (ts *TestState) scrub() nfstypes.SCRUBres {
+	ts.clnt.srv.ADMINPROC_SCRUB(nfstypes.SCRUBargs{Action: nfstypes.Uint32(nfstypes.SCRUB_START)})
+	for {
+		res := ts.clnt.srv.ADMINPROC_SCRUB(nfstypes.SCRUBargs{Action: nfstypes.Uint32(nfstypes.SCRUB_STATUS)})
+		if !res.Running {
+			return res
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Scrubbing a large sparse file takes a step per NSCRUB mapped blocks,
+// not per NSCRUB logical blocks.
+func TestScrubSparse(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("s")
+	sp := ts.Lookup("s", true)
+	ts.clnt.srv.Extents = true
+	ts.Create("e")
+	e := ts.Lookup("e", true)
+	for _, f := range []nfstypes.Nfs_fh3{sp, e} {
+		for _, off := range []uint64{0, 1 << 30, 1 << 38} {
+			ts.WriteOff(f, off, mkdataval(1, disk.BlockSize), nfstypes.FILE_SYNC)
+		}
+	}
+
+	st := ts.clnt.srv.fsstate
+	for _, f := range []nfstypes.Nfs_fh3{sp, e} {
+		op := fstxn.BeginReadOnly(st)
+		ip := op.GetInodeLocked(fh.MakeFh(f).Ino)
+		require.NotNil(t, ip)
+		var steps, nblk uint64
+		var bn uint64 = 0
+		for {
+			steps++
+			bn = ip.Scrub(op.Atxn, bn, func(common.Bnum) bool {
+				nblk++
+				return true
+			})
+			if bn == 0 {
+				break
+			}
+		}
+		op.Abort()
+		assert.LessOrEqual(t, steps, uint64(8), "steps should skip holes")
+		assert.GreaterOrEqual(t, nblk, uint64(3), "data blocks")
+	}
+
+	res := ts.scrub()
+	assert.Equal(t, nfstypes.Uint64(0), res.CsumErrors)
+	assert.Equal(t, nfstypes.Uint64(0), res.Errors)
+}
+
+func TestScrub(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const N = inode.NDIRECT + inode.NSCRUB + 10
+	x := ts.writeLargeFile("x", N)
+	ts.clnt.srv.Extents = true
+	ts.writeLargeFile("e", inode.NSCRUB+10)
+	ts.Create("s")
+	ts.MkDir("d")
+
+	res := ts.scrub()
+	assert.Equal(t, nfstypes.Uint64(1), res.Passes)
+	assert.Equal(t, nfstypes.Uint64(0), res.CsumErrors)
+	assert.Equal(t, nfstypes.Uint64(0), res.Errors)
+	assert.True(t, uint64(res.Blocks) > N+inode.NSCRUB, "scrub should check all blocks")
+
+	// break the checksum of x's first block, and mark a free inode used
+	st := ts.clnt.srv.fsstate
+	op := fstxn.Begin(st)
+	ip := op.GetInodeInum(fh.MakeFh(x).Ino)
+	var blks []common.Bnum
+	ip.Scrub(op.Atxn, 0, func(bn common.Bnum) bool {
+		blks = append(blks, bn)
+		return true
+	})
+	op.Atxn.Op.OverWrite(st.Super.CsumAddr(blks[0]), super.CSUMSZ*8,
+		super.EncodeCsum(12345))
+	op.Atxn.WriteBit(st.Super.InodeBitAddr(st.Super.NInode()-1), true)
+	assert.True(t, op.Commit())
+
+	res = ts.scrub()
+	assert.Equal(t, nfstypes.Uint64(2), res.Passes)
+	assert.Equal(t, nfstypes.Uint64(1), res.CsumErrors)
+	assert.Equal(t, nfstypes.Uint64(1), res.Errors)
+
+	// a slow scrub can be paused, resumed and stopped
+	scrub := func(action uint32) nfstypes.SCRUBres {
+		return ts.clnt.srv.ADMINPROC_SCRUB(nfstypes.SCRUBargs{
+			Action: nfstypes.Uint32(action), Rate: 10})
+	}
+	res = scrub(nfstypes.SCRUB_START)
+	assert.True(t, res.Running)
+	res = scrub(nfstypes.SCRUB_PAUSE)
+	assert.True(t, res.Paused)
+	res = scrub(nfstypes.SCRUB_RESUME)
+	assert.False(t, res.Paused)
+	res = scrub(nfstypes.SCRUB_STOP)
+	assert.False(t, res.Running)
+	assert.Equal(t, nfstypes.Uint64(2), res.Passes)
+}
+
+// Compressed files read back what was written, take fewer blocks than
+// their size if their data compresses, and survive overwrites,
+// truncation, clones, and restarts.
+func TestCompress(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.clnt.srv.Compress = true
+	nfree := ts.clnt.srv.fsstate.Balloc.NumFree()
+
+	const N = 4 * inode.NCLUSTER * inode.NSCRUB
+	data := mkdata(64 * 1024)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	for off := uint64(0); off < N*disk.BlockSize; off += uint64(len(data)) {
+		ts.WriteOff(x, off, data, nfstypes.UNSTABLE)
+	}
+	ts.Commit(x, N*disk.BlockSize)
+	attr := ts.Getattr(x, N*disk.BlockSize)
+	assert.Less(t, uint64(attr.Used), uint64(attr.Size)/4, "data should compress")
+
+	// incompressible data takes a block per block
+	noise := make([]byte, 16*disk.BlockSize)
+	var r uint32 = 1
+	for i := range noise {
+		r = r*1103515245 + 12345
+		noise[i] = byte(r >> 16)
+	}
+	ts.Create("n")
+	n := ts.Lookup("n", true)
+	ts.Write(n, noise, nfstypes.FILE_SYNC)
+	attr = ts.Getattr(n, uint64(len(noise)))
+	assert.Equal(t, attr.Size, attr.Used)
+
+	// overwrite part of a cluster, and cut a cluster in two
+	ts.WriteOff(x, disk.BlockSize+10, []byte("overwrite"), nfstypes.UNSTABLE)
+	ts.Commit(x, 0)
+	cut := 3*inode.CLUSTERSZ + 100
+	ts.Setattr(x, cut)
+	ts.clnt.srv.shrinkst.Wait()
+	ts.Setattr(x, cut+disk.BlockSize)
+
+	reply := ts.clnt.CloneOp(x, fh.MkRootFh3(), "y")
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	y := reply.Obj
+	ts.WriteOff(y, 0, []byte("clone"), nfstypes.FILE_SYNC)
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+
+	want := append(append([]byte{}, data...), data...)[:cut]
+	copy(want[disk.BlockSize+10:], "overwrite")
+	want = append(want, make([]byte, disk.BlockSize)...)
+	ts.readcheck(x, 0, want)
+	copy(want, "clone")
+	ts.readcheck(y, 0, want)
+	ts.readcheck(n, 0, noise)
+	attr = ts.Getattr(x, cut+disk.BlockSize)
+	assert.Less(t, uint64(attr.Used), uint64(attr.Size))
+
+	res := ts.scrub()
+	assert.Equal(t, nfstypes.Uint64(0), res.CsumErrors)
+	assert.Equal(t, nfstypes.Uint64(0), res.Errors)
+
+	ts.Remove("x")
+	ts.Remove("y")
+	ts.Remove("n")
+	ts.clnt.srv.shrinkst.Wait()
+	dirblks := uint64(ts.GetattrDir(fh.MkRootFh3()).Used) / disk.BlockSize
+	assert.Equal(t, nfree-dirblks, ts.clnt.srv.fsstate.Balloc.NumFree())
+}
+
+// The file system runs on an encrypted disk, which opens only with its
+// key, holds no plaintext, and recovers its journal after a crash.
+func TestEncrypt(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	key := make([]byte, crypt_disk.KEYSZ)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	t.Setenv(crypt_disk.KEYENV, hex.EncodeToString(key))
+	k, err := crypt_disk.LoadKey("")
+	require.NoError(t, err)
+	assert.Equal(t, key, k)
+
+	ts.clnt.Shutdown()
+	under := disk.NewMemDisk(crypt_disk.PhysSize(DISKSZ))
+	d, err := crypt_disk.New(under, key)
+	require.NoError(t, err)
+	ts.clnt.srv = MakeNfs(d)
+
+	secret := mkdataval('S', 16*disk.BlockSize)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Write(x, secret, nfstypes.FILE_SYNC)
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.Write(y, secret, nfstypes.UNSTABLE)
+	ts.Commit(y, uint64(len(secret)))
+	ts.clnt.Crash()
+
+	_, err = crypt_disk.New(under, make([]byte, crypt_disk.KEYSZ))
+	assert.Error(t, err, "wrong key")
+	for bn := uint64(0); bn < under.Size(); bn++ {
+		assert.False(t, bytes.Contains(under.Read(bn), secret[:64]),
+			"block %d holds plaintext", bn)
+	}
+
+	d, err = crypt_disk.New(under, key)
+	require.NoError(t, err)
+	ts.clnt.srv = MakeNfs(d)
+	ts.readcheck(x, 0, secret)
+	ts.readcheck(y, 0, secret)
+}
+
+func (ts *TestState) quota(t uint32, id uint32) nfstypes.Quota3 {
+	q, err := ts.clnt.srv.GetQuota(t, id)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, err)
+	return q
+}
+
+func TestQuota(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const uid, gid = 1000, 100
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	reply := ts.clnt.ChownOp(d, uid, gid)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	attr := ts.GetattrDir(d)
+	assert.Equal(t, nfstypes.Uid3(uid), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(gid), attr.Gid)
+	q := ts.quota(nfstypes.QUOTA_USR, uid)
+	assert.Equal(t, nfstypes.Uint64(1), q.Inodes)
+	base := uint64(q.Blocks)
+
+	_, err := ts.clnt.srv.SetQuota(nfstypes.QUOTA_USR, uid,
+		alloc.Limits{BlockHard: base + 8, BlockSoft: base + 6, InodeHard: 3})
+	assert.Equal(t, nfstypes.NFS3_OK, err)
+
+	// new files belong to the user who creates them
+	user := &NfsClient{srv: ts.clnt.srv.As(acl.Cred{Uid: uid, Gid: gid})}
+	assert.Equal(t, nfstypes.NFS3_OK, user.CreateOp(d, "x").Status)
+	x := ts.LookupFh(d, "x")
+	attr = ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Uid3(uid), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(gid), attr.Gid)
+	ts.Write(x, mkdata(4*disk.BlockSize), nfstypes.FILE_SYNC)
+	ts.WriteErr(x, mkdata(16*disk.BlockSize), nfstypes.FILE_SYNC, nfstypes.NFS3ERR_DQUOT)
+	ts.readcheck(x, 0, mkdata(4*disk.BlockSize))
+	q = ts.quota(nfstypes.QUOTA_USR, uid)
+	assert.Equal(t, nfstypes.Uint64(base+4), q.Blocks)
+	assert.Equal(t, nfstypes.Uint64(2), q.Inodes)
+	assert.Equal(t, q.Blocks, ts.quota(nfstypes.QUOTA_GRP, gid).Blocks)
+
+	r := ts.clnt.srv.RQUOTAPROC_GETQUOTA(nfstypes.Getquota_args{Gqa_pathp: "/", Gqa_uid: uid})
+	assert.Equal(t, nfstypes.Q_OK, r.Status)
+	assert.Equal(t, nfstypes.Uint32(base+4), r.Gqr_rquota.Rq_curblocks)
+	assert.Equal(t, nfstypes.Uint32(base+8), r.Gqr_rquota.Rq_bhardlimit)
+	assert.Equal(t, nfstypes.Uint32(2), r.Gqr_rquota.Rq_curfiles)
+	r = ts.clnt.srv.RQUOTAPROC_EXT_GETQUOTA(nfstypes.Ext_getquota_args{
+		Gqa_pathp: "/", Gqa_type: int32(nfstypes.RQ_GRPQUOTA), Gqa_id: gid})
+	assert.Equal(t, nfstypes.Q_OK, r.Status)
+	assert.Equal(t, nfstypes.Uint32(base+4), r.Gqr_rquota.Rq_curblocks)
+
+	assert.Equal(t, nfstypes.NFS3_OK, user.CreateOp(d, "y").Status)
+	res := user.CreateOp(d, "z")
+	assert.Equal(t, nfstypes.NFS3ERR_DQUOT, res.Status)
+
+	// the records survive a crash
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(ts.clnt.srv.fsstate.Super.Disk)
+	q = ts.quota(nfstypes.QUOTA_USR, uid)
+	assert.Equal(t, nfstypes.Uint64(base+4), q.Blocks)
+	assert.Equal(t, nfstypes.Uint64(3), q.Inodes)
+	assert.Equal(t, nfstypes.Uint64(base+8), q.BlockHard)
+
+	// giving x to another user moves its charges
+	reply = ts.clnt.ChownOp(x, uid+1, gid)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Uint64(base), ts.quota(nfstypes.QUOTA_USR, uid).Blocks)
+	assert.Equal(t, nfstypes.Uint64(4), ts.quota(nfstypes.QUOTA_USR, uid+1).Blocks)
+	assert.Equal(t, nfstypes.Uint64(base+4), ts.quota(nfstypes.QUOTA_GRP, gid).Blocks)
+
+	rm := ts.clnt.RemoveOp(d, "x")
+	assert.Equal(t, nfstypes.NFS3_OK, rm.Status)
+	q = ts.quota(nfstypes.QUOTA_USR, uid+1)
+	assert.Equal(t, nfstypes.Uint64(0), q.Blocks)
+	assert.Equal(t, nfstypes.Uint64(0), q.Inodes)
+	assert.Equal(t, nfstypes.Uint64(base), ts.quota(nfstypes.QUOTA_GRP, gid).Blocks)
+
+	reps, err := ts.clnt.srv.RepQuota(nfstypes.QUOTA_USR)
+	assert.Equal(t, nfstypes.NFS3_OK, err)
+	var ids []nfstypes.Uint32
+	for _, rep := range reps {
+		ids = append(ids, rep.Id)
+	}
+	assert.Equal(t, []nfstypes.Uint32{0, uid}, ids)
+}
+
+// gateDisk blocks the first barrier after its gate is set, until the
+// gate is closed.
+type gateDisk struct {
+	disk.Disk
+	mu      *sync.Mutex
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+func (d *gateDisk) Barrier() {
+	d.mu.Lock()
+	gate := d.gate
+	d.gate = nil
+	d.mu.Unlock()
+	if gate != nil {
+		close(d.entered)
+		<-gate
+	}
+	d.Disk.Barrier()
+}
+
+// A transaction that charges a quota doesn't hold the quota tables
+// while it waits for the log.
+func TestQuotaFlush(t *testing.T) {
+	gd := &gateDisk{Disk: disk.NewMemDisk(DISKSZ), mu: new(sync.Mutex)}
+	ts := &TestState{t: t, clnt: &NfsClient{srv: MakeNfs(gd)}}
+	defer ts.Close()
+	st := ts.clnt.srv.fsstate
+
+	ts.Create("a")
+	st.Fence()
+	gate := make(chan struct{})
+	gd.mu.Lock()
+	gd.gate = gate
+	gd.entered = make(chan struct{})
+	gd.mu.Unlock()
+	created := make(chan bool)
+	go func() {
+		ts.Create("b")
+		created <- true
+	}()
+	<-gd.entered
+
+	locked := make(chan bool)
+	go func() {
+		op := fstxn.Begin(st)
+		ip := op.GetInodeLocked(super.USRQUOTAINUM)
+		op.Abort()
+		locked <- ip != nil
+	}()
+	select {
+	case ok := <-locked:
+		assert.True(t, ok)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the quota table should be free while a create waits for the log")
+	}
+	close(gate)
+	<-created
+}
+
+// Only root may give a file to another user, and a file's owner may
+// give it only to one of the owner's groups.
+func TestChown(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const uid, gid = 1000, 100
+	user := &NfsClient{srv: ts.clnt.srv.As(acl.Cred{Uid: uid, Gid: gid, Gids: []uint32{200}})}
+	other := &NfsClient{srv: ts.clnt.srv.As(acl.Cred{Uid: uid + 1, Gid: 200})}
+	assert.Equal(t, nfstypes.NFS3_OK, user.CreateOp(fh.MkRootFh3(), "x").Status)
+	x := ts.Lookup("x", true)
+
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, user.ChownOp(x, uid+1, gid).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, user.ChownOp(x, uid, 300).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, other.ChownOp(x, uid, 200).Status)
+	attr := ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Uid3(uid), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(gid), attr.Gid)
+
+	assert.Equal(t, nfstypes.NFS3_OK, user.ChownOp(x, uid, 200).Status)
+	assert.Equal(t, nfstypes.Gid3(200), ts.Getattr(x, 0).Gid)
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.ChownOp(x, uid+1, 300).Status)
+	attr = ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Uid3(uid+1), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(300), attr.Gid)
+
+	// chown counts the blocks of a large sparse file without walking
+	// its holes
+	ts.Create("s")
+	s := ts.Lookup("s", true)
+	ts.WriteOff(s, 1<<40, []byte("s"), nfstypes.FILE_SYNC)
+	before := ts.quota(nfstypes.QUOTA_USR, 0).Blocks
+	start := time.Now()
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.ChownOp(s, uid+2, gid).Status)
+	assert.Less(t, time.Since(start), time.Second)
+	n := ts.quota(nfstypes.QUOTA_USR, uid+2).Blocks
+	assert.Greater(t, n, nfstypes.Uint64(1), "the data block and its index blocks")
+	assert.Equal(t, before-n, ts.quota(nfstypes.QUOTA_USR, 0).Blocks)
+}
+
+func TestReserve(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	balloc := ts.clnt.srv.fsstate.Balloc
+	data := mkdata(32 * disk.BlockSize)
+	var n = 0
+	for ; ; n++ {
+		name := "x" + strconv.Itoa(n)
+		res := ts.clnt.CreateOp(fh.MkRootFh3(), name)
+		if res.Status != nfstypes.NFS3_OK {
+			assert.Equal(t, nfstypes.NFS3ERR_NOSPC, res.Status)
+			break
+		}
+		x := ts.Lookup(name, true)
+		reply := ts.clnt.WriteOp(x, 0, data, nfstypes.FILE_SYNC)
+		if reply.Status != nfstypes.NFS3_OK {
+			// the write fails before it changes the file
+			assert.Equal(t, nfstypes.NFS3ERR_NOSPC, reply.Status)
+			ts.Getattr(x, 0)
+			n++
+			break
+		}
+	}
+	assert.Greater(t, n, 0)
+	assert.GreaterOrEqual(t, balloc.NumFree(), balloc.Pool())
+
+	// removing files may use the reserve, and frees space for writes
+	for i := 0; i < n; i++ {
+		ts.Remove("x" + strconv.Itoa(i))
+	}
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.Write(y, data, nfstypes.FILE_SYNC)
+	ts.readcheck(y, 0, data)
+}
+
+// allocated returns the # blocks of disk space that file path takes.
+func allocated(t *testing.T, path string) uint64 {
+	var st syscall.Stat_t
+	err := syscall.Stat(path, &st)
+	require.NoError(t, err)
+	return uint64(st.Blocks) * 512 / disk.BlockSize
+}
+
+func TestDiscard(t *testing.T) {
+	ts := newTest(t)
+	_, err := ts.clnt.srv.Trim(1)
+	assert.Equal(t, nfstypes.NFS3ERR_NOTSUPP, err)
+	ts.Close()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	d, derr := file_disk.New(path, DISKSZ)
+	require.NoError(t, derr)
+	ts = &TestState{t: t, clnt: &NfsClient{srv: MakeNfs(d)}}
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdata(256 * disk.BlockSize)
+	for i := uint64(0); i < 4; i++ {
+		ts.WriteOff(x, i*uint64(len(data)), data, nfstypes.FILE_SYNC)
+	}
+	// let the log install the file's blocks before measuring
+	ts.clnt.srv.fsstate.Fence()
+	full := allocated(t, path)
+	ts.Remove("x")
+
+	// the shrinker frees the file's blocks in the background, and the
+	// log may install them after they were discarded, so wait for both
+	// before trimming
+	ts.clnt.srv.shrinkst.Wait()
+	ts.clnt.srv.fsstate.Fence()
+	n, err := ts.clnt.srv.Trim(1)
+	assert.Equal(t, nfstypes.NFS3_OK, err)
+	assert.Greater(t, n, uint64(1024))
+	assert.LessOrEqual(t, allocated(t, path)+1024, full)
+
+	// discarded blocks read as zeros when a file gets them again
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.WriteOff(y, disk.BlockSize+1, []byte{1}, nfstypes.FILE_SYNC)
+	data = make([]byte, disk.BlockSize+2)
+	data[disk.BlockSize+1] = 1
+	ts.readcheck(y, 0, data)
+}
+
+// inLog reports whether a block of the on-disk log holds data.
+func inLog(d disk.Disk, data []byte) bool {
+	for bn := wal.LOGSTART; bn < wal.LOGSTART+wal.LOGSZ; bn++ {
+		if bytes.Equal(d.Read(bn), data) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOrdered(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	d := ts.clnt.srv.fsstate.Super.Disk
+
+	blk := mkdataval(7, disk.BlockSize)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Write(x, blk, nfstypes.FILE_SYNC)
+	assert.True(t, inLog(d, blk), "data should go through the log")
+
+	ts.clnt.srv.Ordered = true
+	data := mkdataval(9, 64*disk.BlockSize)
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.Write(y, data, nfstypes.UNSTABLE)
+	ts.Commit(y, uint64(len(data)))
+	assert.False(t, inLog(d, data[:disk.BlockSize]), "new blocks should bypass the log")
+
+	// partial blocks go through the log
+	ts.WriteOff(y, 70*disk.BlockSize+1, []byte{1}, nfstypes.FILE_SYNC)
+	tail := make([]byte, 6*disk.BlockSize+2)
+	tail[len(tail)-1] = 1
+	ts.readcheck(y, 64*disk.BlockSize, tail)
+
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(d)
+	ts.clnt.srv.Ordered = true
+	ts.readcheck(y, 0, data)
+
+	// y's blocks are stale until a fence, and then z may reuse them
+	ts.Remove("y")
+	ts.clnt.srv.fsstate.Fence()
+	data = mkdataval(11, 64*disk.BlockSize)
+	ts.Create("z")
+	z := ts.Lookup("z", true)
+	ts.Write(z, data, nfstypes.FILE_SYNC)
+	assert.False(t, inLog(d, data[:disk.BlockSize]), "fresh blocks should bypass the log")
+	ts.readcheck(z, 0, data)
+}
+
+func TestGather(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv.Gather = true
+
+	data := mkdataval(5, 8*disk.BlockSize)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	reply := ts.clnt.WriteOp(x, 0, data[:1000], nfstypes.UNSTABLE)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	verf := reply.Resok.Verf
+
+	// later writes wait in x's buffer, merged into one run
+	for off := uint64(1000); off < uint64(len(data)); off += 1000 {
+		var end = off + 1000
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		reply := ts.clnt.WriteOp(x, off, data[off:end], nfstypes.UNSTABLE)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		assert.Equal(t, verf, reply.Resok.Verf)
+		assert.Equal(t, nfstypes.Size3(end), reply.Resok.File_wcc.After.Attributes.Size)
+	}
+	g := ts.clnt.srv.wb.files[fh.MakeFh(x)]
+	assert.Equal(t, 1, len(g.segs))
+	assert.Equal(t, uint64(len(data)-1000), g.nbytes)
+
+	// LOOKUP and READDIRPLUS report the size with the buffered writes,
+	// and removing another file writes back only that file's buffer
+	lookup := ts.clnt.LookupOp(fh.MkRootFh3(), "x")
+	assert.Equal(t, nfstypes.Size3(len(data)), lookup.Resok.Obj_attributes.Attributes.Size)
+	rdp := ts.clnt.ReadDirPlusOp(fh.MkRootFh3(), 4096)
+	assert.Equal(t, nfstypes.NFS3_OK, rdp.Status)
+	var n = 0
+	for e := rdp.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		if e.Name == "x" {
+			assert.Equal(t, nfstypes.Size3(len(data)), e.Name_attributes.Attributes.Size)
+			n++
+		}
+	}
+	assert.Equal(t, 1, n)
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.WriteOff(y, 0, data[:10], nfstypes.UNSTABLE)
+	ts.WriteOff(y, 10, data[:10], nfstypes.UNSTABLE)
+	assert.NotNil(t, ts.clnt.srv.wb.files[fh.MakeFh(y)])
+	ts.Remove("y")
+	assert.Nil(t, ts.clnt.srv.wb.files[fh.MakeFh(y)])
+	assert.Equal(t, uint64(len(data)-1000), g.nbytes)
+
+	// overlapping writes replace buffered bytes
+	ts.WriteOff(x, 2*disk.BlockSize, data[:10], nfstypes.UNSTABLE)
+	copy(data[2*disk.BlockSize:], data[:10])
+	ts.Getattr(x, uint64(len(data)))
+	ts.readcheck(x, 0, data)
+
+	ts.WriteOff(x, 0, data[:10], nfstypes.UNSTABLE)
+	ts.WriteOff(x, 20, data[:10], nfstypes.UNSTABLE)
+	copy(data[20:], data[:10])
+	commit := ts.clnt.CommitOp(x, uint64(len(data)))
+	assert.Equal(t, nfstypes.NFS3_OK, commit.Status)
+	assert.Equal(t, verf, commit.Resok.Verf)
+	assert.Equal(t, 0, len(ts.clnt.srv.wb.files))
+
+	// a crash loses writes that weren't committed, and the verifier
+	ts.WriteOff(x, 0, data[:10], nfstypes.UNSTABLE)
+	ts.WriteOff(x, uint64(len(data)), data[:10], nfstypes.UNSTABLE)
+	ts.clnt.Crash()
+	ts.clnt.srv = MakeNfs(d)
+	ts.Getattr(x, uint64(len(data)))
+	ts.readcheck(x, 0, data)
+	reply = ts.clnt.WriteOp(x, 0, data[:10], nfstypes.UNSTABLE)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.NotEqual(t, verf, reply.Resok.Verf)
+}
+
+func TestConcurReaders(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	ts.clnt.srv.Extents = true
+	const N = 8
+	const NBLK = 16
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdataval(3, NBLK*disk.BlockSize)
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+
+	var wg sync.WaitGroup
+	for g := 0; g < N; g++ {
+		wg.Add(1)
+		go func() {
+			for i := uint64(0); i < NBLK; i++ {
+				fh := ts.Lookup("x", true)
+				ts.Getattr(fh, NBLK*disk.BlockSize)
+				buf := ts.Read(fh, i*disk.BlockSize, disk.BlockSize)
+				assert.Equal(t, data[:disk.BlockSize], buf)
+				ts.ReadDirPlus()
+			}
+			wg.Done()
+		}()
+	}
+	// a writer interleaves with the readers
+	for i := uint64(0); i < NBLK; i++ {
+		ts.WriteOff(x, i*disk.BlockSize, data[:disk.BlockSize], nfstypes.FILE_SYNC)
+	}
+	wg.Wait()
+	ts.readcheck(x, 0, data)
+}
+
+func TestReadOnlyTxn(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	st := ts.clnt.srv.fsstate
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Getattr(x, 0)
+
+	// read-only transactions share the inode's lock
+	op1 := fstxn.BeginReadOnly(st)
+	op2 := fstxn.BeginReadOnly(st)
+	assert.NotNil(t, op1.GetInodeFh(x))
+	assert.NotNil(t, op2.GetInodeFh(x))
+	assert.True(t, op1.Commit())
+	assert.True(t, op2.Commit())
+
+	op := fstxn.BeginReadOnly(st)
+	ip := op.GetInodeFh(x)
+	ip.WriteInode(op.Atxn)
+	assert.Panics(t, func() { op.Commit() }, "a read-only transaction must not write")
+	op.Abort()
+}
@@ -0,0 +1,86 @@
+package nfs
+
+import (
+	"sort"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Quotas.  Each user and group has a quota of blocks and of inodes,
+// which counts the files that it owns.  A transaction that grows a
+// usage beyond its hard limit fails with NFS3ERR_DQUOT; soft limits
+// are only reported.  The records live in two reserved inodes, one
+// table for users and one for groups, which the transaction that
+// changes a usage also updates.
+//
+
+func quotaId(t uint32, id uint32) (alloc.QuotaId, nfstypes.Nfsstat3) {
+	if (t != alloc.USRQUOTA && t != alloc.GRPQUOTA) || id >= alloc.MAXQUOTAID {
+		return alloc.QuotaId{}, nfstypes.NFS3ERR_INVAL
+	}
+	return alloc.QuotaId{Type: t, Id: id}, nfstypes.NFS3_OK
+}
+
+func mkQuota3(id alloc.QuotaId, q alloc.Quota) nfstypes.Quota3 {
+	return nfstypes.Quota3{
+		Type:      nfstypes.Uint32(id.Type),
+		Id:        nfstypes.Uint32(id.Id),
+		BlockHard: nfstypes.Uint64(q.BlockHard),
+		BlockSoft: nfstypes.Uint64(q.BlockSoft),
+		InodeHard: nfstypes.Uint64(q.InodeHard),
+		InodeSoft: nfstypes.Uint64(q.InodeSoft),
+		Blocks:    nfstypes.Uint64(q.Blocks),
+		Inodes:    nfstypes.Uint64(q.Inodes),
+	}
+}
+
+// SetQuota sets the limits of the quota of user or group id, of type
+// t.  Lowering a limit below the usage is allowed; it stops the usage
+// from growing.
+func (nfs *Nfs) SetQuota(t uint32, id uint32, l alloc.Limits) (nfstypes.Quota3, nfstypes.Nfsstat3) {
+	qid, err := quotaId(t, id)
+	if err != nfstypes.NFS3_OK {
+		return nfstypes.Quota3{}, err
+	}
+	op := fstxn.Begin(nfs.fsstate)
+	op.Atxn.SetLimits(qid, l)
+	if !op.Commit() {
+		return nfstypes.Quota3{}, commitErr(op)
+	}
+	util.DPrintf(1, "SetQuota %v: %v\n", qid, l)
+	return mkQuota3(qid, nfs.fsstate.Quotas.Get(qid)), nfstypes.NFS3_OK
+}
+
+// GetQuota returns the quota of user or group id, of type t.
+func (nfs *Nfs) GetQuota(t uint32, id uint32) (nfstypes.Quota3, nfstypes.Nfsstat3) {
+	qid, err := quotaId(t, id)
+	if err != nfstypes.NFS3_OK {
+		return nfstypes.Quota3{}, err
+	}
+	nfs.writeBackAll()
+	return mkQuota3(qid, nfs.fsstate.Quotas.Get(qid)), nfstypes.NFS3_OK
+}
+
+// RepQuota returns the quotas of type t that have limits or usage, in
+// order of id.
+func (nfs *Nfs) RepQuota(t uint32) ([]nfstypes.Quota3, nfstypes.Nfsstat3) {
+	if _, err := quotaId(t, 0); err != nfstypes.NFS3_OK {
+		return nil, err
+	}
+	nfs.writeBackAll()
+	qs := nfs.fsstate.Quotas.List(t)
+	ids := make([]uint32, 0, len(qs))
+	for id := range qs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	reps := make([]nfstypes.Quota3, 0, len(ids))
+	for _, id := range ids {
+		reps = append(reps, mkQuota3(alloc.QuotaId{Type: t, Id: id}, qs[id]))
+	}
+	return reps, nfstypes.NFS3_OK
+}
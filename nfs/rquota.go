@@ -0,0 +1,77 @@
+package nfs
+
+import (
+	"math"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// The RQUOTA program reports quotas to the quota command on clients.
+// The server exports one file system, so it ignores the path.
+
+func rqcount(n nfstypes.Uint64) nfstypes.Uint32 {
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return nfstypes.Uint32(n)
+}
+
+func (nfs *Nfs) getRquota(t uint32, id int32) nfstypes.Getquota_rslt {
+	var reply nfstypes.Getquota_rslt
+	q, err := nfs.GetQuota(t, uint32(id))
+	if err != nfstypes.NFS3_OK {
+		reply.Status = nfstypes.Q_NOQUOTA
+		return reply
+	}
+	reply.Status = nfstypes.Q_OK
+	reply.Gqr_rquota = nfstypes.Rquota{
+		Rq_bsize:      int32(disk.BlockSize),
+		Rq_active:     true,
+		Rq_bhardlimit: rqcount(q.BlockHard),
+		Rq_bsoftlimit: rqcount(q.BlockSoft),
+		Rq_curblocks:  rqcount(q.Blocks),
+		Rq_fhardlimit: rqcount(q.InodeHard),
+		Rq_fsoftlimit: rqcount(q.InodeSoft),
+		Rq_curfiles:   rqcount(q.Inodes),
+	}
+	return reply
+}
+
+// RQUOTAPROC_NULL handles the NULL RPC for the rquota service.
+func (nfs *Nfs) RQUOTAPROC_NULL() {
+	util.DPrintf(1, "RQUOTA Null\n")
+}
+
+// RQUOTAPROC_GETQUOTA returns a user's quota.
+func (nfs *Nfs) RQUOTAPROC_GETQUOTA(args nfstypes.Getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA GetQuota %v\n", args)
+	return nfs.getRquota(nfstypes.RQ_USRQUOTA, args.Gqa_uid)
+}
+
+// RQUOTAPROC_GETACTIVEQUOTA returns a user's quota; all quotas are
+// active.
+func (nfs *Nfs) RQUOTAPROC_GETACTIVEQUOTA(args nfstypes.Getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA GetActiveQuota %v\n", args)
+	return nfs.getRquota(nfstypes.RQ_USRQUOTA, args.Gqa_uid)
+}
+
+// RQUOTAPROC_EXT_NULL handles the NULL RPC for version 2 of the rquota
+// service.
+func (nfs *Nfs) RQUOTAPROC_EXT_NULL() {
+	util.DPrintf(1, "RQUOTA Null\n")
+}
+
+// RQUOTAPROC_EXT_GETQUOTA returns a user's or group's quota.
+func (nfs *Nfs) RQUOTAPROC_EXT_GETQUOTA(args nfstypes.Ext_getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA GetQuota %v\n", args)
+	return nfs.getRquota(uint32(args.Gqa_type), args.Gqa_id)
+}
+
+// RQUOTAPROC_EXT_GETACTIVEQUOTA returns a user's or group's quota.
+func (nfs *Nfs) RQUOTAPROC_EXT_GETACTIVEQUOTA(args nfstypes.Ext_getquota_args) nfstypes.Getquota_rslt {
+	util.DPrintf(1, "RQUOTA GetActiveQuota %v\n", args)
+	return nfs.getRquota(uint32(args.Gqa_type), args.Gqa_id)
+}
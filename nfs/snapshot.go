@@ -0,0 +1,427 @@
+package nfs
+
+import (
+	"strings"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/xattr"
+)
+
+//
+// Snapshots.  A snapshot is a read-only copy of the file system tree,
+// in /.snapshots/<name>.  Its files share their data blocks with the
+// files they are copies of, copy-on-write, so a snapshot costs an
+// inode per file and directory, and the index blocks, but no data
+// blocks until the files change.
+//
+// Taking a snapshot freezes the file system, so that the copy is of
+// one point in time, and copies the tree in many transactions, since
+// it may not fit in one.  The transactions commit without waiting for
+// the log, which Snapshot flushes once, at the end.  The copy is built
+// under a temporary name, ".new-<name>", which the last transaction
+// renames to the snapshot's name; if the server crashes before then,
+// the partial copy remains under the temporary name until
+// DeleteSnapshot removes it.  A file with several links has one copy,
+// with as many links.
+//
+// A snapshot's copies count against the quotas of their files' owners,
+// but taking a snapshot doesn't enforce the limits.
+//
+
+const SNAPDIR = ".snapshots"
+
+const snapTmpPrefix = ".new-"
+
+// ensureRefs creates the reference count table of shared blocks, if
+// the file system doesn't have one yet.
+func (nfs *Nfs) ensureRefs() nfstypes.Nfsstat3 {
+	nfs.growMu.Lock()
+	defer nfs.growMu.Unlock()
+	fs := nfs.fsstate.Super
+	for fs.RefInum() == common.NULLINUM {
+		op := fstxn.Begin(nfs.fsstate)
+		ip := op.AllocInode(nfstypes.NF3REG, common.NULLINUM, alloc.NOOWNER)
+		if ip == nil {
+			op.Abort()
+			return nfstypes.NFS3ERR_NOSPC
+		}
+		if ip.IsShrinking() {
+			inum := ip.Inum
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(inum) {
+				return nfstypes.NFS3ERR_SERVERFAULT
+			}
+			continue
+		}
+		lay := fs.Layout().WithRefs(ip.Inum)
+		op.Atxn.Op.OverWrite(addr.MkAddr(fs.SuperBlock(), 0), disk.BlockSize*8,
+			lay.Encode())
+		if !op.CommitUnstable() {
+			return nfstypes.NFS3ERR_SERVERFAULT
+		}
+		fs.SetLayout(lay)
+		util.DPrintf(1, "ensureRefs: table # %d\n", ip.Inum)
+	}
+	return nfstypes.NFS3_OK
+}
+
+// lookupSnapDir returns the snapshot directory, or NULLINUM if there is
+// none.  If a client made a file of that name, it returns
+// NFS3ERR_EXIST.
+func lookupSnapDir(op *fstxn.FsTxn) (*inode.Inode, common.Inum, nfstypes.Nfsstat3) {
+	root := op.GetInodeInum(common.ROOTINUM)
+	inum, _ := dir.LookupName(root, op, SNAPDIR)
+	if inum == common.NULLINUM {
+		return root, inum, nfstypes.NFS3_OK
+	}
+	ip := op.GetInodeInum(inum)
+	if ip == nil || ip.Kind != nfstypes.NF3DIR || !ip.ReadOnly() {
+		return root, common.NULLINUM, nfstypes.NFS3ERR_EXIST
+	}
+	return root, inum, nfstypes.NFS3_OK
+}
+
+// snapDir returns the snapshot directory, which it creates if there is
+// none.
+func (nfs *Nfs) snapDir() (common.Inum, nfstypes.Nfsstat3) {
+	for {
+		op := fstxn.Begin(nfs.fsstate)
+		root, inum, err := lookupSnapDir(op)
+		if err != nfstypes.NFS3_OK || inum != common.NULLINUM {
+			op.Abort()
+			return inum, err
+		}
+		ip := op.AllocInode(nfstypes.NF3DIR, root.Inum, root.Owner())
+		if ip == nil {
+			op.Abort()
+			return common.NULLINUM, nfstypes.NFS3ERR_NOSPC
+		}
+		if ip.IsShrinking() {
+			inum := ip.Inum
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(inum) {
+				return common.NULLINUM, nfstypes.NFS3ERR_SERVERFAULT
+			}
+			continue
+		}
+		if !dir.InitDir(ip, op, root.Inum) ||
+			!dir.AddName(root, op, ip.Inum, nfstypes.NF3DIR, SNAPDIR) {
+			op.Abort()
+			return common.NULLINUM, nfstypes.NFS3ERR_NOSPC
+		}
+		ip.SetReadOnly(op.Atxn)
+		root.Nlink = root.Nlink + 1 // for ..
+		root.WriteInode(op.Atxn)
+		if !op.CommitUnstable() {
+			return common.NULLINUM, nfstypes.NFS3ERR_SERVERFAULT
+		}
+		return ip.Inum, nfstypes.NFS3_OK
+	}
+}
+
+// entries returns the entries of directory inum.
+func (nfs *Nfs) entries(inum common.Inum, begin func(*fstxn.FsState) *fstxn.FsTxn) []dir.Entry {
+	op := begin(nfs.fsstate)
+	dip := op.GetInodeInum(inum)
+	if dip == nil {
+		op.Abort()
+		return nil
+	}
+	ents := dir.Entries(dip, op)
+	op.Abort()
+	return ents
+}
+
+// snapCopy copies inode inum into directory parent of the snapshot
+// being taken, as name, and returns the copy.  It records the copy of
+// a file with several links in copies, so that snapTree links the
+// copy for the file's other names instead of copying it again.
+func (nfs *Nfs) snapCopy(inum common.Inum, parent common.Inum, name string,
+	copies map[common.Inum]common.Inum) (common.Inum, nfstypes.Nfsstat3) {
+	var op *fstxn.FsTxn
+	var src *inode.Inode
+	var ip *inode.Inode
+	for {
+		op = fstxn.BeginFrozen(nfs.fsstate)
+		dip := op.GetInodeInum(parent)
+		src = op.GetInodeInum(inum)
+		if dip == nil || src == nil {
+			op.Abort()
+			return common.NULLINUM, nfstypes.NFS3ERR_STALE
+		}
+		ip = op.AllocInode(src.Kind, parent, src.Owner())
+		if ip == nil {
+			op.Abort()
+			return common.NULLINUM, nfstypes.NFS3ERR_NOSPC
+		}
+		if ip.IsShrinking() {
+			inum := ip.Inum
+			op.Abort()
+			if !nfs.shrinkst.DoShrinkFrozen(inum) {
+				return common.NULLINUM, nfstypes.NFS3ERR_SERVERFAULT
+			}
+			continue
+		}
+		ip.Atime = src.Atime
+		ip.Mtime = src.Mtime
+		ip.SetReadOnly(op.Atxn)
+		if err := xattr.Copy(ip, src, op.Atxn); err != nfstypes.NFS3_OK {
+			op.Abort()
+			return common.NULLINUM, err
+		}
+		if src.Kind == nfstypes.NF3DIR {
+			if !dir.InitDir(ip, op, parent) {
+				op.Abort()
+				return common.NULLINUM, nfstypes.NFS3ERR_NOSPC
+			}
+			dip.Nlink = dip.Nlink + 1 // for ..
+			dip.WriteInode(op.Atxn)
+		}
+		if !dir.AddName(dip, op, ip.Inum, src.Kind, nfstypes.Filename3(name)) {
+			op.Abort()
+			return common.NULLINUM, nfstypes.NFS3ERR_NOSPC
+		}
+		break
+	}
+	if src.Kind == nfstypes.NF3DIR {
+		if !op.CommitUnstable() {
+			return common.NULLINUM, nfstypes.NFS3ERR_SERVERFAULT
+		}
+		return ip.Inum, nfstypes.NFS3_OK
+	}
+	clone := ip.Inum
+	if src.Nlink > 1 {
+		copies[inum] = clone
+	}
+	nblk := util.RoundUp(src.Size, disk.BlockSize)
+	var bn uint64 = 0
+	for {
+		next, ok := ip.Share(op.Atxn, src, bn)
+		if !ok {
+			op.Abort()
+			return common.NULLINUM, nfstypes.NFS3ERR_NOSPC
+		}
+		if !op.CommitUnstable() {
+			return common.NULLINUM, nfstypes.NFS3ERR_SERVERFAULT
+		}
+		bn = next
+		if bn >= nblk {
+			break
+		}
+		op = fstxn.BeginFrozen(nfs.fsstate)
+		src = op.GetInodeInum(inum)
+		ip = op.GetInodeInum(clone)
+	}
+	return clone, nfstypes.NFS3_OK
+}
+
+// snapLink adds a link to the copy c, named name, to directory parent
+// of the snapshot being taken.
+func (nfs *Nfs) snapLink(c common.Inum, parent common.Inum, name string) nfstypes.Nfsstat3 {
+	op := fstxn.BeginFrozen(nfs.fsstate)
+	dip := op.GetInodeInum(parent)
+	ip := op.GetInodeInum(c)
+	if dip == nil || ip == nil {
+		op.Abort()
+		return nfstypes.NFS3ERR_STALE
+	}
+	if !dir.AddName(dip, op, c, ip.Kind, nfstypes.Filename3(name)) {
+		op.Abort()
+		return nfstypes.NFS3ERR_NOSPC
+	}
+	ip.Nlink = ip.Nlink + 1
+	ip.WriteInode(op.Atxn)
+	if !op.CommitUnstable() {
+		return nfstypes.NFS3ERR_SERVERFAULT
+	}
+	return nfstypes.NFS3_OK
+}
+
+// snapTree copies the tree of directory inum into directory copy, but
+// not the snapshot directory.  copies maps the files with several links
+// that the snapshot has copied already to their copies.
+func (nfs *Nfs) snapTree(inum common.Inum, copy common.Inum,
+	copies map[common.Inum]common.Inum) nfstypes.Nfsstat3 {
+	for _, e := range nfs.entries(inum, fstxn.BeginFrozen) {
+		if inum == common.ROOTINUM && e.Name == SNAPDIR {
+			continue
+		}
+		if c, ok := copies[e.Inum]; ok {
+			if err := nfs.snapLink(c, copy, e.Name); err != nfstypes.NFS3_OK {
+				return err
+			}
+			continue
+		}
+		c, err := nfs.snapCopy(e.Inum, copy, e.Name, copies)
+		if err != nfstypes.NFS3_OK {
+			return err
+		}
+		if e.Kind == nfstypes.NF3DIR {
+			if err := nfs.snapTree(e.Inum, c, copies); err != nfstypes.NFS3_OK {
+				return err
+			}
+		}
+	}
+	return nfstypes.NFS3_OK
+}
+
+func checkSnapName(name string) nfstypes.Nfsstat3 {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return nfstypes.NFS3ERR_INVAL
+	}
+	if dir.NameTooLong(nfstypes.Filename3(snapTmpPrefix + name)) {
+		return nfstypes.NFS3ERR_NAMETOOLONG
+	}
+	return nfstypes.NFS3_OK
+}
+
+// snapRename gives the snapshot in sd named from the name to.
+func (nfs *Nfs) snapRename(sd common.Inum, from string, to string) nfstypes.Nfsstat3 {
+	op := fstxn.BeginFrozen(nfs.fsstate)
+	dip := op.GetInodeInum(sd)
+	inum, _ := dir.LookupName(dip, op, nfstypes.Filename3(from))
+	if inum == common.NULLINUM {
+		op.Abort()
+		return nfstypes.NFS3ERR_NOENT
+	}
+	if !dir.RemName(dip, op, nfstypes.Filename3(from)) ||
+		!dir.AddName(dip, op, inum, nfstypes.NF3DIR, nfstypes.Filename3(to)) {
+		op.Abort()
+		return nfstypes.NFS3ERR_IO
+	}
+	if !op.Commit() {
+		return nfstypes.NFS3ERR_SERVERFAULT
+	}
+	return nfstypes.NFS3_OK
+}
+
+// Snapshot takes a snapshot of the file system, named name.
+func (nfs *Nfs) Snapshot(name string) nfstypes.Nfsstat3 {
+	if err := checkSnapName(name); err != nfstypes.NFS3_OK {
+		return err
+	}
+	nfs.writeBackAll()
+	nfs.snapMu.Lock()
+	defer nfs.snapMu.Unlock()
+	if err := nfs.ensureRefs(); err != nfstypes.NFS3_OK {
+		return err
+	}
+	sd, err := nfs.snapDir()
+	if err != nfstypes.NFS3_OK {
+		return err
+	}
+	tmp := snapTmpPrefix + name
+	for _, e := range nfs.entries(sd, fstxn.Begin) {
+		if e.Name == name || e.Name == tmp {
+			return nfstypes.NFS3ERR_EXIST
+		}
+	}
+
+	util.DPrintf(1, "Snapshot %s: freeze\n", name)
+	nfs.fsstate.Freeze()
+	defer nfs.fsstate.Thaw()
+	copies := make(map[common.Inum]common.Inum)
+	root, err := nfs.snapCopy(common.ROOTINUM, sd, tmp, copies)
+	if err != nfstypes.NFS3_OK {
+		return err
+	}
+	if err := nfs.snapTree(common.ROOTINUM, root, copies); err != nfstypes.NFS3_OK {
+		return err
+	}
+	// the copy must be durable before the rename that names it
+	if !nfs.fsstate.Txn.Flush() {
+		return nfstypes.NFS3ERR_IO
+	}
+	util.DPrintf(1, "Snapshot %s: done\n", name)
+	return nfs.snapRename(sd, tmp, name)
+}
+
+// removeName removes name from directory dinum and drops the link to
+// the inode it names.
+func (nfs *Nfs) removeName(dinum common.Inum, name string, inum common.Inum) nfstypes.Nfsstat3 {
+	op := fstxn.Begin(nfs.fsstate)
+	op.Atxn.SetPrivileged()
+	inodes := lockInodes(op, twoInums(dinum, inum))
+	if inodes == nil {
+		return nfstypes.NFS3ERR_STALE
+	}
+	if !dir.RemName(inodes[0], op, nfstypes.Filename3(name)) {
+		op.Abort()
+		return nfstypes.NFS3ERR_IO
+	}
+	if inodes[1].Kind == nfstypes.NF3DIR {
+		inodes[0].Nlink = inodes[0].Nlink - 1 // for ..
+		inodes[0].WriteInode(op.Atxn)
+	}
+	nfs.doDecLink(op, inodes[1])
+	if !op.Commit() {
+		return nfstypes.NFS3ERR_SERVERFAULT
+	}
+	return nfstypes.NFS3_OK
+}
+
+// removeTree removes everything in directory inum.
+func (nfs *Nfs) removeTree(inum common.Inum) nfstypes.Nfsstat3 {
+	for _, e := range nfs.entries(inum, fstxn.Begin) {
+		if e.Kind == nfstypes.NF3DIR {
+			if err := nfs.removeTree(e.Inum); err != nfstypes.NFS3_OK {
+				return err
+			}
+		}
+		if err := nfs.removeName(inum, e.Name, e.Inum); err != nfstypes.NFS3_OK {
+			return err
+		}
+	}
+	return nfstypes.NFS3_OK
+}
+
+// DeleteSnapshot deletes snapshot name, or the partial copy that a
+// crash left behind if name is ".new-<name>".  Blocks that the
+// snapshot shares with other files stay in use by the other files.
+func (nfs *Nfs) DeleteSnapshot(name string) nfstypes.Nfsstat3 {
+	nfs.snapMu.Lock()
+	defer nfs.snapMu.Unlock()
+	op := fstxn.Begin(nfs.fsstate)
+	_, sd, err := lookupSnapDir(op)
+	op.Abort()
+	if err != nfstypes.NFS3_OK {
+		return err
+	}
+	if sd == common.NULLINUM {
+		return nfstypes.NFS3ERR_NOENT
+	}
+	for _, e := range nfs.entries(sd, fstxn.Begin) {
+		if e.Name == name {
+			if err := nfs.removeTree(e.Inum); err != nfstypes.NFS3_OK {
+				return err
+			}
+			return nfs.removeName(sd, name, e.Inum)
+		}
+	}
+	return nfstypes.NFS3ERR_NOENT
+}
+
+// ListSnapshots returns the names of the snapshots, including partial
+// copies that crashes left behind.
+func (nfs *Nfs) ListSnapshots() ([]string, nfstypes.Nfsstat3) {
+	op := fstxn.Begin(nfs.fsstate)
+	_, sd, err := lookupSnapDir(op)
+	op.Abort()
+	if err != nfstypes.NFS3_OK || sd == common.NULLINUM {
+		return nil, err
+	}
+	var names []string
+	for _, e := range nfs.entries(sd, fstxn.Begin) {
+		names = append(names, e.Name)
+	}
+	return names, nfstypes.NFS3_OK
+}
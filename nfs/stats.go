@@ -1,9 +1,11 @@
 package nfs
 
 import (
+	"fmt"
 	"io"
 	"time"
 
+	"github.com/mit-pdos/go-nfsd/scrub"
 	"github.com/mit-pdos/go-nfsd/util/stats"
 )
 
@@ -47,3 +49,18 @@ func (nfs *Nfs) ResetOpStats() {
 		nfs.stats[i].Reset()
 	}
 }
+
+// Scrubber returns the server's background scrubber.
+func (nfs *Nfs) Scrubber() *scrub.Scrubber {
+	return nfs.scrubber
+}
+
+// WriteScrubStats reports the progress of the background scrub and the
+// errors it found.
+func (nfs *Nfs) WriteScrubStats(w io.Writer) {
+	st := nfs.scrubber.Stats()
+	fmt.Fprintf(w, "scrub: running %v paused %v rate %d passes %d "+
+		"at inode %d: %d inodes %d blocks, %d checksum errors, %d other errors\n",
+		st.Running, st.Paused, st.Rate, st.Passes, st.Inum, st.Inodes,
+		st.Blocks, st.CsumErrors, st.Errors)
+}
@@ -0,0 +1,50 @@
+package nfs
+
+import (
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloc"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Trim discards the free blocks of the data area, a group at a time,
+// like fstrim.  Transactions discard the blocks they free themselves
+// (see alloctxn), so Trim is for images that were written before the
+// disk could discard, and for blocks that commits freed without
+// waiting for the log.
+//
+
+// Trim discards the runs of at least minlen free blocks, and returns
+// the number of blocks it discarded.
+func (nfs *Nfs) Trim(minlen uint64) (uint64, nfstypes.Nfsstat3) {
+	fs := nfs.fsstate.Super
+	if !alloctxn.CanDiscard(fs.Disk) {
+		return 0, nfstypes.NFS3ERR_NOTSUPP
+	}
+	if minlen == 0 {
+		minlen = 1
+	}
+	balloc := nfs.fsstate.Balloc
+	var n uint64 = 0
+	for gi := uint64(0); gi < balloc.NGroup(); gi++ {
+		balloc.FreeRuns(gi, func(runs []alloc.Run) {
+			var flushed = false
+			for _, r := range runs {
+				if r.N < minlen {
+					continue
+				}
+				if !flushed {
+					// the frees of committed transactions must
+					// be durable before their blocks are discarded
+					nfs.fsstate.Txn.Flush()
+					flushed = true
+				}
+				alloctxn.Discard(fs.Disk, fs.Block2addr(r.Start).Blkno, r.N)
+				n += r.N
+			}
+		})
+	}
+	util.DPrintf(1, "Trim: discarded %d blocks\n", n)
+	return n, nfstypes.NFS3_OK
+}
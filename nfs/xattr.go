@@ -0,0 +1,88 @@
+package nfs
+
+import (
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/xattr"
+)
+
+// GetXattr returns the value of fh's extended attribute name.
+func (nfs *Nfs) GetXattr(fh nfstypes.Nfs_fh3, name string) ([]byte, nfstypes.Nfsstat3) {
+	var status nfstypes.Nfsstat3
+	nfs.writeBack(fh)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
+	ip := op.GetInodeFh(fh)
+	if ip == nil {
+		errRet(op, &status, nfstypes.NFS3ERR_STALE)
+		return nil, status
+	}
+	value, err := xattr.Get(ip, op.Atxn, name)
+	if err != nfstypes.NFS3_OK {
+		errRet(op, &status, err)
+		return nil, status
+	}
+	commitReply(op, &status)
+	return value, status
+}
+
+// ListXattr returns the names of fh's extended attributes.
+func (nfs *Nfs) ListXattr(fh nfstypes.Nfs_fh3) ([]string, nfstypes.Nfsstat3) {
+	var status nfstypes.Nfsstat3
+	nfs.writeBack(fh)
+	op := fstxn.BeginReadOnly(nfs.fsstate)
+	ip := op.GetInodeFh(fh)
+	if ip == nil {
+		errRet(op, &status, nfstypes.NFS3ERR_STALE)
+		return nil, status
+	}
+	names := xattr.List(ip, op.Atxn)
+	commitReply(op, &status)
+	return names, status
+}
+
+// SetXattr sets fh's extended attribute name to value; flags are
+// nfstypes.XATTR_CREATE and nfstypes.XATTR_REPLACE.
+func (nfs *Nfs) SetXattr(fh nfstypes.Nfs_fh3, name string, value []byte, flags uint32) nfstypes.Nfsstat3 {
+	var status nfstypes.Nfsstat3
+	nfs.writeBack(fh)
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(fh)
+	if ip == nil {
+		errRet(op, &status, nfstypes.NFS3ERR_STALE)
+		return status
+	}
+	if ip.ReadOnly() {
+		errRet(op, &status, nfstypes.NFS3ERR_ROFS)
+		return status
+	}
+	err := xattr.Set(ip, op.Atxn, name, value, flags)
+	if err != nfstypes.NFS3_OK {
+		errRet(op, &status, err)
+		return status
+	}
+	commitReply(op, &status)
+	return status
+}
+
+// RemoveXattr removes fh's extended attribute name.
+func (nfs *Nfs) RemoveXattr(fh nfstypes.Nfs_fh3, name string) nfstypes.Nfsstat3 {
+	var status nfstypes.Nfsstat3
+	nfs.writeBack(fh)
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(fh)
+	if ip == nil {
+		errRet(op, &status, nfstypes.NFS3ERR_STALE)
+		return status
+	}
+	if ip.ReadOnly() {
+		errRet(op, &status, nfstypes.NFS3ERR_ROFS)
+		return status
+	}
+	err := xattr.Remove(ip, op.Atxn, name)
+	if err != nfstypes.NFS3_OK {
+		errRet(op, &status, err)
+		return status
+	}
+	commitReply(op, &status)
+	return status
+}
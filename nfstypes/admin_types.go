@@ -0,0 +1,181 @@
+package nfstypes
+
+// The admin program is a side-band RPC program, served next to NFS,
+// for operations that NFSv3 has no procedure for.
+const ADMIN_PROGRAM uint32 = 0x20000a00
+const ADMIN_V1 uint32 = 1
+
+type GROWargs struct {
+	Size   Uint64 // new size in blocks, or 0 for the whole disk
+	Inodes Uint64 // # inodes to add
+}
+type GROWres struct {
+	Status Nfsstat3
+	Size   Uint64 // size in blocks
+	Inodes Uint64 // # inodes
+}
+
+const ADMINPROC_NULL uint32 = 0
+const ADMINPROC_GROW uint32 = 1
+
+type Xattrname string
+
+// XATTR_CREATE and XATTR_REPLACE are SETXATTR flags
+const XATTR_CREATE uint32 = 1
+const XATTR_REPLACE uint32 = 2
+
+type GETXATTRargs struct {
+	Object Nfs_fh3
+	Name   Xattrname
+}
+type GETXATTRres struct {
+	Status Nfsstat3
+	Value  []byte
+}
+type SETXATTRargs struct {
+	Object Nfs_fh3
+	Name   Xattrname
+	Value  []byte
+	Flags  Uint32
+}
+type SETXATTRres struct {
+	Status Nfsstat3
+}
+type LISTXATTRargs struct {
+	Object Nfs_fh3
+}
+type LISTXATTRres struct {
+	Status Nfsstat3
+	Names  []byte // the names, each followed by a NUL byte
+}
+type REMOVEXATTRargs struct {
+	Object Nfs_fh3
+	Name   Xattrname
+}
+type REMOVEXATTRres struct {
+	Status Nfsstat3
+}
+
+const ADMINPROC_GETXATTR uint32 = 2
+const ADMINPROC_SETXATTR uint32 = 3
+const ADMINPROC_LISTXATTR uint32 = 4
+const ADMINPROC_REMOVEXATTR uint32 = 5
+
+type Snapname string
+
+type SNAPSHOTargs struct {
+	Name Snapname
+}
+type SNAPSHOTres struct {
+	Status Nfsstat3
+}
+type DELSNAPSHOTargs struct {
+	Name Snapname
+}
+type DELSNAPSHOTres struct {
+	Status Nfsstat3
+}
+type LISTSNAPSHOTSres struct {
+	Status Nfsstat3
+	Names  []byte // the names, each followed by a NUL byte
+}
+
+const ADMINPROC_SNAPSHOT uint32 = 6
+const ADMINPROC_DELSNAPSHOT uint32 = 7
+const ADMINPROC_LISTSNAPSHOTS uint32 = 8
+
+type CLONEargs struct {
+	Src   Nfs_fh3
+	Where Diropargs3
+}
+type CLONEres struct {
+	Status Nfsstat3
+	Obj    Nfs_fh3
+}
+
+const ADMINPROC_CLONE uint32 = 9
+
+// SCRUBargs actions
+const SCRUB_STATUS uint32 = 0
+const SCRUB_START uint32 = 1
+const SCRUB_PAUSE uint32 = 2
+const SCRUB_RESUME uint32 = 3
+const SCRUB_STOP uint32 = 4
+const SCRUB_RATE uint32 = 5
+
+type SCRUBargs struct {
+	Action Uint32
+	Rate   Uint64 // # blocks per second, or 0 for no limit
+}
+type SCRUBres struct {
+	Status     Nfsstat3
+	Running    bool
+	Paused     bool
+	Rate       Uint64
+	Passes     Uint64
+	Inum       Uint64
+	Inodes     Uint64
+	Blocks     Uint64
+	CsumErrors Uint64
+	Errors     Uint64
+}
+
+const ADMINPROC_SCRUB uint32 = 10
+
+// Quota types
+const QUOTA_USR uint32 = 0
+const QUOTA_GRP uint32 = 1
+
+// QUOTA_MAX_ENTRIES bounds the quotas of a type, which have ids less
+// than it
+const QUOTA_MAX_ENTRIES uint32 = 1 << 20
+
+// Quota3 describes a user's or group's quota; limits of 0 mean no
+// limit.
+type Quota3 struct {
+	Type      Uint32
+	Id        Uint32
+	BlockHard Uint64 // # blocks
+	BlockSoft Uint64
+	InodeHard Uint64 // # inodes
+	InodeSoft Uint64
+	Blocks    Uint64 // # blocks in use
+	Inodes    Uint64 // # inodes in use
+}
+type SETQUOTAargs struct {
+	Type      Uint32
+	Id        Uint32
+	BlockHard Uint64
+	BlockSoft Uint64
+	InodeHard Uint64
+	InodeSoft Uint64
+}
+type GETQUOTAargs struct {
+	Type Uint32
+	Id   Uint32
+}
+type QUOTAres struct {
+	Status Nfsstat3
+	Quota  Quota3
+}
+type REPQUOTAargs struct {
+	Type Uint32
+}
+type REPQUOTAres struct {
+	Status Nfsstat3
+	Quotas []Quota3 // the quotas that have limits or usage, by id
+}
+
+const ADMINPROC_SETQUOTA uint32 = 11
+const ADMINPROC_GETQUOTA uint32 = 12
+const ADMINPROC_REPQUOTA uint32 = 13
+
+type TRIMargs struct {
+	Minlen Uint64 // # blocks of the shortest free run to discard
+}
+type TRIMres struct {
+	Status Nfsstat3
+	Blocks Uint64 // # blocks discarded
+}
+
+const ADMINPROC_TRIM uint32 = 14
@@ -0,0 +1,418 @@
+//go:build !goose
+// +build !goose
+
+package nfstypes
+
+import "github.com/zeldovich/go-rpcgen/xdr"
+
+func (v *GROWargs) Xdr(xs *xdr.XdrState) {
+	(*Uint64)(&((v).Size)).Xdr(xs)
+	(*Uint64)(&((v).Inodes)).Xdr(xs)
+}
+func (v *GROWres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	(*Uint64)(&((v).Size)).Xdr(xs)
+	(*Uint64)(&((v).Inodes)).Xdr(xs)
+}
+func (v *Xattrname) Xdr(xs *xdr.XdrState) {
+	xdr.XdrString(xs, int(-1), (*string)(v))
+}
+func (v *GETXATTRargs) Xdr(xs *xdr.XdrState) {
+	(*Nfs_fh3)(&((v).Object)).Xdr(xs)
+	(*Xattrname)(&((v).Name)).Xdr(xs)
+}
+func (v *GETXATTRres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	xdr.XdrVarArray(xs, int(-1), (*[]byte)(&((v).Value)))
+}
+func (v *SETXATTRargs) Xdr(xs *xdr.XdrState) {
+	(*Nfs_fh3)(&((v).Object)).Xdr(xs)
+	(*Xattrname)(&((v).Name)).Xdr(xs)
+	xdr.XdrVarArray(xs, int(-1), (*[]byte)(&((v).Value)))
+	(*Uint32)(&((v).Flags)).Xdr(xs)
+}
+func (v *SETXATTRres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+}
+func (v *LISTXATTRargs) Xdr(xs *xdr.XdrState) {
+	(*Nfs_fh3)(&((v).Object)).Xdr(xs)
+}
+func (v *LISTXATTRres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	xdr.XdrVarArray(xs, int(-1), (*[]byte)(&((v).Names)))
+}
+func (v *REMOVEXATTRargs) Xdr(xs *xdr.XdrState) {
+	(*Nfs_fh3)(&((v).Object)).Xdr(xs)
+	(*Xattrname)(&((v).Name)).Xdr(xs)
+}
+func (v *REMOVEXATTRres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+}
+func (v *Snapname) Xdr(xs *xdr.XdrState) {
+	xdr.XdrString(xs, int(-1), (*string)(v))
+}
+func (v *SNAPSHOTargs) Xdr(xs *xdr.XdrState) {
+	(*Snapname)(&((v).Name)).Xdr(xs)
+}
+func (v *SNAPSHOTres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+}
+func (v *DELSNAPSHOTargs) Xdr(xs *xdr.XdrState) {
+	(*Snapname)(&((v).Name)).Xdr(xs)
+}
+func (v *DELSNAPSHOTres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+}
+func (v *LISTSNAPSHOTSres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	xdr.XdrVarArray(xs, int(-1), (*[]byte)(&((v).Names)))
+}
+func (v *CLONEargs) Xdr(xs *xdr.XdrState) {
+	(*Nfs_fh3)(&((v).Src)).Xdr(xs)
+	(*Diropargs3)(&((v).Where)).Xdr(xs)
+}
+func (v *CLONEres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	(*Nfs_fh3)(&((v).Obj)).Xdr(xs)
+}
+func (v *SCRUBargs) Xdr(xs *xdr.XdrState) {
+	(*Uint32)(&((v).Action)).Xdr(xs)
+	(*Uint64)(&((v).Rate)).Xdr(xs)
+}
+func (v *SCRUBres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	xdr.XdrBool(xs, (*bool)(&((v).Running)))
+	xdr.XdrBool(xs, (*bool)(&((v).Paused)))
+	(*Uint64)(&((v).Rate)).Xdr(xs)
+	(*Uint64)(&((v).Passes)).Xdr(xs)
+	(*Uint64)(&((v).Inum)).Xdr(xs)
+	(*Uint64)(&((v).Inodes)).Xdr(xs)
+	(*Uint64)(&((v).Blocks)).Xdr(xs)
+	(*Uint64)(&((v).CsumErrors)).Xdr(xs)
+	(*Uint64)(&((v).Errors)).Xdr(xs)
+}
+func (v *TRIMargs) Xdr(xs *xdr.XdrState) {
+	(*Uint64)(&((v).Minlen)).Xdr(xs)
+}
+func (v *TRIMres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	(*Uint64)(&((v).Blocks)).Xdr(xs)
+}
+func (v *Quota3) Xdr(xs *xdr.XdrState) {
+	(*Uint32)(&((v).Type)).Xdr(xs)
+	(*Uint32)(&((v).Id)).Xdr(xs)
+	(*Uint64)(&((v).BlockHard)).Xdr(xs)
+	(*Uint64)(&((v).BlockSoft)).Xdr(xs)
+	(*Uint64)(&((v).InodeHard)).Xdr(xs)
+	(*Uint64)(&((v).InodeSoft)).Xdr(xs)
+	(*Uint64)(&((v).Blocks)).Xdr(xs)
+	(*Uint64)(&((v).Inodes)).Xdr(xs)
+}
+func (v *SETQUOTAargs) Xdr(xs *xdr.XdrState) {
+	(*Uint32)(&((v).Type)).Xdr(xs)
+	(*Uint32)(&((v).Id)).Xdr(xs)
+	(*Uint64)(&((v).BlockHard)).Xdr(xs)
+	(*Uint64)(&((v).BlockSoft)).Xdr(xs)
+	(*Uint64)(&((v).InodeHard)).Xdr(xs)
+	(*Uint64)(&((v).InodeSoft)).Xdr(xs)
+}
+func (v *GETQUOTAargs) Xdr(xs *xdr.XdrState) {
+	(*Uint32)(&((v).Type)).Xdr(xs)
+	(*Uint32)(&((v).Id)).Xdr(xs)
+}
+func (v *QUOTAres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	(*Quota3)(&((v).Quota)).Xdr(xs)
+}
+func (v *REPQUOTAargs) Xdr(xs *xdr.XdrState) {
+	(*Uint32)(&((v).Type)).Xdr(xs)
+}
+func (v *REPQUOTAres) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	var n uint32
+	if xs.Encoding() {
+		n = uint32(len((v).Quotas))
+	}
+	xdr.XdrU32(xs, &n)
+	if xs.Decoding() {
+		if n > QUOTA_MAX_ENTRIES {
+			xs.SetError("too many quotas")
+			return
+		}
+		(v).Quotas = make([]Quota3, n)
+	}
+	for i := range (v).Quotas {
+		(*Quota3)(&((v).Quotas[i])).Xdr(xs)
+	}
+}
+
+type ADMIN_PROGRAM_ADMIN_V1_handler interface {
+	ADMINPROC_NULL()
+	ADMINPROC_GROW(GROWargs) GROWres
+	ADMINPROC_GETXATTR(GETXATTRargs) GETXATTRres
+	ADMINPROC_SETXATTR(SETXATTRargs) SETXATTRres
+	ADMINPROC_LISTXATTR(LISTXATTRargs) LISTXATTRres
+	ADMINPROC_REMOVEXATTR(REMOVEXATTRargs) REMOVEXATTRres
+	ADMINPROC_SNAPSHOT(SNAPSHOTargs) SNAPSHOTres
+	ADMINPROC_DELSNAPSHOT(DELSNAPSHOTargs) DELSNAPSHOTres
+	ADMINPROC_LISTSNAPSHOTS() LISTSNAPSHOTSres
+	ADMINPROC_CLONE(CLONEargs) CLONEres
+	ADMINPROC_SCRUB(SCRUBargs) SCRUBres
+	ADMINPROC_SETQUOTA(SETQUOTAargs) QUOTAres
+	ADMINPROC_GETQUOTA(GETQUOTAargs) QUOTAres
+	ADMINPROC_REPQUOTA(REPQUOTAargs) REPQUOTAres
+	ADMINPROC_TRIM(TRIMargs) TRIMres
+}
+type ADMIN_PROGRAM_ADMIN_V1_handler_wrapper struct {
+	h ADMIN_PROGRAM_ADMIN_V1_handler
+}
+
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_NULL(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var out xdr.Void
+	w.h.ADMINPROC_NULL()
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_GROW(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in GROWargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out GROWres
+	out = w.h.ADMINPROC_GROW(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_GETXATTR(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in GETXATTRargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out GETXATTRres
+	out = w.h.ADMINPROC_GETXATTR(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_SETXATTR(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in SETXATTRargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out SETXATTRres
+	out = w.h.ADMINPROC_SETXATTR(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_LISTXATTR(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in LISTXATTRargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out LISTXATTRres
+	out = w.h.ADMINPROC_LISTXATTR(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_REMOVEXATTR(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in REMOVEXATTRargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out REMOVEXATTRres
+	out = w.h.ADMINPROC_REMOVEXATTR(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_SNAPSHOT(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in SNAPSHOTargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out SNAPSHOTres
+	out = w.h.ADMINPROC_SNAPSHOT(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_DELSNAPSHOT(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in DELSNAPSHOTargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out DELSNAPSHOTres
+	out = w.h.ADMINPROC_DELSNAPSHOT(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_LISTSNAPSHOTS(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var out LISTSNAPSHOTSres
+	out = w.h.ADMINPROC_LISTSNAPSHOTS()
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_CLONE(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in CLONEargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out CLONEres
+	out = w.h.ADMINPROC_CLONE(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_SCRUB(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in SCRUBargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out SCRUBres
+	out = w.h.ADMINPROC_SCRUB(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_SETQUOTA(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in SETQUOTAargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out QUOTAres
+	out = w.h.ADMINPROC_SETQUOTA(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_GETQUOTA(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in GETQUOTAargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out QUOTAres
+	out = w.h.ADMINPROC_GETQUOTA(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_REPQUOTA(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in REPQUOTAargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out REPQUOTAres
+	out = w.h.ADMINPROC_REPQUOTA(in)
+	return &out, nil
+}
+func (w *ADMIN_PROGRAM_ADMIN_V1_handler_wrapper) ADMINPROC_TRIM(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in TRIMargs
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out TRIMres
+	out = w.h.ADMINPROC_TRIM(in)
+	return &out, nil
+}
+
+func ADMIN_PROGRAM_ADMIN_V1_regs(h ADMIN_PROGRAM_ADMIN_V1_handler) []xdr.ProcRegistration {
+	w := &ADMIN_PROGRAM_ADMIN_V1_handler_wrapper{h}
+	return []xdr.ProcRegistration{
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_NULL,
+			Handler: w.ADMINPROC_NULL,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_GROW,
+			Handler: w.ADMINPROC_GROW,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_GETXATTR,
+			Handler: w.ADMINPROC_GETXATTR,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_SETXATTR,
+			Handler: w.ADMINPROC_SETXATTR,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_LISTXATTR,
+			Handler: w.ADMINPROC_LISTXATTR,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_REMOVEXATTR,
+			Handler: w.ADMINPROC_REMOVEXATTR,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_SNAPSHOT,
+			Handler: w.ADMINPROC_SNAPSHOT,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_DELSNAPSHOT,
+			Handler: w.ADMINPROC_DELSNAPSHOT,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_LISTSNAPSHOTS,
+			Handler: w.ADMINPROC_LISTSNAPSHOTS,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_CLONE,
+			Handler: w.ADMINPROC_CLONE,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_SCRUB,
+			Handler: w.ADMINPROC_SCRUB,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_SETQUOTA,
+			Handler: w.ADMINPROC_SETQUOTA,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_GETQUOTA,
+			Handler: w.ADMINPROC_GETQUOTA,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_REPQUOTA,
+			Handler: w.ADMINPROC_REPQUOTA,
+		},
+		{
+			Prog:    ADMIN_PROGRAM,
+			Vers:    ADMIN_V1,
+			Proc:    ADMINPROC_TRIM,
+			Handler: w.ADMINPROC_TRIM,
+		},
+	}
+}
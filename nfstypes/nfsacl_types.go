@@ -0,0 +1,57 @@
+package nfstypes
+
+// The NFSACL program is the side-band protocol that Linux clients use
+// to get and set POSIX ACLs on NFSv3 mounts.
+const NFS_ACL_PROGRAM uint32 = 100227
+const NFS_ACL_V3 uint32 = 3
+
+// GETACL and SETACL mask bits
+const NFS_ACL uint32 = 0x0001
+const NFS_ACLCNT uint32 = 0x0002
+const NFS_DFACL uint32 = 0x0004
+const NFS_DFACLCNT uint32 = 0x0008
+
+// NFS_ACL_DEFAULT is set in the tags of a default ACL's entries
+const NFS_ACL_DEFAULT uint32 = 0x1000
+const NFS_ACL_MAX_ENTRIES uint32 = 1024
+
+type Posix_acl_entry struct {
+	Tag  Uint32
+	Id   Uint32
+	Perm Uint32
+}
+type Posix_acl struct {
+	Count   Uint32 // # entries, even if Entries is omitted
+	Entries []Posix_acl_entry
+}
+type GETACL3args struct {
+	Fh   Nfs_fh3
+	Mask Uint32
+}
+type GETACL3resok struct {
+	Attr  Post_op_attr
+	Mask  Uint32
+	Acl   Posix_acl
+	Dfacl Posix_acl
+}
+type GETACL3res struct {
+	Status Nfsstat3
+	Resok  GETACL3resok
+}
+type SETACL3args struct {
+	Fh    Nfs_fh3
+	Mask  Uint32
+	Acl   Posix_acl
+	Dfacl Posix_acl
+}
+type SETACL3resok struct {
+	Attr Post_op_attr
+}
+type SETACL3res struct {
+	Status Nfsstat3
+	Resok  SETACL3resok
+}
+
+const ACLPROC3_NULL uint32 = 0
+const ACLPROC3_GETACL uint32 = 1
+const ACLPROC3_SETACL uint32 = 2
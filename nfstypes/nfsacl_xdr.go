@@ -0,0 +1,126 @@
+//go:build !goose
+// +build !goose
+
+package nfstypes
+
+import "github.com/zeldovich/go-rpcgen/xdr"
+
+func (v *Posix_acl_entry) Xdr(xs *xdr.XdrState) {
+	(*Uint32)(&((v).Tag)).Xdr(xs)
+	(*Uint32)(&((v).Id)).Xdr(xs)
+	(*Uint32)(&((v).Perm)).Xdr(xs)
+}
+func (v *Posix_acl) Xdr(xs *xdr.XdrState) {
+	(*Uint32)(&((v).Count)).Xdr(xs)
+	var n uint32
+	if xs.Encoding() {
+		n = uint32(len((v).Entries))
+	}
+	xdr.XdrU32(xs, &n)
+	if xs.Decoding() {
+		if n > NFS_ACL_MAX_ENTRIES {
+			xs.SetError("too many ACL entries")
+			return
+		}
+		(v).Entries = make([]Posix_acl_entry, n)
+	}
+	for i := range (v).Entries {
+		(*Posix_acl_entry)(&((v).Entries[i])).Xdr(xs)
+	}
+}
+func (v *GETACL3args) Xdr(xs *xdr.XdrState) {
+	(*Nfs_fh3)(&((v).Fh)).Xdr(xs)
+	(*Uint32)(&((v).Mask)).Xdr(xs)
+}
+func (v *GETACL3resok) Xdr(xs *xdr.XdrState) {
+	(*Post_op_attr)(&((v).Attr)).Xdr(xs)
+	(*Uint32)(&((v).Mask)).Xdr(xs)
+	(*Posix_acl)(&((v).Acl)).Xdr(xs)
+	(*Posix_acl)(&((v).Dfacl)).Xdr(xs)
+}
+func (v *GETACL3res) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	switch (v).Status {
+	case NFS3_OK:
+		(*GETACL3resok)(&((v).Resok)).Xdr(xs)
+	default:
+	}
+}
+func (v *SETACL3args) Xdr(xs *xdr.XdrState) {
+	(*Nfs_fh3)(&((v).Fh)).Xdr(xs)
+	(*Uint32)(&((v).Mask)).Xdr(xs)
+	(*Posix_acl)(&((v).Acl)).Xdr(xs)
+	(*Posix_acl)(&((v).Dfacl)).Xdr(xs)
+}
+func (v *SETACL3resok) Xdr(xs *xdr.XdrState) {
+	(*Post_op_attr)(&((v).Attr)).Xdr(xs)
+}
+func (v *SETACL3res) Xdr(xs *xdr.XdrState) {
+	(*Nfsstat3)(&((v).Status)).Xdr(xs)
+	switch (v).Status {
+	case NFS3_OK:
+		(*SETACL3resok)(&((v).Resok)).Xdr(xs)
+	default:
+	}
+}
+
+type NFS_ACL_PROGRAM_NFS_ACL_V3_handler interface {
+	ACLPROC3_NULL()
+	ACLPROC3_GETACL(GETACL3args) GETACL3res
+	ACLPROC3_SETACL(SETACL3args) SETACL3res
+}
+type NFS_ACL_PROGRAM_NFS_ACL_V3_handler_wrapper struct {
+	h NFS_ACL_PROGRAM_NFS_ACL_V3_handler
+}
+
+func (w *NFS_ACL_PROGRAM_NFS_ACL_V3_handler_wrapper) ACLPROC3_NULL(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var out xdr.Void
+	w.h.ACLPROC3_NULL()
+	return &out, nil
+}
+func (w *NFS_ACL_PROGRAM_NFS_ACL_V3_handler_wrapper) ACLPROC3_GETACL(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in GETACL3args
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out GETACL3res
+	out = w.h.ACLPROC3_GETACL(in)
+	return &out, nil
+}
+func (w *NFS_ACL_PROGRAM_NFS_ACL_V3_handler_wrapper) ACLPROC3_SETACL(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in SETACL3args
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out SETACL3res
+	out = w.h.ACLPROC3_SETACL(in)
+	return &out, nil
+}
+
+func NFS_ACL_PROGRAM_NFS_ACL_V3_regs(h NFS_ACL_PROGRAM_NFS_ACL_V3_handler) []xdr.ProcRegistration {
+	w := &NFS_ACL_PROGRAM_NFS_ACL_V3_handler_wrapper{h}
+	return []xdr.ProcRegistration{
+		{
+			Prog:    NFS_ACL_PROGRAM,
+			Vers:    NFS_ACL_V3,
+			Proc:    ACLPROC3_NULL,
+			Handler: w.ACLPROC3_NULL,
+		},
+		{
+			Prog:    NFS_ACL_PROGRAM,
+			Vers:    NFS_ACL_V3,
+			Proc:    ACLPROC3_GETACL,
+			Handler: w.ACLPROC3_GETACL,
+		},
+		{
+			Prog:    NFS_ACL_PROGRAM,
+			Vers:    NFS_ACL_V3,
+			Proc:    ACLPROC3_SETACL,
+			Handler: w.ACLPROC3_SETACL,
+		},
+	}
+}
@@ -0,0 +1,54 @@
+package nfstypes
+
+// The RQUOTA program reports disk quotas to clients, for the quota
+// command.  Version 1 reports users' quotas; version 2 (EXT_RQUOTAVERS)
+// reports users' or groups' quotas.
+const RQUOTAPROG uint32 = 100011
+const RQUOTAVERS uint32 = 1
+const EXT_RQUOTAVERS uint32 = 2
+
+const RQ_PATHLEN uint32 = 1024
+
+// Quota types of EXT_RQUOTAVERS
+const RQ_USRQUOTA uint32 = 0
+const RQ_GRPQUOTA uint32 = 1
+
+type Getquota_args struct {
+	Gqa_pathp string
+	Gqa_uid   int32
+}
+type Ext_getquota_args struct {
+	Gqa_pathp string
+	Gqa_type  int32
+	Gqa_id    int32
+}
+
+// Rquota reports a quota's limits and usage in blocks of Rq_bsize
+// bytes, and in files.
+type Rquota struct {
+	Rq_bsize      int32
+	Rq_active     bool
+	Rq_bhardlimit Uint32
+	Rq_bsoftlimit Uint32
+	Rq_curblocks  Uint32
+	Rq_fhardlimit Uint32
+	Rq_fsoftlimit Uint32
+	Rq_curfiles   Uint32
+	Rq_btimeleft  Uint32
+	Rq_ftimeleft  Uint32
+}
+
+type Gqr_status uint32
+
+const Q_OK Gqr_status = 1
+const Q_NOQUOTA Gqr_status = 2
+const Q_EPERM Gqr_status = 3
+
+type Getquota_rslt struct {
+	Status     Gqr_status
+	Gqr_rquota Rquota
+}
+
+const RQUOTAPROC_NULL uint32 = 0
+const RQUOTAPROC_GETQUOTA uint32 = 1
+const RQUOTAPROC_GETACTIVEQUOTA uint32 = 2
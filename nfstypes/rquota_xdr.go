@@ -0,0 +1,161 @@
+//go:build !goose
+// +build !goose
+
+package nfstypes
+
+import "github.com/zeldovich/go-rpcgen/xdr"
+
+func (v *Getquota_args) Xdr(xs *xdr.XdrState) {
+	xdr.XdrString(xs, int(RQ_PATHLEN), (*string)(&((v).Gqa_pathp)))
+	xdr.XdrS32(xs, (*int32)(&((v).Gqa_uid)))
+}
+func (v *Ext_getquota_args) Xdr(xs *xdr.XdrState) {
+	xdr.XdrString(xs, int(RQ_PATHLEN), (*string)(&((v).Gqa_pathp)))
+	xdr.XdrS32(xs, (*int32)(&((v).Gqa_type)))
+	xdr.XdrS32(xs, (*int32)(&((v).Gqa_id)))
+}
+func (v *Rquota) Xdr(xs *xdr.XdrState) {
+	xdr.XdrS32(xs, (*int32)(&((v).Rq_bsize)))
+	xdr.XdrBool(xs, (*bool)(&((v).Rq_active)))
+	(*Uint32)(&((v).Rq_bhardlimit)).Xdr(xs)
+	(*Uint32)(&((v).Rq_bsoftlimit)).Xdr(xs)
+	(*Uint32)(&((v).Rq_curblocks)).Xdr(xs)
+	(*Uint32)(&((v).Rq_fhardlimit)).Xdr(xs)
+	(*Uint32)(&((v).Rq_fsoftlimit)).Xdr(xs)
+	(*Uint32)(&((v).Rq_curfiles)).Xdr(xs)
+	(*Uint32)(&((v).Rq_btimeleft)).Xdr(xs)
+	(*Uint32)(&((v).Rq_ftimeleft)).Xdr(xs)
+}
+func (v *Gqr_status) Xdr(xs *xdr.XdrState) {
+	xdr.XdrU32(xs, (*uint32)(v))
+}
+func (v *Getquota_rslt) Xdr(xs *xdr.XdrState) {
+	(*Gqr_status)(&((v).Status)).Xdr(xs)
+	switch (v).Status {
+	case Q_OK:
+		(*Rquota)(&((v).Gqr_rquota)).Xdr(xs)
+	default:
+	}
+}
+
+type RQUOTAPROG_RQUOTAVERS_handler interface {
+	RQUOTAPROC_NULL()
+	RQUOTAPROC_GETQUOTA(Getquota_args) Getquota_rslt
+	RQUOTAPROC_GETACTIVEQUOTA(Getquota_args) Getquota_rslt
+}
+type RQUOTAPROG_RQUOTAVERS_handler_wrapper struct {
+	h RQUOTAPROG_RQUOTAVERS_handler
+}
+
+func (w *RQUOTAPROG_RQUOTAVERS_handler_wrapper) RQUOTAPROC_NULL(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var out xdr.Void
+	w.h.RQUOTAPROC_NULL()
+	return &out, nil
+}
+func (w *RQUOTAPROG_RQUOTAVERS_handler_wrapper) RQUOTAPROC_GETQUOTA(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in Getquota_args
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out Getquota_rslt
+	out = w.h.RQUOTAPROC_GETQUOTA(in)
+	return &out, nil
+}
+func (w *RQUOTAPROG_RQUOTAVERS_handler_wrapper) RQUOTAPROC_GETACTIVEQUOTA(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in Getquota_args
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out Getquota_rslt
+	out = w.h.RQUOTAPROC_GETACTIVEQUOTA(in)
+	return &out, nil
+}
+
+func RQUOTAPROG_RQUOTAVERS_regs(h RQUOTAPROG_RQUOTAVERS_handler) []xdr.ProcRegistration {
+	w := &RQUOTAPROG_RQUOTAVERS_handler_wrapper{h}
+	return []xdr.ProcRegistration{
+		{
+			Prog:    RQUOTAPROG,
+			Vers:    RQUOTAVERS,
+			Proc:    RQUOTAPROC_NULL,
+			Handler: w.RQUOTAPROC_NULL,
+		},
+		{
+			Prog:    RQUOTAPROG,
+			Vers:    RQUOTAVERS,
+			Proc:    RQUOTAPROC_GETQUOTA,
+			Handler: w.RQUOTAPROC_GETQUOTA,
+		},
+		{
+			Prog:    RQUOTAPROG,
+			Vers:    RQUOTAVERS,
+			Proc:    RQUOTAPROC_GETACTIVEQUOTA,
+			Handler: w.RQUOTAPROC_GETACTIVEQUOTA,
+		},
+	}
+}
+
+type RQUOTAPROG_EXT_RQUOTAVERS_handler interface {
+	RQUOTAPROC_EXT_NULL()
+	RQUOTAPROC_EXT_GETQUOTA(Ext_getquota_args) Getquota_rslt
+	RQUOTAPROC_EXT_GETACTIVEQUOTA(Ext_getquota_args) Getquota_rslt
+}
+type RQUOTAPROG_EXT_RQUOTAVERS_handler_wrapper struct {
+	h RQUOTAPROG_EXT_RQUOTAVERS_handler
+}
+
+func (w *RQUOTAPROG_EXT_RQUOTAVERS_handler_wrapper) RQUOTAPROC_EXT_NULL(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var out xdr.Void
+	w.h.RQUOTAPROC_EXT_NULL()
+	return &out, nil
+}
+func (w *RQUOTAPROG_EXT_RQUOTAVERS_handler_wrapper) RQUOTAPROC_EXT_GETQUOTA(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in Ext_getquota_args
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out Getquota_rslt
+	out = w.h.RQUOTAPROC_EXT_GETQUOTA(in)
+	return &out, nil
+}
+func (w *RQUOTAPROG_EXT_RQUOTAVERS_handler_wrapper) RQUOTAPROC_EXT_GETACTIVEQUOTA(args *xdr.XdrState) (res xdr.Xdrable, err error) {
+	var in Ext_getquota_args
+	in.Xdr(args)
+	err = args.Error()
+	if err != nil {
+		return
+	}
+	var out Getquota_rslt
+	out = w.h.RQUOTAPROC_EXT_GETACTIVEQUOTA(in)
+	return &out, nil
+}
+
+func RQUOTAPROG_EXT_RQUOTAVERS_regs(h RQUOTAPROG_EXT_RQUOTAVERS_handler) []xdr.ProcRegistration {
+	w := &RQUOTAPROG_EXT_RQUOTAVERS_handler_wrapper{h}
+	return []xdr.ProcRegistration{
+		{
+			Prog:    RQUOTAPROG,
+			Vers:    EXT_RQUOTAVERS,
+			Proc:    RQUOTAPROC_NULL,
+			Handler: w.RQUOTAPROC_EXT_NULL,
+		},
+		{
+			Prog:    RQUOTAPROG,
+			Vers:    EXT_RQUOTAVERS,
+			Proc:    RQUOTAPROC_GETQUOTA,
+			Handler: w.RQUOTAPROC_EXT_GETQUOTA,
+		},
+		{
+			Prog:    RQUOTAPROG,
+			Vers:    EXT_RQUOTAVERS,
+			Proc:    RQUOTAPROC_GETACTIVEQUOTA,
+			Handler: w.RQUOTAPROC_EXT_GETACTIVEQUOTA,
+		},
+	}
+}
@@ -0,0 +1,152 @@
+// rpcsrv is an ONC RPC server over a stream, like rfc1057's, that
+// passes the caller's AUTH_UNIX credentials to the procedures.
+//
+// A program registers a function that returns its procedures for a
+// caller's credentials, such as the nfstypes _regs function applied to
+// a handler that acts on the caller's behalf; the server calls it for
+// every request.  A request without AUTH_UNIX credentials runs as
+// NOBODY.
+package rpcsrv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+)
+
+// NOBODY is the uid and gid of callers without AUTH_UNIX credentials.
+const NOBODY uint32 = 65534
+
+// Regs returns the procedures of one version of a program, running on
+// behalf of the caller with credentials cred.
+type Regs func(cred rfc1057.Auth_unix) []xdr.ProcRegistration
+
+type Server struct {
+	progs map[uint32]map[uint32]Regs
+}
+
+func MakeServer() *Server {
+	return &Server{progs: make(map[uint32]map[uint32]Regs)}
+}
+
+// Register registers the program version whose procedures regs returns.
+func (s *Server) Register(regs Regs) {
+	procs := regs(rfc1057.Auth_unix{})
+	if len(procs) == 0 {
+		panic("Register: no procedures")
+	}
+	prog, vers := procs[0].Prog, procs[0].Vers
+	if s.progs[prog] == nil {
+		s.progs[prog] = make(map[uint32]Regs)
+	}
+	s.progs[prog][vers] = regs
+}
+
+// Run serves the requests that arrive on rw, each in its own goroutine,
+// until reading fails.
+func (s *Server) Run(rw io.ReadWriter) error {
+	for {
+		var hdr [4]byte
+		_, err := io.ReadFull(rw, hdr[:])
+		if err != nil {
+			return err
+		}
+		hlen := binary.BigEndian.Uint32(hdr[:])
+		if hlen&(1<<31) == 0 {
+			return fmt.Errorf("fragments not supported")
+		}
+		buf := make([]byte, hlen&0x7fffffff)
+		_, err = io.ReadFull(rw, buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := s.handle(rw, buf)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}()
+	}
+}
+
+// credOf decodes the caller's credentials, which are NOBODY's unless
+// it sent AUTH_UNIX ones.
+func credOf(auth rfc1057.Opaque_auth) (rfc1057.Auth_unix, bool) {
+	if auth.Flavor != rfc1057.AUTH_UNIX {
+		return rfc1057.Auth_unix{Uid: NOBODY, Gid: NOBODY}, true
+	}
+	var cred rfc1057.Auth_unix
+	err := xdr.DecodeBuf(auth.Body, &cred)
+	return cred, err == nil
+}
+
+func (s *Server) handle(w io.Writer, buf []byte) error {
+	rd := xdr.MakeReader(buf)
+	var req rfc1057.Rpc_msg
+	req.Xdr(rd)
+	err := rd.Error()
+	if err != nil {
+		return err
+	}
+	if req.Body.Mtype != rfc1057.CALL {
+		return fmt.Errorf("request mtype %d != CALL", req.Body.Mtype)
+	}
+
+	var res rfc1057.Rpc_msg
+	var resdata xdr.Xdrable
+	res.Xid = req.Xid
+	res.Body.Mtype = rfc1057.REPLY
+	res.Body.Rbody.Stat = rfc1057.MSG_ACCEPTED
+	reply := &res.Body.Rbody.Areply.Reply_data
+	call := req.Body.Cbody
+	cred, ok := credOf(call.Cred)
+	if call.Rpcvers != 2 {
+		res.Body.Rbody.Stat = rfc1057.MSG_DENIED
+		res.Body.Rbody.Rreply.Stat = rfc1057.RPC_MISMATCH
+	} else if !ok {
+		res.Body.Rbody.Stat = rfc1057.MSG_DENIED
+		res.Body.Rbody.Rreply.Stat = rfc1057.AUTH_ERROR
+		res.Body.Rbody.Rreply.Astat = rfc1057.AUTH_BADCRED
+	} else if s.progs[call.Prog] == nil {
+		reply.Stat = rfc1057.PROG_UNAVAIL
+	} else if s.progs[call.Prog][call.Vers] == nil {
+		reply.Stat = rfc1057.PROG_MISMATCH
+	} else {
+		var h rfc1057.ProcHandler
+		for _, r := range s.progs[call.Prog][call.Vers](cred) {
+			if r.Proc == call.Proc {
+				h = r.Handler
+			}
+		}
+		if h == nil {
+			reply.Stat = rfc1057.PROC_UNAVAIL
+		} else {
+			resdata, err = h(rd)
+			if err != nil {
+				reply.Stat = rfc1057.GARBAGE_ARGS
+			} else {
+				reply.Stat = rfc1057.SUCCESS
+			}
+		}
+	}
+
+	// reserve 4 bytes at the front for the length
+	var reserveLen [4]byte
+	wr := xdr.MakeWriter(reserveLen[:])
+	res.Xdr(wr)
+	if resdata != nil {
+		resdata.Xdr(wr)
+	}
+	err = wr.Error()
+	if err != nil {
+		return err
+	}
+	wbuf := wr.WriteBuf()
+	binary.BigEndian.PutUint32(wbuf[0:4], (1<<31)|uint32(len(wbuf)-4))
+	_, err = w.Write(wbuf)
+	return err
+}
@@ -0,0 +1,53 @@
+package rpcsrv
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+)
+
+const (
+	PROG uint32 = 0x20000000
+	VERS uint32 = 1
+	UID  uint32 = 1 // returns the caller's uid
+)
+
+func regs(cred rfc1057.Auth_unix) []xdr.ProcRegistration {
+	return []xdr.ProcRegistration{{
+		Prog: PROG, Vers: VERS, Proc: UID,
+		Handler: func(args *xdr.XdrState) (xdr.Xdrable, error) {
+			res := xdr.Uint32(cred.Uid)
+			return &res, nil
+		},
+	}}
+}
+
+func TestCred(t *testing.T) {
+	srv := MakeServer()
+	srv.Register(regs)
+	c, s := net.Pipe()
+	defer c.Close()
+	go srv.Run(s)
+	clnt := rfc1057.MakeClient(c, PROG, VERS)
+
+	var none rfc1057.Opaque_auth
+	none.Flavor = rfc1057.AUTH_NONE
+	body, err := xdr.EncodeBuf(&rfc1057.Auth_unix{Uid: 1000, Gid: 100, Gids: []uint32{200}})
+	require.NoError(t, err)
+	unix := rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_UNIX, Body: body}
+
+	var args xdr.Void
+	var res xdr.Uint32
+	require.NoError(t, clnt.Call(UID, unix, none, &args, &res))
+	assert.Equal(t, xdr.Uint32(1000), res)
+	require.NoError(t, clnt.Call(UID, none, none, &args, &res))
+	assert.Equal(t, xdr.Uint32(NOBODY), res, "AUTH_NONE runs as nobody")
+
+	bad := rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_UNIX, Body: body[:8]}
+	assert.Error(t, clnt.Call(UID, bad, none, &args, &res))
+	assert.Error(t, clnt.Call(UID+1, unix, none, &args, &res))
+}
@@ -0,0 +1,271 @@
+package scrub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+//
+// The scrubber walks all inodes and the blocks they refer to, in the
+// background, and verifies their checksums and the invariants that it
+// can check one inode at a time: an inode's fields make sense, its
+// bitmap bit says whether it is in use, and the blocks it refers to
+// are in the data area and allocated.  It checks each inode in
+// read-only transactions of its own that lock only that inode, shared,
+// a few blocks at a time, and aborts them, so clients that change the
+// inode wait for it at most one step.
+// A block that no inode refers to isn't checked.
+//
+
+// Stats reports the progress of the scrubber and the errors it found.
+type Stats struct {
+	Running    bool
+	Paused     bool
+	Rate       uint64      // # blocks per second, or 0 for no limit
+	Passes     uint64      // # passes completed
+	Inum       common.Inum // inode that the current pass is at
+	Inodes     uint64      // # inodes checked
+	Blocks     uint64      // # blocks checked
+	CsumErrors uint64      // # inodes and blocks that failed their checksum
+	Errors     uint64      // # other inconsistencies
+}
+
+// Scrubber runs the background scrub.
+type Scrubber struct {
+	mu      *sync.Mutex
+	cond    *sync.Cond
+	fsstate *fstxn.FsState
+	stop    bool
+	stopc   chan struct{} // closed to interrupt a throttled scrub
+	stats   Stats
+}
+
+// MkScrubber allocates a scrubber, which doesn't run until Start.
+func MkScrubber(st *fstxn.FsState) *Scrubber {
+	mu := new(sync.Mutex)
+	return &Scrubber{
+		mu:      mu,
+		cond:    sync.NewCond(mu),
+		fsstate: st,
+	}
+}
+
+// Start starts a pass over the file system in a new thread, scrubbing
+// at most rate blocks per second, unless a pass is running already.
+func (s *Scrubber) Start(rate uint64) {
+	s.mu.Lock()
+	s.stats.Rate = rate
+	if !s.stats.Running {
+		util.DPrintf(1, "start scrub thread\n")
+		s.stats.Running = true
+		s.stats.Paused = false
+		s.stats.Inum = common.ROOTINUM
+		s.stop = false
+		s.stopc = make(chan struct{})
+		go func() { s.scrubber() }()
+	}
+	s.mu.Unlock()
+}
+
+// SetRate limits the running pass to rate blocks per second; 0 lifts
+// the limit.
+func (s *Scrubber) SetRate(rate uint64) {
+	s.mu.Lock()
+	s.stats.Rate = rate
+	s.mu.Unlock()
+}
+
+// Pause stops the running pass until Resume.
+func (s *Scrubber) Pause() {
+	s.mu.Lock()
+	s.stats.Paused = s.stats.Running
+	s.mu.Unlock()
+}
+
+// Resume continues a paused pass.
+func (s *Scrubber) Resume() {
+	s.mu.Lock()
+	s.stats.Paused = false
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Stop abandons the running pass, and waits for its thread to exit.
+func (s *Scrubber) Stop() {
+	s.mu.Lock()
+	if s.stats.Running && !s.stop {
+		s.stop = true
+		close(s.stopc)
+	}
+	s.cond.Broadcast()
+	for s.stats.Running {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+}
+
+// Stats returns the scrubber's statistics.
+func (s *Scrubber) Stats() Stats {
+	s.mu.Lock()
+	st := s.stats
+	s.mu.Unlock()
+	return st
+}
+
+func (s *Scrubber) scrubber() {
+	done := s.pass()
+	s.mu.Lock()
+	if done {
+		s.stats.Passes++
+	}
+	s.stats.Running = false
+	s.stats.Paused = false
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	util.DPrintf(1, "scrub thread exits (done %v)\n", done)
+}
+
+// proceed waits while the scrub is paused, and reports whether it
+// should go on.
+func (s *Scrubber) proceed(inum common.Inum) bool {
+	s.mu.Lock()
+	s.stats.Inum = inum
+	for s.stats.Paused && !s.stop {
+		s.cond.Wait()
+	}
+	stop := s.stop
+	s.mu.Unlock()
+	return !stop
+}
+
+// throttle sleeps long enough to scrub n blocks at the rate limit.
+func (s *Scrubber) throttle(n uint64) {
+	s.mu.Lock()
+	rate := s.stats.Rate
+	stopc := s.stopc
+	s.mu.Unlock()
+	if rate == 0 {
+		return
+	}
+	select {
+	case <-time.After(time.Duration(n) * time.Second / time.Duration(rate)):
+	case <-stopc:
+	}
+}
+
+func (s *Scrubber) count(blocks uint64, csumErrors uint64, errors uint64) {
+	s.mu.Lock()
+	s.stats.Blocks += blocks
+	s.stats.CsumErrors += csumErrors
+	s.stats.Errors += errors
+	s.mu.Unlock()
+}
+
+// pass scrubs every inode, and reports whether it got to the end.
+func (s *Scrubber) pass() bool {
+	for inum := common.ROOTINUM; inum < s.fsstate.Super.NInode(); inum++ {
+		var bn uint64 = 0
+		for {
+			if !s.proceed(inum) {
+				return false
+			}
+			next, n := s.step(inum, bn)
+			s.throttle(n)
+			if next == 0 {
+				break
+			}
+			bn = next
+		}
+		s.mu.Lock()
+		s.stats.Inodes++
+		s.mu.Unlock()
+	}
+	return true
+}
+
+// inconsistent logs and counts an inconsistency.
+func (s *Scrubber) inconsistent(format string, a ...interface{}) {
+	util.DPrintf(0, "scrub: "+format+"\n", a...)
+	s.count(0, 0, 1)
+}
+
+// step checks inode inum, in its first step, and the blocks that map
+// its logical blocks from bn on, up to inode.NSCRUB blocks.  It returns
+// the logical block at which to continue, or 0 if the inode is done,
+// and the number of blocks it read, counting the inode's as one.  It
+// locks the inode shared, so that reads of the file don't wait for it.
+func (s *Scrubber) step(inum common.Inum, bn uint64) (uint64, uint64) {
+	op := fstxn.BeginReadOnly(s.fsstate)
+	ip := op.GetInodeLocked(inum)
+	var nread uint64 = 0
+	if bn == 0 {
+		nread = 1
+	}
+	if ip == nil {
+		op.Abort()
+		s.count(0, 1, 0)
+		return 0, nread
+	}
+	var next uint64 = 0
+	if (bn > 0 || s.checkInode(op, ip)) && ip.Kind != inode.NF3FREE {
+		var nblk uint64
+		next, nblk = s.checkBlocks(op, ip, bn)
+		nread += nblk
+	}
+	op.Abort()
+	return next, nread
+}
+
+// checkInode checks ip's checksum, even if ip is in the inode cache,
+// its fields, and its bitmap bit.  It reports whether to go on and
+// check ip's blocks.
+func (s *Scrubber) checkInode(op *fstxn.FsTxn, ip *inode.Inode) bool {
+	fs := op.Fs.Super
+	buf := op.Atxn.Op.ReadBuf(fs.Inum2Addr(ip.Inum), super.INODESZ*8)
+	if !buf.IsDirty() && !super.VerifyInode(buf.Data) {
+		op.Atxn.Corrupted("inode", uint64(ip.Inum))
+		s.count(0, 1, 0)
+	}
+	if msg := ip.Check(); msg != "" {
+		s.inconsistent("inode %d: %s", ip.Inum, msg)
+		return false
+	}
+	used := ip.Kind != inode.NF3FREE
+	if op.Atxn.ReadBit(fs.InodeBitAddr(ip.Inum)) != used {
+		s.inconsistent("inode %d: bitmap says in use %v, file type %d",
+			ip.Inum, !used, ip.Kind)
+	}
+	return true
+}
+
+// checkBlocks checks the blocks that map ip's logical blocks from bn
+// on, and returns what step returns.
+func (s *Scrubber) checkBlocks(op *fstxn.FsTxn, ip *inode.Inode, bn uint64) (uint64, uint64) {
+	fs := op.Fs.Super
+	var nblk uint64 = 0
+	var ncsum uint64 = 0
+	next := ip.Scrub(op.Atxn, bn, func(blkno common.Bnum) bool {
+		if blkno < fs.DataStart() || blkno >= fs.MaxBnum() {
+			s.inconsistent("inode %d: block %d is outside the data area",
+				ip.Inum, blkno)
+			return false
+		}
+		if !op.Atxn.ReadBit(fs.BlockBitAddr(blkno)) {
+			s.inconsistent("inode %d: block %d is free", ip.Inum, blkno)
+			return false
+		}
+		nblk++
+		if !op.Atxn.VerifyBlock(blkno) {
+			ncsum++
+		}
+		return true
+	})
+	s.count(nblk, ncsum, 0)
+	return next, nblk
+}
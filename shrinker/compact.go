@@ -0,0 +1,80 @@
+package shrinker
+
+import (
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// DoCompact compacts directory inum, a bounded step per transaction,
+// and shrinks it if that frees blocks at its end.  It stops early if
+// the directory is removed.
+func (shrinkst *ShrinkerSt) DoCompact(inum common.Inum) bool {
+	var more = true
+	var ok = true
+	for more {
+		op := fstxn.Begin(shrinkst.fsstate)
+		op.Atxn.SetPrivileged()
+		ip := op.GetInodeInum(inum)
+		if ip == nil || ip.Kind != nfstypes.NF3DIR {
+			op.Abort()
+			break
+		}
+		if ip.IsShrinking() {
+			op.Abort()
+			ok = shrinkst.DoShrink(inum)
+			if !ok {
+				break
+			}
+			continue
+		}
+		util.DPrintf(1, "%p: doCompact %v\n", op.Atxn.Id(), ip.Inum)
+		var shrink bool
+		more, shrink = dir.CompactStep(ip, op)
+		ok = op.Commit()
+		if !ok {
+			break
+		}
+		if shrink {
+			ok = shrinkst.DoShrink(inum)
+			if !ok {
+				break
+			}
+		}
+		if shrinkst.crashed() {
+			break
+		}
+	}
+	return ok
+}
+
+// StartCompactor launches a goroutine to compact directory inum, unless
+// one is compacting it already.
+func (shrinkst *ShrinkerSt) StartCompactor(inum common.Inum) {
+	shrinkst.mu.Lock()
+	if shrinkst.compacting[inum] {
+		shrinkst.mu.Unlock()
+		return
+	}
+	util.DPrintf(1, "start compact thread # %v\n", inum)
+	shrinkst.compacting[inum] = true
+	shrinkst.nthread = shrinkst.nthread + 1
+	shrinkst.mu.Unlock()
+	go func() { shrinkst.compactor(inum) }()
+}
+
+// compactor is the goroutine body that compacts a directory.
+func (shrinkst *ShrinkerSt) compactor(inum common.Inum) {
+	ok := shrinkst.DoCompact(inum)
+	if !ok {
+		panic("compact")
+	}
+	util.DPrintf(1, "Compactor: done compacting # %d\n", inum)
+	shrinkst.mu.Lock()
+	delete(shrinkst.compacting, inum)
+	shrinkst.nthread = shrinkst.nthread - 1
+	shrinkst.condShut.Broadcast()
+	shrinkst.mu.Unlock()
+}
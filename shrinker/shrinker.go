@@ -8,24 +8,27 @@ import (
 	"github.com/mit-pdos/go-nfsd/fstxn"
 )
 
-// ShrinkerSt manages background inode shrinking threads.
+// ShrinkerSt manages background inode shrinking and directory
+// compaction threads.
 type ShrinkerSt struct {
-	mu       *sync.Mutex
-	condShut *sync.Cond
-	nthread  uint32
-	fsstate  *fstxn.FsState
-	crash    bool
+	mu         *sync.Mutex
+	condShut   *sync.Cond
+	nthread    uint32
+	fsstate    *fstxn.FsState
+	crash      bool
+	compacting map[common.Inum]bool
 }
 
 // MkShrinkerSt allocates a new shrinker state.
 func MkShrinkerSt(st *fstxn.FsState) *ShrinkerSt {
 	mu := new(sync.Mutex)
 	shrinkst := &ShrinkerSt{
-		mu:       mu,
-		condShut: sync.NewCond(mu),
-		nthread:  0,
-		fsstate:  st,
-		crash:    false,
+		mu:         mu,
+		condShut:   sync.NewCond(mu),
+		nthread:    0,
+		fsstate:    st,
+		crash:      false,
+		compacting: make(map[common.Inum]bool),
 	}
 	return shrinkst
 }
@@ -43,10 +46,21 @@ func (shrinkst *ShrinkerSt) crashed() bool {
 // shrinking.  Also, called by shrinker.
 // DoShrink performs the actual shrinking of the given inode.
 func (shrinkst *ShrinkerSt) DoShrink(inum common.Inum) bool {
+	return shrinkst.doShrink(inum, fstxn.Begin)
+}
+
+// DoShrinkFrozen shrinks the given inode in transactions of the thread
+// that froze the file system.
+func (shrinkst *ShrinkerSt) DoShrinkFrozen(inum common.Inum) bool {
+	return shrinkst.doShrink(inum, fstxn.BeginFrozen)
+}
+
+func (shrinkst *ShrinkerSt) doShrink(inum common.Inum, begin func(*fstxn.FsState) *fstxn.FsTxn) bool {
 	var more = true
 	var ok = true
 	for more {
-		op := fstxn.Begin(shrinkst.fsstate)
+		op := begin(shrinkst.fsstate)
+		op.Atxn.SetPrivileged()
 		ip := op.GetInodeInumFree(inum)
 		if ip == nil {
 			panic("shrink")
@@ -74,6 +88,19 @@ func (shrinker *ShrinkerSt) Shutdown() {
 	shrinker.mu.Unlock()
 }
 
+// Wait waits for running shrinker threads to finish, and reports
+// whether there were any (which may have freed blocks).
+func (shrinker *ShrinkerSt) Wait() bool {
+	shrinker.mu.Lock()
+	waited := shrinker.nthread > 0
+	for shrinker.nthread > 0 {
+		util.DPrintf(1, "Wait: shrinker wait %d\n", shrinker.nthread)
+		shrinker.condShut.Wait()
+	}
+	shrinker.mu.Unlock()
+	return waited
+}
+
 // Crash stops all shrinker threads without waiting for completion.
 func (shrinker *ShrinkerSt) Crash() {
 	shrinker.mu.Lock()
@@ -103,6 +130,6 @@ func (shrinkst *ShrinkerSt) shrinker(inum common.Inum) {
 	util.DPrintf(1, "Shrinker: done shrinking # %d\n", inum)
 	shrinkst.mu.Lock()
 	shrinkst.nthread = shrinkst.nthread - 1
-	shrinkst.condShut.Signal()
+	shrinkst.condShut.Broadcast()
 	shrinkst.mu.Unlock()
 }
@@ -0,0 +1,60 @@
+package super
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/goose-lang/primitive/disk"
+)
+
+//
+// Checksums.  Each data block has a CRC32C in the checksum blocks of
+// its region, and each inode has one in its last CSUMSZ bytes.  A
+// checksum is stored XORed with the checksum of all zeros, so that the
+// stored checksum of a block or inode that was never written, which
+// mkfs and Grow leave zero, is 0.
+//
+
+// CSUMSZ is the size of a checksum.
+const CSUMSZ uint64 = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var zeroBlockSum = crc32.Checksum(make([]byte, disk.BlockSize), castagnoli)
+
+var zeroInodeSum = crc32.Checksum(make([]byte, INODESZ-CSUMSZ), castagnoli)
+
+// Checksum returns the stored checksum of data, which is a block or
+// the part of an inode before its checksum.
+func Checksum(data []byte) uint32 {
+	var zero = zeroBlockSum
+	if uint64(len(data)) == INODESZ-CSUMSZ {
+		zero = zeroInodeSum
+	} else if uint64(len(data)) != disk.BlockSize {
+		zero = crc32.Checksum(make([]byte, len(data)), castagnoli)
+	}
+	return crc32.Checksum(data, castagnoli) ^ zero
+}
+
+// EncodeCsum returns the on-disk form of checksum sum.
+func EncodeCsum(sum uint32) []byte {
+	b := make([]byte, CSUMSZ)
+	binary.LittleEndian.PutUint32(b, sum)
+	return b
+}
+
+// DecodeCsum returns the checksum stored in b.
+func DecodeCsum(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b)
+}
+
+// SealInode stores the checksum of the inode in d, which is INODESZ
+// bytes long, in its last CSUMSZ bytes.
+func SealInode(d []byte) {
+	copy(d[INODESZ-CSUMSZ:], EncodeCsum(Checksum(d[:INODESZ-CSUMSZ])))
+}
+
+// VerifyInode checks the checksum of the inode in d.
+func VerifyInode(d []byte) bool {
+	return DecodeCsum(d[INODESZ-CSUMSZ:INODESZ]) == Checksum(d[:INODESZ-CSUMSZ])
+}
@@ -1,61 +1,343 @@
 package super
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
 
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/common"
 )
 
-// FsSuper holds computed values describing the on-disk layout.
-type FsSuper struct {
-	Disk         disk.Disk
-	Size         uint64
-	nLog         uint64 // including commit block
+const (
+	INODESZ  uint64 = 256 // on-disk size of an inode, in bytes
+	INODEBLK uint64 = disk.BlockSize / INODESZ
+)
+
+// The block and inode bitmaps are split into allocation groups, each
+// with its own region of the bitmap and its own allocator lock.
+const (
+	BGROUPSZ uint64 = 8192 // # blocks per allocation group
+	IGROUPSZ uint64 = 1024 // # inodes per allocation group
+)
+
+// Inodes that mkfs reserves, after the root directory's, for the user
+// and group quota tables.
+const (
+	USRQUOTAINUM common.Inum = 2
+	GRPQUOTAINUM common.Inum = 3
+	NRESERVED    uint64      = 4 // # inodes mkfs allocates
+)
+
+const (
+	MAGIC uint64 = 0x676f6e6673640004 // "gonfsd" and version 4
+
+	// the magic number without the version
+	MAGICMASK uint64 = 0xffffffffffff0000
+
+	// # inode blocks for the inodes of one inode bitmap block
+	NINODEBLK uint64 = common.NBITBLOCK * INODESZ / disk.BlockSize
+
+	// # checksum blocks for the blocks of one block bitmap block
+	NCSUMBLK uint64 = common.NBITBLOCK * CSUMSZ / disk.BlockSize
+
+	// # regions that fit in the super block, after the magic number,
+	// Maxaddr, the number of regions, and RefInum
+	MAXREGION uint64 = (disk.BlockSize - 4*8) / (3 * 8)
+)
+
+//
+// The disk starts with the log, followed by the super block and a
+// region of metadata blocks, followed by data blocks:
+//
+//   | log | super | region 0 | data ... |
+//
+// A region holds block bitmap blocks, then inode bitmap blocks, then
+// the inode blocks for those inodes, then NCSUMBLK checksum blocks per
+// block bitmap block, for the blocks that bitmap block covers.
+// Growing the file system adds a region at the start of the new
+// space, for the bitmap and checksum blocks the new blocks need and
+// any new inodes.  Bitmap block k of all regions together covers
+// blocks (or inodes) [k*NBITBLOCK, (k+1)*NBITBLOCK).
+//
+
+// Region describes a run of metadata blocks.
+type Region struct {
+	Start        common.Bnum
 	NBlockBitmap uint64
 	NInodeBitmap uint64
-	nInodeBlk    uint64
-	Maxaddr      uint64
 }
 
-// MkFsSuper builds a super block description for disk d.
+// Len returns the number of blocks in r.
+func (r Region) Len() uint64 {
+	return r.NBlockBitmap + r.NInodeBitmap + r.NInodeBitmap*NINODEBLK +
+		r.NBlockBitmap*NCSUMBLK
+}
+
+// End returns the first block after r.
+func (r Region) End() common.Bnum {
+	return r.Start + common.Bnum(r.Len())
+}
+
+// Layout is the layout recorded in the super block: the size of the
+// file system in blocks, its metadata regions, and the inode of the
+// reference count table of shared blocks, if there is one.  RefInum
+// follows the regions, so a super block written before there were
+// shared blocks has RefInum 0.
+type Layout struct {
+	Maxaddr uint64
+	Regions []Region
+	RefInum common.Inum
+}
+
+// Grow returns l extended to size blocks with the new region r, if r
+// isn't empty.
+func (l *Layout) Grow(size uint64, r Region) *Layout {
+	var regions = make([]Region, 0, len(l.Regions)+1)
+	regions = append(regions, l.Regions...)
+	if r.Len() > 0 {
+		regions = append(regions, r)
+	}
+	return &Layout{Maxaddr: size, Regions: regions, RefInum: l.RefInum}
+}
+
+// WithRefs returns l with the reference count table in inode inum.
+func (l *Layout) WithRefs(inum common.Inum) *Layout {
+	return &Layout{Maxaddr: l.Maxaddr, Regions: l.Regions, RefInum: inum}
+}
+
+// Encode returns the super block for l.
+func (l *Layout) Encode() disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(MAGIC)
+	enc.PutInt(l.Maxaddr)
+	enc.PutInt(uint64(len(l.Regions)))
+	for _, r := range l.Regions {
+		enc.PutInt(uint64(r.Start))
+		enc.PutInt(r.NBlockBitmap)
+		enc.PutInt(r.NInodeBitmap)
+	}
+	enc.PutInt(uint64(l.RefInum))
+	return enc.Finish()
+}
+
+// Errors that Load returns for a disk it can't open.
+var (
+	// ErrBlank means that the disk has no file system yet.
+	ErrBlank = errors.New("disk is blank")
+	// ErrUnknown means that the disk holds something that isn't a
+	// file system with a super block, such as a file system from
+	// before there was one.
+	ErrUnknown = errors.New("disk holds no file system with a super block")
+)
+
+func isBlank(blk disk.Block) bool {
+	for _, b := range blk {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeLayout(blk disk.Block) (*Layout, error) {
+	if isBlank(blk) {
+		return nil, ErrBlank
+	}
+	dec := marshal.NewDec(blk)
+	magic := dec.GetInt()
+	if magic != MAGIC {
+		if magic&MAGICMASK == MAGIC&MAGICMASK {
+			return nil, fmt.Errorf("unsupported file system version %d (want %d)",
+				magic&^MAGICMASK, MAGIC&^MAGICMASK)
+		}
+		return nil, ErrUnknown
+	}
+	maxaddr := dec.GetInt()
+	n := dec.GetInt()
+	if n == 0 || n > MAXREGION {
+		return nil, fmt.Errorf("corrupt super block: %d regions", n)
+	}
+	var regions = make([]Region, 0, n)
+	for i := uint64(0); i < n; i++ {
+		start := dec.GetInt()
+		nbb := dec.GetInt()
+		nib := dec.GetInt()
+		regions = append(regions, Region{Start: start, NBlockBitmap: nbb, NInodeBitmap: nib})
+	}
+	refinum := dec.GetInt()
+	return &Layout{Maxaddr: maxaddr, Regions: regions, RefInum: refinum}, nil
+}
+
+// geometry caches the block numbers of a layout's metadata blocks.
+type geometry struct {
+	lay     *Layout
+	bbitmap []common.Bnum // block bitmap block k
+	ibitmap []common.Bnum // inode bitmap block k
+	itable  []common.Bnum // first inode block for inode bitmap block k
+	csum    []common.Bnum // first checksum block for block bitmap block k
+}
+
+func mkGeometry(l *Layout) *geometry {
+	g := &geometry{lay: l}
+	for _, r := range l.Regions {
+		for i := uint64(0); i < r.NBlockBitmap; i++ {
+			g.bbitmap = append(g.bbitmap, r.Start+common.Bnum(i))
+		}
+		ib := r.Start + common.Bnum(r.NBlockBitmap)
+		it := ib + common.Bnum(r.NInodeBitmap)
+		for i := uint64(0); i < r.NInodeBitmap; i++ {
+			g.ibitmap = append(g.ibitmap, ib+common.Bnum(i))
+			g.itable = append(g.itable, it+common.Bnum(i*NINODEBLK))
+		}
+		cs := it + common.Bnum(r.NInodeBitmap*NINODEBLK)
+		for i := uint64(0); i < r.NBlockBitmap; i++ {
+			g.csum = append(g.csum, cs+common.Bnum(i*NCSUMBLK))
+		}
+	}
+	return g
+}
+
+// FsSuper holds computed values describing the on-disk layout.
+type FsSuper struct {
+	Disk disk.Disk
+	Size uint64
+	nLog uint64 // including commit block
+
+	mu  *sync.Mutex
+	geo *geometry
+
+	nintegrity uint64 // # checksum mismatches
+}
+
+// MkFsSuper builds a super block description for disk d, laid out as
+// a new file system that uses the whole disk.  Load replaces it with
+// the layout on disk, if there is one.
 func MkFsSuper(d disk.Disk) *FsSuper {
 	sz := d.Size()
-	nblockbitmap := (sz / common.NBITBLOCK) + 1
-
-	return &FsSuper{
-		Disk:         d,
-		Size:         sz,
-		nLog:         common.LOGSIZE,
-		NBlockBitmap: nblockbitmap,
+	r := Region{
+		Start:        common.Bnum(common.LOGSIZE + 1),
+		NBlockBitmap: (sz / common.NBITBLOCK) + 1,
 		NInodeBitmap: common.NINODEBITMAP,
-		nInodeBlk:    (common.NINODEBITMAP * common.NBITBLOCK * common.INODESZ) / disk.BlockSize,
-		Maxaddr:      sz}
+	}
+	return &FsSuper{
+		Disk: d,
+		Size: sz,
+		nLog: common.LOGSIZE,
+		mu:   new(sync.Mutex),
+		geo:  mkGeometry(&Layout{Maxaddr: sz, Regions: []Region{r}}),
+	}
+}
+
+// Load reads the layout from blk, the contents of the super block.  It
+// returns ErrBlank if the super block is all zeros, which means that
+// the disk has no file system yet, and another error if the disk holds
+// something Load doesn't understand; only the caller can decide to
+// overwrite that.
+func (fs *FsSuper) Load(blk disk.Block) error {
+	l, err := decodeLayout(blk)
+	if err != nil {
+		return err
+	}
+	if l.Maxaddr > fs.Size {
+		return fmt.Errorf("file system has %d blocks but disk only %d",
+			l.Maxaddr, fs.Size)
+	}
+	fs.SetLayout(l)
+	return nil
+}
+
+func (fs *FsSuper) get() *geometry {
+	fs.mu.Lock()
+	g := fs.geo
+	fs.mu.Unlock()
+	return g
+}
+
+// Layout returns the current layout.
+func (fs *FsSuper) Layout() *Layout {
+	return fs.get().lay
+}
+
+// SetLayout switches to layout l, after it has been written to disk.
+func (fs *FsSuper) SetLayout(l *Layout) {
+	g := mkGeometry(l)
+	fs.mu.Lock()
+	fs.geo = g
+	fs.mu.Unlock()
+}
+
+// SuperBlock returns the block number of the super block.
+func (fs *FsSuper) SuperBlock() common.Bnum {
+	return common.Bnum(fs.nLog)
 }
 
 // MaxBnum returns the maximum block number in the file system.
 func (fs *FsSuper) MaxBnum() common.Bnum {
-	return common.Bnum(fs.Maxaddr)
+	return common.Bnum(fs.get().lay.Maxaddr)
 }
 
-// BitmapBlockStart returns the block number of the first block bitmap block.
-func (fs *FsSuper) BitmapBlockStart() common.Bnum {
-	return common.Bnum(fs.nLog)
+// RefInum returns the inode of the reference count table, or NULLINUM
+// if no blocks have been shared yet.
+func (fs *FsSuper) RefInum() common.Inum {
+	return fs.get().lay.RefInum
 }
 
-// BitmapInodeStart returns the block number of the first inode bitmap block.
-func (fs *FsSuper) BitmapInodeStart() common.Bnum {
-	return fs.BitmapBlockStart() + common.Bnum(fs.NBlockBitmap)
+// IsSysInum reports whether inum is an inode of the file system's own
+// tables, which clients can't name.
+func (fs *FsSuper) IsSysInum(inum common.Inum) bool {
+	return inum == USRQUOTAINUM || inum == GRPQUOTAINUM ||
+		(inum != common.NULLINUM && inum == fs.RefInum())
 }
 
-// InodeStart returns the first block containing inodes.
-func (fs *FsSuper) InodeStart() common.Bnum {
-	return fs.BitmapInodeStart() + common.Bnum(fs.NInodeBitmap)
+// NBlockBitmap returns the number of block bitmap blocks.
+func (fs *FsSuper) NBlockBitmap() uint64 {
+	return uint64(len(fs.get().bbitmap))
 }
 
-// DataStart returns the first data block after metadata.
+// NInodeBitmap returns the number of inode bitmap blocks.
+func (fs *FsSuper) NInodeBitmap() uint64 {
+	return uint64(len(fs.get().ibitmap))
+}
+
+// BlockBitmapBlock returns the block number of block bitmap block k.
+func (fs *FsSuper) BlockBitmapBlock(k uint64) common.Bnum {
+	return fs.get().bbitmap[k]
+}
+
+// InodeBitmapBlock returns the block number of inode bitmap block k.
+func (fs *FsSuper) InodeBitmapBlock(k uint64) common.Bnum {
+	return fs.get().ibitmap[k]
+}
+
+// BlockBitAddr returns the address of block bn's bitmap bit.
+func (fs *FsSuper) BlockBitAddr(bn common.Bnum) addr.Addr {
+	g := fs.get()
+	return addr.MkAddr(g.bbitmap[bn/common.NBITBLOCK], bn%common.NBITBLOCK)
+}
+
+// InodeBitAddr returns the address of inode inum's bitmap bit.
+func (fs *FsSuper) InodeBitAddr(inum common.Inum) addr.Addr {
+	g := fs.get()
+	return addr.MkAddr(g.ibitmap[inum/common.NBITBLOCK], inum%common.NBITBLOCK)
+}
+
+// DataStart returns the first data block after the metadata at the
+// start of the disk.
 func (fs *FsSuper) DataStart() common.Bnum {
-	return fs.InodeStart() + common.Bnum(fs.nInodeBlk)
+	return fs.get().lay.Regions[0].End()
+}
+
+// InodeGoal returns the block near which to allocate inum's data.
+// Inode groups map onto the data area in proportion, so inodes in the
+// same group keep their data together.
+func (fs *FsSuper) InodeGoal(inum common.Inum) common.Bnum {
+	ndata := uint64(fs.MaxBnum() - fs.DataStart())
+	g := uint64(inum) / IGROUPSZ * IGROUPSZ
+	return fs.DataStart() + common.Bnum(g*ndata/uint64(fs.NInode()))
 }
 
 // Block2addr converts a block number to a disk address.
@@ -65,11 +347,42 @@ func (fs *FsSuper) Block2addr(blkno common.Bnum) addr.Addr {
 
 // NInode returns the number of inodes in the file system.
 func (fs *FsSuper) NInode() common.Inum {
-	return common.Inum(fs.nInodeBlk * common.INODEBLK)
+	return common.Inum(uint64(len(fs.get().ibitmap)) * common.NBITBLOCK)
 }
 
 // Inum2Addr computes the disk address of the given inode number.
 func (fs *FsSuper) Inum2Addr(inum common.Inum) addr.Addr {
-	return addr.MkAddr(fs.InodeStart()+common.Bnum(uint64(inum)/common.INODEBLK),
-		(uint64(inum)%common.INODEBLK)*common.INODESZ*8)
+	g := fs.get()
+	i := uint64(inum) % common.NBITBLOCK
+	blk := g.itable[uint64(inum)/common.NBITBLOCK] + common.Bnum(i/INODEBLK)
+	return addr.MkAddr(blk, (i%INODEBLK)*INODESZ*8)
+}
+
+// CsumBlocks returns the checksum blocks of block bitmap block k.
+func (fs *FsSuper) CsumBlocks(k uint64) (common.Bnum, uint64) {
+	return fs.get().csum[k], NCSUMBLK
+}
+
+// CsumAddr returns the address of block bn's checksum.
+func (fs *FsSuper) CsumAddr(bn common.Bnum) addr.Addr {
+	g := fs.get()
+	off := (bn % common.NBITBLOCK) * CSUMSZ
+	blk := g.csum[bn/common.NBITBLOCK] + common.Bnum(off/disk.BlockSize)
+	return addr.MkAddr(blk, (off%disk.BlockSize)*8)
+}
+
+// IntegrityError counts a checksum mismatch.
+func (fs *FsSuper) IntegrityError() {
+	fs.mu.Lock()
+	fs.nintegrity++
+	fs.mu.Unlock()
+}
+
+// NIntegrityErrors returns the number of checksum mismatches since the
+// server started.
+func (fs *FsSuper) NIntegrityErrors() uint64 {
+	fs.mu.Lock()
+	n := fs.nintegrity
+	fs.mu.Unlock()
+	return n
 }
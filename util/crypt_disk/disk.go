@@ -0,0 +1,421 @@
+// package crypt_disk encrypts a disk with AES-GCM, a block at a time
+package crypt_disk
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/goose-lang/primitive/disk"
+)
+
+//
+// Layout of the underlying disk: block 0 holds a header that records
+// the ID of the key, and the rest is divided into groups of a tag
+// block followed by NPERGROUP data blocks.  The tag block holds two
+// records for each of the group's data blocks, each with a generation
+// number and the GCM tag of the block's ciphertext for that
+// generation.  The nonce of a block is its block number and its
+// generation, so no nonce is used twice.
+//
+// A write of a data block goes to the record that doesn't hold the
+// block's current version: Barrier writes the tag blocks first, and
+// after a barrier the data blocks, so that after a crash each data
+// block matches one of its records, which is either its old or its
+// new version.  A block whose first write didn't finish reads as
+// zeros.  Writes are buffered until Barrier, which the journal
+// issues before it relies on a write; buffering them lets a Barrier
+// write each tag block once.
+//
+
+// Underlying disk layout
+const (
+	HDRBLK    uint64 = 0
+	RECSZ     uint64 = 32 // generation, tag, and padding
+	NPERGROUP uint64 = disk.BlockSize / (2 * RECSZ)
+	GROUPSZ   uint64 = NPERGROUP + 1
+	KEYSZ     uint64 = 32 // AES-256
+	KEYIDSZ   uint64 = 8
+
+	// # buffered writes that makes Write flush before Barrier
+	MAXPENDING uint64 = 1024
+
+	// # tag groups whose tag blocks to cache
+	MAXGROUPS uint64 = 1024
+)
+
+// KEYENV is the environment variable that LoadKey reads if there is no
+// key file.
+const KEYENV = "GONFSD_KEY"
+
+var magic = []byte("GONFSENC")
+
+const version uint64 = 1
+
+// A group caches the tag block of a tag group, and the record that
+// holds the current version of each of its data blocks.
+type group struct {
+	mu    *sync.Mutex
+	tb    uint64           // tag block
+	tag   disk.Block       // nil until read
+	valid [NPERGROUP]uint8 // 1 + record holding a block's current version, or 0
+	refs  uint64           // # users, guarded by Disk.mu
+	elem  *list.Element    // in Disk.lru, guarded by Disk.mu
+}
+
+type Disk struct {
+	// guards the group cache, pending, and flushing; never held
+	// across I/O or encryption, which a group's lock covers instead
+	mu        *sync.Mutex
+	flushMu   *sync.Mutex // serializes flushes
+	d         disk.Disk
+	aead      cipher.AEAD
+	groups    map[uint64]*group     // cached groups, by tag block
+	lru       *list.List            // cached groups, most recently used first
+	maxgroups uint64                // # groups to cache, besides those in use
+	pending   map[uint64]disk.Block // writes since the last flush started
+	flushing  map[uint64]disk.Block // writes that the running flush writes
+}
+
+// assert that Disk implements disk.Disk
+var _ disk.Disk = &Disk{}
+
+// PhysSize returns the # blocks of an underlying disk for an encrypted
+// disk of sz blocks.
+func PhysSize(sz uint64) uint64 {
+	return 1 + (sz+NPERGROUP-1)/NPERGROUP*GROUPSZ
+}
+
+// KeyID returns the ID of key that the header records, which
+// identifies the key without revealing it.
+func KeyID(key []byte) []byte {
+	h := sha256.Sum256(append([]byte("go-nfsd key id "), key...))
+	return h[:KEYIDSZ]
+}
+
+// LoadKey reads a 256-bit key, either raw or in hex, from file, or, if
+// file is "", in hex from $GONFSD_KEY.
+func LoadKey(file string) ([]byte, error) {
+	var data []byte
+	if file == "" {
+		v, ok := os.LookupEnv(KEYENV)
+		if !ok {
+			return nil, fmt.Errorf("no key file, and $%s is not set", KEYENV)
+		}
+		data = []byte(v)
+	} else {
+		var err error
+		data, err = os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(data)) == KEYSZ {
+			return data, nil
+		}
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key is not %d bytes or hex: %w", KEYSZ, err)
+	}
+	if uint64(len(key)) != KEYSZ {
+		return nil, fmt.Errorf("key has %d bytes, not %d", len(key), KEYSZ)
+	}
+	return key, nil
+}
+
+// New encrypts d with key.  If d is blank, New writes a header with the
+// key's ID; otherwise, it fails unless d's header records key's ID.
+func New(d disk.Disk, key []byte) (*Disk, error) {
+	if uint64(len(key)) != KEYSZ {
+		return nil, fmt.Errorf("key has %d bytes, not %d", len(key), KEYSZ)
+	}
+	if d.Size() < 1+GROUPSZ || d.Size() >= 1<<40 {
+		return nil, fmt.Errorf("disk of %d blocks is too small or too large",
+			d.Size())
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := KeyID(key)
+	hdr := d.Read(HDRBLK)
+	if bytes.Equal(hdr, make(disk.Block, disk.BlockSize)) {
+		hdr = make(disk.Block, disk.BlockSize)
+		copy(hdr, magic)
+		binary.LittleEndian.PutUint64(hdr[8:], version)
+		copy(hdr[16:], id)
+		d.Write(HDRBLK, hdr)
+		d.Barrier()
+	} else if !bytes.Equal(hdr[:8], magic) {
+		return nil, fmt.Errorf("disk is not encrypted")
+	} else if v := binary.LittleEndian.Uint64(hdr[8:]); v != version {
+		return nil, fmt.Errorf("unknown version %d", v)
+	} else if !bytes.Equal(hdr[16:16+KEYIDSZ], id) {
+		return nil, fmt.Errorf("disk is encrypted with key %x, not %x",
+			hdr[16:16+KEYIDSZ], id)
+	}
+	return &Disk{
+		mu:        new(sync.Mutex),
+		flushMu:   new(sync.Mutex),
+		d:         d,
+		aead:      aead,
+		groups:    make(map[uint64]*group),
+		lru:       list.New(),
+		maxgroups: MAXGROUPS,
+		pending:   make(map[uint64]disk.Block),
+		flushing:  make(map[uint64]disk.Block),
+	}, nil
+}
+
+func tagBlock(a uint64) uint64 {
+	return 1 + a/NPERGROUP*GROUPSZ
+}
+
+func dataBlock(a uint64) uint64 {
+	return tagBlock(a) + 1 + a%NPERGROUP
+}
+
+// getGroup returns the group of tag block tb, which the caller uses
+// until putGroup.  The caller holds d.mu.
+func (d *Disk) getGroup(tb uint64) *group {
+	g, ok := d.groups[tb]
+	if !ok {
+		g = &group{mu: new(sync.Mutex), tb: tb}
+		d.groups[tb] = g
+		g.elem = d.lru.PushFront(g)
+	} else {
+		d.lru.MoveToFront(g.elem)
+	}
+	g.refs++
+	return g
+}
+
+// putGroup ends a use of g, and evicts the least recently used groups
+// that aren't in use while there are too many.  The caller holds d.mu.
+func (d *Disk) putGroup(g *group) {
+	g.refs--
+	e := d.lru.Back()
+	for uint64(len(d.groups)) > d.maxgroups && e != nil {
+		prev := e.Prev()
+		v := e.Value.(*group)
+		if v.refs == 0 {
+			d.lru.Remove(e)
+			delete(d.groups, v.tb)
+		}
+		e = prev
+	}
+}
+
+// record returns the record in slot of block a, in a's group g.  The
+// caller holds g.mu.
+func (d *Disk) record(g *group, a uint64, slot uint64) []byte {
+	if g.tag == nil {
+		g.tag = d.d.Read(g.tb)
+	}
+	off := (a%NPERGROUP*2 + slot) * RECSZ
+	return g.tag[off : off+RECSZ]
+}
+
+func gen(rec []byte) uint64 {
+	return binary.LittleEndian.Uint64(rec)
+}
+
+// nonce returns the nonce of generation g of block a: 5 bytes of
+// block number and 7 of generation.
+func (d *Disk) nonce(a uint64, g uint64) []byte {
+	n := make([]byte, 16)
+	binary.LittleEndian.PutUint64(n, a)
+	binary.LittleEndian.PutUint64(n[5:], g)
+	return n[:d.aead.NonceSize()]
+}
+
+// open decrypts ciphertext c of block a with the tag in slot, and
+// reports whether it is authentic.  The caller holds g.mu.
+func (d *Disk) open(g *group, a uint64, slot uint64, c disk.Block) (disk.Block, bool) {
+	rec := d.record(g, a, slot)
+	n := gen(rec)
+	if n == 0 {
+		return nil, false
+	}
+	sealed := append(append([]byte{}, c...), rec[8:8+d.aead.Overhead()]...)
+	b, err := d.aead.Open(nil, d.nonce(a, n), sealed, nil)
+	return b, err == nil
+}
+
+// current returns the slot that holds the version of block a on disk,
+// and the version, or false if a was never written.  The caller holds
+// g.mu.
+func (d *Disk) current(g *group, a uint64) (uint64, disk.Block, bool) {
+	g0 := gen(d.record(g, a, 0))
+	g1 := gen(d.record(g, a, 1))
+	if g0 == 0 && g1 == 0 {
+		return 0, nil, false
+	}
+	c := d.d.Read(dataBlock(a))
+	var first uint64 = 0
+	if g1 > g0 {
+		first = 1
+	}
+	if b, ok := d.open(g, a, first, c); ok {
+		return first, b, true
+	}
+	if b, ok := d.open(g, a, 1-first, c); ok {
+		return 1 - first, b, true
+	}
+	if g0 == 0 || g1 == 0 { // its first write didn't finish
+		return 0, nil, false
+	}
+	panic(fmt.Sprintf("crypt_disk: block %d fails authentication", a))
+}
+
+func (d *Disk) ReadTo(a uint64, b disk.Block) {
+	if a >= d.Size() {
+		panic(fmt.Sprintf("crypt_disk: read of block %d out of range", a))
+	}
+	d.mu.Lock()
+	p, ok := d.pending[a]
+	if !ok {
+		p, ok = d.flushing[a]
+	}
+	if ok {
+		copy(b, p)
+		d.mu.Unlock()
+		return
+	}
+	g := d.getGroup(tagBlock(a))
+	d.mu.Unlock()
+
+	g.mu.Lock()
+	slot, data, ok := d.current(g, a)
+	if ok {
+		g.valid[a%NPERGROUP] = uint8(1 + slot)
+		copy(b, data)
+	} else {
+		copy(b, make(disk.Block, disk.BlockSize))
+	}
+	g.mu.Unlock()
+
+	d.mu.Lock()
+	d.putGroup(g)
+	d.mu.Unlock()
+}
+
+func (d *Disk) Read(a uint64) disk.Block {
+	buf := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, buf)
+	return buf
+}
+
+func (d *Disk) Write(a uint64, b disk.Block) {
+	if a >= d.Size() {
+		panic(fmt.Sprintf("crypt_disk: write of block %d out of range", a))
+	}
+	d.mu.Lock()
+	d.pending[a] = append(disk.Block{}, b...)
+	full := uint64(len(d.pending)) >= MAXPENDING
+	d.mu.Unlock()
+	if full {
+		d.flush()
+	}
+}
+
+// flush writes the pending writes, tag blocks first, and waits for
+// them, so that the next flush doesn't overwrite the record of a
+// block's version on disk.  Reads of the blocks it writes return the
+// pending versions until it is done.
+func (d *Disk) flush() {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	d.mu.Lock()
+	w := d.pending
+	d.pending = make(map[uint64]disk.Block)
+	d.flushing = w
+	byGroup := make(map[uint64][]uint64)
+	for a := range w {
+		byGroup[tagBlock(a)] = append(byGroup[tagBlock(a)], a)
+	}
+	var groups []*group
+	for tb := range byGroup {
+		groups = append(groups, d.getGroup(tb))
+	}
+	d.mu.Unlock()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].tb < groups[j].tb })
+
+	sealed := make(map[uint64]disk.Block, len(w))
+	slots := make(map[uint64]uint64, len(w))
+	for _, g := range groups {
+		addrs := byGroup[g.tb]
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+		g.mu.Lock()
+		for _, a := range addrs {
+			var cur = uint64(g.valid[a%NPERGROUP])
+			if cur > 0 {
+				cur--
+			} else {
+				var written bool
+				cur, _, written = d.current(g, a)
+				if !written {
+					cur = 1
+				}
+			}
+			slot := 1 - cur
+			n := gen(d.record(g, a, 0))
+			if n1 := gen(d.record(g, a, 1)); n1 > n {
+				n = n1
+			}
+			n = n + 1
+			s := d.aead.Seal(nil, d.nonce(a, n), w[a], nil)
+			rec := d.record(g, a, slot)
+			binary.LittleEndian.PutUint64(rec, n)
+			copy(rec[8:], s[disk.BlockSize:])
+			sealed[a] = s[:disk.BlockSize]
+			slots[a] = slot
+		}
+		d.d.Write(g.tb, append(disk.Block{}, g.tag...))
+		g.mu.Unlock()
+	}
+	d.d.Barrier()
+	for _, g := range groups {
+		g.mu.Lock()
+		for _, a := range byGroup[g.tb] {
+			d.d.Write(dataBlock(a), sealed[a])
+			g.valid[a%NPERGROUP] = uint8(1 + slots[a])
+		}
+		g.mu.Unlock()
+	}
+	d.d.Barrier()
+
+	d.mu.Lock()
+	d.flushing = make(map[uint64]disk.Block)
+	for _, g := range groups {
+		d.putGroup(g)
+	}
+	d.mu.Unlock()
+}
+
+func (d *Disk) Barrier() {
+	d.flush()
+}
+
+func (d *Disk) Size() uint64 {
+	return (d.d.Size() - 1) / GROUPSZ * NPERGROUP
+}
+
+func (d *Disk) Close() {
+	d.Barrier()
+	d.d.Close()
+}
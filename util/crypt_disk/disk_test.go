@@ -0,0 +1,179 @@
+package crypt_disk
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const SZ uint64 = 8 * NPERGROUP
+
+func mkKey(b byte) []byte {
+	key := make([]byte, KEYSZ)
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+func mkBlock(b byte) disk.Block {
+	blk := make(disk.Block, disk.BlockSize)
+	for i := range blk {
+		blk[i] = b
+	}
+	return blk
+}
+
+// crashDisk drops the writes that follow its crash'th barrier.
+type crashDisk struct {
+	disk.Disk
+	barriers int
+	crash    int
+}
+
+func (d *crashDisk) Write(a uint64, b disk.Block) {
+	if d.crash == 0 || d.barriers < d.crash {
+		d.Disk.Write(a, b)
+	}
+}
+
+func (d *crashDisk) Barrier() {
+	d.barriers++
+	d.Disk.Barrier()
+}
+
+func TestRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	phys := disk.NewMemDisk(PhysSize(SZ))
+	d, err := New(phys, mkKey(1))
+	require.NoError(t, err)
+	assert.Equal(SZ, d.Size())
+
+	assert.Equal(mkBlock(0), d.Read(3), "unwritten blocks read as zeros")
+	for a := uint64(0); a < SZ; a += 7 {
+		d.Write(a, mkBlock(byte(a)))
+	}
+	assert.Equal(mkBlock(7), d.Read(7), "reads see buffered writes")
+	d.Barrier()
+	d.Write(7, mkBlock(8))
+	d.Barrier()
+
+	assert.NotEqual(mkBlock(8), phys.Read(dataBlock(7)), "stores ciphertext")
+
+	d, err = New(phys, mkKey(1))
+	require.NoError(t, err)
+	for a := uint64(0); a < SZ; a += 7 {
+		want := mkBlock(byte(a))
+		if a == 7 {
+			want = mkBlock(8)
+		}
+		assert.Equal(want, d.Read(a), "block %d", a)
+	}
+	assert.Equal(mkBlock(0), d.Read(1))
+}
+
+func TestWrongKey(t *testing.T) {
+	phys := disk.NewMemDisk(PhysSize(SZ))
+	d, err := New(phys, mkKey(1))
+	require.NoError(t, err)
+	d.Write(0, mkBlock(1))
+	d.Barrier()
+
+	_, err = New(phys, mkKey(2))
+	assert.Error(t, err)
+}
+
+func TestTampered(t *testing.T) {
+	phys := disk.NewMemDisk(PhysSize(SZ))
+	d, err := New(phys, mkKey(1))
+	require.NoError(t, err)
+	d.Write(5, mkBlock(1))
+	d.Barrier()
+	d.Write(5, mkBlock(2))
+	d.Barrier()
+
+	c := phys.Read(dataBlock(5))
+	c[100] ^= 1
+	phys.Write(dataBlock(5), c)
+
+	d, err = New(phys, mkKey(1))
+	require.NoError(t, err)
+	assert.Panics(t, func() { d.Read(5) })
+}
+
+func TestCrash(t *testing.T) {
+	assert := assert.New(t)
+	phys := disk.NewMemDisk(PhysSize(SZ))
+	d, err := New(phys, mkKey(1))
+	require.NoError(t, err)
+	d.Write(2, mkBlock(1))
+	d.Barrier()
+
+	// crash after the tag blocks are written, before the data blocks
+	cd := &crashDisk{Disk: phys}
+	d, err = New(cd, mkKey(1))
+	require.NoError(t, err)
+	cd.crash = cd.barriers + 1
+	d.Write(2, mkBlock(2))
+	d.Write(3, mkBlock(3))
+	d.Barrier()
+
+	d, err = New(phys, mkKey(1))
+	require.NoError(t, err)
+	assert.Equal(mkBlock(1), d.Read(2), "old version survives")
+	assert.Equal(mkBlock(0), d.Read(3), "unfinished first write reads as zeros")
+
+	d.Write(2, mkBlock(4))
+	d.Barrier()
+	d, err = New(phys, mkKey(1))
+	require.NoError(t, err)
+	assert.Equal(mkBlock(4), d.Read(2), "writes after recovery")
+}
+
+func TestEvict(t *testing.T) {
+	assert := assert.New(t)
+	phys := disk.NewMemDisk(PhysSize(SZ))
+	d, err := New(phys, mkKey(1))
+	require.NoError(t, err)
+	d.maxgroups = 2
+	for a := uint64(0); a < SZ; a += NPERGROUP / 2 {
+		d.Write(a, mkBlock(byte(a)))
+		if a%NPERGROUP == 0 {
+			d.Barrier()
+		}
+	}
+	d.Barrier()
+	assert.LessOrEqual(uint64(len(d.groups)), d.maxgroups)
+	for a := uint64(0); a < SZ; a += NPERGROUP / 2 {
+		assert.Equal(mkBlock(byte(a)), d.Read(a), "block %d", a)
+	}
+	assert.LessOrEqual(uint64(len(d.groups)), d.maxgroups)
+	assert.Equal(d.lru.Len(), len(d.groups))
+}
+
+func TestConcur(t *testing.T) {
+	phys := disk.NewMemDisk(PhysSize(SZ))
+	d, err := New(phys, mkKey(1))
+	require.NoError(t, err)
+	d.maxgroups = 2
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 4; i++ {
+		wg.Add(1)
+		go func(i uint64) {
+			defer wg.Done()
+			for n := 0; n < 3; n++ {
+				for a := i; a < SZ; a += 4 {
+					d.Write(a, mkBlock(byte(a+uint64(n))))
+				}
+				d.Barrier()
+				for a := i; a < SZ; a += 4 {
+					assert.Equal(t, mkBlock(byte(a+uint64(n))), d.Read(a))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+// package file_disk is a disk backed by a file or a block device, like
+// disk.FileDisk, that can also discard blocks, to give their space back
+// to thin-provisioned storage.
+package file_disk
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/goose-lang/primitive/disk"
+)
+
+type Disk struct {
+	fd        int
+	numBlocks uint64
+	blkdev    bool
+}
+
+// assert that Disk implements disk.Disk
+var _ disk.Disk = &Disk{}
+
+// New opens the file or block device at path as a disk of numBlocks
+// blocks, creating a file if there is none, and sizing a file to
+// numBlocks.
+func New(path string, numBlocks uint64) (*Disk, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_CREAT, 0666)
+	if err != nil {
+		return nil, err
+	}
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	blkdev := stat.Mode&unix.S_IFMT == unix.S_IFBLK
+	if !blkdev && uint64(stat.Size) != numBlocks*disk.BlockSize {
+		err = unix.Ftruncate(fd, int64(numBlocks*disk.BlockSize))
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+	return &Disk{fd: fd, numBlocks: numBlocks, blkdev: blkdev}, nil
+}
+
+func (d *Disk) ReadTo(a uint64, buf disk.Block) {
+	if uint64(len(buf)) != disk.BlockSize {
+		panic("buffer is not block-sized")
+	}
+	if a >= d.numBlocks {
+		panic(fmt.Errorf("out-of-bounds read at %v", a))
+	}
+	_, err := unix.Pread(d.fd, buf, int64(a*disk.BlockSize))
+	if err != nil {
+		panic("read failed: " + err.Error())
+	}
+}
+
+func (d *Disk) Read(a uint64) disk.Block {
+	buf := make(disk.Block, disk.BlockSize)
+	d.ReadTo(a, buf)
+	return buf
+}
+
+func (d *Disk) Write(a uint64, v disk.Block) {
+	if uint64(len(v)) != disk.BlockSize {
+		panic(fmt.Errorf("v is not block sized (%d bytes)", len(v)))
+	}
+	if a >= d.numBlocks {
+		panic(fmt.Errorf("out-of-bounds write at %v", a))
+	}
+	_, err := unix.Pwrite(d.fd, v, int64(a*disk.BlockSize))
+	if err != nil {
+		panic("write failed: " + err.Error())
+	}
+}
+
+func (d *Disk) Size() uint64 {
+	return d.numBlocks
+}
+
+func (d *Disk) Barrier() {
+	err := unix.Fsync(d.fd)
+	if err != nil {
+		panic("file sync failed: " + err.Error())
+	}
+}
+
+func (d *Disk) Close() {
+	err := unix.Close(d.fd)
+	if err != nil {
+		panic("close failed: " + err.Error())
+	}
+}
+
+// Discard punches a hole in a file for blocks [a, a+n), or issues
+// BLKDISCARD for them to a block device.  Discarding is advisory, so
+// it ignores errors, such as from a file system without hole punching
+// or a device without discard.
+func (d *Disk) Discard(a uint64, n uint64) {
+	if a >= d.numBlocks || n > d.numBlocks-a {
+		panic(fmt.Errorf("out-of-bounds discard at %v+%v", a, n))
+	}
+	off := a * disk.BlockSize
+	len := n * disk.BlockSize
+	if d.blkdev {
+		r := [2]uint64{off, len}
+		unix.Syscall(unix.SYS_IOCTL, uintptr(d.fd), unix.BLKDISCARD,
+			uintptr(unsafe.Pointer(&r[0])))
+		return
+	}
+	unix.Fallocate(d.fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		int64(off), int64(len))
+}
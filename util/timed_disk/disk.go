@@ -49,6 +49,13 @@ func (d *Disk) Barrier() {
 	d.d.Barrier()
 }
 
+// Discard forwards to the underlying disk, if it can discard.
+func (d *Disk) Discard(a uint64, n uint64) {
+	if dd, ok := d.d.(interface{ Discard(a uint64, n uint64) }); ok {
+		dd.Discard(a, n)
+	}
+}
+
 func (d *Disk) Size() uint64 {
 	return d.d.Size()
 }
@@ -0,0 +1,214 @@
+package xattr
+
+import (
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Extended attributes.  An inode's extended attributes live in a
+// single block, which the inode's Xattr field refers to.  The block is
+// allocated when the first attribute is set, and freed when the last
+// attribute is removed or when the inode is freed.  The block holds
+// the number of attributes, followed by the attributes, each a name
+// length, a value length, the name, and the value.
+//
+// The operations run in the caller's transaction, and the caller must
+// hold the inode's lock.
+//
+
+const (
+	HDRSZ      uint64 = 8     // # bytes of the block header
+	ENTHDRSZ   uint64 = 1 + 2 // # bytes of an attribute's header
+	MAXNAMELEN uint64 = 255   // longest attribute name
+	// largest value, which leaves room for only a one-byte name
+	MAXVALUESZ uint64 = disk.BlockSize - HDRSZ - ENTHDRSZ - 1
+)
+
+type attr struct {
+	name  string
+	value []byte
+}
+
+func (a *attr) size() uint64 {
+	return ENTHDRSZ + uint64(len(a.name)) + uint64(len(a.value))
+}
+
+func decode(blk []byte) []attr {
+	dec := marshal.NewDec(blk)
+	n := dec.GetInt()
+	attrs := make([]attr, 0, n)
+	for i := uint64(0); i < n; i++ {
+		hdr := dec.GetBytes(ENTHDRSZ)
+		namelen := uint64(hdr[0])
+		valuelen := uint64(hdr[1]) | uint64(hdr[2])<<8
+		name := string(dec.GetBytes(namelen))
+		value := make([]byte, valuelen)
+		copy(value, dec.GetBytes(valuelen))
+		attrs = append(attrs, attr{name: name, value: value})
+	}
+	return attrs
+}
+
+func encode(attrs []attr) disk.Block {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(uint64(len(attrs)))
+	for _, a := range attrs {
+		valuelen := len(a.value)
+		enc.PutBytes([]byte{byte(len(a.name)), byte(valuelen), byte(valuelen >> 8)})
+		enc.PutBytes([]byte(a.name))
+		enc.PutBytes(a.value)
+	}
+	return enc.Finish()
+}
+
+func fits(attrs []attr) bool {
+	var sz = HDRSZ
+	for _, a := range attrs {
+		sz += a.size()
+	}
+	return sz <= disk.BlockSize
+}
+
+func find(attrs []attr, name string) int {
+	for i, a := range attrs {
+		if a.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func checkName(name string) nfstypes.Nfsstat3 {
+	if name == "" {
+		return nfstypes.NFS3ERR_INVAL
+	}
+	if uint64(len(name)) > MAXNAMELEN {
+		return nfstypes.NFS3ERR_NAMETOOLONG
+	}
+	return nfstypes.NFS3_OK
+}
+
+func read(ip *inode.Inode, atxn *alloctxn.AllocTxn) []attr {
+	if ip.Xattr == common.NULLBNUM {
+		return nil
+	}
+	buf := atxn.ReadBlock(ip.Xattr)
+	return decode(buf.Data)
+}
+
+// write stores attrs as ip's attributes, allocating ip's attribute
+// block if ip has none, and freeing it if attrs is empty.  It returns
+// false if there is no free block.
+func write(ip *inode.Inode, atxn *alloctxn.AllocTxn, attrs []attr) bool {
+	if len(attrs) == 0 {
+		if ip.Xattr != common.NULLBNUM {
+			atxn.FreeBlock(ip.Owner(), ip.Xattr)
+			ip.Xattr = common.NULLBNUM
+			ip.WriteInode(atxn)
+		}
+		return true
+	}
+	if ip.Xattr == common.NULLBNUM {
+		bn := atxn.AllocBlock(ip.Owner(), atxn.Super.InodeGoal(ip.Inum))
+		if bn == common.NULLBNUM {
+			return false
+		}
+		ip.Xattr = bn
+		ip.WriteInode(atxn)
+	}
+	util.DPrintf(5, "xattr write # %v: %d attrs in %v\n", ip.Inum, len(attrs), ip.Xattr)
+	atxn.WriteBlock(ip.Xattr, encode(attrs))
+	return true
+}
+
+// Get returns the value of ip's attribute name.  It returns
+// NFS3ERR_NOENT if ip has no such attribute.
+func Get(ip *inode.Inode, atxn *alloctxn.AllocTxn, name string) ([]byte, nfstypes.Nfsstat3) {
+	if err := checkName(name); err != nfstypes.NFS3_OK {
+		return nil, err
+	}
+	attrs := read(ip, atxn)
+	i := find(attrs, name)
+	if i < 0 {
+		return nil, nfstypes.NFS3ERR_NOENT
+	}
+	return attrs[i].value, nfstypes.NFS3_OK
+}
+
+// List returns the names of ip's attributes.
+func List(ip *inode.Inode, atxn *alloctxn.AllocTxn) []string {
+	attrs := read(ip, atxn)
+	names := make([]string, 0, len(attrs))
+	for _, a := range attrs {
+		names = append(names, a.name)
+	}
+	return names
+}
+
+// Set sets ip's attribute name to value.  With nfstypes.XATTR_CREATE
+// in flags, it returns NFS3ERR_EXIST if the attribute exists; with
+// nfstypes.XATTR_REPLACE, it
+// returns NFS3ERR_NOENT if the attribute doesn't exist.  It returns
+// NFS3ERR_NOSPC if ip's attributes don't fit in a block or there is no
+// free block for them.
+func Set(ip *inode.Inode, atxn *alloctxn.AllocTxn, name string, value []byte, flags uint32) nfstypes.Nfsstat3 {
+	if err := checkName(name); err != nfstypes.NFS3_OK {
+		return err
+	}
+	if uint64(len(value)) > MAXVALUESZ {
+		return nfstypes.NFS3ERR_INVAL
+	}
+	attrs := read(ip, atxn)
+	i := find(attrs, name)
+	if i >= 0 && flags&nfstypes.XATTR_CREATE != 0 {
+		return nfstypes.NFS3ERR_EXIST
+	}
+	if i < 0 && flags&nfstypes.XATTR_REPLACE != 0 {
+		return nfstypes.NFS3ERR_NOENT
+	}
+	a := attr{name: name, value: append([]byte{}, value...)}
+	if i >= 0 {
+		attrs[i] = a
+	} else {
+		attrs = append(attrs, a)
+	}
+	if !fits(attrs) {
+		return nfstypes.NFS3ERR_NOSPC
+	}
+	if !write(ip, atxn, attrs) {
+		return nfstypes.NFS3ERR_NOSPC
+	}
+	return nfstypes.NFS3_OK
+}
+
+// Remove removes ip's attribute name.  It returns NFS3ERR_NOENT if ip
+// has no such attribute.
+func Remove(ip *inode.Inode, atxn *alloctxn.AllocTxn, name string) nfstypes.Nfsstat3 {
+	if err := checkName(name); err != nfstypes.NFS3_OK {
+		return err
+	}
+	attrs := read(ip, atxn)
+	i := find(attrs, name)
+	if i < 0 {
+		return nfstypes.NFS3ERR_NOENT
+	}
+	attrs = append(attrs[:i], attrs[i+1:]...)
+	write(ip, atxn, attrs)
+	return nfstypes.NFS3_OK
+}
+
+// Copy gives ip, which has no attributes, a copy of src's attributes.
+// It returns NFS3ERR_NOSPC if there is no free block for them.
+func Copy(ip *inode.Inode, src *inode.Inode, atxn *alloctxn.AllocTxn) nfstypes.Nfsstat3 {
+	if !write(ip, atxn, read(src, atxn)) {
+		return nfstypes.NFS3ERR_NOSPC
+	}
+	return nfstypes.NFS3_OK
+}